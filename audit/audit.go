@@ -0,0 +1,261 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	SIGNED_IN           = "session.signed_in"
+	SIGN_IN_REFUSED     = "session.sign_in_refused"
+	SIGNED_OUT          = "session.signed_out"
+	SESSION_ENDED       = "session.ended"
+	SESSIONS_REVOKED    = "session.revoked_all"
+	REFRESH_TOKEN_REUSE = "session.refresh_token_reused"
+	EMAIL_LINK_SENT     = "email.link_sent"
+	GUEST_JOINED        = "guest.joined"
+	USER_APPROVED       = "user.approved"
+	USER_CONVERTED      = "user.converted"
+	USER_SUSPENDED      = "user.suspended"
+	USER_BANNED         = "user.banned"
+	// back to pending, ending a suspension of someone approved is USER_APPROVED
+	USER_SUSPENSION_ENDED = "user.suspension_ended"
+	// only in entries from before suspensions & bans, it was a ban
+	USER_DISAPPROVED    = "user.disapproved"
+	USER_PROMOTED       = "user.promoted"
+	USER_DEMOTED        = "user.demoted"
+	IMAGE_DELETED       = "image.deleted"
+	IMAGES_PURGED       = "image.purged"
+	IMAGE_CONSUMED      = "image.consumed"
+	API_KEY_REJECTED    = "api_key.rejected"
+	API_KEY_CREATED     = "api_key.created"
+	API_KEY_REVOKED     = "api_key.revoked"
+	CSRF_REJECTED       = "csrf.rejected"
+	INVITE_CREATED      = "invite.created"
+	INVITE_REVOKED      = "invite.revoked"
+	INVITE_CHANGED      = "invite.changed"
+	WEBHOOK_ADDED       = "webhook.added"
+	WEBHOOK_REMOVED     = "webhook.removed"
+	KIOSK_PAIRED        = "kiosk.paired"
+	SIGNING_KEY_ROTATED = "signing_key.rotated"
+	IMAGES_REENCRYPTED  = "encryption.rotated"
+	BACKUP_WRITTEN      = "backup.written"
+	AUDIT_EXPORTED      = "audit.exported"
+	AUDIT_PRUNED        = "audit.pruned"
+)
+
+// every action, in the order the admin page lists them
+var ACTIONS = []string{
+	SIGNED_IN, SIGN_IN_REFUSED, SIGNED_OUT, SESSION_ENDED, SESSIONS_REVOKED, REFRESH_TOKEN_REUSE, EMAIL_LINK_SENT, GUEST_JOINED,
+	USER_APPROVED, USER_CONVERTED, USER_SUSPENDED, USER_SUSPENSION_ENDED, USER_BANNED, USER_DISAPPROVED, USER_PROMOTED, USER_DEMOTED,
+	IMAGE_DELETED, IMAGES_PURGED, IMAGE_CONSUMED,
+	API_KEY_REJECTED, API_KEY_CREATED, API_KEY_REVOKED, CSRF_REJECTED,
+	INVITE_CREATED, INVITE_REVOKED, INVITE_CHANGED, WEBHOOK_ADDED, WEBHOOK_REMOVED, KIOSK_PAIRED,
+	SIGNING_KEY_ROTATED, IMAGES_REENCRYPTED, BACKUP_WRITTEN, AUDIT_EXPORTED, AUDIT_PRUNED,
+}
+
+var CSV_HEADER = []string{"at", "actor", "action", "target", "ip", "detail"}
+
+// a line longer than this is skipped when reading, nothing we write comes close
+const MAX_LINE_BYTES = 64 * 1024
+
+// Open doesn't touch the file, it's created by the first Record
+func Open(path string) *Log {
+	return &Log{path: path}
+}
+
+// Record appends entry, it's synced to disk before returning. A zero At is now.
+func (log *Log) Record(entry Entry) error {
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	entry.At = entry.At.UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (filter Filter) matches(entry Entry) bool {
+	return (filter.Actor == "" || strings.Contains(strings.ToLower(entry.Actor), strings.ToLower(filter.Actor))) &&
+		(filter.Action == "" || entry.Action == filter.Action) &&
+		(filter.Target == "" || strings.Contains(strings.ToLower(entry.Target), strings.ToLower(filter.Target))) &&
+		(filter.Since.IsZero() || !entry.At.Before(filter.Since)) &&
+		(filter.Until.IsZero() || entry.At.Before(filter.Until))
+}
+
+// Query is the entries filter matches, newest first
+func (log *Log) Query(filter Filter) ([]Entry, error) {
+	matched := []Entry{}
+	err := log.each(func(entry Entry, _ []byte) {
+		if filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+	return matched, nil
+}
+
+// each goes through the log oldest first, lines that don't parse are skipped & counted in a warning
+func (log *Log) each(do func(entry Entry, line []byte)) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.eachLocked(do)
+}
+
+func (log *Log) eachLocked(do func(entry Entry, line []byte)) error {
+	file, err := os.Open(log.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), MAX_LINE_BYTES)
+	unreadable := 0
+	for scanner.Scan() {
+		entry := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			unreadable++
+			continue
+		}
+		do(entry, scanner.Bytes())
+	}
+	if unreadable > 0 {
+		slog.Warn(fmt.Sprintf("Skipped %v unreadable lines in %v", unreadable, log.path))
+	}
+	return scanner.Err()
+}
+
+// Snapshot is the whole log as it is on disk, taken between writes so it never ends halfway through a line
+func (log *Log) Snapshot() ([]byte, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return os.ReadFile(log.path)
+}
+
+// Check says whether data is a log Snapshot could have taken, for checking backups before restoring them
+func Check(data []byte) error {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &Entry{}); err != nil {
+			return fmt.Errorf("Line %v isn't an entry: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Prune drops every entry from before cutoff & is the only thing that ever rewrites the log.
+// What's kept goes to a temp file that's renamed over the log, so a crash halfway loses nothing.
+func (log *Log) Prune(cutoff time.Time) (int, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	kept := []byte{}
+	dropped := 0
+	err := log.eachLocked(func(entry Entry, line []byte) {
+		if entry.At.Before(cutoff) {
+			dropped++
+			return
+		}
+		kept = append(append(kept, line...), '\n')
+	})
+	if err != nil || dropped == 0 {
+		return 0, err
+	}
+
+	tmpPath := log.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Write(kept)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, log.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if dir, err := os.Open(filepath.Dir(log.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return dropped, nil
+}
+
+// WriteJsonl writes entries one JSON object per line, the same as the log itself
+func WriteJsonl(w io.Writer, entries []Entry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCsv writes entries under CSV_HEADER, times in RFC 3339
+func WriteCsv(w io.Writer, entries []Entry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(CSV_HEADER); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		row := []string{entry.At.UTC().Format(time.RFC3339), csvSafe(entry.Actor), entry.Action, csvSafe(entry.Target), entry.Ip, csvSafe(entry.Detail)}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvSafe keeps spreadsheets from running anything a user typed, e.g. a guest named =HYPERLINK(...)
+func csvSafe(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordQueryPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := Open(path)
+	if entries, err := log.Query(Filter{}); err != nil || len(entries) != 0 {
+		t.Fatalf("An empty log gave %v %v", entries, err)
+	}
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := []Entry{
+		{At: start, Actor: "admin@mysite.com", Action: USER_APPROVED, Target: "guest@gmail.com", Ip: "10.0.0.1"},
+		{At: start.Add(time.Hour), Actor: "guest@gmail.com", Action: SIGNED_IN, Ip: "10.0.0.2"},
+		{At: start.Add(2 * time.Hour), Actor: "key:default", Action: IMAGE_CONSUMED, Target: "abc.jpg"},
+		{At: start.Add(3 * time.Hour), Actor: "cli", Action: USER_DISAPPROVED, Target: "guest@gmail.com", Detail: "=cmd"},
+	}
+	for _, entry := range records {
+		if err := log.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a torn write shouldn't hide everything after it
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString("{\"at\":\n")
+	file.Close()
+	if err := log.Record(Entry{Actor: "guest@gmail.com", Action: SIGNED_OUT}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := log.Query(Filter{})
+	if err != nil || len(all) != 5 || all[0].Action != SIGNED_OUT || all[4].Action != USER_APPROVED {
+		t.Fatalf("Not everything newest first: %+v %v", all, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Log is readable by others: %v", info.Mode())
+	}
+	for name, test := range map[string]struct {
+		filter Filter
+		want   int
+	}{
+		"actor ignores case":  {Filter{Actor: "GUEST@"}, 2},
+		"action is exact":     {Filter{Action: "user"}, 0},
+		"target":              {Filter{Target: "guest@gmail.com"}, 2},
+		"since is inclusive":  {Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, 2},
+		"limit keeps newest":  {Filter{Target: "guest", Limit: 1}, 1},
+		"everything together": {Filter{Actor: "admin", Action: USER_APPROVED, Target: "guest"}, 1},
+	} {
+		if got, _ := log.Query(test.filter); len(got) != test.want {
+			t.Errorf("%v: got %v entries, wanted %v", name, len(got), test.want)
+		}
+	}
+	if got, _ := log.Query(Filter{Target: "guest", Limit: 1}); got[0].Action != USER_DISAPPROVED {
+		t.Errorf("Limit kept the wrong entry: %+v", got[0])
+	}
+
+	out := bytes.Buffer{}
+	if err = WriteCsv(&out, all); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil || len(rows) != 6 || strings.Join(rows[0], ",") != "at,actor,action,target,ip,detail" {
+		t.Fatalf("Bad CSV: %v %v", rows, err)
+	}
+	if rows[2][5] != "'=cmd" {
+		t.Errorf("A formula made it into the CSV: %q", rows[2][5])
+	}
+	out.Reset()
+	WriteJsonl(&out, all)
+	if lines := strings.Count(out.String(), "\n"); lines != 5 {
+		t.Errorf("JSONL has %v lines", lines)
+	}
+
+	dropped, err := log.Prune(start.Add(90 * time.Minute))
+	if err != nil || dropped != 2 {
+		t.Fatalf("Pruned %v %v", dropped, err)
+	}
+	if left, _ := log.Query(Filter{}); len(left) != 3 || left[2].Action != IMAGE_CONSUMED {
+		t.Errorf("Pruning kept the wrong entries: %+v", left)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Pruning left its temp file behind")
+	}
+}
@@ -0,0 +1,36 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	At time.Time `json:"at"`
+	// an email, "cli", "imagebarn" for the server itself, "key:<name>" for an API key, "kiosk", or empty when nobody could be told apart
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	// who or what it was done to, e.g. an email, an invite id, or a file name
+	Target string `json:"target,omitempty"`
+	Ip     string `json:"ip,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Filter picks entries out of the log, zero values match everything
+type Filter struct {
+	// Actor & Target match anywhere in the field, ignoring case
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// only the newest this many, 0 for all of them
+	Limit int
+}
+
+// Log is a JSON lines file that's only ever appended to, until Prune drops what's past retention
+type Log struct {
+	path  string
+	mutex sync.Mutex
+}
@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const MANIFEST_NAME = "manifest.json"
+
+// bumped whenever an older ImageBarn couldn't restore what a newer one writes
+const FORMAT_VERSION = 1
+
+var ErrNeedPassphrase = errors.New("backup is encrypted, a passphrase is needed")
+
+// NewWriter starts an archive on out, encrypted when passphrase isn't empty
+func NewWriter(out io.Writer, passphrase string) (*Writer, error) {
+	w := &Writer{manifest: Manifest{Version: FORMAT_VERSION, Created: time.Now().UTC(), Files: map[string]string{}}}
+	if passphrase != "" {
+		crypt, err := newEncryptWriter(out, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		w.crypt = crypt
+		out = crypt
+	}
+	w.gzip = gzip.NewWriter(out)
+	w.tar = tar.NewWriter(w.gzip)
+	return w, nil
+}
+
+// AddFile copies the file at path into the archive as name
+func (w *Writer) AddFile(name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return w.add(name, file, info.Size(), info.ModTime())
+}
+
+func (w *Writer) AddBytes(name string, data []byte) error {
+	return w.add(name, bytes.NewReader(data), int64(len(data)), w.manifest.Created)
+}
+
+func (w *Writer) add(name string, content io.Reader, size int64, modTime time.Time) error {
+	if _, exists := w.manifest.Files[name]; exists || name == MANIFEST_NAME {
+		return fmt.Errorf("%v is already in the backup", name)
+	}
+	err := w.tar.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: size, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err = io.CopyN(io.MultiWriter(w.tar, hash), content, size); err != nil {
+		return fmt.Errorf("Failed to back up %v: %v", name, err)
+	}
+	w.manifest.Files[name] = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// Close writes the manifest & finishes the archive, it isn't restorable until this succeeds
+func (w *Writer) Close() error {
+	manifest, err := json.Marshal(w.manifest)
+	if err != nil {
+		return err
+	}
+	err = w.tar.WriteHeader(&tar.Header{Name: MANIFEST_NAME, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(manifest)), ModTime: w.manifest.Created})
+	if err != nil {
+		return err
+	}
+	if _, err = w.tar.Write(manifest); err != nil {
+		return err
+	}
+	if err = w.tar.Close(); err != nil {
+		return err
+	}
+	if err = w.gzip.Close(); err != nil {
+		return err
+	}
+	if w.crypt != nil {
+		return w.crypt.Close()
+	}
+	return nil
+}
+
+// Extract unpacks an archive into dir & checks every file against the manifest.
+//
+//	dir should be empty, it's left half filled when an error is returned.
+func Extract(in io.Reader, passphrase string, dir string) (*Manifest, error) {
+	buffered := bufio.NewReader(in)
+	var reader io.Reader = buffered
+	if isEncrypted(buffered) {
+		if passphrase == "" {
+			return nil, ErrNeedPassphrase
+		}
+		decrypted, err := newDecryptReader(buffered, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		reader = decrypted
+	}
+	gzipReader, err := gzip.NewReader(reader)
+	if errors.Is(err, ErrWrongPassphrase) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Not an ImageBarn backup: %w", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	sums := map[string]string{}
+	var manifest *Manifest
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Backup is unreadable: %w", err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("Backup has %v after its manifest", header.Name)
+		}
+		if header.Name == MANIFEST_NAME {
+			manifest = &Manifest{}
+			if err = json.NewDecoder(tarReader).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("Backup manifest is unreadable: %w", err)
+			}
+			continue
+		}
+		// nothing we write escapes dir or is anything but a plain file
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(header.Name) {
+			return nil, fmt.Errorf("Backup holds something unexpected: %v", header.Name)
+		}
+		if _, exists := sums[header.Name]; exists {
+			return nil, fmt.Errorf("Backup holds %v twice", header.Name)
+		}
+		sums[header.Name], err = extractFile(tarReader, filepath.Join(dir, filepath.FromSlash(header.Name)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a gzip stream is only checked once it's read to the end
+	if _, err = io.Copy(io.Discard, gzipReader); err != nil {
+		return nil, fmt.Errorf("Backup is unreadable: %w", err)
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("Backup has no manifest, it was probably cut short")
+	}
+	if manifest.Version != FORMAT_VERSION {
+		return nil, fmt.Errorf("Backup format %v isn't supported, this ImageBarn reads %v", manifest.Version, FORMAT_VERSION)
+	}
+	for name, sum := range manifest.Files {
+		if sums[name] != sum {
+			return nil, fmt.Errorf("%v doesn't match the manifest", name)
+		}
+	}
+	if len(sums) != len(manifest.Files) {
+		return nil, fmt.Errorf("Backup holds files missing from its manifest")
+	}
+	return manifest, nil
+}
+
+func extractFile(content io.Reader, path string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, hash), content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), file.Sync()
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+func writeArchive(t *testing.T, passphrase string, files map[string][]byte) []byte {
+	out := bytes.Buffer{}
+	w, err := NewWriter(&out, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err = w.AddBytes(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	// bigger than a few chunks so the chunking is exercised, random so gzip can't shrink it into one
+	big := make([]byte, 3*helpme.STREAM_CHUNK_SIZE+100)
+	rand.Read(big)
+	files := map[string][]byte{
+		"approved-users.json":                 []byte(`{"guest@gmail.com":true}`),
+		"images/15#guest@gmail.com/7#cow.png": big,
+	}
+
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		archive := writeArchive(t, passphrase, files)
+		if passphrase != "" && bytes.Contains(archive, []byte("guest@gmail.com")) {
+			t.Fatal("Encrypted backup leaks its contents")
+		}
+
+		dir := t.TempDir()
+		manifest, err := Extract(bytes.NewReader(archive), passphrase, dir)
+		if err != nil {
+			t.Fatalf("Failed to extract (passphrase %q): %v", passphrase, err)
+		}
+		if len(manifest.Files) != len(files) {
+			t.Fatalf("Manifest should list %v files, got %v", len(files), manifest.Files)
+		}
+		for name, data := range files {
+			extracted, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil || !bytes.Equal(extracted, data) {
+				t.Fatalf("%v didn't come back the same: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestEncryptedNeedsTheRightPassphrase(t *testing.T) {
+	archive := writeArchive(t, "right", map[string][]byte{"admins.json": []byte(`[]`)})
+
+	if _, err := Extract(bytes.NewReader(archive), "", t.TempDir()); !errors.Is(err, ErrNeedPassphrase) {
+		t.Fatalf("Expected ErrNeedPassphrase, got %v", err)
+	}
+	if _, err := Extract(bytes.NewReader(archive), "wrong", t.TempDir()); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	// dropping the last chunk has to be noticed, not read as a shorter backup
+	if _, err := Extract(bytes.NewReader(archive[:len(archive)-1]), "right", t.TempDir()); err == nil {
+		t.Fatal("Extracted a truncated backup")
+	}
+}
+
+func TestExtractRejectsTampering(t *testing.T) {
+	archive := writeArchive(t, "", map[string][]byte{"admins.json": []byte(`["someone@gmail.com"]`)})
+	// cut before the manifest
+	if _, err := Extract(bytes.NewReader(archive[:len(archive)/2]), "", t.TempDir()); err == nil {
+		t.Fatal("Extracted half a backup")
+	}
+
+	// a hand built archive trying to write outside the data dir
+	evil := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&evil)
+	tarWriter := tar.NewWriter(gzipWriter)
+	tarWriter.WriteHeader(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0600, Size: 2})
+	tarWriter.Write([]byte("hi"))
+	tarWriter.Close()
+	gzipWriter.Close()
+	dir := t.TempDir()
+	_, err := Extract(&evil, "", filepath.Join(dir, "data"))
+	if err == nil || !strings.Contains(err.Error(), "unexpected") {
+		t.Fatalf("Expected the path to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatal("A file was written outside the data dir")
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// encrypted archives start with this, then the salt, then the sealed chunks
+const ENCRYPTED_MAGIC = "imagebarn-backup-enc-v1\n"
+const SALT_SIZE = 16
+
+// scrypt's recommended interactive parameters, around 100ms & 32MB
+const SCRYPT_N = 1 << 15
+const SCRYPT_R = 8
+const SCRYPT_P = 1
+
+// a wrong passphrase & a tampered archive look the same to GCM
+var ErrWrongPassphrase = helpme.ErrStreamTampered
+
+func deriveAead(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the salt is new for every archive so the key is too, which is all the stream needs
+func newEncryptWriter(out io.Writer, passphrase string) (io.WriteCloser, error) {
+	salt := make([]byte, SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := deriveAead(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(out, ENCRYPTED_MAGIC); err != nil {
+		return nil, err
+	}
+	if _, err = out.Write(salt); err != nil {
+		return nil, err
+	}
+	return helpme.NewSealWriter(out, aead, nil), nil
+}
+
+// isEncrypted peeks at the start of in without consuming anything
+func isEncrypted(in *bufio.Reader) bool {
+	start, _ := in.Peek(len(ENCRYPTED_MAGIC))
+	return string(start) == ENCRYPTED_MAGIC
+}
+
+func newDecryptReader(in *bufio.Reader, passphrase string) (io.Reader, error) {
+	if _, err := in.Discard(len(ENCRYPTED_MAGIC)); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, SALT_SIZE)
+	if _, err := io.ReadFull(in, salt); err != nil {
+		return nil, fmt.Errorf("Backup is cut short: %v", err)
+	}
+	aead, err := deriveAead(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return helpme.NewOpenReader(in, aead, nil), nil
+}
@@ -0,0 +1,24 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// Manifest is the last entry of every archive, nothing is restored unless every file matches it
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// archive path -> sha256 hex
+	Files map[string]string `json:"files"`
+}
+
+// Writer builds an archive, call Close to finish it
+type Writer struct {
+	tar      *tar.Writer
+	gzip     *gzip.Writer
+	crypt    io.WriteCloser
+	manifest Manifest
+}
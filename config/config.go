@@ -0,0 +1,602 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// used when neither -config nor IMAGEBARN_CONFIG is given, it's fine for this one to not exist
+const DEFAULT_CONFIG_FILE = "./imagebarn.yaml"
+
+const LIVE_FEED_OFF = "off"
+const LIVE_FEED_PUBLIC = "public"
+const LIVE_FEED_KEYED = "keyed"
+
+// each uploader gets an equal shot, then a random one of their images
+const SELECTION_FAIR = "fair"
+
+// every waiting image gets an equal shot, heavy uploaders show up more
+const SELECTION_RANDOM = "random"
+
+// first in, first out
+const SELECTION_OLDEST = "oldest"
+
+const FSCK_OFF = "off"
+
+// log what's wrong, change nothing
+const FSCK_REPORT = "report"
+const FSCK_REPAIR = "repair"
+
+// image encryption keys are AES-256
+const IMAGE_KEY_SIZE = 32
+
+const CSP_ENFORCE = "enforce"
+
+// violations are reported but nothing is blocked, for trying a policy out
+const CSP_REPORT_ONLY = "report-only"
+const CSP_OFF = "off"
+
+const FRAME_DENY = "DENY"
+const FRAME_SAMEORIGIN = "SAMEORIGIN"
+const FRAME_OFF = "off"
+
+const SMTP_STARTTLS = "starttls"
+const SMTP_TLS = "tls"
+
+// only for a relay on the same machine
+const SMTP_NONE = "none"
+
+// sign in links are meant to be used right away
+const MAX_EMAIL_LINK_LIFETIME = time.Hour
+
+var REFERRER_POLICIES = []string{"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin", "same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url"}
+
+// the name bearer_token goes by next to api_keys
+const DEFAULT_API_KEY_NAME = "default"
+
+func Default() *Config {
+	return &Config{
+		ListenAddress:    "127.0.0.1:30109",
+		DataDir:          ".",
+		UploadLimitMb:    35,
+		MaxImagesPerUser: 5,
+		GuestMaxImages:   2,
+		ImageWorkers:     1,
+		SessionLifetime:  90 * 24 * time.Hour,
+		FsckOnStart:      FSCK_REPORT,
+		LiveFeed:         LIVE_FEED_OFF,
+		SelectionPolicy:  SELECTION_FAIR,
+		LogLevel:         "debug",
+		AuditRetention:   365 * 24 * time.Hour,
+		Mqtt: MqttConfig{
+			ClientId:    "imagebarn",
+			TopicPrefix: "imagebarn",
+		},
+		Email: EmailConfig{
+			SmtpPort:     587,
+			Security:     SMTP_STARTTLS,
+			LinkLifetime: 15 * time.Minute,
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			Csp:            CSP_ENFORCE,
+			HstsMaxAge:     180 * 24 * time.Hour,
+			FrameOptions:   FRAME_DENY,
+			ReferrerPolicy: "same-origin",
+		},
+	}
+}
+
+// Load reads the config file, env vars & flags in that order, then validates the result.
+// Whatever follows the flags is returned untouched, that's a CLI subcommand.
+//
+//	Every problem found is reported in the one error instead of stopping at the first.
+func Load(args []string) (*Config, []string, error) {
+	config := Default()
+
+	flags := flag.NewFlagSet("imagebarn", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("IMAGEBARN_CONFIG"), "YAML config file, defaults to "+DEFAULT_CONFIG_FILE+" when it exists")
+	// flags are applied after the file & env, so just remember them for now
+	overrides := []func(){}
+	stringFlag := func(name string, target *string, usage string) {
+		flags.Func(name, usage, func(value string) error {
+			overrides = append(overrides, func() { *target = value })
+			return nil
+		})
+	}
+	intFlag := func(name string, target *int, usage string) {
+		flags.Func(name, usage, func(value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("not a whole number")
+			}
+			overrides = append(overrides, func() { *target = parsed })
+			return nil
+		})
+	}
+	stringFlag("listen", &config.ListenAddress, "address to listen on, e.g. 127.0.0.1:30109")
+	stringFlag("data-dir", &config.DataDir, "directory holding images & state files")
+	intFlag("upload-limit-mb", &config.UploadLimitMb, "largest upload allowed in MB")
+	intFlag("max-images-per-user", &config.MaxImagesPerUser, "images each user may have waiting")
+	intFlag("image-workers", &config.ImageWorkers, "how many images can be converted at once")
+	stringFlag("selection-policy", &config.SelectionPolicy, "fair, random, or oldest")
+	stringFlag("log-level", &config.LogLevel, "debug, info, warn, or error")
+	stringFlag("fsck-on-start", &config.FsckOnStart, "off, report, or repair")
+	stringFlag("image-encryption-key-file", &config.ImageEncryptionKeyFile, "file holding the key new images are encrypted with")
+	flags.Func("session-lifetime", "how long a sign in lasts, e.g. 2160h", func(value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		overrides = append(overrides, func() { config.SessionLifetime = parsed })
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if err := config.loadFile(*configFile); err != nil {
+		return nil, nil, err
+	}
+	envErr := config.loadEnv()
+	for _, override := range overrides {
+		override()
+	}
+	config.fillMqttTopics()
+
+	if err := errors.Join(envErr, config.Validate()); err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("Unable to create data_dir \"%v\": %v", config.DataDir, err)
+	}
+	return config, flags.Args(), nil
+}
+
+// SlogLevel is the validated log_level
+func (config *Config) SlogLevel() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(config.LogLevel))
+	return level
+}
+
+// DataPath is where a state file named name lives
+func (config *Config) DataPath(name string) string {
+	return filepath.Join(config.DataDir, name)
+}
+
+// ImageEncryptionKeys reads the key new images are encrypted with, nil when encryption is off, & the keys older images may be under
+func (config *Config) ImageEncryptionKeys() ([]byte, [][]byte, error) {
+	var current []byte
+	var err error
+	if config.ImageEncryptionKeyFile != "" {
+		if current, err = readImageKeyFile(config.ImageEncryptionKeyFile); err != nil {
+			return nil, nil, fmt.Errorf("image_encryption_key_file (IMAGE_ENCRYPTION_KEY_FILE) can't be used: %v", err)
+		}
+	} else if config.ImageEncryptionKey != "" {
+		if current, err = ParseImageKey(config.ImageEncryptionKey); err != nil {
+			return nil, nil, fmt.Errorf("image_encryption_key (IMAGE_ENCRYPTION_KEY) can't be used: %v", err)
+		}
+	}
+	previous := [][]byte{}
+	for _, keyFile := range config.PreviousImageEncryptionKeyFiles {
+		key, err := readImageKeyFile(keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("previous_image_encryption_key_files (PREVIOUS_IMAGE_ENCRYPTION_KEY_FILES) \"%v\" can't be used: %v", keyFile, err)
+		}
+		previous = append(previous, key)
+	}
+	return current, previous, nil
+}
+
+// ParseImageKey decodes a key like `imagebarn encryption genkey` prints
+func ParseImageKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("not base64: %v", err)
+	}
+	if len(key) != IMAGE_KEY_SIZE {
+		return nil, fmt.Errorf("expected %v bytes, got %v", IMAGE_KEY_SIZE, len(key))
+	}
+	return key, nil
+}
+
+func readImageKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImageKey(string(data))
+}
+
+func (config *Config) loadFile(path string) error {
+	if path == "" {
+		path = DEFAULT_CONFIG_FILE
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	// a typo'd key should fail loudly instead of silently using the default
+	decoder.KnownFields(true)
+	if err = decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("Unable to read config file %v: %v", path, err)
+	}
+	return nil
+}
+
+// empty env vars count as unset, the .env.example has plenty of them
+func (config *Config) loadEnv() error {
+	var errs []error
+	str := func(key string, target *string) {
+		if value := os.Getenv(key); value != "" {
+			*target = value
+		}
+	}
+	num := func(key string, target *int) {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v=\"%v\" is not a whole number", key, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	str("LISTEN_ADDRESS", &config.ListenAddress)
+	str("DATA_DIR", &config.DataDir)
+	str("BASE_URI", &config.BaseUri)
+	str("ADMIN_USER", &config.AdminUser)
+	str("BEARER_TOKEN", &config.BearerToken)
+	str("GOOGLE_CLIENT_ID", &config.GoogleClientId)
+	str("GOOGLE_CLIENT_SECRET", &config.GoogleClientSecret)
+	if value := os.Getenv("API_KEYS"); value != "" {
+		config.ApiKeys = map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			name, token, found := strings.Cut(strings.TrimSpace(pair), ":")
+			if !found {
+				errs = append(errs, fmt.Errorf("API_KEYS entries look like name:token, got \"%v\"", pair))
+				continue
+			}
+			config.ApiKeys[name] = token
+		}
+	}
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		config.TrustedProxies = []string{}
+		for _, proxy := range strings.Split(value, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				config.TrustedProxies = append(config.TrustedProxies, proxy)
+			}
+		}
+	}
+	num("UPLOAD_LIMIT_MB", &config.UploadLimitMb)
+	num("MAX_IMAGES_PER_USER", &config.MaxImagesPerUser)
+	num("GUEST_MAX_IMAGES", &config.GuestMaxImages)
+	num("IMAGE_WORKERS", &config.ImageWorkers)
+	str("SELECTION_POLICY", &config.SelectionPolicy)
+	str("LOG_LEVEL", &config.LogLevel)
+	if value := os.Getenv("SESSION_LIFETIME"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SESSION_LIFETIME=\"%v\" is not a duration like 2160h: %v", value, err))
+		} else {
+			config.SessionLifetime = parsed
+		}
+	}
+	if value := os.Getenv("SIGNING_KEY_ROTATION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SIGNING_KEY_ROTATION=\"%v\" is not a duration like 720h: %v", value, err))
+		} else {
+			config.SigningKeyRotation = parsed
+		}
+	}
+	if value := os.Getenv("AUDIT_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("AUDIT_RETENTION=\"%v\" is not a duration like 8760h: %v", value, err))
+		} else {
+			config.AuditRetention = parsed
+		}
+	}
+	if value := os.Getenv("CORS_ALLOWED_ORIGINS"); value != "" {
+		config.Cors.AllowedOrigins = []string{}
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				config.Cors.AllowedOrigins = append(config.Cors.AllowedOrigins, origin)
+			}
+		}
+	}
+	if value := os.Getenv("CORS_KEY_ORIGINS"); value != "" {
+		config.Cors.KeyOrigins = map[string][]string{}
+		for _, pair := range strings.Split(value, ",") {
+			name, origin, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found {
+				errs = append(errs, fmt.Errorf("CORS_KEY_ORIGINS entries look like name=https://origin, got \"%v\"", pair))
+				continue
+			}
+			config.Cors.KeyOrigins[name] = append(config.Cors.KeyOrigins[name], origin)
+		}
+	}
+	if value := os.Getenv("AUTO_APPROVE_DOMAINS"); value != "" {
+		config.AutoApproveDomains = []string{}
+		for _, domain := range strings.Split(value, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				config.AutoApproveDomains = append(config.AutoApproveDomains, domain)
+			}
+		}
+	}
+	str("CSP_MODE", &config.SecurityHeaders.Csp)
+	if value := os.Getenv("HSTS_MAX_AGE"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("HSTS_MAX_AGE=\"%v\" is not a duration like 4320h: %v", value, err))
+		} else {
+			config.SecurityHeaders.HstsMaxAge = parsed
+		}
+	}
+	str("FRAME_OPTIONS", &config.SecurityHeaders.FrameOptions)
+	str("REFERRER_POLICY", &config.SecurityHeaders.ReferrerPolicy)
+	str("FSCK_ON_START", &config.FsckOnStart)
+	str("IMAGE_ENCRYPTION_KEY", &config.ImageEncryptionKey)
+	str("IMAGE_ENCRYPTION_KEY_FILE", &config.ImageEncryptionKeyFile)
+	if value := os.Getenv("PREVIOUS_IMAGE_ENCRYPTION_KEY_FILES"); value != "" {
+		config.PreviousImageEncryptionKeyFiles = []string{}
+		for _, keyFile := range strings.Split(value, ",") {
+			if keyFile = strings.TrimSpace(keyFile); keyFile != "" {
+				config.PreviousImageEncryptionKeyFiles = append(config.PreviousImageEncryptionKeyFiles, keyFile)
+			}
+		}
+	}
+	str("LIVE_FEED", &config.LiveFeed)
+	str("LIVE_FEED_KEY", &config.LiveFeedKey)
+	str("KIOSK_EMPTY_ARTWORK", &config.KioskEmptyArtwork)
+	str("MQTT_BROKER", &config.Mqtt.Broker)
+	str("MQTT_CLIENT_ID", &config.Mqtt.ClientId)
+	str("MQTT_USERNAME", &config.Mqtt.Username)
+	str("MQTT_PASSWORD", &config.Mqtt.Password)
+	str("MQTT_TOPIC_PREFIX", &config.Mqtt.TopicPrefix)
+	str("MQTT_POOL_TOPIC", &config.Mqtt.PoolTopic)
+	str("MQTT_CONSUMED_TOPIC", &config.Mqtt.ConsumedTopic)
+	str("MQTT_COMMAND_TOPIC", &config.Mqtt.CommandTopic)
+	str("SMTP_HOST", &config.Email.SmtpHost)
+	num("SMTP_PORT", &config.Email.SmtpPort)
+	str("SMTP_USERNAME", &config.Email.Username)
+	str("SMTP_PASSWORD", &config.Email.Password)
+	str("SMTP_FROM", &config.Email.From)
+	str("SMTP_SECURITY", &config.Email.Security)
+	if value := os.Getenv("EMAIL_LINK_LIFETIME"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("EMAIL_LINK_LIFETIME=\"%v\" is not a duration like 15m: %v", value, err))
+		} else {
+			config.Email.LinkLifetime = parsed
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (config *Config) fillMqttTopics() {
+	if config.Mqtt.PoolTopic == "" {
+		config.Mqtt.PoolTopic = config.Mqtt.TopicPrefix + "/pool"
+	}
+	if config.Mqtt.ConsumedTopic == "" {
+		config.Mqtt.ConsumedTopic = config.Mqtt.TopicPrefix + "/consumed"
+	}
+	if config.Mqtt.CommandTopic == "" {
+		config.Mqtt.CommandTopic = config.Mqtt.TopicPrefix + "/command"
+	}
+}
+
+// Validate checks the whole config & returns every problem joined together
+func (config *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, port, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		fail("listen_address (LISTEN_ADDRESS) \"%v\" is not a host:port: %v", config.ListenAddress, err)
+	} else if portNum, err := strconv.Atoi(port); err != nil || portNum < 0 || portNum > 65535 {
+		fail("listen_address (LISTEN_ADDRESS) \"%v\" has an invalid port", config.ListenAddress)
+	}
+	if config.DataDir == "" {
+		fail("data_dir (DATA_DIR) can't be empty, use \".\" for the working directory")
+	} else if info, err := os.Stat(config.DataDir); err == nil && !info.IsDir() {
+		fail("data_dir (DATA_DIR) \"%v\" is not a directory", config.DataDir)
+	}
+
+	if config.BaseUri == "" {
+		fail("base_uri (BASE_URI) is required, e.g. https://imagebarn.mysite.com")
+	} else if parsed, err := url.Parse(config.BaseUri); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		fail("base_uri (BASE_URI) \"%v\" must be an http or https url", config.BaseUri)
+	}
+	if !strings.Contains(config.AdminUser, "@") {
+		fail("admin_user (ADMIN_USER) must be the admin's email")
+	}
+	if config.BearerToken == "" {
+		fail("bearer_token (BEARER_TOKEN) is required, displays can't fetch images without it")
+	}
+	tokens := map[string]string{config.BearerToken: DEFAULT_API_KEY_NAME}
+	for name, token := range config.ApiKeys {
+		if name == "" || name == DEFAULT_API_KEY_NAME {
+			fail("api_keys (API_KEYS) can't use the name \"%v\"", name)
+		}
+		if token == "" {
+			fail("api_keys (API_KEYS) \"%v\" has no token", name)
+		} else if other, exists := tokens[token]; exists {
+			fail("api_keys (API_KEYS) \"%v\" has the same token as \"%v\"", name, other)
+		}
+		tokens[token] = name
+	}
+	if config.GoogleClientId == "" || config.GoogleClientSecret == "" {
+		fail("google_client_id & google_client_secret (GOOGLE_CLIENT_ID & GOOGLE_CLIENT_SECRET) are required")
+	}
+
+	for _, proxy := range config.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			fail("trusted_proxies (TRUSTED_PROXIES) has an invalid IP address \"%v\"", proxy)
+		}
+	}
+	if config.UploadLimitMb < 1 {
+		fail("upload_limit_mb (UPLOAD_LIMIT_MB) must be at least 1, got %v", config.UploadLimitMb)
+	}
+	if config.MaxImagesPerUser < 1 {
+		fail("max_images_per_user (MAX_IMAGES_PER_USER) must be at least 1, got %v", config.MaxImagesPerUser)
+	}
+	if config.GuestMaxImages < 1 {
+		fail("guest_max_images (GUEST_MAX_IMAGES) must be at least 1, got %v", config.GuestMaxImages)
+	}
+	if config.ImageWorkers < 1 {
+		fail("image_workers (IMAGE_WORKERS) must be at least 1, got %v", config.ImageWorkers)
+	}
+	switch config.SelectionPolicy {
+	case SELECTION_FAIR, SELECTION_RANDOM, SELECTION_OLDEST:
+	default:
+		fail("selection_policy (SELECTION_POLICY) \"%v\" is unknown, use %v, %v, or %v", config.SelectionPolicy, SELECTION_FAIR, SELECTION_RANDOM, SELECTION_OLDEST)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		fail("log_level (LOG_LEVEL) \"%v\" is unknown, use debug, info, warn, or error", config.LogLevel)
+	}
+	if config.SessionLifetime < time.Minute {
+		fail("session_lifetime (SESSION_LIFETIME) must be at least 1m, got %v", config.SessionLifetime)
+	}
+	if config.SigningKeyRotation != 0 && config.SigningKeyRotation < time.Hour {
+		fail("signing_key_rotation (SIGNING_KEY_ROTATION) must be 0 or at least 1h, got %v", config.SigningKeyRotation)
+	}
+	if config.AuditRetention != 0 && config.AuditRetention < 24*time.Hour {
+		fail("audit_retention (AUDIT_RETENTION) must be 0 or at least 24h, got %v", config.AuditRetention)
+	}
+	for _, origin := range config.Cors.AllowedOrigins {
+		if !IsOrigin(origin) {
+			fail("cors.allowed_origins (CORS_ALLOWED_ORIGINS) \"%v\" must be * or look like https://display.mysite.com", origin)
+		}
+	}
+	for name, origins := range config.Cors.KeyOrigins {
+		for _, origin := range origins {
+			if !IsOrigin(origin) {
+				fail("cors.key_origins (CORS_KEY_ORIGINS) \"%v\" of %v must be * or look like https://display.mysite.com", origin, name)
+			}
+		}
+	}
+	for _, domain := range config.AutoApproveDomains {
+		if !IsDomain(domain) {
+			fail("auto_approve_domains (AUTO_APPROVE_DOMAINS) \"%v\" must look like ourcompany.com", domain)
+		}
+	}
+	switch config.SecurityHeaders.Csp {
+	case CSP_ENFORCE, CSP_REPORT_ONLY, CSP_OFF:
+	default:
+		fail("security_headers.csp (CSP_MODE) \"%v\" is unknown, use %v, %v, or %v", config.SecurityHeaders.Csp, CSP_ENFORCE, CSP_REPORT_ONLY, CSP_OFF)
+	}
+	if config.SecurityHeaders.HstsMaxAge < 0 {
+		fail("security_headers.hsts_max_age (HSTS_MAX_AGE) can't be negative, got %v", config.SecurityHeaders.HstsMaxAge)
+	}
+	switch config.SecurityHeaders.FrameOptions {
+	case FRAME_DENY, FRAME_SAMEORIGIN, FRAME_OFF:
+	default:
+		fail("security_headers.frame_options (FRAME_OPTIONS) \"%v\" is unknown, use %v, %v, or %v", config.SecurityHeaders.FrameOptions, FRAME_DENY, FRAME_SAMEORIGIN, FRAME_OFF)
+	}
+	if !slices.Contains(REFERRER_POLICIES, config.SecurityHeaders.ReferrerPolicy) {
+		fail("security_headers.referrer_policy (REFERRER_POLICY) \"%v\" is unknown, use one of %v", config.SecurityHeaders.ReferrerPolicy, strings.Join(REFERRER_POLICIES, ", "))
+	}
+	switch config.FsckOnStart {
+	case FSCK_OFF, FSCK_REPORT, FSCK_REPAIR:
+	default:
+		fail("fsck_on_start (FSCK_ON_START) \"%v\" is unknown, use %v, %v, or %v", config.FsckOnStart, FSCK_OFF, FSCK_REPORT, FSCK_REPAIR)
+	}
+	if _, _, err := config.ImageEncryptionKeys(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch config.LiveFeed {
+	case LIVE_FEED_OFF, LIVE_FEED_PUBLIC:
+	case LIVE_FEED_KEYED:
+		if config.LiveFeedKey == "" {
+			fail("live_feed is keyed but no live_feed_key (LIVE_FEED_KEY) was provided")
+		}
+	default:
+		fail("live_feed (LIVE_FEED) \"%v\" is unknown, use %v, %v, or %v", config.LiveFeed, LIVE_FEED_OFF, LIVE_FEED_PUBLIC, LIVE_FEED_KEYED)
+	}
+	if config.KioskEmptyArtwork != "" {
+		if _, err := os.Stat(config.KioskEmptyArtwork); err != nil {
+			fail("kiosk_empty_artwork (KIOSK_EMPTY_ARTWORK) can't be used: %v", err)
+		}
+	}
+	if config.Mqtt.Broker != "" {
+		if parsed, err := url.Parse(config.Mqtt.Broker); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			fail("mqtt.broker (MQTT_BROKER) \"%v\" must look like tcp://localhost:1883", config.Mqtt.Broker)
+		}
+	}
+	if config.Email.SmtpHost != "" {
+		if config.Email.SmtpPort < 1 || config.Email.SmtpPort > 65535 {
+			fail("email.smtp_port (SMTP_PORT) %v is not a port", config.Email.SmtpPort)
+		}
+		if _, err := mail.ParseAddress(config.Email.From); err != nil {
+			fail("email.from (SMTP_FROM) \"%v\" must be an address like ImageBarn <barn@mysite.com>", config.Email.From)
+		}
+		switch config.Email.Security {
+		case SMTP_STARTTLS, SMTP_TLS:
+		case SMTP_NONE:
+			if config.Email.Username != "" {
+				fail("email.security (SMTP_SECURITY) is none, the SMTP password would be sent without TLS")
+			}
+		default:
+			fail("email.security (SMTP_SECURITY) \"%v\" is unknown, use %v, %v, or %v", config.Email.Security, SMTP_STARTTLS, SMTP_TLS, SMTP_NONE)
+		}
+		if config.Email.LinkLifetime < time.Minute || config.Email.LinkLifetime > MAX_EMAIL_LINK_LIFETIME {
+			fail("email.link_lifetime (EMAIL_LINK_LIFETIME) must be between 1m & %v, got %v", MAX_EMAIL_LINK_LIFETIME, config.Email.LinkLifetime)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// IsOrigin is true for * or a scheme & host, with a port if it isn't the default, the way browsers send Origin
+func IsOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return false
+	}
+	return strings.EqualFold(parsed.Scheme+"://"+parsed.Host, origin)
+}
+
+// IsDomain is true for a host name with at least one dot, a leading @ is allowed since that's how people write them
+func IsDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return false
+	}
+	for _, r := range domain {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setRequiredEnv(t *testing.T) {
+	t.Setenv("BASE_URI", "https://imagebarn.mysite.com")
+	t.Setenv("ADMIN_USER", "admin@mysite.com")
+	t.Setenv("BEARER_TOKEN", "token")
+	t.Setenv("GOOGLE_CLIENT_ID", "id")
+	t.Setenv("GOOGLE_CLIENT_SECRET", "secret")
+}
+
+func TestLoadLaterSourcesWin(t *testing.T) {
+	setRequiredEnv(t)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "imagebarn.yaml")
+	err := os.WriteFile(configFile, []byte(`
+listen_address: 0.0.0.0:8080
+data_dir: `+dir+`
+upload_limit_mb: 10
+max_images_per_user: 8
+session_lifetime: 24h
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("UPLOAD_LIMIT_MB", "20")
+
+	config, rest, err := Load([]string{"-config", configFile, "-max-images-per-user", "3", "user", "list"})
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if len(rest) != 2 || rest[0] != "user" {
+		t.Fatalf("Subcommand wasn't left alone: %v", rest)
+	}
+	if config.ListenAddress != "0.0.0.0:8080" || config.SessionLifetime != 24*time.Hour {
+		t.Fatalf("File values weren't used: %+v", config)
+	}
+	if config.UploadLimitMb != 20 {
+		t.Fatalf("Env should beat the file, got %v MB", config.UploadLimitMb)
+	}
+	if config.MaxImagesPerUser != 3 {
+		t.Fatalf("Flag should beat the file, got %v images", config.MaxImagesPerUser)
+	}
+	if config.ImageWorkers != 1 || config.Mqtt.PoolTopic != "imagebarn/pool" {
+		t.Fatalf("Defaults weren't kept: %+v", config)
+	}
+	if config.DataPath("approved-users.json") != filepath.Join(dir, "approved-users.json") {
+		t.Fatalf("State files aren't in the data dir: %v", config.DataPath("approved-users.json"))
+	}
+}
+
+func TestLoadReportsEveryError(t *testing.T) {
+	t.Setenv("BASE_URI", "")
+	t.Setenv("ADMIN_USER", "")
+	t.Setenv("BEARER_TOKEN", "")
+	t.Setenv("UPLOAD_LIMIT_MB", "lots")
+	t.Setenv("LIVE_FEED", "keyed")
+	t.Setenv("LIVE_FEED_KEY", "")
+	t.Setenv("CSP_MODE", "strict")
+	t.Setenv("REFERRER_POLICY", "nobody")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://display.mysite.com/slideshow")
+	t.Setenv("AUTO_APPROVE_DOMAINS", "ourcompany.com,*@gmail.com")
+	t.Setenv("GUEST_MAX_IMAGES", "0")
+	t.Setenv("SMTP_HOST", "smtp.mysite.com")
+	t.Setenv("SMTP_FROM", "ImageBarn")
+	t.Setenv("AUDIT_RETENTION", "1h")
+
+	_, _, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	if err == nil || !strings.Contains(err.Error(), "Unable to open config file") {
+		t.Fatalf("A missing explicit config file should fail, got %v", err)
+	}
+
+	_, _, err = Load([]string{"-listen", "nope", "-data-dir", t.TempDir()})
+	if err == nil {
+		t.Fatal("Loaded a config with no admin, bearer token, or google credentials")
+	}
+	for _, wanted := range []string{"LISTEN_ADDRESS", "BASE_URI", "ADMIN_USER", "BEARER_TOKEN", "GOOGLE_CLIENT_ID", "UPLOAD_LIMIT_MB", "LIVE_FEED_KEY", "CSP_MODE", "REFERRER_POLICY", "CORS_ALLOWED_ORIGINS", "AUTO_APPROVE_DOMAINS", "GUEST_MAX_IMAGES", "SMTP_FROM", "AUDIT_RETENTION"} {
+		if !strings.Contains(err.Error(), wanted) {
+			t.Errorf("Missing %v from the errors:\n%v", wanted, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package config
+
+import "reflect"
+
+// RestartOnlyChanges names the settings that differ from running but only take effect after a restart
+func (config *Config) RestartOnlyChanges(running *Config) []string {
+	changed := []string{}
+	check := func(name string, new any, old any) {
+		if !reflect.DeepEqual(new, old) {
+			changed = append(changed, name)
+		}
+	}
+	check("listen_address", config.ListenAddress, running.ListenAddress)
+	check("data_dir", config.DataDir, running.DataDir)
+	check("base_uri", config.BaseUri, running.BaseUri)
+	check("admin_user", config.AdminUser, running.AdminUser)
+	check("google_client_id", config.GoogleClientId, running.GoogleClientId)
+	check("google_client_secret", config.GoogleClientSecret, running.GoogleClientSecret)
+	check("image_workers", config.ImageWorkers, running.ImageWorkers)
+	check("session_lifetime", config.SessionLifetime, running.SessionLifetime)
+	check("fsck_on_start", config.FsckOnStart, running.FsckOnStart)
+	check("image_encryption_key", config.ImageEncryptionKey, running.ImageEncryptionKey)
+	check("image_encryption_key_file", config.ImageEncryptionKeyFile, running.ImageEncryptionKeyFile)
+	check("previous_image_encryption_key_files", config.PreviousImageEncryptionKeyFiles, running.PreviousImageEncryptionKeyFiles)
+	check("live_feed", config.LiveFeed, running.LiveFeed)
+	check("live_feed_key", config.LiveFeedKey, running.LiveFeedKey)
+	check("kiosk_empty_artwork", config.KioskEmptyArtwork, running.KioskEmptyArtwork)
+	check("mqtt", config.Mqtt, running.Mqtt)
+	check("email", config.Email, running.Email)
+	return changed
+}
@@ -0,0 +1,101 @@
+package config
+
+import "time"
+
+// Config is everything ImageBarn reads at startup.
+//
+//	Later sources win: defaults, then the config file, then env vars (.env included), then flags.
+type Config struct {
+	ListenAddress string `yaml:"listen_address"`
+	// approved users, issued versions, keys, webhooks & images all live under here
+	DataDir string `yaml:"data_dir"`
+	BaseUri string `yaml:"base_uri"`
+
+	AdminUser          string `yaml:"admin_user"`
+	GoogleClientId     string `yaml:"google_client_id"`
+	GoogleClientSecret string `yaml:"google_client_secret"`
+
+	ImageWorkers    int           `yaml:"image_workers"`
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+	// what the filesystem check does at startup
+	FsckOnStart string `yaml:"fsck_on_start"`
+	// base64 of 32 random bytes, setting either encrypts new images. The file wins if both are set
+	ImageEncryptionKey     string `yaml:"image_encryption_key"`
+	ImageEncryptionKeyFile string `yaml:"image_encryption_key_file"`
+	// keys images may still be under, `imagebarn encryption rotate` moves them to the current one
+	PreviousImageEncryptionKeyFiles []string `yaml:"previous_image_encryption_key_files"`
+
+	LiveFeed          string     `yaml:"live_feed"`
+	LiveFeedKey       string     `yaml:"live_feed_key"`
+	KioskEmptyArtwork string     `yaml:"kiosk_empty_artwork"`
+	Mqtt              MqttConfig `yaml:"mqtt"`
+	// sign in links by email, next to Google's
+	Email EmailConfig `yaml:"email"`
+
+	// the rest is picked up again on SIGHUP, see RestartOnlyChanges for everything else
+
+	BearerToken string `yaml:"bearer_token"`
+	// extra keys for /api by name, bearer_token is always accepted as the "default" key
+	ApiKeys          map[string]string `yaml:"api_keys"`
+	TrustedProxies   []string          `yaml:"trusted_proxies"`
+	UploadLimitMb    int               `yaml:"upload_limit_mb"`
+	MaxImagesPerUser int               `yaml:"max_images_per_user"`
+	// what guests without a Google account get instead
+	GuestMaxImages int `yaml:"guest_max_images"`
+	// which waiting image /api/image hands out next
+	SelectionPolicy string `yaml:"selection_policy"`
+	LogLevel        string `yaml:"log_level"`
+	// how often a new session signing key takes over, 0 leaves it to `imagebarn signing-key rotate`
+	SigningKeyRotation time.Duration         `yaml:"signing_key_rotation"`
+	SecurityHeaders    SecurityHeadersConfig `yaml:"security_headers"`
+	Cors               CorsConfig            `yaml:"cors"`
+	// anyone signing in with a verified address at one of these is approved, e.g. ourcompany.com
+	AutoApproveDomains []string `yaml:"auto_approve_domains"`
+	// how long the audit log keeps entries, 0 keeps them forever
+	AuditRetention time.Duration `yaml:"audit_retention"`
+}
+
+// CorsConfig is which web pages may call /api from a browser, nothing else is allowed
+type CorsConfig struct {
+	// any key may be used from these, "*" for anywhere
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// more origins for a single key, by its name
+	KeyOrigins map[string][]string `yaml:"key_origins"`
+}
+
+// SecurityHeadersConfig is sent with every response
+type SecurityHeadersConfig struct {
+	// enforce, report-only, or off. Violations get logged either way
+	Csp string `yaml:"csp"`
+	// only sent when base_uri is https, 0 leaves it off
+	HstsMaxAge time.Duration `yaml:"hsts_max_age"`
+	// DENY, SAMEORIGIN, or off to let other sites frame the pages
+	FrameOptions   string `yaml:"frame_options"`
+	ReferrerPolicy string `yaml:"referrer_policy"`
+}
+
+// EmailConfig is the SMTP server sign in links go out through, an empty smtp_host turns email sign in off
+type EmailConfig struct {
+	SmtpHost string `yaml:"smtp_host"`
+	SmtpPort int    `yaml:"smtp_port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// e.g. ImageBarn <barn@mysite.com>
+	From string `yaml:"from"`
+	// starttls, tls, or none
+	Security string `yaml:"security"`
+	// how long a link works, each only works once
+	LinkLifetime time.Duration `yaml:"link_lifetime"`
+}
+
+type MqttConfig struct {
+	// empty turns MQTT off
+	Broker        string `yaml:"broker"`
+	ClientId      string `yaml:"client_id"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	TopicPrefix   string `yaml:"topic_prefix"`
+	PoolTopic     string `yaml:"pool_topic"`
+	ConsumedTopic string `yaml:"consumed_topic"`
+	CommandTopic  string `yaml:"command_topic"`
+}
@@ -0,0 +1,59 @@
+package events
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// how many events a slow subscriber may fall behind before events are dropped for it
+const SUBSCRIBER_BUFFER = 16
+
+var defaultBus = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[int]chan Event)}
+}
+
+// Subscribe returns a channel receiving every published event and a func to stop receiving.
+//
+//	The channel is closed once the returned func is called.
+func Subscribe() (<-chan Event, func()) {
+	return defaultBus.Subscribe()
+}
+
+func Publish(eventType Type, email string, data map[string]string) {
+	defaultBus.Publish(Event{Type: eventType, Email: email, Data: data, At: time.Now()})
+}
+
+func (bus *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+
+	bus.rwMutex.Lock()
+	id := bus.nextId
+	bus.nextId++
+	bus.subscribers[id] = ch
+	bus.rwMutex.Unlock()
+
+	return ch, func() {
+		bus.rwMutex.Lock()
+		if _, exists := bus.subscribers[id]; exists {
+			delete(bus.subscribers, id)
+			close(ch)
+		}
+		bus.rwMutex.Unlock()
+	}
+}
+
+// never blocks the publisher, a subscriber with a full buffer misses the event instead
+func (bus *Bus) Publish(event Event) {
+	bus.rwMutex.RLock()
+	defer bus.rwMutex.RUnlock()
+	for id, ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Debug(fmt.Sprintf("Dropped %v event for slow subscriber %v", event.Type, id))
+		}
+	}
+}
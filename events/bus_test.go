@@ -0,0 +1,64 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEveryoneSubscribedGetsEachEvent(t *testing.T) {
+	bus := NewBus()
+	first, stopFirst := bus.Subscribe()
+	second, stopSecond := bus.Subscribe()
+	defer stopSecond()
+
+	bus.Publish(Event{Type: IMAGE_PROCESSED, Email: "guest@gmail.com", At: time.Now()})
+	for _, ch := range []<-chan Event{first, second} {
+		select {
+		case event := <-ch:
+			if event.Type != IMAGE_PROCESSED || event.Email != "guest@gmail.com" {
+				t.Errorf("Got the wrong event: %+v", event)
+			}
+		default:
+			t.Error("A subscriber missed the event")
+		}
+	}
+
+	stopFirst()
+	if _, open := <-first; open {
+		t.Error("Unsubscribing didn't close the channel")
+	}
+	// a second call is harmless
+	stopFirst()
+	bus.Publish(Event{Type: IMAGE_GHOSTED})
+	if event := <-second; event.Type != IMAGE_GHOSTED {
+		t.Errorf("The remaining subscriber got %+v", event)
+	}
+}
+
+func TestSlowSubscribersMissEventsInsteadOfBlocking(t *testing.T) {
+	bus := NewBus()
+	slow, stopSlow := bus.Subscribe()
+	defer stopSlow()
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < SUBSCRIBER_BUFFER+5; i++ {
+			bus.Publish(Event{Type: POOL_EMPTY})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing blocked on a subscriber that isn't reading")
+	}
+
+	received := 0
+	for len(slow) > 0 {
+		<-slow
+		received++
+	}
+	if received != SUBSCRIBER_BUFFER {
+		t.Errorf("Received %v events, the buffer holds %v", received, SUBSCRIBER_BUFFER)
+	}
+}
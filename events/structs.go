@@ -0,0 +1,36 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	IMAGE_PROCESSED  Type = "image-processed"
+	IMAGE_GHOSTED    Type = "image-ghosted"
+	APPROVAL_CHANGED Type = "approval-changed"
+	IMAGE_CONSUMED   Type = "image-consumed"
+	// someone signed in but isn't approved yet
+	USER_AWAITING_APPROVAL Type = "user-awaiting-approval"
+	// an image was asked for and there was nothing left to give
+	POOL_EMPTY Type = "pool-empty"
+	// displays should skip ahead to the next image now
+	DISPLAY_ADVANCE Type = "display-advance"
+)
+
+type Event struct {
+	Type Type
+	// the user the event is about, empty when it concerns nobody in particular
+	Email string
+	// free-form details, e.g. the decoded file name for image events
+	Data map[string]string
+	At   time.Time
+}
+
+type Bus struct {
+	subscribers map[int]chan Event
+	nextId      int
+	rwMutex     sync.RWMutex
+}
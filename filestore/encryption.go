@@ -0,0 +1,406 @@
+package filestore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// encrypted images start with this, no real image does
+const IMAGE_MAGIC = "imagebarn-image-enc-v1\n"
+
+// the first bytes of the key's sha256, enough to pick it out of the keyring without giving anything away
+const IMAGE_KEY_ID_SIZE = 8
+
+// every image gets its own random key, wrapped by the master key in the header
+const IMAGE_DEK_SIZE = 32
+
+// magic, key id, wrap nonce, wrapped key, plaintext size
+const IMAGE_HEADER_SIZE = len(IMAGE_MAGIC) + IMAGE_KEY_ID_SIZE + 12 + IMAGE_DEK_SIZE + 16 + 8
+
+// encryption status reports images that are stored as they are under this
+const PLAIN_IMAGE = "plain"
+
+var ErrUnknownImageKey = errors.New("image is encrypted with a key ImageBarn doesn't have, add it to previous_image_encryption_key_files")
+
+// the master keys only change on a restart
+var imageKeys = &imageKeyring{byId: map[string]*imageKey{}}
+
+// SetImageKeys picks up the master keys from the config, new images are stored plain when there's no current one
+func SetImageKeys(barnConfig *config.Config) error {
+	current, previous, err := barnConfig.ImageEncryptionKeys()
+	if err != nil {
+		return err
+	}
+	keyring, err := newImageKeyring(current, previous)
+	if err != nil {
+		return err
+	}
+	imageKeys = keyring
+	return nil
+}
+
+// EncryptingImages is whether new images are encrypted
+func EncryptingImages() bool {
+	return imageKeys.current != nil
+}
+
+func newImageKeyring(current []byte, previous [][]byte) (*imageKeyring, error) {
+	keyring := &imageKeyring{byId: map[string]*imageKey{}}
+	if current != nil {
+		key, err := newImageKey(current)
+		if err != nil {
+			return nil, err
+		}
+		keyring.current = key
+		keyring.byId[key.id] = key
+	}
+	for _, raw := range previous {
+		key, err := newImageKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keyring.byId[key.id] = key
+	}
+	return keyring, nil
+}
+
+func newImageKey(raw []byte) (*imageKey, error) {
+	aead, err := newAead(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &imageKey{id: string(sum[:IMAGE_KEY_ID_SIZE]), aead: aead}, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the stream is bound to the magic & size only, so rewrapping just swaps the header
+func imageStreamAad(plainSize uint64) []byte {
+	aad := make([]byte, len(IMAGE_MAGIC)+8)
+	copy(aad, IMAGE_MAGIC)
+	binary.BigEndian.PutUint64(aad[len(IMAGE_MAGIC):], plainSize)
+	return aad
+}
+
+// wrapDek seals the image's own key under the master key, the id is checked along with it
+func wrapDek(key *imageKey, dek []byte, plainSize uint64) ([]byte, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, IMAGE_HEADER_SIZE)
+	header = append(header, IMAGE_MAGIC...)
+	header = append(header, key.id...)
+	header = append(header, nonce...)
+	header = key.aead.Seal(header, nonce, dek, []byte(key.id))
+	return binary.BigEndian.AppendUint64(header, plainSize), nil
+}
+
+// readImageHeader unwraps the image's key, in has to be just past the magic
+func readImageHeader(in io.Reader) (*imageHeader, error) {
+	rest := make([]byte, IMAGE_HEADER_SIZE-len(IMAGE_MAGIC))
+	if _, err := io.ReadFull(in, rest); err != nil {
+		return nil, fmt.Errorf("Encrypted image is cut short: %v", err)
+	}
+	keyId := string(rest[:IMAGE_KEY_ID_SIZE])
+	nonce := rest[IMAGE_KEY_ID_SIZE : IMAGE_KEY_ID_SIZE+12]
+	wrapped := rest[IMAGE_KEY_ID_SIZE+12 : len(rest)-8]
+	plainSize := binary.BigEndian.Uint64(rest[len(rest)-8:])
+	key := imageKeys.byId[keyId]
+	if key == nil {
+		return nil, ErrUnknownImageKey
+	}
+	dek, err := key.aead.Open(nil, nonce, wrapped, []byte(keyId))
+	if err != nil {
+		return nil, helpme.ErrStreamTampered
+	}
+	return &imageHeader{keyId: keyId, dek: dek, plainSize: plainSize}, nil
+}
+
+// OpenImage opens an image for reading whether it's encrypted or not, size is of what the reader gives.
+//
+//	An encrypted image that was tampered with errors partway through reading, so don't trust a partial read.
+func OpenImage(path string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	buffered := bufio.NewReader(file)
+	if start, _ := buffered.Peek(len(IMAGE_MAGIC)); string(start) != IMAGE_MAGIC {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return &imageReader{Reader: buffered, file: file}, info.Size(), nil
+	}
+	buffered.Discard(len(IMAGE_MAGIC))
+	header, err := readImageHeader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	aead, err := newAead(header.dek)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return &imageReader{Reader: helpme.NewOpenReader(buffered, aead, imageStreamAad(header.plainSize)), file: file}, int64(header.plainSize), nil
+}
+
+// ReadImage reads a whole image, decrypting it if it's encrypted
+func ReadImage(path string) ([]byte, error) {
+	reader, size, err := OpenImage(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("Image %v is %v bytes, expected %v", path, len(data), size)
+	}
+	return data, nil
+}
+
+// storeImage stores size bytes from in at path, encrypted when there's a current key
+func storeImage(path string, in io.Reader, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = writeImageTo(file, in, size, imageKeys.current); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+func writeImageTo(out io.Writer, in io.Reader, size int64, key *imageKey) error {
+	if key == nil {
+		written, err := io.Copy(out, in)
+		if err == nil && written != size {
+			err = fmt.Errorf("Expected %v bytes, got %v", size, written)
+		}
+		return err
+	}
+	dek := make([]byte, IMAGE_DEK_SIZE)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	header, err := wrapDek(key, dek, uint64(size))
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(header); err != nil {
+		return err
+	}
+	aead, err := newAead(dek)
+	if err != nil {
+		return err
+	}
+	sealer := helpme.NewSealWriter(out, aead, imageStreamAad(uint64(size)))
+	written, err := io.Copy(sealer, in)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("Expected %v bytes, got %v", size, written)
+	}
+	return sealer.Close()
+}
+
+// ImageKeyId names the key an image is encrypted with, or PLAIN_IMAGE
+func ImageKeyId(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	start := make([]byte, len(IMAGE_MAGIC)+IMAGE_KEY_ID_SIZE)
+	if _, err = io.ReadFull(file, start); err != nil || string(start[:len(IMAGE_MAGIC)]) != IMAGE_MAGIC {
+		return PLAIN_IMAGE, nil
+	}
+	return hex.EncodeToString(start[len(IMAGE_MAGIC):]), nil
+}
+
+// CurrentImageKeyId is what ImageKeyId gives for images under the current key
+func CurrentImageKeyId() string {
+	if imageKeys.current == nil {
+		return PLAIN_IMAGE
+	}
+	return hex.EncodeToString([]byte(imageKeys.current.id))
+}
+
+func hasImageKey(keyId string) bool {
+	raw, err := hex.DecodeString(keyId)
+	return err == nil && imageKeys.byId[string(raw)] != nil
+}
+
+// EncryptionStatus counts the images under each key, PLAIN_IMAGE included
+func EncryptionStatus() (map[string]int, error) {
+	counts := map[string]int{}
+	err := walkImages(func(path string) error {
+		keyId, err := ImageKeyId(path)
+		if err != nil {
+			return err
+		}
+		counts[keyId]++
+		return nil
+	})
+	return counts, err
+}
+
+// RotateImages brings every image to the current key: plain ones are encrypted, older keys rewrapped.
+// With encryption off it decrypts them instead. Returns how many images changed.
+//
+//	Each image is locked out from everything else while it's rewritten, so this is safe while serving.
+func RotateImages() (int, error) {
+	changed := 0
+	err := walkImages(func(path string) error {
+		imagesRWMutex.Lock()
+		defer imagesRWMutex.Unlock()
+		rotated, err := rotateImage(path)
+		if os.IsNotExist(err) {
+			// ghosted or deleted since the walk
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to rotate %v: %v", path, err)
+		}
+		if rotated {
+			changed++
+		}
+		return nil
+	})
+	return changed, err
+}
+
+func rotateImage(path string) (bool, error) {
+	current := imageKeys.current
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	buffered := bufio.NewReader(file)
+	start, _ := buffered.Peek(len(IMAGE_MAGIC))
+	encrypted := string(start) == IMAGE_MAGIC
+	if !encrypted && current == nil {
+		return false, nil
+	}
+
+	tmpPath := path + helpme.TEMP_SUFFIX
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+
+	switch {
+	case !encrypted:
+		err = writeImageTo(tmp, buffered, info.Size(), current)
+	case current == nil:
+		reader, size, openErr := OpenImage(path)
+		if openErr != nil {
+			return false, openErr
+		}
+		defer reader.Close()
+		err = writeImageTo(tmp, reader, size, nil)
+	default:
+		buffered.Discard(len(IMAGE_MAGIC))
+		header, headerErr := readImageHeader(buffered)
+		if headerErr != nil {
+			return false, headerErr
+		}
+		if header.keyId == current.id {
+			return false, nil
+		}
+		// only the wrapped key changes, the chunks are copied as they are
+		wrapped, wrapErr := wrapDek(current, header.dek, header.plainSize)
+		if wrapErr != nil {
+			return false, wrapErr
+		}
+		if _, err = tmp.Write(wrapped); err == nil {
+			_, err = io.Copy(tmp, buffered)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	// keep the modified time, the oldest selection policy goes by it
+	os.Chtimes(tmpPath, info.ModTime(), info.ModTime())
+	return true, os.Rename(tmpPath, path)
+}
+
+// walkImages runs do for every file ImageBarn saved under the images dir, in a stable order
+func walkImages(do func(path string) error) error {
+	paths := []string{}
+	err := filepath.WalkDir(imagesDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == imagesDir {
+			return nil
+		}
+		if _, ok := decodeExact(entry.Name()); !ok {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := do(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+func useImageKeys(t *testing.T, current string, previous ...string) {
+	barnConfig := config.Default()
+	barnConfig.ImageEncryptionKey = current
+	for _, key := range previous {
+		keyFile := filepath.Join(t.TempDir(), "previous.key")
+		if err := os.WriteFile(keyFile, []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+		barnConfig.PreviousImageEncryptionKeyFiles = append(barnConfig.PreviousImageEncryptionKeyFiles, keyFile)
+	}
+	if err := SetImageKeys(barnConfig); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetImageKeys(config.Default()) })
+}
+
+func newImageKey64(t *testing.T) string {
+	key := make([]byte, config.IMAGE_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptedImagesRoundTripAndRotate(t *testing.T) {
+	newTestFilestore(t)
+	guest := Encode("guest@gmail.com")
+	plain := writeImage(t, guest, Encode("plain.png"), "moo")
+	// big enough to take a few chunks
+	big := make([]byte, 2*helpme.STREAM_CHUNK_SIZE+7)
+	rand.Read(big)
+
+	oldKey, newKey := newImageKey64(t), newImageKey64(t)
+	useImageKeys(t, oldKey)
+	encrypted := ImagePath(guest, Encode("big.png"))
+	if err := storeImage(encrypted, bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _ := os.ReadFile(encrypted)
+	if bytes.Contains(onDisk, big[:64]) {
+		t.Fatal("Image was stored in the clear")
+	}
+	for path, want := range map[string][]byte{plain: []byte("moo"), encrypted: big} {
+		if got, err := ReadImage(path); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%v didn't read back: %v", path, err)
+		}
+	}
+
+	// the old key still reads while it's listed, rotating moves everything off it
+	useImageKeys(t, newKey, oldKey)
+	if changed, err := RotateImages(); err != nil || changed != 2 {
+		t.Fatalf("Expected 2 images rotated, got %v: %v", changed, err)
+	}
+	useImageKeys(t, newKey)
+	counts, err := EncryptionStatus()
+	if err != nil || counts[CurrentImageKeyId()] != 2 || counts[PLAIN_IMAGE] != 0 {
+		t.Fatalf("Expected both images under the new key, got %v: %v", counts, err)
+	}
+	if got, err := ReadImage(encrypted); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("Rewrapped image didn't read back: %v", err)
+	}
+
+	useImageKeys(t, oldKey)
+	if _, err := ReadImage(plain); !errors.Is(err, ErrUnknownImageKey) {
+		t.Fatalf("Expected ErrUnknownImageKey, got %v", err)
+	}
+
+	// turning encryption off & rotating decrypts
+	useImageKeys(t, "", newKey)
+	if changed, err := RotateImages(); err != nil || changed != 2 {
+		t.Fatalf("Expected 2 images decrypted, got %v: %v", changed, err)
+	}
+	if data, _ := os.ReadFile(plain); string(data) != "moo" {
+		t.Fatalf("Expected plain moo on disk, got %q", data)
+	}
+}
+
+func TestTamperedImageFailsToRead(t *testing.T) {
+	newTestFilestore(t)
+	useImageKeys(t, newImageKey64(t))
+	data := make([]byte, helpme.STREAM_CHUNK_SIZE+100)
+	path := filepath.Join(imagesDir, "image")
+	os.MkdirAll(imagesDir, 0700)
+	if err := storeImage(path, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _ := os.ReadFile(path)
+	for name, broken := range map[string][]byte{
+		"flipped":   append(append([]byte{}, onDisk[:len(onDisk)-1]...), onDisk[len(onDisk)-1]^1),
+		"truncated": onDisk[:IMAGE_HEADER_SIZE+helpme.STREAM_CHUNK_SIZE+16],
+	} {
+		os.WriteFile(path, broken, 0600)
+		if _, err := ReadImage(path); !errors.Is(err, helpme.ErrStreamTampered) {
+			t.Fatalf("%v: expected ErrStreamTampered, got %v", name, err)
+		}
+	}
+}
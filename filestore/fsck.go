@@ -0,0 +1,148 @@
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// not something ImageBarn wrote, repairing moves it to lost+found
+const FSCK_STRAY = "stray"
+
+// images of someone who isn't approved, repairing deletes them like banning does
+const FSCK_ORPHAN = "orphan"
+
+// an approved user without a folder, repairing makes it
+const FSCK_MISSING_DIR = "missing-dir"
+
+// a .ghost next to the image it's a copy of, ghosting was interrupted. Repairing removes the ghost
+const FSCK_LEFTOVER_GHOST = "leftover-ghost"
+
+// an upload that never got any bytes, repairing removes it
+const FSCK_EMPTY = "empty"
+
+// more images than max_images_per_user, only reported since the uploader picks what goes
+const FSCK_OVER_LIMIT = "over-limit"
+
+// encrypted with a key that isn't configured, only reported since the key may just be missing from the config
+const FSCK_UNKNOWN_KEY = "unknown-key"
+
+// files younger than this may still be uploading or converting, fsck leaves them be
+const FSCK_GRACE = time.Minute
+
+// Fsck checks the images dir against itself & the approved users, fixing what it found when repair is set.
+//
+//	Safe while serving, but anything touched in the last FSCK_GRACE is skipped.
+func (fs *Filestore) Fsck(repair bool) ([]FsckIssue, error) {
+	issues := []FsckIssue{}
+	report := func(kind string, path string, detail string, fix func() error) {
+		issue := FsckIssue{Kind: kind, Path: path, Detail: detail}
+		if repair && fix != nil {
+			imagesRWMutex.RLock()
+			err := fix()
+			imagesRWMutex.RUnlock()
+			if err != nil {
+				issue.Detail = fmt.Sprintf("%v, repair failed: %v", detail, err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		issues = append(issues, issue)
+	}
+
+	dirContents, err := os.ReadDir(imagesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	hasDir := map[string]bool{}
+	for _, dirEntry := range dirContents {
+		path := filepath.Join(imagesDir, dirEntry.Name())
+		email, ok := decodeExact(dirEntry.Name())
+		if !ok || !dirEntry.IsDir() {
+			report(FSCK_STRAY, path, "not a user's folder", func() error { return moveToLostFound(path) })
+			continue
+		}
+		hasDir[email] = true
+		// hidden users keep their images until they're approved again or banned
+		if isApproved, _ := fs.approvedUsers.Lookup(email); !isApproved && !IsHidden(email) {
+			report(FSCK_ORPHAN, path, fmt.Sprintf("%v isn't approved", email), func() error {
+				// they may have been approved since the check
+				if isApproved, _ := fs.approvedUsers.Lookup(email); isApproved {
+					return fmt.Errorf("%v is approved now", email)
+				}
+				return os.RemoveAll(path)
+			})
+			continue
+		}
+		if err := checkUserDir(dirEntry.Name(), email, report); err != nil {
+			return nil, err
+		}
+	}
+
+	for email, isApproved := range fs.approvedUsers.CopyOfUsersMap() {
+		if isApproved && !hasDir[email] {
+			path := ImagePath(Encode(email), "")
+			report(FSCK_MISSING_DIR, path, fmt.Sprintf("%v is approved", email), func() error { return os.MkdirAll(path, 0700) })
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+	return issues, nil
+}
+
+func checkUserDir(dirName string, email string, report func(string, string, string, func() error)) error {
+	dir, err := os.ReadDir(ImagePath(dirName, ""))
+	if err != nil {
+		return err
+	}
+	onDisk := map[string]bool{}
+	for _, fileEntry := range dir {
+		onDisk[fileEntry.Name()] = true
+	}
+
+	images := 0
+	for _, fileEntry := range dir {
+		path := filepath.Join(imagesDir, dirName, fileEntry.Name())
+		name, ok := decodeExact(fileEntry.Name())
+		if !ok || fileEntry.IsDir() {
+			report(FSCK_STRAY, path, "not an image ImageBarn saved", func() error { return moveToLostFound(path) })
+			continue
+		}
+		images++
+		info, err := fileEntry.Info()
+		if err != nil || time.Since(info.ModTime()) < FSCK_GRACE {
+			continue
+		}
+		if info.Size() == 0 {
+			report(FSCK_EMPTY, path, "upload has no bytes", func() error { return os.Remove(path) })
+			continue
+		}
+		if isGhostFile(fileEntry.Name()) && onDisk[Encode(strings.TrimSuffix(name, ".ghost"))] {
+			report(FSCK_LEFTOVER_GHOST, path, "the original is still waiting", func() error { return os.Remove(path) })
+			continue
+		}
+		if keyId, err := ImageKeyId(path); err == nil && keyId != PLAIN_IMAGE && !hasImageKey(keyId) {
+			report(FSCK_UNKNOWN_KEY, path, fmt.Sprintf("encrypted with key %v", keyId), nil)
+		}
+	}
+	if images > MaxImagesFor(email) {
+		report(FSCK_OVER_LIMIT, ImagePath(dirName, ""), fmt.Sprintf("%v has %v images, %v are allowed", email, images, MaxImagesFor(email)), nil)
+	}
+	return nil
+}
+
+// keeps the path under the images dir in the name so it's clear where it came from
+func moveToLostFound(path string) error {
+	if err := os.MkdirAll(lostFoundDir, 0700); err != nil {
+		return err
+	}
+	relPath, err := filepath.Rel(imagesDir, path)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(lostFoundDir, fmt.Sprintf("%v-%v", time.Now().UTC().Format("20060102T150405"), strings.ReplaceAll(relPath, string(filepath.Separator), "_")))
+	return os.Rename(path, target)
+}
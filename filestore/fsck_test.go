@@ -0,0 +1,159 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+func newTestFilestore(t *testing.T) *Filestore {
+	barnConfig := config.Default()
+	barnConfig.DataDir = t.TempDir()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.MaxImagesPerUser = 2
+	fs := NewFilestore(barnConfig, &sync.WaitGroup{})
+	t.Cleanup(func() { ApplyLimits(config.Default()) })
+	return fs
+}
+
+// writes an image that's old enough for fsck to look at
+func writeImage(t *testing.T, userFolder string, file string, data string) string {
+	path := filepath.Join(imagesDir, userFolder, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * FSCK_GRACE)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFsckReportsThenRepairs(t *testing.T) {
+	fs := newTestFilestore(t)
+	fs.ApprovedUsers().Approve("guest@gmail.com")
+	fs.ApprovedUsers().Disapprove("gone@gmail.com")
+
+	guest := Encode("guest@gmail.com")
+	good := writeImage(t, guest, Encode("cow.png"), "moo")
+	empty := writeImage(t, guest, Encode("empty.png"), "")
+	ghost := writeImage(t, guest, Encode("cow.png.ghost"), "moo")
+	stray := writeImage(t, guest, "3#cowbell.png", "clank")
+	orphan := writeImage(t, Encode("gone@gmail.com"), Encode("pig.png"), "oink")
+	topStray := writeImage(t, "", "notes.txt", "hi")
+	// still uploading, too new to judge
+	uploading := filepath.Join(imagesDir, guest, Encode("new.png"))
+	if err := os.WriteFile(uploading, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := fs.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, issue := range issues {
+		if issue.Repaired {
+			t.Errorf("Repaired %v without being asked", issue.Path)
+		}
+		found[issue.Path] = issue.Kind
+	}
+	wanted := map[string]string{
+		empty:                FSCK_EMPTY,
+		ghost:                FSCK_LEFTOVER_GHOST,
+		stray:                FSCK_STRAY,
+		topStray:             FSCK_STRAY,
+		filepath.Dir(orphan): FSCK_ORPHAN,
+		ImagePath(Encode("admin@mysite.com"), ""): FSCK_MISSING_DIR,
+		ImagePath(guest, ""):                      FSCK_OVER_LIMIT,
+	}
+	for path, kind := range wanted {
+		if found[path] != kind {
+			t.Errorf("Expected %v for %v, got %q", kind, path, found[path])
+		}
+	}
+	if len(found) != len(wanted) {
+		t.Errorf("Expected %v issues, got %+v", len(wanted), issues)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Fatalf("Reporting shouldn't change anything: %v", err)
+	}
+
+	if _, err = fs.Fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, ghost, stray, topStray, orphan} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v should be gone after repairing: %v", path, err)
+		}
+	}
+	for _, path := range []string{good, uploading, ImagePath(Encode("admin@mysite.com"), "")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%v should be kept: %v", path, err)
+		}
+	}
+	lostFound, _ := os.ReadDir(lostFoundDir)
+	if len(lostFound) != 2 {
+		t.Errorf("Strays should be moved to lost+found, not deleted: %v", lostFound)
+	}
+
+	issues, err = fs.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("Repairing should leave nothing behind: %+v", issues)
+	}
+}
+
+func TestGatherImagesSkipsBadNames(t *testing.T) {
+	fs := newTestFilestore(t)
+	fs.ApprovedUsers().Approve("guest@gmail.com")
+	guest := Encode("guest@gmail.com")
+	// these used to panic or fail the whole gather
+	writeImage(t, guest, "-1#x", "")
+	writeImage(t, guest, "3#cowbell.png", "")
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writeImage(t, guest, Encode(name), "img")
+	}
+
+	authUser := helpme.NewAuthUser("guest@gmail.com", nil)
+	if err := fs.GatherImages(authUser); err != nil {
+		t.Fatalf("Being over the limit shouldn't fail: %v", err)
+	}
+	if len(authUser.Images) != 3 {
+		t.Fatalf("Expected the 3 real images, got %v", authUser.Images)
+	}
+}
+
+func TestFsckReportDoesntAddUnknownOwners(t *testing.T) {
+	fs := newTestFilestore(t)
+	orphan := writeImage(t, Encode("stranger@gmail.com"), Encode("pig.png"), "oink")
+	_, changesBefore := fs.ApprovedUsers().CopyOfUsersMapAndChanges()
+
+	issues, err := fs.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported := false
+	for _, issue := range issues {
+		reported = reported || (issue.Path == filepath.Dir(orphan) && issue.Kind == FSCK_ORPHAN)
+	}
+	if !reported {
+		t.Errorf("An unknown user's folder wasn't reported: %+v", issues)
+	}
+	if _, exists := fs.ApprovedUsers().Lookup("stranger@gmail.com"); exists {
+		t.Error("Reporting added the folder's owner to the approved users")
+	}
+	if _, changes := fs.ApprovedUsers().CopyOfUsersMapAndChanges(); changes != changesBefore {
+		t.Errorf("Reporting changed the approved users, %v changes became %v", changesBefore, changes)
+	}
+}
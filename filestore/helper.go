@@ -1,24 +1,56 @@
 package filestore
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"io/fs"
 	"log/slog"
 	"math/big"
-	psuedoRand "math/rand"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/gofiber/fiber/v2"
 	"gopkg.in/h2non/bimg.v1"
+	"kmfg.dev/imagebarn/v1/events"
 	"kmfg.dev/imagebarn/v1/helpme"
 )
 
-const IMAGES_DIR = "./images/%v/%v"
+// ImagePath is where file lives in a user's (encoded) folder, pass an empty file for the folder itself.
+//
+//	Not filepath.Join on purpose, cleaning "3#../" style names could walk out of the images dir.
+func ImagePath(userFolder string, file string) string {
+	return fmt.Sprintf("%v/%v/%v", imagesDir, userFolder, file)
+}
+
+// SendImage sends an image as the response, escaping the path since encoded names have a #.
+//
+//	Encrypted images are decrypted as they stream out, never in full on disk or in memory.
+func SendImage(c *fiber.Ctx, userFolder string, file string) error {
+	path := ImagePath(userFolder, file)
+	if keyId, err := ImageKeyId(path); err != nil || keyId == PLAIN_IMAGE {
+		segments := strings.Split(path, "/")
+		for i := range segments {
+			segments[i] = url.PathEscape(segments[i])
+		}
+		return c.SendFile(strings.Join(segments, "/"))
+	}
+	reader, size, err := OpenImage(path)
+	if err != nil {
+		return err
+	}
+	// SendFile would go by the extension, ghosts keep theirs before .ghost
+	if name, err := Decode(file); err == nil {
+		c.Type(strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(name, ".ghost")), "."))
+	}
+	// closed by fasthttp once it's sent
+	return c.SendStream(reader, int(size))
+}
 
 func (fs *Filestore) GetAuthUser(email string) *helpme.AuthUser {
 	authUser := helpme.NewAuthUser(email, nil)
@@ -63,16 +95,47 @@ func canDecode(encoded string) (int, int, error) {
 	if err != nil {
 		return -1, -1, fmt.Errorf("Decoding failed. Could not convert \"%v\" to integer: %v", encoded[:encodeMarkerIdx], err)
 	}
+	if strLen < 0 {
+		return -1, -1, fmt.Errorf("Decoding failed. Negative length %v", strLen)
+	}
 
 	return encodeMarkerIdx, strLen, nil
 }
 
+// decodeExact only accepts names Encode could have made, "3#abcdef" gets past canDecode but isn't one
+func decodeExact(encoded string) (string, bool) {
+	decoded, err := Decode(encoded)
+	if err != nil || Encode(decoded) != encoded {
+		return "", false
+	}
+	return decoded, true
+}
+
 func ReadDir(authUser *helpme.AuthUser) ([]fs.DirEntry, error) {
-	return os.ReadDir(fmt.Sprintf(IMAGES_DIR, Encode(authUser.Email()), ""))
+	return os.ReadDir(ImagePath(Encode(authUser.Email()), ""))
 }
 
 func DeleteAll(email string) error {
-	return os.RemoveAll(fmt.Sprintf(IMAGES_DIR, Encode(email), ""))
+	imagesRWMutex.RLock()
+	defer imagesRWMutex.RUnlock()
+	return os.RemoveAll(ImagePath(Encode(email), ""))
+}
+
+// MoveAll hands every image of from to to, who mustn't have a folder yet. Having no images to move is fine.
+func MoveAll(from string, to string) error {
+	imagesRWMutex.Lock()
+	defer imagesRWMutex.Unlock()
+	toPath := ImagePath(Encode(to), "")
+	if _, err := os.Stat(toPath); err == nil {
+		return fmt.Errorf("%v already has an images folder", to)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Rename(ImagePath(Encode(from), ""), toPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
 func (fs *Filestore) GatherImages(authUser *helpme.AuthUser) error {
@@ -85,27 +148,34 @@ func (fs *Filestore) GatherImages(authUser *helpme.AuthUser) error {
 		return err
 	}
 
-	imageNamesArr := [helpme.MAX_IMAGES_PER_USER]string{}
-	imageCount := 0
-	for i := 0; i < len(dir); i++ {
-		if _, _, err := canDecode(dir[i].Name()); err == nil {
-			if imageCount >= helpme.MAX_IMAGES_PER_USER {
-				return fmt.Errorf("Images found exceed max allowed images (%v)", helpme.MAX_IMAGES_PER_USER)
-			}
-			imageNamesArr[imageCount], err = Decode(dir[i].Name())
-			if err != nil {
-				// panic bc we just said we can decode but failed to decode!
-				panic(err)
-			}
-			imageCount++
+	imageNames := []string{}
+	for i := range dir {
+		// anything else is for fsck to deal with
+		if imageName, ok := decodeExact(dir[i].Name()); ok && !dir[i].IsDir() {
+			imageNames = append(imageNames, imageName)
 		}
 	}
+	// max_images_per_user can be lowered on a reload, they're just maxed out until they delete some
+	if len(imageNames) > MaxImagesFor(authUser.Email()) {
+		slog.Debug(fmt.Sprintf("%v has %v images, more than the %v allowed", authUser.Email(), len(imageNames), MaxImagesFor(authUser.Email())))
+	}
 
-	authUser.Images = &imageNamesArr
+	authUser.Images = imageNames
 
 	return nil
 }
 
+// how many ImageBarn files are in a user's folder, ghosts included like GatherImages
+func countImages(dir []fs.DirEntry) int {
+	count := 0
+	for i := range dir {
+		if _, ok := decodeExact(dir[i].Name()); ok && !dir[i].IsDir() {
+			count++
+		}
+	}
+	return count
+}
+
 func getHeaderIfAccepted(header textproto.MIMEHeader) string {
 	contentType, exists := header["Content-Type"]
 	if !exists || len(contentType) < 1 {
@@ -123,7 +193,7 @@ func getHeaderIfAccepted(header textproto.MIMEHeader) string {
 }
 
 func convertHeicToWebp(filePath, fileNameUnecoded, userFolder string) error {
-	fileBytes, err := bimg.Read(filePath)
+	fileBytes, err := ReadImage(filePath)
 	if err != nil {
 		return err
 	}
@@ -132,7 +202,7 @@ func convertHeicToWebp(filePath, fileNameUnecoded, userFolder string) error {
 		return err
 	}
 	newFilenameEnc := Encode(fmt.Sprintf("%v.webp", fileNameUnecoded))
-	err = bimg.Write(fmt.Sprintf("./images/%v/%v", userFolder, newFilenameEnc), newImgBytes)
+	err = storeImage(ImagePath(userFolder, newFilenameEnc), bytes.NewReader(newImgBytes), int64(len(newImgBytes)))
 	if err != nil {
 		return err
 	}
@@ -143,58 +213,10 @@ func convertHeicToWebp(filePath, fileNameUnecoded, userFolder string) error {
 	return nil
 }
 
-func (fs *Filestore) GetRandomImage() (string, string, error) {
-	dirContents, err := os.ReadDir("./images")
-	if err != nil {
-		return "", "", err
-	}
-
-	dirNames := []string{}
-	for _, dirEntry := range dirContents {
-		if dirEntry.IsDir() {
-			dirNames = append(dirNames, dirEntry.Name())
-		}
-	}
-
-	psuedoRand.Shuffle(len(dirNames), func(i, j int) {
-		dirNames[i], dirNames[j] = dirNames[j], dirNames[i]
-	})
-
-	for _, dirName := range dirNames {
-		if _, _, err := canDecode(dirName); err != nil {
-			continue
-		}
-
-		pickedDirContent, err := os.ReadDir("./images/" + dirName)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("Couldn't open directory %v: %v", dirName, err))
-			continue
-		}
-
-		fileNames := []string{}
-		for _, fileEntry := range pickedDirContent {
-			if !fileEntry.IsDir() {
-				fileNames = append(fileNames, fileEntry.Name())
-			}
-		}
-
-		psuedoRand.Shuffle(len(fileNames), func(i, j int) {
-			fileNames[i], fileNames[j] = fileNames[j], fileNames[i]
-		})
-
-		for _, fileName := range fileNames {
-			if _, _, err := canDecode(fileName); err != nil || isGhostFile(fileName) {
-				continue
-			}
-			return dirName, fileName, nil
-		}
-	}
-
-	return "", "", fmt.Errorf("No available images found")
-}
-
 func (fs *Filestore) GhostImage(directory string, file string) error {
-	fullPath := fmt.Sprintf("./images/%v/%v", directory, file)
+	imagesRWMutex.RLock()
+	defer imagesRWMutex.RUnlock()
+	fullPath := ImagePath(directory, file)
 	originalFile, err := os.Open(fullPath)
 	defer originalFile.Close()
 	if err != nil {
@@ -204,7 +226,7 @@ func (fs *Filestore) GhostImage(directory string, file string) error {
 	if err != nil {
 		return err
 	}
-	ghostFileFullPath := fmt.Sprintf("./images/%v/%v", directory, Encode(decFilename+".ghost"))
+	ghostFileFullPath := ImagePath(directory, Encode(decFilename+".ghost"))
 	ghostFile, err := os.Create(ghostFileFullPath)
 	defer ghostFile.Close()
 	if err != nil {
@@ -223,11 +245,79 @@ func (fs *Filestore) GhostImage(directory string, file string) error {
 	if err != nil {
 		return err
 	}
-	return err
+	if email, err := Decode(directory); err == nil {
+		events.Publish(events.IMAGE_GHOSTED, email, map[string]string{"fileName": decFilename})
+	}
+	return nil
+}
+
+// AvailableCounts is how many images each user still has waiting to be consumed
+func (fs *Filestore) AvailableCounts() (map[string]int, error) {
+	dirContents, err := os.ReadDir(imagesDir)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, dirEntry := range dirContents {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		email, err := Decode(dirEntry.Name())
+		if err != nil {
+			continue
+		}
+		dir, err := os.ReadDir(ImagePath(dirEntry.Name(), ""))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Couldn't open directory %v: %v", dirEntry.Name(), err))
+			continue
+		}
+		counts[email] = 0
+		for i := range dir {
+			if _, _, err := canDecode(dir[i].Name()); err == nil && !dir[i].IsDir() && !isGhostFile(dir[i].Name()) {
+				counts[email]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// ListImages is every image on disk, email may be empty for everyone's
+func ListImages(email string) ([]ImageEntry, error) {
+	dirContents, err := os.ReadDir(imagesDir)
+	if os.IsNotExist(err) {
+		return []ImageEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []ImageEntry{}
+	for _, dirEntry := range dirContents {
+		dirEmail, ok := decodeExact(dirEntry.Name())
+		if !ok || !dirEntry.IsDir() || (email != "" && dirEmail != email) {
+			continue
+		}
+		dir, err := os.ReadDir(ImagePath(dirEntry.Name(), ""))
+		if err != nil {
+			return nil, err
+		}
+		for _, fileEntry := range dir {
+			name, ok := decodeExact(fileEntry.Name())
+			if !ok || fileEntry.IsDir() {
+				continue
+			}
+			info, err := fileEntry.Info()
+			if err != nil {
+				continue
+			}
+			ghost := isGhostFile(fileEntry.Name())
+			entries = append(entries, ImageEntry{dirEmail, strings.TrimSuffix(name, ".ghost"), ghost, info.Size(), info.ModTime()})
+		}
+	}
+	return entries, nil
 }
 
 func isDirGhosted(dirName string) bool {
-	dir, err := os.ReadDir("./images/" + dirName)
+	dir, err := os.ReadDir(ImagePath(dirName, ""))
 	if err != nil {
 		slog.Warn(fmt.Sprintf("Failed to check if dir \"%v\" was ghosted: %v", dirName, err))
 		return true
@@ -247,27 +337,6 @@ func isDirGhosted(dirName string) bool {
 	return availableFilesCount == 0
 }
 
-// return of 0 is considered empty dir or error
-func imagesDirHash(dirName string) uint32 {
-	dir, err := os.ReadDir("./images/" + dirName)
-	if err != nil {
-		slog.Debug(err.Error())
-		return 0
-	}
-	totalFiles := ""
-	for i := range dir {
-		if _, _, err := canDecode(dir[i].Name()); err == nil {
-			totalFiles += dir[i].Name()
-		}
-	}
-	if totalFiles == "" {
-		return 0
-	}
-	h := fnv.New32a()
-	h.Write([]byte(totalFiles))
-	return h.Sum32()
-}
-
 func isGhostFile(filename string) bool {
 	const ext = ".ghost"
 	if len(filename) < len(ext) {
@@ -1,32 +1,21 @@
 package filestore
 
 import (
-	"fmt"
 	"net/url"
 	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/events"
 )
 
-func HashImageDir(c *fiber.Ctx) error {
-	email := c.Locals("email").(string)
-	hash := imagesDirHash(Encode(email))
-	if hash == 0 {
-		return c.SendStatus(204)
-	}
-	return c.SendString(fmt.Sprintf("%d", hash))
-}
-
 func GetImage(c *fiber.Ctx) error {
 	email := c.Locals("email").(string)
 	unescapedFileName, err := url.PathUnescape(c.Params("fileName", ""))
 	if err != nil {
 		return err
 	}
-	encFileName := Encode(unescapedFileName)
-	filePath := fmt.Sprintf(IMAGES_DIR, Encode(email), encFileName)
-	return c.SendFile(url.PathEscape(filePath))
+	return SendImage(c, Encode(email), Encode(unescapedFileName))
 }
 
 func UploadImage(c *fiber.Ctx) error {
@@ -42,14 +31,30 @@ func UploadImage(c *fiber.Ctx) error {
 	}
 	needToConvert = fileType == "image/heic"
 
-	wg.Add(1)
-	defer wg.Done()
-	err = os.MkdirAll(fmt.Sprintf(IMAGES_DIR, Encode(email), ""), 0700)
+	// the upload button hides at the limit, but nothing stopped a direct POST
+	if dir, err := os.ReadDir(ImagePath(Encode(email), "")); err == nil && countImages(dir) >= MaxImagesFor(email) {
+		return c.SendStatus(409)
+	}
+	// fiber's body limit is fixed at startup, this one follows reloads
+	if file.Size > uploadLimitBytes.Load() {
+		return c.SendStatus(413)
+	}
+
+	jobs.Add(1)
+	defer jobs.Done()
+	imagesRWMutex.RLock()
+	defer imagesRWMutex.RUnlock()
+	err = os.MkdirAll(ImagePath(Encode(email), ""), 0700)
+	if err != nil {
+		return err
+	}
+	filePath := ImagePath(Encode(email), Encode(file.Filename))
+	source, err := file.Open()
 	if err != nil {
 		return err
 	}
-	filePath := fmt.Sprintf(IMAGES_DIR, Encode(email), Encode(file.Filename))
-	err = c.SaveFile(file, filePath)
+	err = storeImage(filePath, source, file.Size)
+	source.Close()
 	if err != nil {
 		return err
 	}
@@ -63,6 +68,7 @@ func UploadImage(c *fiber.Ctx) error {
 		time.Sleep(1 * time.Second)
 		convertHeicToWebp(filePath, file.Filename, Encode(email))
 	}
+	events.Publish(events.IMAGE_PROCESSED, email, map[string]string{"fileName": file.Filename})
 	return c.SendStatus(201)
 }
 
@@ -72,7 +78,9 @@ func DeleteImage(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	err = os.Remove(fmt.Sprintf("./images/%v/%v", Encode(email), Encode(unescapedFileName)))
+	imagesRWMutex.RLock()
+	err = os.Remove(ImagePath(Encode(email), Encode(unescapedFileName)))
+	imagesRWMutex.RUnlock()
 	if err != nil {
 		return err
 	}
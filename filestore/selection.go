@@ -0,0 +1,142 @@
+package filestore
+
+import (
+	"fmt"
+	"log/slog"
+	psuedoRand "math/rand"
+	"os"
+	"time"
+
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+// a waiting image, still encoded
+type candidate struct {
+	directory string
+	file      string
+	modTime   time.Time
+}
+
+// PickImage returns the (encoded) directory & file of the next image to show, following selection_policy
+func (fs *Filestore) PickImage() (string, string, error) {
+	switch selectionPolicy.Load() {
+	case config.SELECTION_RANDOM:
+		return fs.pickRandom()
+	case config.SELECTION_OLDEST:
+		return fs.pickOldest()
+	default:
+		return fs.pickFair()
+	}
+}
+
+// each uploader gets an equal shot, then a random one of their images
+func (fs *Filestore) pickFair() (string, string, error) {
+	dirContents, err := os.ReadDir(imagesDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	dirNames := []string{}
+	for _, dirEntry := range dirContents {
+		if dirEntry.IsDir() {
+			dirNames = append(dirNames, dirEntry.Name())
+		}
+	}
+
+	psuedoRand.Shuffle(len(dirNames), func(i, j int) {
+		dirNames[i], dirNames[j] = dirNames[j], dirNames[i]
+	})
+
+	for _, dirName := range dirNames {
+		if _, _, err := canDecode(dirName); err != nil || isHiddenDir(dirName) {
+			continue
+		}
+
+		pickedDirContent, err := os.ReadDir(ImagePath(dirName, ""))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Couldn't open directory %v: %v", dirName, err))
+			continue
+		}
+
+		fileNames := []string{}
+		for _, fileEntry := range pickedDirContent {
+			if !fileEntry.IsDir() {
+				fileNames = append(fileNames, fileEntry.Name())
+			}
+		}
+
+		psuedoRand.Shuffle(len(fileNames), func(i, j int) {
+			fileNames[i], fileNames[j] = fileNames[j], fileNames[i]
+		})
+
+		for _, fileName := range fileNames {
+			if _, _, err := canDecode(fileName); err != nil || isGhostFile(fileName) {
+				continue
+			}
+			return dirName, fileName, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("No available images found")
+}
+
+// every waiting image gets an equal shot
+func (fs *Filestore) pickRandom() (string, string, error) {
+	candidates, err := waitingImages()
+	if err != nil {
+		return "", "", err
+	}
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("No available images found")
+	}
+	picked := candidates[psuedoRand.Intn(len(candidates))]
+	return picked.directory, picked.file, nil
+}
+
+// first in, first out by upload time
+func (fs *Filestore) pickOldest() (string, string, error) {
+	candidates, err := waitingImages()
+	if err != nil {
+		return "", "", err
+	}
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("No available images found")
+	}
+	oldest := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.modTime.Before(oldest.modTime) {
+			oldest = candidate
+		}
+	}
+	return oldest.directory, oldest.file, nil
+}
+
+func waitingImages() ([]candidate, error) {
+	dirContents, err := os.ReadDir(imagesDir)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []candidate{}
+	for _, dirEntry := range dirContents {
+		if _, _, err := canDecode(dirEntry.Name()); err != nil || !dirEntry.IsDir() || isHiddenDir(dirEntry.Name()) {
+			continue
+		}
+		dir, err := os.ReadDir(ImagePath(dirEntry.Name(), ""))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Couldn't open directory %v: %v", dirEntry.Name(), err))
+			continue
+		}
+		for _, fileEntry := range dir {
+			if _, _, err := canDecode(fileEntry.Name()); err != nil || fileEntry.IsDir() || isGhostFile(fileEntry.Name()) {
+				continue
+			}
+			info, err := fileEntry.Info()
+			if err != nil {
+				// removed since the ReadDir
+				continue
+			}
+			candidates = append(candidates, candidate{dirEntry.Name(), fileEntry.Name(), info.ModTime()})
+		}
+	}
+	return candidates, nil
+}
@@ -0,0 +1,47 @@
+package filestore
+
+import (
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+func TestHiddenUsersArentPickedOrRepairedAway(t *testing.T) {
+	fs := newTestFilestore(t)
+	fs.ApprovedUsers().Approve("guest@gmail.com")
+	fs.ApprovedUsers().Disapprove("paused@gmail.com")
+	SetHiddenUsers([]string{"paused@gmail.com"})
+	t.Cleanup(func() { SetHiddenUsers(nil) })
+
+	writeImage(t, Encode("guest@gmail.com"), Encode("cow.png"), "moo")
+	hidden := writeImage(t, Encode("paused@gmail.com"), Encode("pig.png"), "oink")
+
+	for _, policy := range []string{config.SELECTION_FAIR, config.SELECTION_RANDOM, config.SELECTION_OLDEST} {
+		selectionPolicy.Store(policy)
+		// enough tries that fair & random would have stumbled on it
+		for i := 0; i < 20; i++ {
+			directory, _, err := fs.PickImage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if email, _ := Decode(directory); email != "guest@gmail.com" {
+				t.Fatalf("%v picked a hidden image of %v", policy, email)
+			}
+		}
+	}
+
+	issues, err := fs.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range issues {
+		if issue.Path == hidden || issue.Path == ImagePath(Encode("paused@gmail.com"), "") {
+			t.Errorf("fsck flagged a hidden user's images: %+v", issue)
+		}
+	}
+
+	SetHiddenUsers(nil)
+	if issues, _ = fs.Fsck(false); len(issues) != 1 || issues[0].Kind != FSCK_ORPHAN {
+		t.Errorf("Once they're no longer hidden their images are orphans, got %+v", issues)
+	}
+}
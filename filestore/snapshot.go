@@ -0,0 +1,64 @@
+package filestore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// held for reading by anything changing the images dir, Snapshot holds it for writing.
+//
+//	Read locks aren't reentrant once a writer waits, so lock only at the outermost call.
+var imagesRWMutex = sync.RWMutex{}
+
+// Snapshot hard links every file under the images dir into target, then runs while before changes resume.
+// Whatever while captures matches the linked images exactly. Links are cheap, so uploads only wait a moment.
+func Snapshot(target string, while func() error) error {
+	imagesRWMutex.Lock()
+	defer imagesRWMutex.Unlock()
+
+	err := filepath.WalkDir(imagesDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(imagesDir, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(target, relPath)
+		if entry.IsDir() {
+			return os.MkdirAll(targetPath, 0700)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		// some filesystems can't link, copying is slower but just as consistent under the lock
+		if err := os.Link(path, targetPath); err != nil {
+			return copyFile(path, targetPath)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return while()
+}
+
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
@@ -1,32 +1,160 @@
 package filestore
 
 import (
+	"crypto/cipher"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/config"
 	"kmfg.dev/imagebarn/v1/helpme"
 )
 
-const APPROVED_USERS_FILE = "./approved-users.json"
+// both live in the data dir
+const APPROVED_USERS_FILE = "approved-users.json"
+const IMAGES_DIR_NAME = "images"
+
+// where fsck moves files it doesn't recognize instead of deleting them
+const LOST_FOUND_DIR_NAME = "lost+found"
 
 var wg *sync.WaitGroup
+var approvedUsersFile = APPROVED_USERS_FILE
+var imagesDir = "./" + IMAGES_DIR_NAME
+var lostFoundDir = "./" + LOST_FOUND_DIR_NAME
+
+// these can change on a config reload
+var maxImagesPerUser atomic.Int64
+var guestMaxImages atomic.Int64
+var uploadLimitBytes atomic.Int64
+var selectionPolicy atomic.Value
+
+// users whose images stay on disk but aren't handed out, e.g. while they're suspended
+var hiddenUsers atomic.Pointer[map[string]bool]
+
+type ImageEntry struct {
+	Email string
+	Name  string
+	// already shown, kept until the uploader's page clears it
+	Ghost   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// something fsck found, Repaired is only set when it was asked to repair & managed to
+type FsckIssue struct {
+	Kind     string
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+type imageKeyring struct {
+	// nil stores new images plain
+	current *imageKey
+	// every key images can be read with, current included
+	byId map[string]*imageKey
+}
+
+type imageKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type imageHeader struct {
+	keyId     string
+	dek       []byte
+	plainSize uint64
+}
+
+// closes the file under whatever is reading it
+type imageReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *imageReader) Close() error {
+	return r.file.Close()
+}
 
 type Filestore struct {
 	approvedUsers       *helpme.ApprovedUsers
 	storeRoutineRunning bool
+	// the approved users changes last written to disk
+	storedChanges uint64
+	storeMutex    sync.Mutex
 }
 
-func NewFilestore(adminUserEmail string, waitGroup *sync.WaitGroup) *Filestore {
-	approvedUsers, err := loadApprovedUsers(adminUserEmail)
+func NewFilestore(barnConfig *config.Config, waitGroup *sync.WaitGroup) *Filestore {
+	approvedUsersFile = barnConfig.DataPath(APPROVED_USERS_FILE)
+	imagesDir = barnConfig.DataPath(IMAGES_DIR_NAME)
+	lostFoundDir = barnConfig.DataPath(LOST_FOUND_DIR_NAME)
+	ApplyLimits(barnConfig)
+	if err := SetImageKeys(barnConfig); err != nil {
+		panic(err)
+	}
+	approvedUsers, err := loadApprovedUsers(barnConfig.AdminUser)
 	if err != nil {
 		panic(err)
 	}
 	wg = waitGroup
-	return &Filestore{approvedUsers, false}
+	return &Filestore{approvedUsers: approvedUsers}
+}
+
+func init() {
+	ApplyLimits(config.Default())
+}
+
+// ApplyLimits picks up the upload limit, per-user quota & selection policy, safe to call while serving
+func ApplyLimits(barnConfig *config.Config) {
+	maxImagesPerUser.Store(int64(barnConfig.MaxImagesPerUser))
+	guestMaxImages.Store(int64(barnConfig.GuestMaxImages))
+	uploadLimitBytes.Store(int64(barnConfig.UploadLimitMb) * 1024 * 1024)
+	selectionPolicy.Store(barnConfig.SelectionPolicy)
+}
+
+func MaxImagesPerUser() int {
+	return int(maxImagesPerUser.Load())
+}
+
+// guests signed in without Google get addresses nobody else can have, at the reserved .invalid TLD
+const GUEST_DOMAIN = "@guest.invalid"
+
+func IsGuest(email string) bool {
+	return strings.HasSuffix(email, GUEST_DOMAIN)
+}
+
+// MaxImagesFor is how many images email may have waiting, guests get fewer
+func MaxImagesFor(email string) int {
+	if IsGuest(email) {
+		return int(guestMaxImages.Load())
+	}
+	return MaxImagesPerUser()
+}
+
+// SetHiddenUsers replaces who's hidden, their images are kept but skipped by PickImage & fsck
+func SetHiddenUsers(emails []string) {
+	hidden := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		hidden[email] = true
+	}
+	hiddenUsers.Store(&hidden)
+}
+
+func IsHidden(email string) bool {
+	hidden := hiddenUsers.Load()
+	return hidden != nil && (*hidden)[email]
+}
+
+// isHiddenDir is IsHidden for an encoded folder name
+func isHiddenDir(dirName string) bool {
+	email, err := Decode(dirName)
+	return err == nil && IsHidden(email)
 }
 
 func (fs *Filestore) ApprovedUsers() *helpme.ApprovedUsers {
@@ -41,51 +169,60 @@ func (fs *Filestore) StoreApprovedUsersRoutine(stopChan chan struct{}) {
 	if fs.storeRoutineRunning {
 		return
 	}
+	fs.storeRoutineRunning = true
+	wg.Add(1)
 	go func() {
-		fs.storeRoutineRunning = true
-		wg.Add(1)
 		defer wg.Done()
 		for {
 			select {
 			case <-stopChan:
+				if err := fs.StoreApprovedUsers(); err != nil {
+					slog.Error(fmt.Sprintf("Failed final store of approved users!: %v", err))
+				}
 				slog.Info("Safely stopping approved user storage routine.")
 				return
 			default:
 				time.Sleep(2 * time.Second)
-				// why copy data then save?
-				//  on devices that use sd card storage this could be super slow to lock for an entire marshal
-				approvedUsersMap := fs.approvedUsers.CopyOfUsersMap()
-
-				data, err := json.Marshal(approvedUsersMap)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed to marshal authorized user for storge!: %v", err))
-					continue
-				}
-
-				file, err := os.Create(APPROVED_USERS_FILE)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed to create file authorized user storge!: %v", err))
-					continue
-				}
-
-				_, err = file.Write(data)
-				file.Close()
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed write to file authorized user storge!: %v", err))
-					continue
+				if err := fs.StoreApprovedUsers(); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to store approved users!: %v", err))
 				}
 			}
 		}
 	}()
 }
 
-func loadApprovedUsers(adminUserEmail string) (*helpme.ApprovedUsers, error) {
-	data, err := os.ReadFile(APPROVED_USERS_FILE)
+// StoreApprovedUsers writes the approved users to disk if they changed since the last write
+func (fs *Filestore) StoreApprovedUsers() error {
+	fs.storeMutex.Lock()
+	defer fs.storeMutex.Unlock()
+	// why copy data then save?
+	//  on devices that use sd card storage this could be super slow to lock for an entire marshal
+	approvedUsersMap, changes := fs.approvedUsers.CopyOfUsersMapAndChanges()
+	if changes == fs.storedChanges {
+		return nil
+	}
+
+	data, err := json.Marshal(approvedUsersMap)
 	if err != nil {
+		return fmt.Errorf("Failed to marshal authorized users: %v", err)
+	}
+
+	if err = helpme.WriteFileAtomic(approvedUsersFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write authorized users: %v", err)
+	}
+	fs.storedChanges = changes
+	return nil
+}
+
+func loadApprovedUsers(adminUserEmail string) (*helpme.ApprovedUsers, error) {
+	data, err := helpme.ReadFileVerified(approvedUsersFile)
+	if os.IsNotExist(err) {
 		approvedUsers := helpme.NewApprovedUsers()
 		approvedUsers.Approve(adminUserEmail)
-		slog.Warn(fmt.Sprintf("Failed to read file %v. Loading empty approve with admin only: %v", APPROVED_USERS_FILE, err))
+		slog.Warn(fmt.Sprintf("Failed to read file %v. Loading empty approve with admin only: %v", approvedUsersFile, err))
 		return approvedUsers, nil
+	} else if err != nil {
+		return nil, err
 	}
 
 	var approvedUserTmp map[string]bool
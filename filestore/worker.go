@@ -1,32 +1,35 @@
 package filestore
 
 import (
-	"fmt"
-	"os"
-	"strconv"
 	"sync"
+	"time"
 )
 
 var Semaphore chan struct{}
 var Once sync.Once
 var PoolSize int
 
-func SetupImageConverterWorker() {
-	Once.Do(initTheStuff)
+// uploads & conversions still being written, separate from the routine wait group so shutdown can give up on them
+var jobs sync.WaitGroup
+
+func SetupImageConverterWorker(poolSize int) {
+	Once.Do(func() {
+		PoolSize = poolSize
+		Semaphore = make(chan struct{}, PoolSize)
+	})
 }
 
-func initTheStuff() {
-	poolSizeStr := os.Getenv("IMAGE_WORKERS")
-	if poolSizeStr == "" {
-		poolSizeStr = "1"
-	}
-	var err error
-	PoolSize, err = strconv.Atoi(poolSizeStr)
-	if err != nil {
-		panic(fmt.Errorf("Your IMAGE_WORKERS is set incorrectly. Make sure it defines an integer value!: %v", err))
-	} else if PoolSize < 1 {
-		panic("Your IMAGE_WORKERS is set incorrectly. You need at least one worker!")
+// WaitForJobs blocks until every upload & conversion has finished, false if the timeout hit first
+func WaitForJobs(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
-
-	Semaphore = make(chan struct{}, PoolSize)
 }
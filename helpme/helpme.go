@@ -11,12 +11,14 @@ func NewApprovedUsers() *ApprovedUsers {
 func (au *ApprovedUsers) Disapprove(email string) {
 	au.rwMutex.Lock()
 	au.users[email] = false
+	au.changes++
 	au.rwMutex.Unlock()
 }
 
 func (au *ApprovedUsers) Approve(email string) {
 	au.rwMutex.Lock()
 	au.users[email] = true
+	au.changes++
 	au.rwMutex.Unlock()
 }
 
@@ -26,7 +28,10 @@ func (au *ApprovedUsers) IsApproved(email string) bool {
 	if !exists {
 		au.rwMutex.RUnlock()
 		au.rwMutex.Lock()
-		au.users[email] = false
+		if _, exists := au.users[email]; !exists {
+			au.users[email] = false
+			au.changes++
+		}
 		au.rwMutex.Unlock()
 	} else {
 		au.rwMutex.RUnlock()
@@ -34,6 +39,22 @@ func (au *ApprovedUsers) IsApproved(email string) bool {
 	return isApproved
 }
 
+// Forget drops email altogether, e.g. when a guest becomes a regular account
+func (au *ApprovedUsers) Forget(email string) {
+	au.rwMutex.Lock()
+	delete(au.users, email)
+	au.changes++
+	au.rwMutex.Unlock()
+}
+
+// Lookup is IsApproved without adding email when it's unknown, for checks that mustn't change anything
+func (au *ApprovedUsers) Lookup(email string) (isApproved bool, exists bool) {
+	au.rwMutex.RLock()
+	defer au.rwMutex.RUnlock()
+	isApproved, exists = au.users[email]
+	return isApproved, exists
+}
+
 // use this for operations where we dont need the entire map
 func (au *ApprovedUsers) SetSizeCopyOfUsersMap(count int) map[string]bool {
 	copiedMap := map[string]bool{}
@@ -50,6 +71,20 @@ func (au *ApprovedUsers) SetSizeCopyOfUsersMap(count int) map[string]bool {
 	return copiedMap
 }
 
+// CopyOfUsersMapAndChanges copies the map along with how many modifications it reflects,
+//
+//	a copy with the same count as the last one has nothing new in it
+func (au *ApprovedUsers) CopyOfUsersMapAndChanges() (map[string]bool, uint64) {
+	copiedMap := map[string]bool{}
+	au.rwMutex.RLock()
+	for email, isApproved := range au.users {
+		copiedMap[email] = isApproved
+	}
+	changes := au.changes
+	au.rwMutex.RUnlock()
+	return copiedMap, changes
+}
+
 func (au *ApprovedUsers) CopyOfUsersMap() map[string]bool {
 	copiedMap := map[string]bool{}
 	au.rwMutex.RLock()
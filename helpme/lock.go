@@ -0,0 +1,28 @@
+package helpme
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrLocked means someone else, normally the running server, holds the lock
+var ErrLocked = errors.New("already locked by another ImageBarn process")
+
+// LockFile takes an exclusive lock on path without waiting for it. Close the file to release it,
+// the OS also releases it if the process dies.
+func LockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("Failed to lock %v: %v", path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,135 @@
+package helpme
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-json"
+)
+
+const BACKUP_SUFFIX = ".bak"
+const TEMP_SUFFIX = ".tmp"
+
+// data is kept as a string so it round trips byte for byte, raw JSON gets re-escaped
+type checksummed struct {
+	Checksum string `json:"checksum"`
+	Data     string `json:"data"`
+}
+
+// WriteFileAtomic replaces path with data without ever leaving a half written file behind.
+//
+//	data goes to a temp file that is fsynced then renamed over path. The previous
+//	contents of path stay around as path.bak, one generation back, in case path is
+//	corrupted anyway. data is wrapped in JSON with a checksum ReadFileVerified checks.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	sum := sha256.Sum256(data)
+	wrapped, err := json.Marshal(checksummed{hex.EncodeToString(sum[:]), string(data)})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + TEMP_SUFFIX
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(wrapped)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// only a file that verifies is worth keeping as the backup
+	if _, err := ReadFileVerified(path); err == nil {
+		if err := os.Rename(path, path+BACKUP_SUFFIX); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// ReadFileVerified returns the JSON last written by WriteFileAtomic.
+//
+//	If path is missing, unreadable, or fails its checksum the backup generation is used instead.
+//	Files from before checksums existed are returned as is. Returns an os.IsNotExist error
+//	when neither path nor its backup exist.
+func ReadFileVerified(path string) ([]byte, error) {
+	data, err := readVerified(path)
+	if err == nil {
+		return data, nil
+	}
+	backupData, backupErr := readVerified(path + BACKUP_SUFFIX)
+	if backupErr != nil {
+		if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%v is unusable (%v) and so is its backup (%v)", path, err, backupErr)
+	}
+	if !os.IsNotExist(err) {
+		slog.Warn(fmt.Sprintf("%v is unusable, falling back to its backup: %v", path, err))
+	}
+	return backupData, nil
+}
+
+// VerifyFile checks path itself, without falling back to the backup like ReadFileVerified does
+func VerifyFile(path string) error {
+	_, err := readVerified(path)
+	return err
+}
+
+// RestoreBackup rewrites path from its backup, for when VerifyFile fails but the backup is good
+func RestoreBackup(path string) error {
+	data, err := readVerified(path + BACKUP_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("backup is unusable too: %v", err)
+	}
+	info, err := os.Stat(path + BACKUP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	// path doesn't verify, so WriteFileAtomic leaves the backup where it is
+	return WriteFileAtomic(path, data, info.Mode().Perm())
+}
+
+func readVerified(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped checksummed
+	if err := json.Unmarshal(raw, &wrapped); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %v", err)
+	}
+	if wrapped.Checksum == "" {
+		// written before checksums, still has to be valid JSON to be trusted
+		return raw, nil
+	}
+	sum := sha256.Sum256([]byte(wrapped.Data))
+	if hex.EncodeToString(sum[:]) != wrapped.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return []byte(wrapped.Data), nil
+}
+
+// a rename isn't durable until the directory holding it is synced
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,70 @@
+package helpme
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteThenReadVerified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approved-users.json")
+	if err := WriteFileAtomic(path, []byte(`{"a@b.c":true}`), 0600); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	data, err := ReadFileVerified(path)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(data) != `{"a@b.c":true}` {
+		t.Fatalf("Read %s but wrote something else", data)
+	}
+	if _, err := os.Stat(path + TEMP_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("Temp file was left behind: %v", err)
+	}
+}
+
+func TestCorruptFileFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issued-versions.json")
+	if err := WriteFileAtomic(path, []byte(`{"a@b.c":1}`), 0600); err != nil {
+		t.Fatalf("Failed first write: %v", err)
+	}
+	if err := WriteFileAtomic(path, []byte(`{"a@b.c":2}`), 0600); err != nil {
+		t.Fatalf("Failed second write: %v", err)
+	}
+
+	// what a crash mid os.Create & Write used to leave behind
+	if err := os.WriteFile(path, []byte(`{"checksum":"abc","da`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFileVerified(path)
+	if err != nil {
+		t.Fatalf("Didn't fall back to the backup: %v", err)
+	}
+	if string(data) != `{"a@b.c":1}` {
+		t.Fatalf("Read %s but wanted the previous generation", data)
+	}
+
+	// valid JSON with the wrong checksum is just as untrustworthy
+	if err := os.WriteFile(path, []byte(`{"checksum":"abc","data":"{}"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ReadFileVerified(path); err != nil || string(data) != `{"a@b.c":1}` {
+		t.Fatalf("Checksum mismatch wasn't caught, read %s: %v", data, err)
+	}
+}
+
+func TestReadLegacyAndMissing(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "legacy.json")
+	if err := os.WriteFile(legacyPath, []byte(`{"a@b.c":true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFileVerified(legacyPath)
+	if err != nil || string(data) != `{"a@b.c":true}` {
+		t.Fatalf("Failed to read a file written before checksums, read %s: %v", data, err)
+	}
+
+	if _, err := ReadFileVerified(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("Wanted a not exist error, got %v", err)
+	}
+}
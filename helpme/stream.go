@@ -0,0 +1,110 @@
+package helpme
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// sealed separately so a huge stream never has to fit in memory
+const STREAM_CHUNK_SIZE = 64 * 1024
+
+var ErrStreamTampered = errors.New("wrong key or passphrase, or the data is corrupted")
+
+// NewSealWriter encrypts everything written to it onto out, Close seals the last chunk.
+//
+//	aead's key must only ever seal this one stream, the nonces are a counter.
+//	aad is checked with every chunk, use it to bind a header to the stream.
+func NewSealWriter(out io.Writer, aead cipher.AEAD, aad []byte) io.WriteCloser {
+	return &sealWriter{out: out, aead: aead, aad: aad, buf: make([]byte, 0, STREAM_CHUNK_SIZE)}
+}
+
+// NewOpenReader decrypts what a seal writer wrote, a stream cut short or tampered with fails with ErrStreamTampered
+func NewOpenReader(in io.Reader, aead cipher.AEAD, aad []byte) io.Reader {
+	buffered, ok := in.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(in)
+	}
+	return &openReader{in: buffered, aead: aead, aad: aad}
+}
+
+// the last chunk is marked so cutting chunks off the end is caught
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk only goes out once there's more after it, Close seals the last one
+		if len(w.buf) == STREAM_CHUNK_SIZE {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):STREAM_CHUNK_SIZE], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *sealWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *sealWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.counter, final), w.buf, w.aad)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *openReader) open() error {
+	sealed := make([]byte, STREAM_CHUNK_SIZE+r.aead.Overhead())
+	n, err := io.ReadFull(r.in, sealed)
+	if err == io.EOF {
+		// the final chunk never came
+		return ErrStreamTampered
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// a short chunk has to be the last, a full one is the last if nothing follows it
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		_, peekErr := r.in.Peek(1)
+		final = peekErr == io.EOF
+	}
+	plain, err := r.aead.Open(nil, chunkNonce(r.aead, r.counter, final), sealed[:n], r.aad)
+	if err != nil {
+		return ErrStreamTampered
+	}
+	r.counter++
+	r.buf = plain
+	r.done = final
+	return nil
+}
@@ -1,30 +1,50 @@
 package helpme
 
 import (
+	"bufio"
+	"crypto/cipher"
+	"io"
 	"sync"
 )
 
-const MAX_IMAGES_PER_USER = 5
-
 type Alike struct {
 	String string
 	Score  float32
 }
 
 type ApprovedUsers struct {
-	users   map[string]bool
+	users map[string]bool
+	// bumped on every modification so storage can skip writes when nothing changed
+	changes uint64
 	rwMutex sync.RWMutex
 }
 
 type AuthUser struct {
 	email  string
-	Images *[MAX_IMAGES_PER_USER]string
+	Images []string
 }
 
-func NewAuthUser(email string, images *[MAX_IMAGES_PER_USER]string) *AuthUser {
+func NewAuthUser(email string, images []string) *AuthUser {
 	return &AuthUser{email, images}
 }
 
 func (au *AuthUser) Email() string {
 	return au.email
 }
+
+type sealWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+}
+
+type openReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
@@ -146,6 +146,7 @@ User=imagebarn
 WorkingDirectory=/opt/imagebarn
 EnvironmentFile=/opt/imagebarn/.env
 ExecStart=/opt/imagebarn/imagebarn
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=on-failure
 
 [Install]
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upgrades a plain connection, usually port 587
+const SECURITY_STARTTLS = "starttls"
+
+// TLS from the first byte, usually port 465
+const SECURITY_TLS = "tls"
+
+// only for a relay on the same machine, passwords are never sent without TLS
+const SECURITY_NONE = "none"
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+func New(config Config) (*Mailer, error) {
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("From address \"%v\" can't be used: %v", config.From, err)
+	}
+	switch config.Security {
+	case SECURITY_STARTTLS, SECURITY_TLS, SECURITY_NONE:
+	default:
+		return nil, fmt.Errorf("Unknown security \"%v\", use %v, %v, or %v", config.Security, SECURITY_STARTTLS, SECURITY_TLS, SECURITY_NONE)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DEFAULT_TIMEOUT
+	}
+	return &Mailer{config: config, from: from}, nil
+}
+
+// Send delivers a plain text email to a single address, the whole conversation has to finish within the timeout
+func (mailer *Mailer) Send(to string, subject string, body string) error {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("Can't send to \"%v\": %v", to, err)
+	}
+	message, err := mailer.message(recipient.Address, subject, body)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(mailer.config.Host, strconv.Itoa(mailer.config.Port))
+	dialer := &net.Dialer{Timeout: mailer.config.Timeout}
+	var conn net.Conn
+	if mailer.config.Security == SECURITY_TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: mailer.config.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to reach SMTP server %v: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(mailer.config.Timeout))
+	client, err := smtp.NewClient(conn, mailer.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP server %v didn't greet us: %v", addr, err)
+	}
+	defer client.Close()
+
+	if mailer.config.Security == SECURITY_STARTTLS {
+		if err = client.StartTLS(&tls.Config{ServerName: mailer.config.Host}); err != nil {
+			return fmt.Errorf("SMTP server %v failed STARTTLS: %v", addr, err)
+		}
+	}
+	if mailer.config.Username != "" {
+		if mailer.config.Security == SECURITY_NONE {
+			return fmt.Errorf("Won't send the SMTP password to %v without TLS", addr)
+		}
+		if err = client.Auth(smtp.PlainAuth("", mailer.config.Username, mailer.config.Password, mailer.config.Host)); err != nil {
+			return fmt.Errorf("SMTP server %v turned down the login: %v", addr, err)
+		}
+	}
+	if err = client.Mail(mailer.from.Address); err != nil {
+		return fmt.Errorf("SMTP server %v refused the sender: %v", addr, err)
+	}
+	if err = client.Rcpt(recipient.Address); err != nil {
+		return fmt.Errorf("SMTP server %v refused %v: %v", addr, recipient.Address, err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP server %v refused the message: %v", addr, err)
+	}
+	if _, err = writer.Write(message); err != nil {
+		return fmt.Errorf("Failed to send the message to %v: %v", addr, err)
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("SMTP server %v refused the message: %v", addr, err)
+	}
+	return client.Quit()
+}
+
+func (mailer *Mailer) message(to string, subject string, body string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(mailer.from.Address, "@")
+	headers := []string{
+		"From: " + mailer.from.String(),
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%v@%v>", hex.EncodeToString(id), domain),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	}
+	message := bytes.NewBufferString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+	// quoted-printable gets anything through servers that only take 7 bit, & ends every line in \r\n
+	encoder := quotedprintable.NewWriter(message)
+	if _, err := encoder.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n"))); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	message.WriteString("\r\n")
+	return message.Bytes(), nil
+}
@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/mailer/mailertest"
+)
+
+func TestSendReachesTheServer(t *testing.T) {
+	server := mailertest.NewServer(t)
+	mailer, err := New(Config{Host: server.Host, Port: server.Port, From: "Barn Dänce <barn@mysite.com>", Security: SECURITY_NONE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "Hi!\n\n.this line starts with a dot\nhttps://barn.mysite.com/auth/email/" + strings.Repeat("x", 90) + "\n"
+	if err = mailer.Send("guest@gmail.com", "Your sign in link", body); err != nil {
+		t.Fatal(err)
+	}
+
+	message := server.Next(t)
+	if message.From != "barn@mysite.com" || len(message.To) != 1 || message.To[0] != "guest@gmail.com" {
+		t.Errorf("Wrong envelope: %+v", message)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(message.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from, err := parsed.Header.AddressList("From"); err != nil || from[0].Name != "Barn Dänce" {
+		t.Errorf("From header didn't survive: %v %v", parsed.Header.Get("From"), err)
+	}
+	if parsed.Header.Get("Message-ID") == "" || parsed.Header.Get("Date") == "" {
+		t.Error("Missing Message-ID or Date, spam filters frown on that")
+	}
+	if got, err := message.Body(); err != nil || strings.TrimRight(got, "\n") != strings.TrimRight(body, "\n") {
+		t.Errorf("Body changed on the way:\n%q\n%v", got, err)
+	}
+}
+
+func TestPasswordsNeedTls(t *testing.T) {
+	server := mailertest.NewServer(t)
+	mailer, err := New(Config{Host: server.Host, Port: server.Port, Username: "barn", Password: "hunter2", From: "barn@mysite.com", Security: SECURITY_NONE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mailer.Send("guest@gmail.com", "Hi", "Hi"); err == nil || !strings.Contains(err.Error(), "without TLS") {
+		t.Errorf("Sent a password in the clear, got %v", err)
+	}
+	if server.Pending() != 0 {
+		t.Error("A message went out anyway")
+	}
+
+	if _, err = New(Config{From: "not an address", Security: SECURITY_NONE}); err == nil {
+		t.Error("Accepted a bad from address")
+	}
+	if _, err = New(Config{From: "barn@mysite.com", Security: "ssl"}); err == nil {
+		t.Error("Accepted unknown security")
+	}
+}
@@ -0,0 +1,165 @@
+// Package mailertest is an SMTP server that keeps every message it's sent, for tests that need to read their mail.
+package mailertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const WAIT_TIMEOUT = 5 * time.Second
+
+type Message struct {
+	From string
+	To   []string
+	// the whole message as it was sent, headers & all
+	Data string
+}
+
+type Server struct {
+	Host     string
+	Port     int
+	listener net.Listener
+	messages chan Message
+	wg       sync.WaitGroup
+}
+
+// NewServer listens on a free port on localhost until the test ends. It doesn't do TLS or logins, so mail it with security none.
+func NewServer(t testing.TB) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	server := &Server{Host: addr.IP.String(), Port: addr.Port, listener: listener, messages: make(chan Message, 32)}
+	server.wg.Add(1)
+	go server.accept()
+	t.Cleanup(func() {
+		listener.Close()
+		server.wg.Wait()
+	})
+	return server
+}
+
+func (server *Server) Addr() string {
+	return net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+}
+
+// Next waits for the next message to arrive, failing the test if none does
+func (server *Server) Next(t testing.TB) Message {
+	t.Helper()
+	select {
+	case message := <-server.messages:
+		return message
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatal("No mail arrived")
+		return Message{}
+	}
+}
+
+// Pending is how many messages arrived that Next hasn't handed out
+func (server *Server) Pending() int {
+	return len(server.messages)
+}
+
+// Body is the message's body decoded from quoted-printable, as a person would read it
+func (message Message) Body() (string, error) {
+	parsed, err := mail.ReadMessage(strings.NewReader(message.Data))
+	if err != nil {
+		return "", err
+	}
+	reader := parsed.Body
+	if strings.EqualFold(parsed.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		reader = quotedprintable.NewReader(reader)
+	}
+	body, err := io.ReadAll(reader)
+	return strings.ReplaceAll(string(body), "\r\n", "\n"), err
+}
+
+func (server *Server) accept() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			defer conn.Close()
+			server.serve(conn)
+		}()
+	}
+}
+
+// serve speaks just enough SMTP for net/smtp
+func (server *Server) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 mailertest ready")
+	message := Message{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-mailertest")
+			reply("250 8BITMIME")
+		case "HELO", "NOOP":
+			reply("250 OK")
+		case "MAIL":
+			message = Message{From: addressIn(arg)}
+			reply("250 OK")
+		case "RCPT":
+			message.To = append(message.To, addressIn(arg))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data := strings.Builder{}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				// undo dot stuffing
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			message.Data = data.String()
+			server.messages <- message
+			reply("250 OK")
+		case "RSET":
+			message = Message{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+// the address out of e.g. FROM:<barn@mysite.com> BODY=8BITMIME
+func addressIn(arg string) string {
+	_, rest, _ := strings.Cut(arg, "<")
+	address, _, _ := strings.Cut(rest, ">")
+	return address
+}
@@ -0,0 +1,24 @@
+package mailer
+
+import (
+	"net/mail"
+	"time"
+)
+
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// the address mail comes from, e.g. ImageBarn <barn@mysite.com>
+	From string
+	// SECURITY_STARTTLS, SECURITY_TLS, or SECURITY_NONE
+	Security string
+	Timeout  time.Duration
+}
+
+type Mailer struct {
+	config Config
+	// config.From parsed, the envelope is sent from just its address
+	from *mail.Address
+}
@@ -1,52 +1,259 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/lmittmann/tint"
+	"golang.org/x/term"
+	"kmfg.dev/imagebarn/v1/backup"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
 	"kmfg.dev/imagebarn/v1/web"
 )
 
-const PORT = 30109
+// where backup & restore look for a passphrase before asking for one
+const BACKUP_PASSPHRASE_ENV = "IMAGEBARN_BACKUP_PASSPHRASE"
+
+// changed by SIGHUP along with the rest of the reloadable config
+var logLevel = new(slog.LevelVar)
+
+// env vars that were set to something other than the .env before it was read, those beat the .env even on a reload.
+//
+//	systemd's EnvironmentFile hands us the .env itself, those still follow edits to the file.
+var inheritedEnv = map[string]bool{}
 
 func main() {
-	err := godotenv.Load()
+	setupLogs(os.Stdout)
+	dotEnv, _ := godotenv.Read()
+	for _, keyValue := range os.Environ() {
+		key, value, _ := strings.Cut(keyValue, "=")
+		if dotEnvValue, inDotEnv := dotEnv[key]; !inDotEnv || dotEnvValue != value {
+			inheritedEnv[key] = true
+		}
+	}
+	// the .env is optional now that there's a config file, but a broken one shouldn't be ignored
+	err := loadDotEnv()
 	if err != nil {
-		panic(fmt.Errorf("Unable to start ImageBarn: %v", err))
+		slog.Error(fmt.Sprintf("Unable to read .env: %v", err))
+		os.Exit(1)
+	}
+	barnConfig, command, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, web.ADMIN_USAGE)
+		return
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to start ImageBarn, fix your config:\n%v", err))
+		os.Exit(1)
+	}
+	if len(command) > 0 {
+		os.Exit(runCommand(barnConfig, command))
 	}
-	setupLogs()
+	logLevel.Set(barnConfig.SlogLevel())
+
+	// released by the OS when we exit, however that happens
+	lock, err := helpme.LockFile(barnConfig.DataPath(web.LOCK_FILE))
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to lock the data dir %v, is ImageBarn already running?: %v", barnConfig.DataDir, err))
+		os.Exit(1)
+	}
+	defer lock.Close()
 
 	// the passing of the channel and wait group down so far feels a little messy
 	signalChain := make(chan os.Signal, 1)
-	signal.Notify(signalChain, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChain, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	stopChan := make(chan struct{})
 	wg := sync.WaitGroup{}
 
-	go web.StartServer(PORT, stopChan, &wg)
+	serverErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serverErr <- web.StartServer(barnConfig, stopChan, &wg)
+	}()
 
-	sig := <-signalChain
-	slog.Info(fmt.Sprintf("Received signal: %s, initiating shutdown...", sig))
+	for running := true; running; {
+		select {
+		case sig := <-signalChain:
+			if sig == syscall.SIGHUP {
+				reloadConfig()
+				continue
+			}
+			slog.Info(fmt.Sprintf("Received signal: %s, initiating shutdown...", sig))
+			running = false
+		case err := <-serverErr:
+			slog.Error(fmt.Sprintf("Server stopped unexpectedly, initiating shutdown...: %v", err))
+			running = false
+		}
+	}
 	close(stopChan)
 
 	wg.Wait()
 	slog.Info("All routines have safely stopped... Exiting!")
 }
 
-func setupLogs() *slog.Logger {
-	w := os.Stdout
+// runCommand runs a CLI command inside the running server, or on the data dir itself if no server holds it.
+// Returns the exit code.
+func runCommand(barnConfig *config.Config, command []string) int {
+	// the CLI's output is the point, keep the logs to problems & out of the way of pipes
+	logLevel.Set(slog.LevelWarn)
+	setupLogs(os.Stderr)
+	request, err := prepareRequest(command)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lock, err := helpme.LockFile(barnConfig.DataPath(web.LOCK_FILE))
+	if errors.Is(err, helpme.ErrLocked) {
+		if command[0] == "restore" {
+			err = fmt.Errorf("Stop the server first, restore only goes into a fresh data dir")
+		} else {
+			err = web.SendAdminCommand(barnConfig, request, os.Stdout)
+		}
+	} else if err == nil {
+		if command[0] == "restore" {
+			err = restore(barnConfig, request)
+		} else {
+			err = web.RunOffline(barnConfig, request, os.Stdout)
+		}
+		lock.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// fileArg is which of command's args is a file, -1 if none
+func fileArg(command []string) int {
+	switch {
+	case command[0] == "backup" || command[0] == "restore":
+		return 1
+	case len(command) > 1 && command[0] == "audit" && command[1] == "export":
+		return 2
+	case len(command) > 1 && command[0] == "invite" && command[1] == "poster":
+		return 3
+	}
+	return -1
+}
+
+// the server may run from another directory, so backup files are made absolute here.
+// An encrypted backup's passphrase comes from BACKUP_PASSPHRASE_ENV or the terminal.
+func prepareRequest(command []string) (web.ControlRequest, error) {
+	request := web.ControlRequest{Args: command}
+	at := fileArg(command)
+	if at < 0 || len(command) <= at {
+		return request, nil
+	}
+	absPath, err := filepath.Abs(command[at])
+	if err != nil {
+		return request, err
+	}
+	request.Args = append([]string{}, command...)
+	request.Args[at] = absPath
+	if command[0] == "backup" && len(command) == 3 && command[2] == "encrypt" {
+		request.Passphrase, err = readPassphrase(true)
+	}
+	return request, err
+}
+
+func restore(barnConfig *config.Config, request web.ControlRequest) error {
+	if len(request.Args) != 2 {
+		return fmt.Errorf("Expected exactly one backup file")
+	}
+	passphrase := os.Getenv(BACKUP_PASSPHRASE_ENV)
+	err := web.Restore(barnConfig, request.Args[1], passphrase, os.Stdout)
+	if errors.Is(err, backup.ErrNeedPassphrase) && passphrase == "" {
+		if passphrase, err = readPassphrase(false); err != nil {
+			return err
+		}
+		err = web.Restore(barnConfig, request.Args[1], passphrase, os.Stdout)
+	}
+	return err
+}
+
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(BACKUP_PASSPHRASE_ENV); passphrase != "" {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("Set %v or run this from a terminal to give a passphrase", BACKUP_PASSPHRASE_ENV)
+	}
+	fmt.Fprint(os.Stderr, "Backup passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("The passphrase can't be empty")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Again: ")
+		again, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("The passphrases don't match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+// reloadConfig reads everything again like startup did, a bad config is logged & the running one stays
+func reloadConfig() {
+	slog.Info("Received SIGHUP, reloading config...")
+	if err := loadDotEnv(); err != nil {
+		slog.Error(fmt.Sprintf("Rejected config reload, keeping the running config. Unable to read .env: %v", err))
+		return
+	}
+	newConfig, _, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error(fmt.Sprintf("Rejected config reload, keeping the running config:\n%v", err))
+		return
+	}
+	logLevel.Set(newConfig.SlogLevel())
+	web.ApplyConfig(newConfig)
+}
+
+// like godotenv.Load, but a reload picks up edited values too
+func loadDotEnv() error {
+	dotEnv, err := godotenv.Read()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range dotEnv {
+		if !inheritedEnv[key] {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
 
+func setupLogs(w *os.File) *slog.Logger {
 	logger := slog.New(
 		tint.NewHandler(w, &tint.Options{
 			AddSource:  true,
 			TimeFormat: time.ANSIC,
-			Level:      slog.LevelDebug,
+			Level:      logLevel,
 		}),
 	)
 
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPrepareRequestMakesFilesAbsolute(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster := filepath.Join(wd, "summer-party.pdf")
+	for _, test := range []struct {
+		command []string
+		wanted  []string
+	}{
+		{[]string{"backup", "summer-party.pdf"}, []string{"backup", poster}},
+		{[]string{"invite", "poster", "DXG-MWbo", "summer-party.pdf"}, []string{"invite", "poster", "DXG-MWbo", poster}},
+		{[]string{"audit", "export", "summer-party.pdf", "actor=cli"}, []string{"audit", "export", poster, "actor=cli"}},
+		{[]string{"invite", "poster", "DXG-MWbo"}, []string{"invite", "poster", "DXG-MWbo"}},
+		{[]string{"user", "approve", "summer-party.pdf"}, []string{"user", "approve", "summer-party.pdf"}},
+	} {
+		request, err := prepareRequest(test.command)
+		if err != nil || !slices.Equal(request.Args, test.wanted) {
+			t.Errorf("%v became %v %v, wanted %v", test.command, request.Args, err, test.wanted)
+		}
+	}
+}
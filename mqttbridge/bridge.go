@@ -0,0 +1,145 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+const QOS = 1
+const CONNECT_TIMEOUT = 10 * time.Second
+const DISCONNECT_QUIESCE_MS = 250
+
+// catches changes no event is published for, like a user deleting their own image
+const POOL_REFRESH_INTERVAL = 1 * time.Minute
+
+const COMMAND_NEXT = "next"
+
+// Connect dials the broker. If it isn't up within CONNECT_TIMEOUT, paho keeps retrying in the background.
+//
+//	countAvailable is asked for fresh numbers every time the pool might have changed.
+func Connect(config Config, countAvailable func() (map[string]int, error)) (*Bridge, error) {
+	bridge := &Bridge{config: config, countAvailable: countAvailable}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientId).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(bridge.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn(fmt.Sprintf("Lost connection to MQTT broker %v: %v", config.Broker, err))
+		})
+	bridge.client = mqtt.NewClient(opts)
+
+	token := bridge.client.Connect()
+	if !token.WaitTimeout(CONNECT_TIMEOUT) {
+		slog.Warn(fmt.Sprintf("MQTT broker %v isn't reachable yet, still trying in the background.", config.Broker))
+		return bridge, nil
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("Failed to connect to MQTT broker %v: %v", config.Broker, err)
+	}
+	return bridge, nil
+}
+
+// Start publishes pool changes & consumptions until stopChan closes, then disconnects
+func (bridge *Bridge) Start(stopChan chan struct{}, wg *sync.WaitGroup) {
+	eventChan, unsubscribe := events.Subscribe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer unsubscribe()
+		refresh := time.NewTicker(POOL_REFRESH_INTERVAL)
+		defer refresh.Stop()
+		for {
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping MQTT bridge.")
+				bridge.client.Disconnect(DISCONNECT_QUIESCE_MS)
+				return
+			case <-refresh.C:
+				bridge.PublishPool()
+			case event, ok := <-eventChan:
+				if !ok {
+					return
+				}
+				bridge.handle(event)
+			}
+		}
+	}()
+}
+
+func (bridge *Bridge) handle(event events.Event) {
+	switch event.Type {
+	case events.IMAGE_CONSUMED:
+		bridge.publishJson(bridge.config.ConsumedTopic, false, ConsumedMessage{event.Email, event.Data["fileName"], event.At.UTC()})
+		bridge.PublishPool()
+	case events.IMAGE_PROCESSED, events.IMAGE_GHOSTED, events.APPROVAL_CHANGED, events.POOL_EMPTY:
+		bridge.PublishPool()
+	}
+}
+
+// PublishPool replaces the retained pool stats with current numbers
+func (bridge *Bridge) PublishPool() {
+	counts, err := bridge.countAvailable()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Couldn't count available images for MQTT: %v", err))
+		return
+	}
+	stats := PoolStats{Barns: counts, UpdatedAt: time.Now().UTC()}
+	for _, count := range counts {
+		stats.Available += count
+	}
+	bridge.publishJson(bridge.config.PoolTopic, true, stats)
+}
+
+func (bridge *Bridge) publishJson(topic string, retained bool, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to marshal MQTT message for %v: %v", topic, err))
+		return
+	}
+	// don't wait on the broker, paho queues while reconnecting
+	token := bridge.client.Publish(topic, QOS, retained, payload)
+	go func() {
+		if token.WaitTimeout(CONNECT_TIMEOUT) && token.Error() != nil {
+			slog.Warn(fmt.Sprintf("Failed to publish to %v: %v", topic, token.Error()))
+		}
+	}()
+}
+
+// runs on every (re)connect, subscriptions don't survive a clean session
+func (bridge *Bridge) onConnect(client mqtt.Client) {
+	slog.Info(fmt.Sprintf("Connected to MQTT broker %v", bridge.config.Broker))
+	token := client.Subscribe(bridge.config.CommandTopic, QOS, bridge.onCommand)
+	go func() {
+		if token.WaitTimeout(CONNECT_TIMEOUT) && token.Error() != nil {
+			slog.Warn(fmt.Sprintf("Failed to subscribe to %v: %v", bridge.config.CommandTopic, token.Error()))
+		}
+	}()
+	go bridge.PublishPool()
+}
+
+// accepts a bare "next" or {"command": "next"}
+func (bridge *Bridge) onCommand(_ mqtt.Client, message mqtt.Message) {
+	command := strings.TrimSpace(string(message.Payload()))
+	var parsed Command
+	if err := json.Unmarshal(message.Payload(), &parsed); err == nil {
+		command = parsed.Command
+	}
+	switch command {
+	case COMMAND_NEXT:
+		slog.Debug("Advancing displays from MQTT command.")
+		events.Publish(events.DISPLAY_ADVANCE, "", nil)
+	default:
+		slog.Warn(fmt.Sprintf("Ignoring unknown MQTT command \"%v\" on %v", command, message.Topic()))
+	}
+}
@@ -0,0 +1,98 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+// Runs against a real broker, e.g. `mosquitto -p 1883` then
+//
+//	MQTT_TEST_BROKER=tcp://localhost:1883 go test ./mqttbridge
+func TestBridgeAgainstBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if broker == "" {
+		t.Skip("Set MQTT_TEST_BROKER to run against a local broker")
+	}
+	prefix := fmt.Sprintf("imagebarn-test/%d", time.Now().UnixNano())
+	config := Config{
+		Broker:        broker,
+		ClientId:      "imagebarn-test-bridge",
+		PoolTopic:     prefix + "/pool",
+		ConsumedTopic: prefix + "/consumed",
+		CommandTopic:  prefix + "/command",
+	}
+	counts := map[string]int{"a@b.c": 2, "d@e.f": 1}
+	bridge, err := Connect(config, func() (map[string]int, error) { return counts, nil })
+	if err != nil {
+		t.Fatalf("Failed to connect bridge: %v", err)
+	}
+	stopChan := make(chan struct{})
+	wg := sync.WaitGroup{}
+	bridge.Start(stopChan, &wg)
+	defer func() {
+		close(stopChan)
+		wg.Wait()
+	}()
+
+	messages := make(chan mqtt.Message, 32)
+	watcher := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("imagebarn-test-watcher"))
+	if token := watcher.Connect(); !token.WaitTimeout(CONNECT_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("Watcher failed to connect: %v", token.Error())
+	}
+	defer watcher.Disconnect(DISCONNECT_QUIESCE_MS)
+	if token := watcher.Subscribe(prefix+"/#", QOS, func(_ mqtt.Client, message mqtt.Message) {
+		messages <- message
+	}); !token.WaitTimeout(CONNECT_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("Watcher failed to subscribe: %v", token.Error())
+	}
+
+	var stats PoolStats
+	json.Unmarshal(waitForTopic(t, messages, config.PoolTopic).Payload(), &stats)
+	if stats.Available != 3 || stats.Barns["a@b.c"] != 2 {
+		t.Fatalf("Unexpected pool stats %+v", stats)
+	}
+
+	events.Publish(events.IMAGE_CONSUMED, "a@b.c", map[string]string{"fileName": "barn.webp"})
+	var consumed ConsumedMessage
+	json.Unmarshal(waitForTopic(t, messages, config.ConsumedTopic).Payload(), &consumed)
+	if consumed.Email != "a@b.c" || consumed.FileName != "barn.webp" {
+		t.Fatalf("Unexpected consumed message %+v", consumed)
+	}
+
+	eventChan, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	watcher.Publish(config.CommandTopic, QOS, false, `{"command": "next"}`)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-eventChan:
+			if event.Type == events.DISPLAY_ADVANCE {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Command never advanced the displays")
+		}
+	}
+}
+
+func waitForTopic(t *testing.T, messages chan mqtt.Message, topic string) mqtt.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-messages:
+			if message.Topic() == topic {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("Nothing published to %v", topic)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package mqttbridge
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type Config struct {
+	// e.g. tcp://localhost:1883 or ssl://broker.lan:8883
+	Broker   string
+	ClientId string
+	Username string
+	Password string
+	// retained, always holds the latest PoolStats
+	PoolTopic string
+	// one ConsumedMessage per image a display pulls
+	ConsumedTopic string
+	// anything published here can drive the displays, see COMMAND_NEXT
+	CommandTopic string
+}
+
+type Bridge struct {
+	client         mqtt.Client
+	config         Config
+	countAvailable func() (map[string]int, error)
+}
+
+type PoolStats struct {
+	Available int `json:"available"`
+	// available images per user's barn, keyed by email
+	Barns     map[string]int `json:"barns"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+type ConsumedMessage struct {
+	Email      string    `json:"email"`
+	FileName   string    `json:"fileName"`
+	ConsumedAt time.Time `json:"consumedAt"`
+}
+
+type Command struct {
+	Command string `json:"command"`
+}
@@ -0,0 +1,76 @@
+package poster
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Helvetica's widths in thousandths of the font size for ' ' through '~', it's one of the fonts every PDF viewer has
+var HELVETICA_WIDTHS = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// anything Helvetica can't show without embedding a font is printed as ?
+func helveticaText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, text)
+}
+
+func textWidth(text string, size float64) float64 {
+	width := 0
+	for _, r := range helveticaText(text) {
+		width += HELVETICA_WIDTHS[r-' ']
+	}
+	return float64(width) * size / 1000
+}
+
+// renderPdf writes a single page PDF by hand, it only needs rectangles & one built in font
+func renderPdf(poster Poster, modules [][]bool) []byte {
+	content := bytes.Buffer{}
+	moduleSize := QR_SIZE / float64(len(modules))
+	left := (PAGE_WIDTH - QR_SIZE) / 2
+	for _, run := range darkRuns(modules) {
+		// PDFs count up from the bottom of the page
+		y := PAGE_HEIGHT - QR_TOP - float64(run[0]+1)*moduleSize
+		fmt.Fprintf(&content, "%.2f %.2f %.2f %.2f re\n", left+float64(run[1])*moduleSize, y, float64(run[2])*moduleSize, moduleSize)
+	}
+	content.WriteString("f\n")
+	escaper := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	for _, line := range poster.lines() {
+		x := (PAGE_WIDTH - textWidth(line.text, line.size)) / 2
+		fmt.Fprintf(&content, "BT /F1 %.2f Tf %.2f %.2f Td (%v) Tj ET\n", line.size, x, PAGE_HEIGHT-line.baseline, escaper.Replace(helveticaText(line.text)))
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %v %v] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>", PAGE_WIDTH, PAGE_HEIGHT),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", content.Len(), content.String()),
+	}
+	out := bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, object := range objects {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%v 0 obj\n%v\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	// every xref entry is exactly 20 bytes, the trailing space matters
+	fmt.Fprintf(&out, "xref\n0 %v\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %v /Root 1 0 R >>\nstartxref\n%v\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,67 @@
+package poster
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// A4 at 150 DPI, plenty for a table tent
+const PNG_WIDTH = 1240
+const PNG_SCALE = PNG_WIDTH / PAGE_WIDTH
+
+func renderPng(poster Poster, modules [][]bool, fontData []byte) ([]byte, error) {
+	parsed, err := opentype.Parse(fontData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the poster font: %v", err)
+	}
+	// a variable, so pixel positions can round
+	scale := float64(PNG_SCALE)
+	page := image.NewRGBA(image.Rect(0, 0, PNG_WIDTH, int(PAGE_HEIGHT*scale)))
+	draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// whole pixels per module keep the code sharp, centered in the space the other formats give it
+	moduleSize := int(QR_SIZE*scale) / len(modules)
+	left := (PNG_WIDTH - moduleSize*len(modules)) / 2
+	top := int(QR_TOP*scale) + (int(QR_SIZE*scale)-moduleSize*len(modules))/2
+	for _, run := range darkRuns(modules) {
+		rect := image.Rect(left+run[1]*moduleSize, top+run[0]*moduleSize, left+(run[1]+run[2])*moduleSize, top+(run[0]+1)*moduleSize)
+		draw.Draw(page, rect, image.Black, image.Point{}, draw.Src)
+	}
+
+	for _, line := range poster.lines() {
+		size := line.size * scale
+		face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		drawer := &font.Drawer{Dst: page, Src: image.NewUniform(color.Black), Face: face}
+		// the site's font runs wider than Helvetica, so it's measured again
+		width := drawer.MeasureString(line.text).Round()
+		if maxWidth := int((PAGE_WIDTH - 2*MARGIN) * scale); width > maxWidth {
+			face.Close()
+			size = size * float64(maxWidth) / float64(width)
+			if face, err = opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull}); err != nil {
+				return nil, err
+			}
+			drawer.Face = face
+			width = drawer.MeasureString(line.text).Round()
+		}
+		drawer.Dot = fixed.P((PNG_WIDTH-width)/2, int(line.baseline*scale))
+		drawer.DrawString(line.text)
+		face.Close()
+	}
+
+	out := bytes.Buffer{}
+	if err = png.Encode(&out, page); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,87 @@
+package poster
+
+import (
+	"fmt"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const FORMAT_PNG = "png"
+const FORMAT_SVG = "svg"
+const FORMAT_PDF = "pdf"
+
+var CONTENT_TYPES = map[string]string{
+	FORMAT_PNG: "image/png",
+	FORMAT_SVG: "image/svg+xml",
+	FORMAT_PDF: "application/pdf",
+}
+
+// everything is laid out on A4 portrait in points, PNGs are scaled up from it
+const PAGE_WIDTH = 595.0
+const PAGE_HEIGHT = 842.0
+const MARGIN = 40.0
+
+const QR_SIZE = 400.0
+const QR_TOP = 170.0
+
+const TITLE_SIZE = 36.0
+const CAPTION_SIZE = 20.0
+const LINK_SIZE = 10.0
+
+// Render draws the poster as format. fontData is the TrueType font PNGs are lettered in, SVGs & PDFs leave it to the viewer.
+func Render(format string, poster Poster, fontData []byte) ([]byte, error) {
+	qr, err := qrcode.New(poster.Link, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make a QR code for %v: %v", poster.Link, err)
+	}
+	// the page's margin is plenty of quiet zone
+	qr.DisableBorder = true
+	modules := qr.Bitmap()
+
+	switch format {
+	case FORMAT_PNG:
+		return renderPng(poster, modules, fontData)
+	case FORMAT_SVG:
+		return renderSvg(poster, modules), nil
+	case FORMAT_PDF:
+		return renderPdf(poster, modules), nil
+	}
+	return nil, fmt.Errorf("Unknown poster format %v, use %v, %v, or %v", format, FORMAT_PNG, FORMAT_SVG, FORMAT_PDF)
+}
+
+// lines is the text on the page, titles too wide for it are shrunk by how wide they'd be in Helvetica
+func (poster Poster) lines() []line {
+	lines := []line{}
+	if poster.Title != "" {
+		lines = append(lines, line{poster.Title, fitSize(poster.Title, TITLE_SIZE), 120})
+	}
+	if poster.Caption != "" {
+		lines = append(lines, line{poster.Caption, fitSize(poster.Caption, CAPTION_SIZE), QR_TOP + QR_SIZE + 60})
+	}
+	return append(lines, line{poster.Link, fitSize(poster.Link, LINK_SIZE), QR_TOP + QR_SIZE + 100})
+}
+
+func fitSize(text string, size float64) float64 {
+	if width := textWidth(text, size); width > PAGE_WIDTH-2*MARGIN {
+		return size * (PAGE_WIDTH - 2*MARGIN) / width
+	}
+	return size
+}
+
+// runs of dark modules in each row as [row, first column, length], drawing runs keeps SVGs & PDFs small
+func darkRuns(modules [][]bool) [][3]int {
+	runs := [][3]int{}
+	for row := range modules {
+		for col := 0; col < len(modules[row]); col++ {
+			if !modules[row][col] {
+				continue
+			}
+			start := col
+			for col < len(modules[row]) && modules[row][col] {
+				col++
+			}
+			runs = append(runs, [3]int{row, start, col - start})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,101 @@
+package poster
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testPoster = Poster{Title: "Barn Dance & (Hoedown)", Caption: "Scan to share your photos", Link: "https://barn.mysite.com/invite/abc123"}
+
+func TestPdfOffsetsPointAtTheirObjects(t *testing.T) {
+	pdf, err := Render(FORMAT_PDF, testPoster, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("Doesn't look like a PDF:\n%s", pdf)
+	}
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if startxref == nil {
+		t.Fatal("No startxref")
+	}
+	xref, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %v doesn't point at the xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(pdf[xref:], -1)
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 objects in the xref, got %v", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%v 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("Object %v's offset points at %q", i+1, pdf[offset:offset+10])
+		}
+	}
+	if !bytes.Contains(pdf, []byte(`(Barn Dance & \(Hoedown\)) Tj`)) {
+		t.Error("The title's parentheses weren't escaped")
+	}
+}
+
+func TestSvgIsWellFormed(t *testing.T) {
+	svg, err := Render(FORMAT_SVG, testPoster, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	texts := []string{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Not well formed: %v\n%s", err, svg)
+		}
+		if data, ok := token.(xml.CharData); ok && strings.TrimSpace(string(data)) != "" {
+			texts = append(texts, string(data))
+		}
+	}
+	if strings.Join(texts, "|") != testPoster.Title+"|"+testPoster.Caption+"|"+testPoster.Link {
+		t.Errorf("Wrong text on the poster: %v", texts)
+	}
+}
+
+func TestPngIsAnA4Page(t *testing.T) {
+	fontData, err := os.ReadFile("../web/static/fonts/Poppins-SemiBold.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Render(FORMAT_PNG, testPoster, fontData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := page.Bounds().Size(); size.X != PNG_WIDTH || size.Y != 1754 {
+		t.Errorf("Expected a 1240x1754 page, got %v", size)
+	}
+	// QR codes always have a dark finder pattern in the top left corner, modules are a few pixels in from where it could start
+	scale := float64(PNG_SCALE)
+	if r, _, _, _ := page.At(int(PNG_WIDTH/2-QR_SIZE*scale/2)+20, int(QR_TOP*scale)+20).RGBA(); r != 0 {
+		t.Error("The QR code's corner isn't dark")
+	}
+	if r, _, _, _ := page.At(10, 10).RGBA(); r == 0 {
+		t.Error("The page isn't white")
+	}
+
+	if _, err = Render("gif", testPoster, fontData); err == nil {
+		t.Error("Rendered an unknown format")
+	}
+}
@@ -0,0 +1,16 @@
+package poster
+
+// Poster is one printable page, a title over a QR code for Link with a caption & the link itself under it
+type Poster struct {
+	Title string
+	// what scanning does, e.g. "Scan to share your photos"
+	Caption string
+	Link    string
+}
+
+// line is a line of text centered on the page, in points from the top
+type line struct {
+	text     string
+	size     float64
+	baseline float64
+}
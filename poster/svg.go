@@ -0,0 +1,33 @@
+package poster
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// printed at A4, the viewer picks a font close to the one on the site
+const SVG_FONTS = "Poppins, Helvetica, Arial, sans-serif"
+
+func renderSvg(poster Poster, modules [][]bool) []byte {
+	out := bytes.Buffer{}
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="210mm" height="297mm" viewBox="0 0 %v %v">`+"\n", PAGE_WIDTH, PAGE_HEIGHT)
+	out.WriteString(`<rect width="100%" height="100%" fill="#fff"/>` + "\n")
+
+	moduleSize := QR_SIZE / float64(len(modules))
+	left := (PAGE_WIDTH - QR_SIZE) / 2
+	out.WriteString(`<path fill="#000" shape-rendering="crispEdges" d="`)
+	for _, run := range darkRuns(modules) {
+		fmt.Fprintf(&out, "M%.2f %.2fh%.2fv%.2fh-%.2fz", left+float64(run[1])*moduleSize, QR_TOP+float64(run[0])*moduleSize,
+			float64(run[2])*moduleSize, moduleSize, float64(run[2])*moduleSize)
+	}
+	out.WriteString(`"/>` + "\n")
+
+	for _, line := range poster.lines() {
+		fmt.Fprintf(&out, `<text x="%v" y="%.2f" font-family="%v" font-size="%.2f" text-anchor="middle" fill="#000">`, PAGE_WIDTH/2, line.baseline, SVG_FONTS, line.size)
+		xml.EscapeText(&out, []byte(line.text))
+		out.WriteString("</text>\n")
+	}
+	out.WriteString("</svg>\n")
+	return out.Bytes()
+}
@@ -0,0 +1,539 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+const ADMIN_USAGE = `usage: imagebarn [flags] <command>
+
+  user list                   with everyone's state & where it came from
+  user approve <email>        also ends a suspension or ban
+  user suspend <email> <days> <reason>
+                              hides their images & keeps them out until approved, 0 days only ends by approving
+  user convert <guest-email> <email>
+                              moves a guest's images, approval & promotion to a real address they sign in with
+  user ban <email> [reason]   deletes their images & refuses them signing in, disapprove does the same
+  user promote <email>
+  user demote <email>
+  invite list
+  invite create <days> [max uses] [label]
+                              approves whoever signs in through its link, 0 uses is no limit
+  invite revoke <id>
+  invite guests <id> on|off   lets people join through it with just a name, guests get fewer images
+  invite poster <id> <file>   a page to print with the invite's QR code, .pdf, .png, or .svg
+  image list [email]
+  image purge <email>
+  key list
+  key create <name>           the key is only shown once
+  key revoke <name>
+  sessions list [email]
+  sessions end <id>           signs out a single session
+  sessions revoke <email>     signs them out everywhere
+  fsck [repair]               repair moves unknown files to lost+found
+  backup <file> [encrypt]     works while the server runs
+  restore <file>              only into a fresh data dir, with the server stopped
+  signing-key list            keys sessions are signed & verified with
+  signing-key rotate          signs new sessions with a new key, the old one verifies until they expire
+  encryption genkey           prints a new image encryption key
+  encryption status           counts the images under each key
+  encryption rotate           moves every image to the current key, or decrypts them when there's none
+  audit list [filters]        newest first, filters look like actor=bob action=user.approved since=2026-01-02
+  audit export <file> [filters]
+                              everything that matches, .jsonl or .csv
+  audit prune                 drops entries past audit_retention now instead of waiting on the server
+`
+
+// RunAdminCommand runs a CLI command against the loaded state, either in the server or offline.
+func RunAdminCommand(request ControlRequest, out io.Writer) error {
+	args := request.Args
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Fprint(out, ADMIN_USAGE)
+		return nil
+	}
+	command, sub, rest := args[0], "", []string{}
+	if len(args) > 1 {
+		sub, rest = args[1], args[2:]
+	}
+	if command == "backup" && sub != "" && (len(rest) == 0 || (len(rest) == 1 && rest[0] == "encrypt")) {
+		if len(rest) == 1 && request.Passphrase == "" {
+			return fmt.Errorf("Encrypting needs a passphrase")
+		}
+		if err := writeBackup(sub, request.Passphrase, out); err != nil {
+			return err
+		}
+		detail := ""
+		if len(rest) == 1 {
+			detail = "encrypted"
+		}
+		auditCli(audit.BACKUP_WRITTEN, sub, detail)
+		return nil
+	}
+	switch command + " " + sub {
+	case "user list":
+		return listUsers(out)
+	case "user approve":
+		return withEmail(rest, func(email string) error {
+			if err := approveUser(email, APPROVAL_CLI, "", ""); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Approved %v\n", email)
+			return nil
+		})
+	case "user suspend":
+		if len(rest) < 3 || rest[0] == "" {
+			return fmt.Errorf("Expected an email, how many days, & why")
+		}
+		days, err := strconv.ParseFloat(rest[1], 64)
+		if err != nil || days < 0 {
+			return fmt.Errorf("Days has to be a number, got %v", rest[1])
+		}
+		until := time.Time{}
+		if days > 0 {
+			until = time.Now().Add(time.Duration(days * float64(24*time.Hour)))
+		}
+		if err = suspendUser(rest[0], strings.Join(rest[2:], " "), until, APPROVAL_CLI, "", ""); err != nil {
+			return err
+		}
+		if until.IsZero() {
+			fmt.Fprintf(out, "Suspended %v until they're approved\n", rest[0])
+		} else {
+			fmt.Fprintf(out, "Suspended %v until %v\n", rest[0], until.Local().Format(time.DateTime))
+		}
+		return nil
+	case "user convert":
+		if len(rest) != 2 || rest[0] == "" || rest[1] == "" {
+			return fmt.Errorf("Expected the guest's email & the address to convert them to")
+		}
+		if err := convertGuest(rest[0], rest[1], APPROVAL_CLI, "", ""); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Converted %v to %v, they'll sign in with it from now on\n", rest[0], rest[1])
+		return nil
+	case "user ban", "user disapprove":
+		if len(rest) == 0 || rest[0] == "" {
+			return fmt.Errorf("Expected an email")
+		}
+		if err := banUser(rest[0], strings.Join(rest[1:], " "), APPROVAL_CLI, "", ""); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Banned %v, deleted their images & signed them out\n", rest[0])
+		return nil
+	case "user promote":
+		return withEmail(rest, func(email string) error {
+			if isApproved, _ := barnage.fs.ApprovedUsers().Lookup(email); !isApproved {
+				return fmt.Errorf("%v isn't approved, approve them first", email)
+			}
+			if err := setPromotedAdmin(email, true); err != nil {
+				return err
+			}
+			auditCli(audit.USER_PROMOTED, email, "")
+			fmt.Fprintf(out, "Promoted %v to admin\n", email)
+			return nil
+		})
+	case "user demote":
+		return withEmail(rest, func(email string) error {
+			if email == AdminUserEmail {
+				return fmt.Errorf("%v is ADMIN_USER, change it in the config instead", email)
+			}
+			if err := setPromotedAdmin(email, false); err != nil {
+				return err
+			}
+			auditCli(audit.USER_DEMOTED, email, "")
+			fmt.Fprintf(out, "Demoted %v\n", email)
+			return nil
+		})
+	case "invite list":
+		return listInvitesTo(out)
+	case "invite create":
+		if len(rest) == 0 {
+			return fmt.Errorf("Expected how many days the invite lasts")
+		}
+		days, err := strconv.ParseFloat(rest[0], 64)
+		if err != nil {
+			return fmt.Errorf("Days has to be a number, got %v", rest[0])
+		}
+		maxUses := 0
+		if len(rest) > 1 {
+			if maxUses, err = strconv.Atoi(rest[1]); err != nil {
+				return fmt.Errorf("Max uses has to be a whole number, got %v", rest[1])
+			}
+		}
+		label := ""
+		if len(rest) > 2 {
+			label = strings.Join(rest[2:], " ")
+		}
+		invite, err := createInvite(label, APPROVAL_CLI, time.Duration(days*float64(24*time.Hour)), maxUses, false)
+		if err != nil {
+			return err
+		}
+		auditCli(audit.INVITE_CREATED, invite.Id, inviteAuditDetail(invite))
+		fmt.Fprintf(out, "Created invite %v, good until %v:\n%v\n", invite.Id, invite.Expires.Local().Format(time.DateTime), invite.Link())
+		return nil
+	case "invite revoke":
+		if len(rest) != 1 || rest[0] == "" {
+			return fmt.Errorf("Expected exactly one invite id")
+		}
+		if err := revokeInvite(rest[0]); err != nil {
+			return err
+		}
+		auditCli(audit.INVITE_REVOKED, rest[0], "")
+		fmt.Fprintf(out, "Revoked invite %v\n", rest[0])
+		return nil
+	case "invite guests":
+		if len(rest) != 2 || (rest[1] != "on" && rest[1] != "off") {
+			return fmt.Errorf("Expected an invite id & on or off")
+		}
+		if err := allowGuests(rest[0], rest[1] == "on"); err != nil {
+			return err
+		}
+		auditCli(audit.INVITE_CHANGED, rest[0], "guests "+rest[1])
+		if rest[1] == "on" {
+			fmt.Fprintf(out, "Guests can join through invite %v\n", rest[0])
+		} else {
+			fmt.Fprintf(out, "Guests can no longer join through invite %v\n", rest[0])
+		}
+		return nil
+	case "invite poster":
+		if len(rest) != 2 || rest[0] == "" || rest[1] == "" {
+			return fmt.Errorf("Expected an invite id & a file to write")
+		}
+		invite, exists := inviteById(rest[0])
+		if !exists {
+			return fmt.Errorf("No invite %v", rest[0])
+		}
+		data, err := renderInvitePoster(invite, strings.TrimPrefix(filepath.Ext(rest[1]), "."))
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(rest[1], data, 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote the poster for invite %v to %v\n", invite.Id, rest[1])
+		return nil
+	case "image list":
+		email := ""
+		if len(rest) > 0 {
+			email = rest[0]
+		}
+		return listImages(email, out)
+	case "image purge":
+		return withEmail(rest, func(email string) error {
+			if err := filestore.DeleteAll(email); err != nil {
+				return err
+			}
+			// approved users keep an empty folder, same as approving makes
+			if isApproved, _ := barnage.fs.ApprovedUsers().Lookup(email); isApproved {
+				if err := os.MkdirAll(filestore.ImagePath(filestore.Encode(email), ""), 0700); err != nil {
+					return err
+				}
+			}
+			auditCli(audit.IMAGES_PURGED, email, "")
+			fmt.Fprintf(out, "Purged every image of %v\n", email)
+			return nil
+		})
+	case "key list":
+		return listKeys(out)
+	case "key create":
+		return withName(rest, func(name string) error {
+			token, err := createStoredApiKey(name)
+			if err != nil {
+				return err
+			}
+			auditCli(audit.API_KEY_CREATED, name, "")
+			fmt.Fprintf(out, "Created key %v, it won't be shown again:\n%v\n", name, token)
+			return nil
+		})
+	case "key revoke":
+		return withName(rest, func(name string) error {
+			if err := revokeStoredApiKey(name); err != nil {
+				return err
+			}
+			auditCli(audit.API_KEY_REVOKED, name, "")
+			fmt.Fprintf(out, "Revoked key %v, displays paired with it stop working\n", name)
+			return nil
+		})
+	case "sessions list":
+		email := ""
+		if len(rest) > 0 {
+			email = rest[0]
+		}
+		return listSessionsTo(email, out)
+	case "sessions end":
+		if len(rest) != 1 || rest[0] == "" {
+			return fmt.Errorf("Expected exactly one session id")
+		}
+		family := revokeSessionFamily(rest[0])
+		if family == nil {
+			return fmt.Errorf("No session %v", rest[0])
+		}
+		auditCli(audit.SESSION_ENDED, family.Email, describeUserAgent(family.UserAgent))
+		fmt.Fprintf(out, "Signed %v out of %v\n", family.Email, describeUserAgent(family.UserAgent))
+		return nil
+	case "sessions revoke":
+		return withEmail(rest, func(email string) error {
+			InvalidateJwt(email)
+			auditCli(audit.SESSIONS_REVOKED, email, "everywhere")
+			fmt.Fprintf(out, "Signed %v out everywhere\n", email)
+			return nil
+		})
+	case "fsck ", "fsck repair":
+		return runFsck(sub == "repair", out)
+	case "signing-key list":
+		return listSigningKeys(out)
+	case "signing-key rotate":
+		key, err := rotateSigningKey()
+		if err != nil {
+			return err
+		}
+		auditCli(audit.SIGNING_KEY_ROTATED, key.Kid, "")
+		fmt.Fprintf(out, "Now signing with %v, the old key verifies existing sessions until they expire\n", key.Kid)
+		return nil
+	case "encryption genkey":
+		key := make([]byte, config.IMAGE_KEY_SIZE)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, base64.StdEncoding.EncodeToString(key))
+		return nil
+	case "encryption status":
+		return encryptionStatus(out)
+	case "encryption rotate":
+		changed, err := filestore.RotateImages()
+		if changed > 0 || err == nil {
+			auditCli(audit.IMAGES_REENCRYPTED, filestore.CurrentImageKeyId(), fmt.Sprintf("rewrote %v images", changed))
+			fmt.Fprintf(out, "Rewrote %v images, new ones are stored under %v\n", changed, filestore.CurrentImageKeyId())
+		}
+		return err
+	case "audit list":
+		return listAudit(rest, out)
+	case "audit export":
+		if len(rest) == 0 || rest[0] == "" {
+			return fmt.Errorf("Expected a file to write, .jsonl or .csv")
+		}
+		return exportAuditTo(rest[0], rest[1:], out)
+	case "audit prune":
+		dropped, err := pruneAudit(APPROVAL_CLI)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Dropped %v entries past retention\n", dropped)
+		return nil
+	}
+	fmt.Fprint(out, ADMIN_USAGE)
+	return fmt.Errorf("Unknown command: %v", args)
+}
+
+func withEmail(args []string, do func(email string) error) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("Expected exactly one email")
+	}
+	return do(args[0])
+}
+
+func withName(args []string, do func(name string) error) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("Expected exactly one key name")
+	}
+	return do(args[0])
+}
+
+func listUsers(out io.Writer) error {
+	users := barnage.fs.ApprovedUsers().CopyOfUsersMap()
+	counts, err := barnage.fs.AvailableCounts()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	emails := make([]string, 0, len(users))
+	for email := range users {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tNAME\tSTATE\tADMIN\tWAITING\tSOURCE")
+	for _, email := range emails {
+		source := "-"
+		if record, exists := approvalOf(email); exists {
+			source = fmt.Sprintf("%v, %v", record.Describe(), record.At.Local().Format(time.DateTime))
+		} else if joined := approvalSource(email); joined != "" {
+			source = joined
+		}
+		name := guestName(email)
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", email, name, userState(email), isAdminEmail(email), counts[email], source)
+	}
+	return w.Flush()
+}
+
+func listInvitesTo(out io.Writer) error {
+	now := time.Now()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tUSES\tEXPIRES\tSTATUS\tGUESTS\tCREATED BY")
+	for _, invite := range listInvites() {
+		uses, status := fmt.Sprint(invite.Uses), invite.Problem(now)
+		if invite.MaxUses > 0 {
+			uses = fmt.Sprintf("%v/%v", invite.Uses, invite.MaxUses)
+		}
+		if status == "" {
+			status = "usable"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", invite.Id, invite.Label, uses, invite.Expires.Local().Format(time.DateTime), status, invite.Guests, invite.CreatedBy)
+	}
+	return w.Flush()
+}
+
+func listImages(email string, out io.Writer) error {
+	entries, err := filestore.ListImages(email)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tNAME\tSHOWN\tSIZE\tMODIFIED")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", entry.Email, entry.Name, entry.Ghost, entry.Size, entry.ModTime.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func encryptionStatus(out io.Writer) error {
+	counts, err := filestore.EncryptionStatus()
+	if err != nil {
+		return err
+	}
+	keyIds := make([]string, 0, len(counts))
+	for keyId := range counts {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+	current := filestore.CurrentImageKeyId()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tIMAGES\tCURRENT")
+	for _, keyId := range keyIds {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", keyId, counts[keyId], keyId == current)
+	}
+	return w.Flush()
+}
+
+func listSigningKeys(out io.Writer) error {
+	signingKeysRWMutex.RLock()
+	defer signingKeysRWMutex.RUnlock()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tCREATED\tRETIRED\tVERIFIES UNTIL")
+	for _, key := range signingKeys {
+		retired, until := "-", "-"
+		if key.Retired != nil {
+			retired = key.Retired.Local().Format(time.DateTime)
+			until = key.Retired.Add(maxTokenLifetime()).Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", key.Kid, key.Created.Local().Format(time.DateTime), retired, until)
+	}
+	return w.Flush()
+}
+
+func listSessionsTo(email string, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tDEVICE\tIP\tCREATED\tLAST SEEN")
+	for _, session := range listSessions(email, "") {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", session.Id, session.Email, session.Device, session.Ip, session.Created.Format(time.DateTime), session.LastSeen.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func listKeys(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFINGERPRINT\tSOURCE\tCREATED")
+	for _, key := range listApiKeys() {
+		source, created := "cli", key.Created.Format(time.DateTime)
+		if key.FromConfig {
+			source, created = "config", "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", key.Name, key.Fingerprint, source, created)
+	}
+	return w.Flush()
+}
+
+// auditFilterArgs reads key=value filters, the same ones the audit page takes
+func auditFilterArgs(args []string) (audit.Filter, error) {
+	values := map[string]string{}
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return audit.Filter{}, fmt.Errorf("Filters look like key=value, got \"%v\"", arg)
+		}
+		switch key {
+		case "actor", "action", "target", "since", "until", "limit":
+			values[key] = value
+		default:
+			return audit.Filter{}, fmt.Errorf("Unknown filter \"%v\", use actor, action, target, since, until, or limit", key)
+		}
+	}
+	return parseAuditFilter(func(key string) string { return values[key] })
+}
+
+func listAudit(args []string, out io.Writer) error {
+	filter, err := auditFilterArgs(args)
+	if err != nil {
+		return err
+	}
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tACTOR\tACTION\tTARGET\tIP\tDETAIL")
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", entry.At.Local().Format(time.DateTime), dash(entry.Actor), entry.Action, dash(entry.Target), dash(entry.Ip), dash(entry.Detail))
+	}
+	return w.Flush()
+}
+
+func exportAuditTo(path string, args []string, out io.Writer) error {
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format != AUDIT_FORMAT_JSONL && format != AUDIT_FORMAT_CSV {
+		return fmt.Errorf("Expected a .jsonl or .csv file, got %v", path)
+	}
+	filter, err := auditFilterArgs(args)
+	if err != nil {
+		return err
+	}
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeAudit(file, format, entries)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	auditCli(audit.AUDIT_EXPORTED, path, fmt.Sprintf("%v entries as %v", len(entries), format))
+	fmt.Fprintf(out, "Wrote %v entries to %v\n", len(entries), path)
+	return nil
+}
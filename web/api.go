@@ -3,59 +3,95 @@ package web
 import (
 	"fmt"
 	"log/slog"
-	"net/url"
-	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/events"
+	"kmfg.dev/imagebarn/v1/filestore"
 )
 
-var authToken string
+var poolEmpty atomic.Bool
 
-func RegisterApi(fiber *fiber.App) {
-	authToken = os.Getenv("BEARER_TOKEN")
-	if authToken == "" {
-		panic("Bearer Token was not provided in the .env! This makes ImageBarn useless. Please double check the presence of BEARER_TOKEN= in your .env")
-	}
-	apiRouter := fiber.Group("/api")
+const API_ROUTE = "/api"
+const API_IMAGE_ROUTE = API_ROUTE + "/image"
+const API_PAIR_ROUTE = API_ROUTE + "/display/pair"
+
+// the one method each route answers to, preflights are held to these
+var API_METHODS = map[string]string{API_IMAGE_ROUTE: fiber.MethodGet, API_PAIR_ROUTE: fiber.MethodPost}
+
+func RegisterApi(barnage *BarnageWeb) {
+	apiRouter := barnage.fiber.Group(API_ROUTE)
 	apiRouter.Use(limiter.New(limiter.Config{
 		Max:               60,
 		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
 		LimiterMiddleware: limiter.SlidingWindow{},
 	}))
+	apiRouter.Use(corsPreflight(API_METHODS))
 	apiRouter.Use(authHeaderMiddleware)
-	apiRouter.Get("/image", getImageThenRemove)
+	apiRouter.Get(strings.TrimPrefix(API_IMAGE_ROUTE, API_ROUTE), getImageThenRemove)
+	apiRouter.Post(strings.TrimPrefix(API_PAIR_ROUTE, API_ROUTE), createPairingCodeApi)
 }
 
+// a key used from a page its CORS origins don't cover is refused before anything happens, like an image being ghosted
 func authHeaderMiddleware(c *fiber.Ctx) error {
-	c.Response().Header.Add("Access-Control-Allow-Origin", "*")
-	c.Response().Header.Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	c.Response().Header.Add("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	c.Response().Header.Add("Access-Control-Allow-Credentials", "true")
-
-	if c.Method() == "OPTIONS" {
-		return c.SendStatus(204)
-	}
-
-	authBytes := c.Request().Header.Peek("Authorization")
-	doesntMatchToken := string(authBytes[:]) != "Bearer "+authToken
-	if doesntMatchToken {
+	token, hasBearer := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	name, valid := apiKeyName(token)
+	if !hasBearer || !valid {
+		// displays without a key poll too, only a key that's wrong is worth recording
+		if hasBearer {
+			auditRejection(c, audit.API_KEY_REJECTED, c.Method()+" "+c.Path())
+		}
 		return c.SendStatus(401)
 	}
+	if !allowCors(c, name) {
+		slog.Debug(fmt.Sprintf("Refused key %v from %v, it isn't one of its CORS origins", name, c.Get(fiber.HeaderOrigin)))
+		return c.SendStatus(403)
+	}
+	c.Locals("apiKey", token)
+	c.Locals(API_KEY_NAME_LOCAL, name)
 	return c.Next()
 }
 
 func getImageThenRemove(c *fiber.Ctx) error {
-	pickedDirectory, pickedFile, err := barnage.fs.GetRandomImage()
+	return consumeImage(c, nil)
+}
+
+// consumeImage sends a random image then ghosts it. Every display pulls through here.
+//
+//	beforeSend gets the uploader & file name of the picked image, e.g. to set extra headers.
+func consumeImage(c *fiber.Ctx, beforeSend func(email string, fileName string)) error {
+	pickedDirectory, pickedFile, err := barnage.fs.PickImage()
 	if err != nil {
 		slog.Debug(fmt.Sprintf("Couldn't find any images to ghost: %v", err))
+		// only the first miss after serving something, displays poll an empty pool constantly
+		if poolEmpty.CompareAndSwap(false, true) {
+			events.Publish(events.POOL_EMPTY, "", nil)
+		}
 		// no content available
 		return c.SendStatus(204)
 	}
-	fullPath := fmt.Sprintf("./images/%v/%v", pickedDirectory, pickedFile)
-	escapedPickedFile := url.PathEscape(fullPath)
-	sendFileErr := c.SendFile(escapedPickedFile)
+	poolEmpty.Store(false)
+	email, _ := filestore.Decode(pickedDirectory)
+	fileName, _ := filestore.Decode(pickedFile)
+	if beforeSend != nil {
+		beforeSend(email, fileName)
+	}
+	fullPath := filestore.ImagePath(pickedDirectory, pickedFile)
+	sendFileErr := filestore.SendImage(c, pickedDirectory, pickedFile)
+	if sendFileErr == nil {
+		consumed := map[string]string{"fileName": fileName}
+		if seq := showNow(fullPath); seq > 0 {
+			consumed["seq"] = strconv.Itoa(seq)
+		}
+		events.Publish(events.IMAGE_CONSUMED, email, consumed)
+		auditRequest(c, audit.IMAGE_CONSUMED, email, fileName)
+	}
 	err = barnage.fs.GhostImage(pickedDirectory, pickedFile)
 	if err != nil {
 		return err
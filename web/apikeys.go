@@ -0,0 +1,200 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// keys made with `imagebarn key create`, lives in the data dir
+const API_KEYS_FILE = "api-keys.json"
+const API_KEY_BYTES = 32
+
+// hex characters of the hash a kiosk remembers, 8 bytes
+const API_KEY_FINGERPRINT_LENGTH = 16
+
+// hash -> name for bearer_token & api_keys, swapped whole on a config reload
+var configApiKeys atomic.Pointer[map[string]string]
+
+var apiKeysFile = API_KEYS_FILE
+
+// name -> key for the ones created from the CLI
+var storedApiKeys = map[string]StoredApiKey{}
+var storedApiKeysRWMutex = sync.RWMutex{}
+
+func hashApiKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setApiKeys(barnConfig *config.Config) {
+	keys := map[string]string{hashApiKey(barnConfig.BearerToken): config.DEFAULT_API_KEY_NAME}
+	for name, token := range barnConfig.ApiKeys {
+		keys[hashApiKey(token)] = name
+	}
+	configApiKeys.Store(&keys)
+}
+
+func loadStoredApiKeys() error {
+	data, err := helpme.ReadFileVerified(apiKeysFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", apiKeysFile, err)
+	}
+	keys := map[string]StoredApiKey{}
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", apiKeysFile, err)
+	}
+	storedApiKeysRWMutex.Lock()
+	storedApiKeys = keys
+	storedApiKeysRWMutex.Unlock()
+	return nil
+}
+
+// every current key as hash -> name
+func allApiKeys() map[string]string {
+	keys := map[string]string{}
+	if fromConfig := configApiKeys.Load(); fromConfig != nil {
+		for hash, name := range *fromConfig {
+			keys[hash] = name
+		}
+	}
+	storedApiKeysRWMutex.RLock()
+	for name, key := range storedApiKeys {
+		keys[key.Hash] = name
+	}
+	storedApiKeysRWMutex.RUnlock()
+	return keys
+}
+
+// apiKeyName is the name of the key token belongs to, false if it isn't a current key
+func apiKeyName(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	hash := []byte(hashApiKey(token))
+	// compare against every key so the timing doesn't hint at which one was close
+	matchedName, matched := "", false
+	for key, name := range allApiKeys() {
+		if subtle.ConstantTimeCompare([]byte(key), hash) == 1 {
+			matchedName, matched = name, true
+		}
+	}
+	return matchedName, matched
+}
+
+// the current bearer_token's fingerprint, the admin pairs displays with it
+func defaultKeyFingerprint() string {
+	for hash, name := range *configApiKeys.Load() {
+		if name == config.DEFAULT_API_KEY_NAME {
+			return hash[:API_KEY_FINGERPRINT_LENGTH]
+		}
+	}
+	return ""
+}
+
+// kiosks remember the fingerprint of the key that paired them, they stop once it's revoked
+func isCurrentKeyFingerprint(fingerprint string) bool {
+	for hash := range allApiKeys() {
+		if hash[:API_KEY_FINGERPRINT_LENGTH] == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// createStoredApiKey makes a new key & returns its token, which is never shown again
+func createStoredApiKey(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("A key needs a name")
+	}
+	for _, existing := range allApiKeys() {
+		if existing == name {
+			return "", fmt.Errorf("There's already a key named %v", name)
+		}
+	}
+	b := make([]byte, API_KEY_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	storedApiKeysRWMutex.Lock()
+	defer storedApiKeysRWMutex.Unlock()
+	keys := copyStoredApiKeys()
+	keys[name] = StoredApiKey{Hash: hashApiKey(token), Created: time.Now().UTC()}
+	if err := writeStoredApiKeys(keys); err != nil {
+		return "", err
+	}
+	storedApiKeys = keys
+	return token, nil
+}
+
+func revokeStoredApiKey(name string) error {
+	storedApiKeysRWMutex.Lock()
+	defer storedApiKeysRWMutex.Unlock()
+	if _, exists := storedApiKeys[name]; !exists {
+		for _, configName := range *configApiKeys.Load() {
+			if configName == name {
+				return fmt.Errorf("%v comes from your config, remove it there & reload", name)
+			}
+		}
+		return fmt.Errorf("There's no key named %v", name)
+	}
+	keys := copyStoredApiKeys()
+	delete(keys, name)
+	if err := writeStoredApiKeys(keys); err != nil {
+		return err
+	}
+	storedApiKeys = keys
+	return nil
+}
+
+// listApiKeys describes every current key, sorted by name
+func listApiKeys() []ApiKeyInfo {
+	infos := []ApiKeyInfo{}
+	for hash, name := range *configApiKeys.Load() {
+		infos = append(infos, ApiKeyInfo{Name: name, Fingerprint: hash[:API_KEY_FINGERPRINT_LENGTH], FromConfig: true})
+	}
+	storedApiKeysRWMutex.RLock()
+	for name, key := range storedApiKeys {
+		infos = append(infos, ApiKeyInfo{Name: name, Fingerprint: key.Hash[:API_KEY_FINGERPRINT_LENGTH], Created: key.Created})
+	}
+	storedApiKeysRWMutex.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// call with storedApiKeysRWMutex held
+func copyStoredApiKeys() map[string]StoredApiKey {
+	keys := map[string]StoredApiKey{}
+	for name, key := range storedApiKeys {
+		keys[name] = key
+	}
+	return keys
+}
+
+func writeStoredApiKeys(keys map[string]StoredApiKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	if err = helpme.WriteFileAtomic(apiKeysFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", apiKeysFile, err)
+	}
+	return nil
+}
@@ -2,19 +2,18 @@ package web
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
 	"kmfg.dev/imagebarn/v1/filestore"
 )
 
@@ -31,7 +30,8 @@ const PARTIALS_IMAGES_ROUTE = PARTIALS_ROUTE + "/images"
 const INDEX_VIEW = BASE_VIEW + "/index"
 const PARTIALS_IMAGES_VIEW = BASE_PARTIAL + "/images"
 
-const MAX_IMAGES_PER_USER = 5
+// how long shutdown waits on in-flight requests & conversions before giving up on them
+const SHUTDOWN_TIMEOUT = 30 * time.Second
 
 //go:embed static/*
 var staticFS embed.FS
@@ -42,63 +42,136 @@ var viewsFS embed.FS
 var AdminUserEmail string
 var barnage *BarnageWeb
 
-func StartServer(port int, stopChan chan struct{}, wg *sync.WaitGroup) {
+// StartServer blocks until stopChan closes & the server has drained, or listening fails.
+func StartServer(barnConfig *config.Config, stopChan chan struct{}, wg *sync.WaitGroup) error {
 
 	engine := html.NewFileSystem(http.FS(viewsFS), ".html")
 	engine.Reload(false)
 	engine.Delims("{{", "}}")
 
-	imageUploadSizeLimitMb, err := strconv.Atoi(os.Getenv("UPLOAD_LIMIT_MB"))
-	if err != nil {
-		panic(fmt.Errorf("Cannot use %v MB for image upload size! Double check your .env is formatted correctly: %v", os.Getenv("UPLOAD_LIMIT_MB"), err))
-	}
+	// trusted proxies are handled by clientIP so they can be reloaded
+	// locals reach the views, that's how every template gets the CSP nonce
 	app := fiber.New(fiber.Config{
-		Views:                   engine,
-		ServerHeader:            "ImageBarn v0.0.0",
-		BodyLimit:               imageUploadSizeLimitMb * 1024 * 1024,
-		EnableTrustedProxyCheck: true,
-		TrustedProxies:          getTrustedProxies(),
+		Views:             engine,
+		PassLocalsToViews: true,
+		ServerHeader:      "ImageBarn v0.0.0",
+		BodyLimit:         barnConfig.UploadLimitMb * 1024 * 1024,
 	})
+	setSecurityHeaders(barnConfig)
 	app.Use(logFiber)
+	app.Use(securityHeaders)
 	app.Use("/static", filesystem.New(filesystem.Config{
 		Root:       http.FS(staticFS),
 		PathPrefix: "static",
 		Browse:     false,
 	}))
+	RegisterCspReports(app)
+	app.Use(csrfMiddleware)
 	app.Get(INDEX_ROUTE, index)
 	app.Get(INDEX_AS_PARTIAL_ROUTE, indexAsPartial)
-	app.Get(LOGOUT_ROUTE, logout)
+	app.Post(LOGOUT_ROUTE, logout)
 	app.Get(PARTIALS_IMAGES_ROUTE, partialsImages)
 
-	filestore.SetupImageConverterWorker()
-	StartJWTServices(stopChan, wg)
-	barnage = NewBarnage(app, stopChan, wg)
+	// storage & outgoing integrations keep going until requests have drained, so nothing they'd record is lost
+	drainedChan := make(chan struct{})
+
+	setTrustedProxies(barnConfig.TrustedProxies)
+	setCorsPolicy(barnConfig)
+	if err := openState(barnConfig); err != nil {
+		return err
+	}
+	filestore.SetupImageConverterWorker(barnConfig.ImageWorkers)
+	StartJWTServices(drainedChan, wg)
+	barnage = NewBarnage(barnConfig, app, stopChan, drainedChan, wg)
+	fsckOnStart(barnConfig)
 	InitOAuth(barnage)
 	RegisterUploader(barnage)
 	RegisterApprover(barnage)
-	RegisterApi(app)
+	RegisterInvites(barnage)
+	RegisterGuests(barnage)
+	RegisterEmailSignIn(barnage)
+	RegisterEvents(barnage)
+	RegisterLiveFeed(barnage)
+	RegisterKiosk(barnage)
+	RegisterWebhooks(barnage)
+	RegisterMqtt(barnage)
+	RegisterApi(barnage)
+	RegisterJwks(barnage)
+	RegisterSessions(barnage)
+	RegisterAudit(barnage)
+	if err := serveControl(barnConfig, stopChan, wg); err != nil {
+		return err
+	}
+	startupConfig.Store(barnConfig)
 
 	// PLEASE REVERSE PROXY AND USE HTTPS
-	app.Listen(fmt.Sprintf("127.0.0.1:%v", port))
+	return serve(app, barnConfig.ListenAddress, stopChan, drainedChan)
 }
 
+// openState points every store at the data dir & loads it, shared by the server & offline CLI commands
+func openState(barnConfig *config.Config) error {
+	AdminUserEmail = barnConfig.AdminUser
+	baseUri = barnConfig.BaseUri
+	keyFile = barnConfig.DataPath(KEY_FILE)
+	signingKeysFile = barnConfig.DataPath(SIGNING_KEYS_FILE)
+	issuedVersionFile = barnConfig.DataPath(ISSUED_VERSION_FILE)
+	sessionsFile = barnConfig.DataPath(SESSIONS_FILE)
+	sessionLifetime = barnConfig.SessionLifetime
+	adminsFile = barnConfig.DataPath(ADMINS_FILE)
+	apiKeysFile = barnConfig.DataPath(API_KEYS_FILE)
+	approvalsFile = barnConfig.DataPath(APPROVALS_FILE)
+	invitesFile = barnConfig.DataPath(INVITES_FILE)
+	guestsFile = barnConfig.DataPath(GUESTS_FILE)
+	auditLog = audit.Open(barnConfig.DataPath(AUDIT_FILE))
+
+	loadIssuedVersions()
+	loadSessions()
+	setApiKeys(barnConfig)
+	applySigningKeyRotation(barnConfig)
+	setAutoApproveDomains(barnConfig)
+	applyAuditRetention(barnConfig)
+	return errors.Join(loadSigningKeys(), loadPromotedAdmins(), loadStoredApiKeys(), loadApprovals(), loadInvites(), loadGuests())
+}
+
+// serve listens until stopChan closes, then stops accepting connections, waits on in-flight requests & conversions,
+// and closes drainedChan so state gets its final flush.
+func serve(app *fiber.App, addr string, stopChan chan struct{}, drainedChan chan struct{}) error {
+	defer close(drainedChan)
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(addr)
+	}()
+
+	select {
+	case err := <-listenErr:
+		return fmt.Errorf("Stopped listening on %v: %v", addr, err)
+	case <-stopChan:
+	}
+
+	deadline := time.Now().Add(SHUTDOWN_TIMEOUT)
+	slog.Info("No longer accepting connections, draining in-flight requests...")
+	if err := app.ShutdownWithTimeout(SHUTDOWN_TIMEOUT); err != nil {
+		slog.Warn(fmt.Sprintf("Gave up waiting on in-flight requests: %v", err))
+	}
+	if !filestore.WaitForJobs(time.Until(deadline)) {
+		slog.Warn("Gave up waiting on image uploads & conversions, some may be incomplete!")
+	}
+	slog.Info("Requests drained.")
+	return nil
+}
+
+// only signs this browser out, the sessions page can sign out the rest
 func logout(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
-	if valid {
-		InvalidateJwt(email)
+	if email, valid := sessionEmail(c); valid {
+		auditRequest(c, audit.SIGNED_OUT, email, "")
 	}
-	c.Cookie(&fiber.Cookie{
-		Name:     "jwt",
-		Value:    "",
-		Expires:  time.Now(),
-		HTTPOnly: true,
-		Secure:   isSecure,
-	})
-	return indexAsPartial(c)
+	endSession(c)
+	return c.Render(INDEX_VIEW, signedOutBind(c, fiber.Map{}))
 }
 
 func partialsImages(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
+	email, valid := sessionEmail(c)
 	if !valid {
 		return fmt.Errorf("Invalid JWT!")
 	}
@@ -106,17 +179,17 @@ func partialsImages(c *fiber.Ctx) error {
 }
 
 func indexAsPartial(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
+	email, valid := sessionEmail(c)
 	if !valid {
-		return c.Render(INDEX_VIEW, fiber.Map{})
+		return c.Render(INDEX_VIEW, signedOutBind(c, fiber.Map{}))
 	}
 	return c.Render(INDEX_VIEW, fiber.Map{"BarnageUser": getBarnageUser(email), "ImageUploadRoute": IMAGE_ROUTE})
 }
 
 func index(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
+	email, valid := sessionEmail(c)
 	if !valid {
-		return c.Render(INDEX_VIEW, fiber.Map{}, MAIN_LAYOUT)
+		return c.Render(INDEX_VIEW, signedOutBind(c, fiber.Map{}), MAIN_LAYOUT)
 	}
 	return c.Render(INDEX_VIEW, fiber.Map{"BarnageUser": getBarnageUser(email), "ImageUploadRoute": IMAGE_ROUTE}, MAIN_LAYOUT)
 }
@@ -128,19 +201,3 @@ func logFiber(c *fiber.Ctx) error {
 	}
 	return err
 }
-
-func getTrustedProxies() []string {
-	commaSeparatedProxies := strings.ReplaceAll(os.Getenv("TRUSTED_PROXIES"), " ", "")
-	proxiesSlice := strings.Split(commaSeparatedProxies, ",")
-	proxiesSlice = append(proxiesSlice, "127.0.0.1")
-	proxiesSlice = append(proxiesSlice, "::1")
-	for i := range proxiesSlice {
-		if proxiesSlice[i] == "" {
-			continue
-		}
-		if net.ParseIP(proxiesSlice[i]) == nil {
-			panic(fmt.Errorf("IP Address \"%s\" is not valid! Double check your TRUSTED_PROXIES list.", proxiesSlice[i]))
-		}
-	}
-	return proxiesSlice
-}
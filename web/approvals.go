@@ -0,0 +1,309 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/events"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// where everyone's approval came from, lives in the data dir
+const APPROVALS_FILE = "approvals.json"
+
+// on the approve page, by is the admin's email
+const APPROVAL_ADMIN = "admin"
+const APPROVAL_CLI = "cli"
+
+// auto_approve_domains, by is the domain
+const APPROVAL_DOMAIN = "domain"
+
+// by is the invite's id
+const APPROVAL_INVITE = "invite"
+
+// a suspension with an end date ran out, by is empty
+const APPROVAL_SUSPENSION_ENDED = "suspension_ended"
+
+// where someone stands, everyone starts out pending
+const USER_PENDING = "pending"
+const USER_APPROVED = "approved"
+
+// images are kept but not handed out, they can still sign in to see why
+const USER_SUSPENDED = "suspended"
+
+// images are deleted & signing in is refused
+const USER_BANNED = "banned"
+
+// reasons are shown to whoever's suspended, keep them to a sentence or two
+const SUSPENSION_REASON_MAX = 300
+const SUSPENSION_CHECK_EVERY = time.Minute
+
+var approvalsFile = APPROVALS_FILE
+var approvals = map[string]ApprovalRecord{}
+var approvalsRWMutex = sync.RWMutex{}
+
+// lowercase & without the @, set on start & every reload
+var autoApproveDomains atomic.Pointer[[]string]
+
+func setAutoApproveDomains(barnConfig *config.Config) {
+	domains := []string{}
+	for _, domain := range barnConfig.AutoApproveDomains {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+	autoApproveDomains.Store(&domains)
+}
+
+func loadApprovals() error {
+	data, err := helpme.ReadFileVerified(approvalsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", approvalsFile, err)
+	}
+	loaded := map[string]ApprovalRecord{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", approvalsFile, err)
+	}
+	approvalsRWMutex.Lock()
+	defer approvalsRWMutex.Unlock()
+	approvals = loaded
+	hideSuspended(loaded)
+	return nil
+}
+
+// hideSuspended keeps suspended users' images out of the pool & fsck's way, called with approvals locked
+func hideSuspended(records map[string]ApprovalRecord) {
+	suspended := []string{}
+	for email, record := range records {
+		if record.UserState() == USER_SUSPENDED {
+			suspended = append(suspended, email)
+		}
+	}
+	filestore.SetHiddenUsers(suspended)
+}
+
+func approvalOf(email string) (ApprovalRecord, bool) {
+	approvalsRWMutex.RLock()
+	defer approvalsRWMutex.RUnlock()
+	record, exists := approvals[email]
+	return record, exists
+}
+
+// written straight through, approvals only change when someone acts. record's State, Source, By, Reason & Until are kept.
+func recordApproval(email string, record ApprovalRecord) (ApprovalRecord, error) {
+	approvalsRWMutex.Lock()
+	defer approvalsRWMutex.Unlock()
+	record.Approved = record.State == USER_APPROVED
+	record.At = time.Now()
+	updated := make(map[string]ApprovalRecord, len(approvals)+1)
+	for existing, existingRecord := range approvals {
+		updated[existing] = existingRecord
+	}
+	updated[email] = record
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return record, err
+	}
+	if err = helpme.WriteFileAtomic(approvalsFile, data, 0600); err != nil {
+		return record, fmt.Errorf("Failed to write %v: %v", approvalsFile, err)
+	}
+	approvals = updated
+	hideSuspended(updated)
+	return record, nil
+}
+
+// moveApproval hands from's record to to, for a guest becoming a regular account
+func moveApproval(from string, to string) error {
+	approvalsRWMutex.Lock()
+	defer approvalsRWMutex.Unlock()
+	record, exists := approvals[from]
+	if !exists {
+		return nil
+	}
+	updated := make(map[string]ApprovalRecord, len(approvals))
+	for existing, existingRecord := range approvals {
+		if existing != from {
+			updated[existing] = existingRecord
+		}
+	}
+	updated[to] = record
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if err = helpme.WriteFileAtomic(approvalsFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", approvalsFile, err)
+	}
+	approvals = updated
+	hideSuspended(updated)
+	return nil
+}
+
+// UserState is approved, suspended, or banned. Disapprovals from before there were states count as bans, their images were deleted too.
+func (record ApprovalRecord) UserState() string {
+	if record.State != "" {
+		return record.State
+	}
+	if record.Approved {
+		return USER_APPROVED
+	}
+	return USER_BANNED
+}
+
+// Describe says where an approval, suspension or ban came from the way the approve page & CLI show it
+func (record ApprovalRecord) Describe() string {
+	verb := record.UserState()
+	described := verb
+	switch record.Source {
+	case APPROVAL_ADMIN:
+		described = fmt.Sprintf("%v by %v", verb, record.By)
+	case APPROVAL_CLI:
+		described = fmt.Sprintf("%v from the CLI", verb)
+	case APPROVAL_DOMAIN:
+		described = fmt.Sprintf("%v for being at %v", verb, record.By)
+	case APPROVAL_INVITE:
+		if invite, exists := inviteById(record.By); exists && invite.Label != "" {
+			described = fmt.Sprintf("%v through invite %v", verb, invite.Label)
+		} else {
+			described = fmt.Sprintf("%v through invite %v", verb, record.By)
+		}
+	case APPROVAL_SUSPENSION_ENDED:
+		described = fmt.Sprintf("%v when their suspension ended", verb)
+	}
+	if !record.Until.IsZero() {
+		described += fmt.Sprintf(" until %v", record.Until.Local().Format(time.DateTime))
+	}
+	if record.Reason != "" {
+		described += fmt.Sprintf(": %v", record.Reason)
+	}
+	return described
+}
+
+// userState is where someone stands right now. Anyone without a record, or approved before approvals.json, goes by the approved users file.
+func userState(email string) string {
+	if isApproved, _ := barnage.fs.ApprovedUsers().Lookup(email); isApproved || email == AdminUserEmail {
+		return USER_APPROVED
+	}
+	if record, exists := approvalOf(email); exists && record.UserState() != USER_APPROVED {
+		return record.UserState()
+	}
+	return USER_PENDING
+}
+
+func isBanned(email string) bool {
+	record, exists := approvalOf(email)
+	return exists && record.UserState() == USER_BANNED
+}
+
+// suspensionOf is why & until when email is suspended, nil if they aren't
+func suspensionOf(email string) *ApprovalRecord {
+	if record, exists := approvalOf(email); exists && record.UserState() == USER_SUSPENDED {
+		return &record
+	}
+	return nil
+}
+
+// endSuspensions puts everyone whose suspension has run out back the way they were
+func endSuspensions(now time.Time) {
+	approvalsRWMutex.RLock()
+	ended := map[string]ApprovalRecord{}
+	for email, record := range approvals {
+		if record.UserState() == USER_SUSPENDED && !record.Until.IsZero() && !record.Until.After(now) {
+			ended[email] = record
+		}
+	}
+	approvalsRWMutex.RUnlock()
+	for email, suspension := range ended {
+		if err := endSuspension(email, suspension); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to end %v's suspension: %v", email, err))
+		}
+	}
+}
+
+// endSuspension only approves someone who was approved when they were suspended, anyone else is pending again
+func endSuspension(email string, suspension ApprovalRecord) error {
+	if suspension.Before == USER_APPROVED {
+		return approveUser(email, APPROVAL_SUSPENSION_ENDED, "", "")
+	}
+	record, err := recordApproval(email, ApprovalRecord{State: USER_PENDING, Source: APPROVAL_SUSPENSION_ENDED})
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Ended the suspension of %v, %v", email, record.Describe()))
+	recordAudit(AUDIT_SYSTEM, "", audit.USER_SUSPENSION_ENDED, email, record.Describe())
+	events.Publish(events.APPROVAL_CHANGED, email, map[string]string{"isApproved": "false", "state": USER_PENDING})
+	return nil
+}
+
+func suspensionsRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping suspensions routine.")
+				return
+			case <-time.After(SUSPENSION_CHECK_EVERY):
+				endSuspensions(time.Now())
+			}
+		}
+	}()
+}
+
+// approvalDomain is the auto approved domain email is at, if it's at one
+func approvalDomain(email string) (string, bool) {
+	domains := autoApproveDomains.Load()
+	at := strings.LastIndex(email, "@")
+	if domains == nil || at < 0 {
+		return "", false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range *domains {
+		if domain == allowed {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// autoApprove approves someone who just signed in through an invite, or with a verified address at an auto approved domain.
+//
+//	Nobody suspended or banned gets back in this way, & an invite isn't used up on someone already approved.
+func autoApprove(email string, inviteToken string, verified bool, ip string) {
+	if email == AdminUserEmail || barnage.fs.ApprovedUsers().IsApproved(email) {
+		return
+	}
+	if record, exists := approvalOf(email); exists && (record.UserState() == USER_SUSPENDED || record.UserState() == USER_BANNED) {
+		slog.Info(fmt.Sprintf("Not auto approving %v, they're %v", email, record.Describe()))
+		return
+	}
+	if inviteToken != "" {
+		invite, err := redeemInvite(inviteToken)
+		if err == nil {
+			if err = approveUser(email, APPROVAL_INVITE, invite.Id, ip); err == nil {
+				return
+			}
+		}
+		slog.Info(fmt.Sprintf("Couldn't approve %v through their invite: %v", email, err))
+	}
+	if domain, matches := approvalDomain(email); matches {
+		if !verified {
+			slog.Info(fmt.Sprintf("Not auto approving %v, Google hasn't verified the address", email))
+			return
+		}
+		if err := approveUser(email, APPROVAL_DOMAIN, domain, ip); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to auto approve %v: %v", email, err))
+		}
+	}
+}
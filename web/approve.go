@@ -7,16 +7,34 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/events"
 	"kmfg.dev/imagebarn/v1/filestore"
 	"kmfg.dev/imagebarn/v1/helpme"
 )
 
 type ViewApprovedUser struct {
-	Email      string
-	IsApproved bool
+	Email string
+	// what guests called themselves, empty for everyone else
+	Name string
+	// pending, approved, suspended, or banned
+	State string
+	// where the last approval, suspension or ban came from, empty if nobody has acted on them yet
+	Source string
+}
+
+func viewApprovedUser(email string) ViewApprovedUser {
+	return ViewApprovedUser{Email: email, Name: guestName(email), State: userState(email), Source: approvalSource(email)}
+}
+
+// Tomorrow is the earliest a suspension can end on, they end at the start of the day
+func (vau *ViewApprovedUser) Tomorrow() string {
+	return time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
 }
 
 func (vau *ViewApprovedUser) AdminUserEmail() string {
@@ -31,7 +49,12 @@ func RegisterApprover(barnage *BarnageWeb) {
 	approveRouter.Get("", showAll)
 	approveRouter.Post("", showAllSearch)
 	approveRouter.Put("/:email", approve)
-	barnage.fiber.Group("/disapprove").Use(adminCheckMiddleware).Put("/:email", disapprove)
+	barnage.fiber.Group("/suspend").Use(adminCheckMiddleware).Put("/:email", suspend)
+	barnage.fiber.Group("/ban").Use(adminCheckMiddleware).Put("/:email", ban)
+	barnage.fiber.Group("/convert").Use(adminCheckMiddleware).Put("/:email", convert)
+	// from before there were suspensions, it bans like `user disapprove` does
+	barnage.fiber.Group("/disapprove").Use(adminCheckMiddleware).Put("/:email", ban)
+	suspensionsRoutine(barnage.stopChan, barnage.wg)
 }
 
 func showAllSearch(c *fiber.Ctx) error {
@@ -47,6 +70,10 @@ func showAllSearch(c *fiber.Ctx) error {
 
 	for email := range copiedMap {
 		res := CompareTwoStringsOptimized(email, searchQuery)
+		// guests are searched by the name they picked
+		if name := guestName(email); name != "" {
+			res = max(res, CompareTwoStringsOptimized(name, searchQuery))
+		}
 		if res >= minLikeness {
 			emailScores = append(emailScores, helpme.Alike{String: email, Score: res})
 		}
@@ -64,10 +91,8 @@ func showAllSearch(c *fiber.Ctx) error {
 
 	matchedSlice := make([]*ViewApprovedUser, N)
 	for i := 0; i < N; i++ {
-		matchedSlice[i] = &ViewApprovedUser{
-			Email:      emailScores[i].String,
-			IsApproved: copiedMap[emailScores[i].String],
-		}
+		matched := viewApprovedUser(emailScores[i].String)
+		matchedSlice[i] = &matched
 	}
 
 	return c.Render(PARTIALS_APPROVE_VIEW, fiber.Map{
@@ -87,8 +112,8 @@ func showAll(c *fiber.Ctx) error {
 	copiedMap := barnage.fs.ApprovedUsers().CopyOfUsersMap()
 
 	approvedSlice := make([]ViewApprovedUser, 0, len(copiedMap))
-	for email, isApproved := range copiedMap {
-		approvedSlice = append(approvedSlice, ViewApprovedUser{Email: email, IsApproved: isApproved})
+	for email := range copiedMap {
+		approvedSlice = append(approvedSlice, viewApprovedUser(email))
 	}
 
 	sort.Slice(approvedSlice, func(i, j int) bool {
@@ -176,42 +201,187 @@ func approve(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if emailToApprove == AdminUserEmail {
+	adminEmail, _ := sessionEmail(c)
+	if err = approveUser(emailToApprove, APPROVAL_ADMIN, adminEmail, clientIP(c)); err != nil {
 		return c.SendStatus(400)
 	}
-	slog.Info(fmt.Sprintf("Approving %v", emailToApprove))
-	barnage.fs.ApprovedUsers().Approve(emailToApprove)
-	err = os.MkdirAll(fmt.Sprintf("./images/%v", filestore.Encode(emailToApprove)), 0700)
+	return showAllSearch(c)
+}
+
+// approveUser, suspendUser & banUser are shared by the approve page, the CLI & auto approval.
+// Where it came from is recorded first, nobody's state changes without it. ip is empty from the CLI.
+// Approving works from any state, a suspended user's images come back into the pool.
+func approveUser(email string, source string, by string, ip string) error {
+	if email == AdminUserEmail {
+		return fmt.Errorf("%v is ADMIN_USER, they're always approved", email)
+	}
+	record, err := recordApproval(email, ApprovalRecord{State: USER_APPROVED, Source: source, By: by})
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Approving %v, %v", email, record.Describe()))
+	recordAudit(approvalActor(email, source, by), ip, audit.USER_APPROVED, email, record.Describe())
+	barnage.fs.ApprovedUsers().Approve(email)
+	events.Publish(events.APPROVAL_CHANGED, email, map[string]string{"isApproved": "true", "state": USER_APPROVED})
+	err = os.MkdirAll(filestore.ImagePath(filestore.Encode(email), ""), 0700)
 	if err != nil {
 		slog.Debug(fmt.Sprintf("Couldn't make dir for new approved user: %v", err))
 	}
+	return nil
+}
+
+func suspend(c *fiber.Ctx) error {
+	emailToSuspend, err := obtainEmail(c)
+	if err != nil {
+		return err
+	}
+	until, err := parseSuspensionEnd(c.FormValue("until", ""))
+	if err != nil {
+		return c.SendStatus(400)
+	}
+	adminEmail, _ := sessionEmail(c)
+	if err = suspendUser(emailToSuspend, c.FormValue("reason", ""), until, APPROVAL_ADMIN, adminEmail, clientIP(c)); err != nil {
+		slog.Info(fmt.Sprintf("Couldn't suspend %v: %v", emailToSuspend, err))
+		return c.SendStatus(400)
+	}
+	return showAllSearch(c)
+}
+
+// parseSuspensionEnd is empty for no end, or a 2006-01-02 date the suspension ends at the start of
+func parseSuspensionEnd(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	until, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v isn't a date like 2006-01-02", value)
+	}
+	return until, nil
+}
+
+// suspendUser takes away approval & any promotion but keeps their images, hidden until they're approved again.
+// A zero until lasts until someone approves them.
+func suspendUser(email string, reason string, until time.Time, source string, by string, ip string) error {
+	if email == AdminUserEmail {
+		return fmt.Errorf("%v is ADMIN_USER, they can't be suspended", email)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return fmt.Errorf("Say why they're suspended, they'll see it")
+	}
+	if len(reason) > SUSPENSION_REASON_MAX {
+		return fmt.Errorf("Reasons can be at most %v characters", SUSPENSION_REASON_MAX)
+	}
+	if !until.IsZero() && !until.After(time.Now()) {
+		return fmt.Errorf("A suspension has to end in the future")
+	}
+	if isBanned(email) {
+		return fmt.Errorf("%v is banned, approve them before suspending them", email)
+	}
+	// changing a suspension keeps where it started from
+	before := userState(email)
+	if suspension := suspensionOf(email); suspension != nil {
+		before = suspension.Before
+	}
+	record, err := recordApproval(email, ApprovalRecord{State: USER_SUSPENDED, Source: source, By: by, Reason: reason, Until: until, Before: before})
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Suspending %v, %v", email, record.Describe()))
+	recordAudit(approvalActor(email, source, by), ip, audit.USER_SUSPENDED, email, record.Describe())
+	barnage.fs.ApprovedUsers().Disapprove(email)
+	events.Publish(events.APPROVAL_CHANGED, email, map[string]string{"isApproved": "false", "state": USER_SUSPENDED})
+	if err := setPromotedAdmin(email, false); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to demote %v: %v", email, err))
+	}
+	return nil
+}
+
+// convert turns the guest in the path into a regular account for the email in the form
+func convert(c *fiber.Ctx) error {
+	guestEmail, err := obtainEmail(c)
+	if err != nil {
+		return err
+	}
+	adminEmail, _ := sessionEmail(c)
+	if err = convertGuest(guestEmail, c.FormValue("email", ""), APPROVAL_ADMIN, adminEmail, clientIP(c)); err != nil {
+		slog.Info(fmt.Sprintf("Couldn't convert %v: %v", guestEmail, err))
+		return c.SendStatus(400)
+	}
 	return showAllSearch(c)
 }
 
-func disapprove(c *fiber.Ctx) error {
-	emailToDisapprove, err := obtainEmail(c)
+func ban(c *fiber.Ctx) error {
+	emailToBan, err := obtainEmail(c)
 	if err != nil {
 		return err
 	}
-	if emailToDisapprove == AdminUserEmail {
+	adminEmail, _ := sessionEmail(c)
+	if err = banUser(emailToBan, c.FormValue("reason", ""), APPROVAL_ADMIN, adminEmail, clientIP(c)); err != nil {
 		return c.SendStatus(400)
 	}
-	slog.Info(fmt.Sprintf("Disapproving %v", emailToDisapprove))
-	barnage.fs.ApprovedUsers().Disapprove(emailToDisapprove)
-	if err := filestore.DeleteAll(emailToDisapprove); err != nil {
-		slog.Warn(fmt.Sprintf("Failed to remove dir for %v: %v", emailToDisapprove, err))
+	return showAllSearch(c)
+}
+
+// banning also takes away any promotion, deletes their images & signs them out everywhere. They can't sign in again until they're approved.
+func banUser(email string, reason string, source string, by string, ip string) error {
+	if email == AdminUserEmail {
+		return fmt.Errorf("%v is ADMIN_USER, they can't be banned", email)
+	}
+	reason = strings.TrimSpace(reason)
+	if len(reason) > SUSPENSION_REASON_MAX {
+		return fmt.Errorf("Reasons can be at most %v characters", SUSPENSION_REASON_MAX)
+	}
+	record, err := recordApproval(email, ApprovalRecord{State: USER_BANNED, Source: source, By: by, Reason: reason})
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Banning %v, %v", email, record.Describe()))
+	recordAudit(approvalActor(email, source, by), ip, audit.USER_BANNED, email, record.Describe())
+	barnage.fs.ApprovedUsers().Disapprove(email)
+	events.Publish(events.APPROVAL_CHANGED, email, map[string]string{"isApproved": "false", "state": USER_BANNED})
+	if err := setPromotedAdmin(email, false); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to demote %v: %v", email, err))
+	}
+	if err := filestore.DeleteAll(email); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to remove dir for %v: %v", email, err))
 	} else {
-		slog.Info(fmt.Sprintf("Removed %v images", emailToDisapprove))
+		slog.Info(fmt.Sprintf("Removed %v images", email))
 	}
-	return showAllSearch(c)
+	InvalidateJwt(email)
+	return nil
+}
+
+// approvalActor is who the audit log says did it, someone approved through an invite or their domain did it themselves
+func approvalActor(email string, source string, by string) string {
+	switch source {
+	case APPROVAL_ADMIN:
+		return by
+	case APPROVAL_CLI:
+		return APPROVAL_CLI
+	case APPROVAL_SUSPENSION_ENDED:
+		return AUDIT_SYSTEM
+	}
+	return email
+}
+
+func approvalSource(email string) string {
+	if record, exists := approvalOf(email); exists {
+		return record.Describe()
+	}
+	if guest, exists := guestByEmail(email); exists {
+		return fmt.Sprintf("joined as a guest through invite %v", guest.InviteId)
+	}
+	return ""
 }
 
 func adminCheckMiddleware(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
+	email, valid := sessionEmail(c)
 	if !valid {
 		return fmt.Errorf("Invalid JWT!")
 	}
-	if email != AdminUserEmail {
+	if !isAdminEmail(email) {
 		return c.SendStatus(403)
 	}
 	return c.Next()
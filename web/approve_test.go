@@ -0,0 +1,153 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+func TestSuspendingHidesImagesAndBanningKeepsThemOut(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	useAuditDir(t)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	run("user", "approve", "guest@gmail.com")
+	if state := userState("stranger@gmail.com"); state != USER_PENDING {
+		t.Errorf("Someone who never signed in is %v", state)
+	}
+	if _, exists := barnage.fs.ApprovedUsers().Lookup("stranger@gmail.com"); exists {
+		t.Error("Asking for someone's state added them to the approved users")
+	}
+	image := filestore.ImagePath(filestore.Encode("guest@gmail.com"), "sunset.webp")
+	if err = os.WriteFile(image, []byte("webp"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run("user", "suspend", "guest@gmail.com", "2", "Posted", "the", "same", "meme")
+	if _, err = os.Stat(image); err != nil || !filestore.IsHidden("guest@gmail.com") {
+		t.Fatalf("Suspending didn't keep their image hidden: %v", err)
+	}
+	if users := run("user", "list"); !strings.Contains(users, "suspended") || !strings.Contains(users, ": Posted the same meme") {
+		t.Errorf("user list doesn't show the suspension:\n%v", users)
+	}
+	if suspension := suspensionOf("guest@gmail.com"); suspension == nil || suspension.Until.Before(time.Now().Add(47*time.Hour)) {
+		t.Errorf("The suspension doesn't end in 2 days: %+v", suspension)
+	}
+	autoApprove("guest@gmail.com", "", true, "")
+	if userState("guest@gmail.com") != USER_SUSPENDED {
+		t.Error("Signing in again ended a suspension")
+	}
+
+	endSuspensions(time.Now())
+	if userState("guest@gmail.com") != USER_SUSPENDED {
+		t.Fatal("A suspension ended early")
+	}
+	endSuspensions(time.Now().Add(72 * time.Hour))
+	if userState("guest@gmail.com") != USER_APPROVED || filestore.IsHidden("guest@gmail.com") {
+		t.Fatal("A suspension that ran out wasn't ended")
+	}
+	if record, _ := approvalOf("guest@gmail.com"); approvalActor("guest@gmail.com", record.Source, record.By) != AUDIT_SYSTEM {
+		t.Errorf("The audit log says someone other than the server ended it: %+v", record)
+	}
+	if err = barnage.fs.StoreApprovedUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone suspended before anyone approved them is only pending again
+	barnage.fs.ApprovedUsers().IsApproved("newcomer@gmail.com")
+	if err = suspendUser("newcomer@gmail.com", "Spam", time.Now().Add(time.Hour), APPROVAL_CLI, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = suspendUser("newcomer@gmail.com", "More spam", time.Now().Add(2*time.Hour), APPROVAL_CLI, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	endSuspensions(time.Now().Add(3 * time.Hour))
+	if state := userState("newcomer@gmail.com"); state != USER_PENDING || barnage.fs.ApprovedUsers().IsApproved("newcomer@gmail.com") {
+		t.Fatalf("A suspension of someone who was pending ended with them %v", state)
+	}
+	if listed := run("audit", "list", "target=newcomer@gmail.com"); !strings.Contains(listed, audit.USER_SUSPENSION_ENDED) || strings.Contains(listed, audit.USER_APPROVED) {
+		t.Errorf("The audit log doesn't show the suspension ending without approving them:\n%v", listed)
+	}
+	// & they can still be let in like anyone else who's pending
+	invite, err := createInvite("Second chance", "admin@mysite.com", time.Hour, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	autoApprove("newcomer@gmail.com", invite.Token, true, "")
+	if state := userState("newcomer@gmail.com"); state != USER_APPROVED {
+		t.Errorf("An invite didn't approve someone whose suspension ended while pending, they're %v", state)
+	}
+
+	for _, bad := range []struct {
+		reason string
+		until  time.Time
+	}{{"  ", time.Time{}}, {"Spam", time.Now().Add(-time.Hour)}, {strings.Repeat("a", SUSPENSION_REASON_MAX+1), time.Time{}}} {
+		if err = suspendUser("guest@gmail.com", bad.reason, bad.until, APPROVAL_CLI, "", ""); err == nil {
+			t.Errorf("Suspended with reason %q until %v", bad.reason, bad.until)
+		}
+	}
+	if err = suspendUser("admin@mysite.com", "Spam", time.Time{}, APPROVAL_CLI, "", ""); err == nil {
+		t.Error("ADMIN_USER was suspended")
+	}
+
+	run("user", "ban", "guest@gmail.com", "Spam")
+	if _, err = os.Stat(filepath.Dir(image)); !os.IsNotExist(err) {
+		t.Errorf("Banning kept their images: %v", err)
+	}
+	if err = suspendUser("guest@gmail.com", "Spam", time.Time{}, APPROVAL_CLI, "", ""); err == nil {
+		t.Error("Suspending a banned user took the ban off")
+	}
+	if listed := run("audit", "list", "target=guest@gmail.com"); !strings.Contains(listed, audit.USER_SUSPENDED) || !strings.Contains(listed, audit.USER_BANNED) {
+		t.Errorf("The audit log is missing the suspension or ban:\n%v", listed)
+	}
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html")})
+	app.Get("/sign-in/:email", func(c *fiber.Ctx) error {
+		return finishSignIn(c, c.Params("email"), "", true, "in a test")
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/sign-in/guest@gmail.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 403 || len(resp.Cookies()) != 0 {
+		t.Errorf("A banned user signed in, got %v %v", resp.StatusCode, resp.Cookies())
+	}
+
+	run("user", "approve", "guest@gmail.com")
+	if resp, err = app.Test(httptest.NewRequest("GET", "/sign-in/guest@gmail.com", nil)); err != nil || resp.StatusCode != 200 {
+		t.Errorf("Approving didn't lift the ban, got %v %v", resp.StatusCode, err)
+	}
+
+	// disapprovals from before there were states were bans, their images were deleted too
+	if state := (ApprovalRecord{Approved: false, Source: APPROVAL_ADMIN}).UserState(); state != USER_BANNED {
+		t.Errorf("An old disapproval is %v", state)
+	}
+}
@@ -0,0 +1,319 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+// lives in the data dir, one JSON object per line & only ever appended to
+const AUDIT_FILE = "audit.jsonl"
+
+const AUDIT_ROUTE = "/audit"
+const PARTIALS_AUDIT_VIEW = BASE_PARTIAL + "/audit"
+
+// the page shows the newest this many, exports have everything that matches
+const AUDIT_VIEW_LIMIT = 200
+
+// how often entries past retention are dropped
+const AUDIT_PRUNE_EVERY = 24 * time.Hour
+
+const AUDIT_FORMAT_JSONL = "jsonl"
+const AUDIT_FORMAT_CSV = "csv"
+
+// the actor for anything done with an API key is key:<name>
+const API_KEY_NAME_LOCAL = "apiKeyName"
+
+// the actor for what the server does on its own, like scheduled rotations
+const AUDIT_SYSTEM = "imagebarn"
+
+// requests turned away for a wrong key or CSRF token are recorded one by one up to these each minute,
+// past them they're only counted & summed up in one entry, so a flood doesn't become a flood of fsyncs
+const AUDIT_REJECTIONS_PER_IP = 5
+const AUDIT_REJECTIONS_PER_MINUTE = 60
+const AUDIT_REJECTIONS_EVERY = 1 * time.Minute
+
+var auditLog = audit.Open(AUDIT_FILE)
+
+// this minute's rejections, by IP & the ones that weren't recorded by action then IP
+var (
+	rejectionsMutex      = sync.Mutex{}
+	rejectionsRecorded   = 0
+	rejectionsByIp       = map[string]int{}
+	unrecordedRejections = map[string]map[string]int{}
+)
+
+// 0 keeps everything, can change on a config reload
+var auditRetention atomic.Int64
+
+func applyAuditRetention(barnConfig *config.Config) {
+	auditRetention.Store(int64(barnConfig.AuditRetention))
+}
+
+func RegisterAudit(barnage *BarnageWeb) {
+	auditRouter := barnage.fiber.Group(AUDIT_ROUTE)
+	auditRouter.Use(adminCheckMiddleware)
+	auditRouter.Get("", showAudit)
+	auditRouter.Get("/export.:format", exportAudit)
+	auditPruneRoutine(barnage.stopChan, barnage.wg)
+	rejectionsRoutine(barnage.stopChan, barnage.wg)
+}
+
+// recordAudit never fails what's being recorded, a log that can't be written is only warned about
+func recordAudit(actor string, ip string, action string, target string, detail string) {
+	err := auditLog.Record(audit.Entry{Actor: actor, Action: action, Target: target, Ip: ip, Detail: detail})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to write %v to the audit log: %v", action, err))
+	}
+}
+
+// auditRequest records who's signed in on c, or the API key or display making it
+func auditRequest(c *fiber.Ctx, action string, target string, detail string) {
+	recordAudit(requestActor(c), clientIP(c), action, target, detail)
+}
+
+// auditRejection records a request that was turned away, unless its IP or everyone has hit this minute's limit
+func auditRejection(c *fiber.Ctx, action string, detail string) {
+	ip := clientIP(c)
+	rejectionsMutex.Lock()
+	rejectionsByIp[ip]++
+	record := rejectionsByIp[ip] <= AUDIT_REJECTIONS_PER_IP && rejectionsRecorded < AUDIT_REJECTIONS_PER_MINUTE
+	if record {
+		rejectionsRecorded++
+	} else {
+		if unrecordedRejections[action] == nil {
+			unrecordedRejections[action] = map[string]int{}
+		}
+		unrecordedRejections[action][ip]++
+	}
+	rejectionsMutex.Unlock()
+	if record {
+		recordAudit(requestActor(c), ip, action, "", detail)
+	}
+}
+
+// flushRejections sums up what wasn't recorded in one entry per action, from the IP with the most, & starts a new minute
+func flushRejections() {
+	rejectionsMutex.Lock()
+	unrecorded := unrecordedRejections
+	rejectionsRecorded = 0
+	rejectionsByIp = map[string]int{}
+	unrecordedRejections = map[string]map[string]int{}
+	rejectionsMutex.Unlock()
+
+	for action, byIp := range unrecorded {
+		total, topIp := 0, ""
+		for ip, count := range byIp {
+			total += count
+			if topIp == "" || count > byIp[topIp] {
+				topIp = ip
+			}
+		}
+		recordAudit(AUDIT_SYSTEM, topIp, action, "", fmt.Sprintf("%v more weren't recorded one by one, from %v IPs, %v from this one", total, len(byIp), byIp[topIp]))
+	}
+}
+
+func rejectionsRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopChan:
+				flushRejections()
+				slog.Info("Safely stopping audit rejections routine.")
+				return
+			case <-time.After(AUDIT_REJECTIONS_EVERY):
+				flushRejections()
+			}
+		}
+	}()
+}
+
+func auditCli(action string, target string, detail string) {
+	recordAudit(APPROVAL_CLI, "", action, target, detail)
+}
+
+func requestActor(c *fiber.Ctx) string {
+	if name, isKey := c.Locals(API_KEY_NAME_LOCAL).(string); isKey {
+		return "key:" + name
+	}
+	if email, valid := sessionEmail(c); valid {
+		return email
+	}
+	if _, valid := getKioskSettingsFromJWT(c.Cookies(KIOSK_COOKIE, "")); valid {
+		return "kiosk"
+	}
+	return ""
+}
+
+// pruneAudit drops entries past retention, recording that it did as actor
+func pruneAudit(actor string) (int, error) {
+	retention := time.Duration(auditRetention.Load())
+	if retention <= 0 {
+		return 0, nil
+	}
+	dropped, err := auditLog.Prune(time.Now().Add(-retention))
+	if err == nil && dropped > 0 {
+		slog.Info(fmt.Sprintf("Dropped %v audit log entries older than %v", dropped, retention))
+		recordAudit(actor, "", audit.AUDIT_PRUNED, "", fmt.Sprintf("%v entries older than %v", dropped, retention))
+	}
+	return dropped, err
+}
+
+func auditPruneRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			if _, err := pruneAudit(AUDIT_SYSTEM); err != nil {
+				slog.Warn(fmt.Sprintf("Failed to prune the audit log!: %v", err))
+			}
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping audit log routine.")
+				return
+			case <-time.After(AUDIT_PRUNE_EVERY):
+			}
+		}
+	}()
+}
+
+// parseAuditFilter reads actor, action, target, since, until & limit, shared by the page & the CLI.
+// Dates are 2006-01-02 or RFC 3339, until a bare date takes in the whole day.
+func parseAuditFilter(get func(key string) string) (audit.Filter, error) {
+	filter := audit.Filter{
+		Actor:  strings.TrimSpace(get("actor")),
+		Action: strings.TrimSpace(get("action")),
+		Target: strings.TrimSpace(get("target")),
+	}
+	if filter.Action != "" && !isAuditAction(filter.Action) {
+		return filter, fmt.Errorf("Unknown action \"%v\"", filter.Action)
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(get("since"), false); err != nil {
+		return filter, fmt.Errorf("since %v", err)
+	}
+	if filter.Until, err = parseAuditTime(get("until"), true); err != nil {
+		return filter, fmt.Errorf("until %v", err)
+	}
+	if limit := strings.TrimSpace(get("limit")); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("limit must be a whole number, got \"%v\"", limit)
+		}
+	}
+	return filter, nil
+}
+
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		if endOfDay {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must look like 2006-01-02 or 2006-01-02T15:04:05Z, got \"%v\"", value)
+	}
+	return parsed, nil
+}
+
+func isAuditAction(action string) bool {
+	for _, known := range audit.ACTIONS {
+		if action == known {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAudit writes entries as jsonl or csv
+func writeAudit(w io.Writer, format string, entries []audit.Entry) error {
+	switch format {
+	case AUDIT_FORMAT_JSONL:
+		return audit.WriteJsonl(w, entries)
+	case AUDIT_FORMAT_CSV:
+		return audit.WriteCsv(w, entries)
+	}
+	return fmt.Errorf("Unknown format \"%v\", use %v or %v", format, AUDIT_FORMAT_JSONL, AUDIT_FORMAT_CSV)
+}
+
+func showAudit(c *fiber.Ctx) error {
+	bind := fiber.Map{
+		"Actions": audit.ACTIONS,
+		// exports take the same filters, minus the page's limit
+		"JsonlExport": auditExportLink(c, AUDIT_FORMAT_JSONL),
+		"CsvExport":   auditExportLink(c, AUDIT_FORMAT_CSV),
+		"Actor":       c.Query("actor"),
+		"Action":      c.Query("action"),
+		"Target":      c.Query("target"),
+		"Since":       c.Query("since"),
+		"Until":       c.Query("until"),
+	}
+	filter, err := parseAuditFilter(func(key string) string { return c.Query(key) })
+	if err != nil {
+		bind["Error"] = err.Error()
+		return c.Render(PARTIALS_AUDIT_VIEW, bind)
+	}
+	filter.Limit = AUDIT_VIEW_LIMIT
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return err
+	}
+	bind["Entries"] = entries
+	bind["Limited"] = len(entries) == AUDIT_VIEW_LIMIT
+	return c.Render(PARTIALS_AUDIT_VIEW, bind)
+}
+
+func auditExportLink(c *fiber.Ctx, format string) string {
+	query := url.Values{}
+	for _, key := range []string{"actor", "action", "target", "since", "until"} {
+		if value := c.Query(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	link := fmt.Sprintf("%v/export.%v", AUDIT_ROUTE, format)
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
+
+func exportAudit(c *fiber.Ctx) error {
+	format := c.Params("format", "")
+	if format != AUDIT_FORMAT_JSONL && format != AUDIT_FORMAT_CSV {
+		return c.SendStatus(404)
+	}
+	filter, err := parseAuditFilter(func(key string) string { return c.Query(key) })
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return err
+	}
+	// exporting is itself worth knowing about, the log names everyone who signed in
+	auditRequest(c, audit.AUDIT_EXPORTED, "", fmt.Sprintf("%v entries as %v", len(entries), format))
+	contentType := "application/x-ndjson"
+	if format == AUDIT_FORMAT_CSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Attachment(fmt.Sprintf("imagebarn-audit-%v.%v", time.Now().Format("2006-01-02"), format))
+	return writeAudit(c, format, entries)
+}
@@ -0,0 +1,162 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+// useAuditDir keeps what a test records out of the source tree
+func useAuditDir(t *testing.T) {
+	oldAuditLog := auditLog
+	auditLog = audit.Open(filepath.Join(t.TempDir(), AUDIT_FILE))
+	t.Cleanup(func() { auditLog = oldAuditLog })
+	// & starts every test on a fresh minute of rejections
+	rejectionsMutex.Lock()
+	rejectionsRecorded, rejectionsByIp, unrecordedRejections = 0, map[string]int{}, map[string]map[string]int{}
+	rejectionsMutex.Unlock()
+}
+
+func TestRejectionFloodsAreSummedUp(t *testing.T) {
+	useAuditDir(t)
+	setTrustedProxies([]string{"0.0.0.0"})
+	defer setTrustedProxies([]string{})
+
+	app := fiber.New()
+	app.Use(csrfMiddleware)
+	app.Post(LOGOUT_ROUTE, logout)
+	reject := func(ip string) {
+		req := httptest.NewRequest("POST", LOGOUT_ROUTE, nil)
+		req.Header.Set(fiber.HeaderXForwardedFor, ip)
+		if resp, err := app.Test(req); err != nil || resp.StatusCode != 403 {
+			t.Fatalf("A forged request from %v got %v %v", ip, resp.StatusCode, err)
+		}
+	}
+	for range 20 {
+		reject("198.51.100.1")
+	}
+	for i := range AUDIT_REJECTIONS_PER_MINUTE {
+		reject(fmt.Sprintf("203.0.113.%v", i))
+	}
+
+	entries, _ := auditLog.Query(audit.Filter{Action: audit.CSRF_REJECTED})
+	if len(entries) != AUDIT_REJECTIONS_PER_MINUTE {
+		t.Fatalf("Wanted %v rejections recorded before the minute's up, got %v", AUDIT_REJECTIONS_PER_MINUTE, len(entries))
+	}
+	flushRejections()
+	entries, _ = auditLog.Query(audit.Filter{Action: audit.CSRF_REJECTED, Actor: AUDIT_SYSTEM})
+	if len(entries) != 1 || entries[0].Ip != "198.51.100.1" || entries[0].Detail != "20 more weren't recorded one by one, from 6 IPs, 15 from this one" {
+		t.Fatalf("The rest were summed up as %+v", entries)
+	}
+
+	// a new minute records again
+	reject("198.51.100.1")
+	flushRejections()
+	if entries, _ = auditLog.Query(audit.Filter{Action: audit.CSRF_REJECTED}); len(entries) != AUDIT_REJECTIONS_PER_MINUTE+2 {
+		t.Errorf("Wanted one more rejection & no empty summary, got %v entries", len(entries))
+	}
+}
+
+func TestAuditRecordsAdminActions(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	run("user", "approve", "guest@gmail.com")
+	run("user", "ban", "guest@gmail.com")
+	run("invite", "create", "1", "0", "Reunion")
+	run("key", "create", "lobby")
+
+	listed := run("audit", "list", "target=guest@")
+	if !strings.Contains(listed, audit.USER_APPROVED) || !strings.Contains(listed, audit.USER_BANNED) || strings.Contains(listed, audit.INVITE_CREATED) {
+		t.Errorf("Filtering by target listed:\n%v", listed)
+	}
+	if listed = run("audit", "list", "actor=cli", "action="+audit.API_KEY_CREATED); !strings.Contains(listed, "lobby") {
+		t.Errorf("Key creation wasn't recorded:\n%v", listed)
+	}
+	for _, bad := range [][]string{{"who=me"}, {"action=user"}, {"since=yesterday"}, {"limit=-1"}} {
+		if err := RunOffline(barnConfig, ControlRequest{Args: append([]string{"audit", "list"}, bad...)}, io.Discard); err == nil {
+			t.Errorf("Accepted filter %v", bad)
+		}
+	}
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html")})
+	app.Use(csrfMiddleware)
+	app.Get(AUDIT_ROUTE, showAudit)
+	app.Get(AUDIT_ROUTE+"/export.:format", exportAudit)
+	app.Post(LOGOUT_ROUTE, logout)
+	get := func(path string) (*http.Response, string) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// turned away requests are recorded too
+	resp, err := app.Test(httptest.NewRequest("POST", LOGOUT_ROUTE, nil))
+	if err != nil || resp.StatusCode != 403 {
+		t.Fatalf("Logout without a CSRF token got %v %v", resp.StatusCode, err)
+	}
+	if entries, _ := auditLog.Query(audit.Filter{Action: audit.CSRF_REJECTED}); len(entries) != 1 || entries[0].Ip == "" || entries[0].Detail != "POST "+LOGOUT_ROUTE {
+		t.Errorf("CSRF rejection recorded as %+v", entries)
+	}
+
+	resp, body := get(AUDIT_ROUTE + "?action=" + audit.USER_APPROVED)
+	if resp.StatusCode != 200 || !strings.Contains(body, "guest@gmail.com") || strings.Contains(body, "Reunion") {
+		t.Fatalf("The page got %v:\n%v", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, `href="/audit/export.csv?action=user.approved"`) {
+		t.Errorf("Export links don't carry the filter:\n%v", body)
+	}
+	if _, body = get(AUDIT_ROUTE + "?since=nope"); !strings.Contains(body, "since must look like") {
+		t.Errorf("A bad date didn't say so:\n%v", body)
+	}
+
+	resp, body = get(AUDIT_ROUTE + "/export.csv?target=guest%40gmail.com")
+	if resp.StatusCode != 200 || !strings.Contains(resp.Header.Get(fiber.HeaderContentDisposition), ".csv") {
+		t.Fatalf("CSV export got %v %v", resp.StatusCode, resp.Header)
+	}
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil || len(rows) != 3 || rows[1][2] != audit.USER_BANNED || rows[2][2] != audit.USER_APPROVED {
+		t.Errorf("CSV export has %v %v", rows, err)
+	}
+	if _, body = get(AUDIT_ROUTE + "/export.jsonl"); strings.Count(body, "\n") < 5 {
+		t.Errorf("JSONL export is missing entries:\n%v", body)
+	}
+	if resp, _ = get(AUDIT_ROUTE + "/export.xml"); resp.StatusCode != 404 {
+		t.Errorf("Unknown export format got %v", resp.StatusCode)
+	}
+	if entries, _ := auditLog.Query(audit.Filter{Action: audit.AUDIT_EXPORTED}); len(entries) != 2 {
+		t.Errorf("Exports weren't recorded, got %+v", entries)
+	}
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/backup"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/helpme"
+	"kmfg.dev/imagebarn/v1/webhook"
+)
+
+// every state file a backup carries, each is checked by parsing it into what loads it
+var backupStateFiles = map[string]func(data []byte) error{
+	filestore.APPROVED_USERS_FILE: func(data []byte) error { return json.Unmarshal(data, &map[string]bool{}) },
+	ISSUED_VERSION_FILE:           func(data []byte) error { return json.Unmarshal(data, &map[string]int{}) },
+	SESSIONS_FILE:                 func(data []byte) error { return json.Unmarshal(data, &map[string]*SessionFamily{}) },
+	ADMINS_FILE:                   func(data []byte) error { return json.Unmarshal(data, &[]string{}) },
+	API_KEYS_FILE:                 func(data []byte) error { return json.Unmarshal(data, &map[string]StoredApiKey{}) },
+	WEBHOOKS_FILE:                 func(data []byte) error { return json.Unmarshal(data, &[]webhook.Webhook{}) },
+	APPROVALS_FILE:                func(data []byte) error { return json.Unmarshal(data, &map[string]ApprovalRecord{}) },
+	INVITES_FILE:                  func(data []byte) error { return json.Unmarshal(data, &[]Invite{}) },
+	GUESTS_FILE:                   func(data []byte) error { return json.Unmarshal(data, &map[string]Guest{}) },
+	AUDIT_FILE:                    audit.Check,
+	SIGNING_KEYS_FILE: func(data []byte) error {
+		_, err := parseSigningKeys(data)
+		return err
+	},
+	// only in backups from before signing keys rotated, it's moved into SIGNING_KEYS_FILE on start
+	KEY_FILE: func(data []byte) error {
+		_, err := decodePrivateKeyFromPEM(data)
+		return err
+	},
+}
+
+// writeBackup archives the state & images at path. Uploads, ghosting & deletes only pause while the images are linked.
+func writeBackup(path string, passphrase string, out io.Writer) error {
+	snapshotDir := barnage.config.DataPath(fmt.Sprintf(".backup-%v", time.Now().UnixNano()))
+	defer os.RemoveAll(snapshotDir)
+	snapshotImagesDir := filepath.Join(snapshotDir, filestore.IMAGES_DIR_NAME)
+
+	var state map[string][]byte
+	err := filestore.Snapshot(snapshotImagesDir, func() error {
+		var err error
+		state, err = stateSnapshot()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to snapshot the data dir: %v", err)
+	}
+
+	tmpPath := path + helpme.TEMP_SUFFIX
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+	archive, err := backup.NewWriter(file, passphrase)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = archive.AddBytes(name, state[name]); err != nil {
+			return err
+		}
+	}
+	images := 0
+	err = filepath.WalkDir(snapshotImagesDir, func(imagePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(snapshotDir, imagePath)
+		if err != nil {
+			return err
+		}
+		images++
+		return archive.AddFile(filepath.ToSlash(relPath), imagePath)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	encrypted := ""
+	if passphrase != "" {
+		encrypted = ", encrypted"
+	}
+	fmt.Fprintf(out, "Backed up %v state files & %v images to %v%v\n", len(state), images, path, encrypted)
+	return nil
+}
+
+// stateSnapshot is the state as it is in memory right now, the files can be a couple seconds behind
+func stateSnapshot() (map[string][]byte, error) {
+	state := map[string][]byte{}
+	var err error
+	if state[filestore.APPROVED_USERS_FILE], err = json.Marshal(barnage.fs.ApprovedUsers().CopyOfUsersMap()); err != nil {
+		return nil, err
+	}
+	issuedVersionRWMutex.RLock()
+	state[ISSUED_VERSION_FILE], err = json.Marshal(issuedVersion)
+	issuedVersionRWMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	sessionsRWMutex.RLock()
+	state[SESSIONS_FILE], err = json.Marshal(sessionFamilies)
+	sessionsRWMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the rest are written straight through, so the files are current
+	for _, name := range []string{ADMINS_FILE, API_KEYS_FILE, WEBHOOKS_FILE, SIGNING_KEYS_FILE, APPROVALS_FILE, INVITES_FILE, GUESTS_FILE} {
+		data, err := helpme.ReadFileVerified(barnage.config.DataPath(name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		state[name] = data
+	}
+	// appended to rather than written atomically, so it has no checksum
+	data, err := auditLog.Snapshot()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		state[AUDIT_FILE] = data
+	}
+	return state, nil
+}
+
+// Restore checks a backup then loads it into the data dir, which has to be fresh. Only call it while holding LOCK_FILE.
+func Restore(barnConfig *config.Config, archivePath string, passphrase string, out io.Writer) error {
+	for name := range backupStateFiles {
+		if _, err := os.Stat(barnConfig.DataPath(name)); err == nil {
+			return fmt.Errorf("%v already has %v, restore only goes into a fresh data dir", barnConfig.DataDir, name)
+		}
+	}
+	imagesDir := barnConfig.DataPath(filestore.IMAGES_DIR_NAME)
+	if dir, err := os.ReadDir(imagesDir); err == nil && len(dir) > 0 {
+		return fmt.Errorf("%v already has images, restore only goes into a fresh data dir", barnConfig.DataDir)
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stagingDir := barnConfig.DataPath(fmt.Sprintf(".restore-%v", time.Now().UnixNano()))
+	defer os.RemoveAll(stagingDir)
+	manifest, err := backup.Extract(file, passphrase, stagingDir)
+	if err != nil {
+		return err
+	}
+
+	// check everything before moving anything, a bad backup leaves the data dir as it was
+	state := map[string][]byte{}
+	for name := range manifest.Files {
+		// images/<encoded email>/<encoded file>
+		if parts := strings.Split(name, "/"); len(parts) == 3 && parts[0] == filestore.IMAGES_DIR_NAME {
+			continue
+		}
+		check, known := backupStateFiles[name]
+		if !known {
+			return fmt.Errorf("Backup holds %v, which this ImageBarn doesn't know", name)
+		}
+		data, err := os.ReadFile(filepath.Join(stagingDir, name))
+		if err != nil {
+			return err
+		}
+		if err = check(data); err != nil {
+			return fmt.Errorf("Backup's %v is unusable: %v", name, err)
+		}
+		state[name] = data
+	}
+
+	for name, data := range state {
+		if name == KEY_FILE || name == AUDIT_FILE {
+			err = os.WriteFile(barnConfig.DataPath(name), data, 0600)
+		} else {
+			err = helpme.WriteFileAtomic(barnConfig.DataPath(name), data, 0600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	images := len(manifest.Files) - len(state)
+	if images > 0 {
+		os.Remove(imagesDir)
+		if err = os.Rename(filepath.Join(stagingDir, filestore.IMAGES_DIR_NAME), imagesDir); err != nil {
+			return err
+		}
+	}
+	// empty folders don't make it into a backup, approved users still need theirs
+	approvedUsers := map[string]bool{}
+	json.Unmarshal(state[filestore.APPROVED_USERS_FILE], &approvedUsers)
+	for email, isApproved := range approvedUsers {
+		if isApproved {
+			if err = os.MkdirAll(filepath.Join(imagesDir, filestore.Encode(email)), 0700); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(out, "Restored %v state files & %v images from a backup taken %v\n", len(state), images, manifest.Created.Local().Format(time.DateTime))
+	return nil
+}
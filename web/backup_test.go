@@ -0,0 +1,65 @@
+package web
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+func TestBackupRestoresIntoFreshDataDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data dir stays "." so the filestore globals point somewhere harmless for later tests
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args, Passphrase: "hunter2"}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	run("user", "approve", "guest@gmail.com")
+	run("key", "create", "fridge")
+	if err = os.WriteFile(filestore.ImagePath(filestore.Encode("guest@gmail.com"), filestore.Encode("cow.png")), []byte("moo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	run("backup", "barn.tgz", "encrypt")
+
+	restored := *barnConfig
+	restored.DataDir = "restored"
+	if err = Restore(&restored, "barn.tgz", "hunter2", &bytes.Buffer{}); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	image, err := os.ReadFile(filepath.Join("restored", "images", filestore.Encode("guest@gmail.com"), filestore.Encode("cow.png")))
+	if err != nil || string(image) != "moo" {
+		t.Fatalf("Image didn't come back: %v", err)
+	}
+	for _, name := range []string{filestore.APPROVED_USERS_FILE, API_KEYS_FILE, SIGNING_KEYS_FILE} {
+		original, _ := helpme.ReadFileVerified(name)
+		restoredFile, err := helpme.ReadFileVerified(filepath.Join("restored", name))
+		if err != nil {
+			t.Fatalf("%v didn't come back: %v", name, err)
+		}
+		if !bytes.Equal(original, restoredFile) {
+			t.Fatalf("%v changed:\n%s\n%s", name, original, restoredFile)
+		}
+	}
+
+	if err = Restore(&restored, "barn.tgz", "hunter2", &bytes.Buffer{}); err == nil {
+		t.Fatal("Restored over a data dir that's in use")
+	}
+}
@@ -0,0 +1,129 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+// both live in the data dir. The server holds the lock for as long as it runs,
+// CLI commands go through the socket then so they never write over the server's state.
+const CONTROL_SOCKET = "imagebarn.sock"
+const LOCK_FILE = "imagebarn.lock"
+
+// how long one CLI command may take over the socket
+const CONTROL_TIMEOUT = 30 * time.Second
+
+// one command at a time, same as if someone typed them one after another
+var controlMutex = sync.Mutex{}
+
+// serveControl runs CLI commands sent over the control socket until stopChan closes.
+//
+//	Only call it while holding LOCK_FILE, a leftover socket is removed first.
+func serveControl(barnConfig *config.Config, stopChan chan struct{}, wg *sync.WaitGroup) error {
+	socketPath := barnConfig.DataPath(CONTROL_SOCKET)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove old control socket: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on control socket: %v", err)
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("Failed to restrict control socket: %v", err)
+	}
+
+	go func() {
+		<-stopChan
+		listener.Close()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("Safely stopping control socket.")
+				return
+			}
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Control socket accept failed: %v", err))
+				continue
+			}
+			go handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	var request ControlRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		slog.Warn(fmt.Sprintf("Bad control request: %v", err))
+		return
+	}
+	slog.Info(fmt.Sprintf("Running CLI command: %v", request.Args))
+
+	output := bytes.Buffer{}
+	controlMutex.Lock()
+	err := RunAdminCommand(request, &output)
+	controlMutex.Unlock()
+
+	response := ControlResponse{Output: output.String()}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if err = json.NewEncoder(conn).Encode(response); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to answer control request: %v", err))
+	}
+}
+
+// SendAdminCommand runs a CLI command inside the running server
+func SendAdminCommand(barnConfig *config.Config, request ControlRequest, out io.Writer) error {
+	conn, err := net.DialTimeout("unix", barnConfig.DataPath(CONTROL_SOCKET), CONTROL_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("The server holds the data dir but its control socket isn't answering: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	var response ControlResponse
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("No answer from the server: %v", err)
+	}
+	fmt.Fprint(out, response.Output)
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// RunOffline runs a CLI command straight against the data dir, only while holding LOCK_FILE
+func RunOffline(barnConfig *config.Config, request ControlRequest, out io.Writer) error {
+	// fsck is how you find out what's broken, it reports the state files itself
+	if err := openState(barnConfig); err != nil && (len(request.Args) == 0 || request.Args[0] != "fsck") {
+		return err
+	}
+	barnage = &BarnageWeb{config: barnConfig, fs: filestore.NewFilestore(barnConfig, &sync.WaitGroup{})}
+
+	err := RunAdminCommand(request, out)
+	// the server's store routines aren't running, write whatever changed now
+	return errors.Join(err, barnage.fs.StoreApprovedUsers(), storeIssuedVersions(), storeSessions())
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+// browsers cache a preflight this many seconds
+const CORS_MAX_AGE = "600"
+const CORS_ALLOWED_HEADERS = "Authorization, Content-Type"
+
+var corsPolicy atomic.Pointer[config.CorsConfig]
+
+// set on start & every reload, origins are compared lowercase. Our own pages are always allowed.
+func setCorsPolicy(barnConfig *config.Config) {
+	policy := config.CorsConfig{AllowedOrigins: []string{}, KeyOrigins: map[string][]string{}}
+	if base, err := url.Parse(barnConfig.BaseUri); err == nil && base.Host != "" {
+		policy.AllowedOrigins = append(policy.AllowedOrigins, strings.ToLower(base.Scheme+"://"+base.Host))
+	}
+	for _, origin := range barnConfig.Cors.AllowedOrigins {
+		policy.AllowedOrigins = append(policy.AllowedOrigins, strings.ToLower(origin))
+	}
+	for name, origins := range barnConfig.Cors.KeyOrigins {
+		for _, origin := range origins {
+			policy.KeyOrigins[name] = append(policy.KeyOrigins[name], strings.ToLower(origin))
+		}
+	}
+	corsPolicy.Store(&policy)
+}
+
+// corsOrigin is what Access-Control-Allow-Origin should say to origin, false when it may not call the API.
+//
+//	An empty keyName is a preflight, which can't carry the key yet, so any key allowing origin is enough.
+func corsOrigin(origin string, keyName string) (string, bool) {
+	policy := corsPolicy.Load()
+	if policy == nil {
+		return "", false
+	}
+	origin = strings.ToLower(origin)
+	allowed := slices.Clone(policy.AllowedOrigins)
+	if keyName == "" {
+		for _, origins := range policy.KeyOrigins {
+			allowed = append(allowed, origins...)
+		}
+	} else {
+		allowed = append(allowed, policy.KeyOrigins[keyName]...)
+	}
+	switch {
+	case slices.Contains(allowed, origin):
+		return origin, true
+	case slices.Contains(allowed, "*"):
+		return "*", true
+	}
+	return "", false
+}
+
+// corsPreflight answers OPTIONS for /api with the methods the route really has. The rest goes on to the key check.
+func corsPreflight(methods map[string]string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		origin := c.Get(fiber.HeaderOrigin)
+		if c.Method() != fiber.MethodOptions || origin == "" || c.Get(fiber.HeaderAccessControlRequestMethod) == "" {
+			return c.Next()
+		}
+		c.Vary(fiber.HeaderOrigin)
+		method, exists := methods[c.Path()]
+		if !exists {
+			return c.SendStatus(404)
+		}
+		allowOrigin, allowed := corsOrigin(origin, "")
+		if !allowed || c.Get(fiber.HeaderAccessControlRequestMethod) != method {
+			slog.Debug(fmt.Sprintf("Refused a preflight from %v for %v %v", origin, c.Get(fiber.HeaderAccessControlRequestMethod), c.Path()))
+			return c.SendStatus(403)
+		}
+		c.Set(fiber.HeaderAccessControlAllowOrigin, allowOrigin)
+		c.Set(fiber.HeaderAccessControlAllowMethods, method)
+		c.Set(fiber.HeaderAccessControlAllowHeaders, CORS_ALLOWED_HEADERS)
+		c.Set(fiber.HeaderAccessControlMaxAge, CORS_MAX_AGE)
+		return c.SendStatus(204)
+	}
+}
+
+// allowCors lets the response through to a page on another origin if keyName may be used from it.
+// Requests that aren't cross origin don't send Origin & are always fine.
+func allowCors(c *fiber.Ctx, keyName string) bool {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	c.Vary(fiber.HeaderOrigin)
+	allowOrigin, allowed := corsOrigin(origin, keyName)
+	if !allowed {
+		return false
+	}
+	c.Set(fiber.HeaderAccessControlAllowOrigin, allowOrigin)
+	return true
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+// a display's page on another origin calling /api, the handlers just say ok
+func newCorsApp(t *testing.T, allowedOrigins []string) *fiber.App {
+	useAuditDir(t)
+	barnConfig := config.Default()
+	barnConfig.BaseUri = "https://barn.example"
+	barnConfig.BearerToken = "default-token"
+	barnConfig.ApiKeys = map[string]string{"lobby": "lobby-token"}
+	barnConfig.Cors = config.CorsConfig{
+		AllowedOrigins: allowedOrigins,
+		KeyOrigins:     map[string][]string{"lobby": {"https://Lobby.example"}},
+	}
+	oldKeys, oldPolicy := configApiKeys.Load(), corsPolicy.Load()
+	t.Cleanup(func() {
+		configApiKeys.Store(oldKeys)
+		corsPolicy.Store(oldPolicy)
+	})
+	setApiKeys(barnConfig)
+	setCorsPolicy(barnConfig)
+
+	app := fiber.New()
+	apiRouter := app.Group(API_ROUTE)
+	apiRouter.Use(corsPreflight(API_METHODS))
+	apiRouter.Use(authHeaderMiddleware)
+	ok := func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	}
+	apiRouter.Get("/image", ok)
+	apiRouter.Post("/display/pair", ok)
+	return app
+}
+
+func corsRequest(t *testing.T, app *fiber.App, method string, path string, origin string, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set(fiber.HeaderOrigin, origin)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestPreflightsOnlyAllowKnownOriginsAndRealMethods(t *testing.T) {
+	app := newCorsApp(t, []string{"https://frame.example"})
+	preflight := func(origin string, path string, method string) *http.Response {
+		return corsRequest(t, app, "OPTIONS", path, origin, map[string]string{
+			fiber.HeaderAccessControlRequestMethod:  method,
+			fiber.HeaderAccessControlRequestHeaders: "authorization",
+		})
+	}
+
+	resp := preflight("https://lobby.example", API_IMAGE_ROUTE, "GET")
+	if resp.StatusCode != 204 || resp.Header.Get(fiber.HeaderAccessControlAllowOrigin) != "https://lobby.example" ||
+		resp.Header.Get(fiber.HeaderAccessControlAllowMethods) != "GET" || resp.Header.Get(fiber.HeaderAccessControlAllowHeaders) != CORS_ALLOWED_HEADERS {
+		t.Fatalf("Expected the lobby's preflight allowed, got %v %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get(fiber.HeaderAccessControlAllowCredentials) != "" {
+		t.Fatal("Credentials are never needed, the key is in a header")
+	}
+	if resp = preflight("https://frame.example", API_PAIR_ROUTE, "POST"); resp.StatusCode != 204 || resp.Header.Get(fiber.HeaderAccessControlAllowMethods) != "POST" {
+		t.Fatalf("Expected pairing allowed from a global origin, got %v %v", resp.StatusCode, resp.Header)
+	}
+
+	for name, resp := range map[string]*http.Response{
+		"unknown origin":  preflight("https://evil.example", API_IMAGE_ROUTE, "GET"),
+		"made up method":  preflight("https://lobby.example", API_IMAGE_ROUTE, "DELETE"),
+		"the other route": preflight("https://lobby.example", API_PAIR_ROUTE, "GET"),
+	} {
+		if resp.StatusCode != 403 || resp.Header.Get(fiber.HeaderAccessControlAllowOrigin) != "" {
+			t.Fatalf("Preflight with %v was allowed: %v %v", name, resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+func TestBrowserDisplaysAreHeldToTheirKeysOrigins(t *testing.T) {
+	app := newCorsApp(t, []string{"https://frame.example"})
+	withKey := func(token string) map[string]string {
+		return map[string]string{fiber.HeaderAuthorization: "Bearer " + token}
+	}
+
+	resp := corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://lobby.example", withKey("lobby-token"))
+	if resp.StatusCode != 200 || resp.Header.Get(fiber.HeaderAccessControlAllowOrigin) != "https://lobby.example" || resp.Header.Get(fiber.HeaderVary) != fiber.HeaderOrigin {
+		t.Fatalf("Expected the lobby display through, got %v %v", resp.StatusCode, resp.Header)
+	}
+	// the lobby's origin is only for the lobby's key
+	if resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://lobby.example", withKey("default-token")); resp.StatusCode != 403 {
+		t.Fatalf("Default key was used from the lobby's origin: %v", resp.StatusCode)
+	}
+	for _, token := range []string{"default-token", "lobby-token"} {
+		if resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://frame.example", withKey(token)); resp.StatusCode != 200 {
+			t.Fatalf("Global origin refused for %v: %v", token, resp.StatusCode)
+		}
+	}
+	if resp = corsRequest(t, app, "POST", API_PAIR_ROUTE, "https://barn.example", withKey("default-token")); resp.StatusCode != 200 {
+		t.Fatalf("Our own pages were refused: %v", resp.StatusCode)
+	}
+	if resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://evil.example", withKey("lobby-token")); resp.StatusCode != 403 {
+		t.Fatalf("A stolen key worked from another page: %v", resp.StatusCode)
+	}
+	if resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://lobby.example", nil); resp.StatusCode != 401 {
+		t.Fatalf("No key should still be a 401, got %v", resp.StatusCode)
+	}
+
+	// displays that aren't browsers don't send an Origin
+	resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "", withKey("default-token"))
+	if resp.StatusCode != 200 || resp.Header.Get(fiber.HeaderAccessControlAllowOrigin) != "" {
+		t.Fatalf("Expected a plain response, got %v %v", resp.StatusCode, resp.Header)
+	}
+
+	app = newCorsApp(t, []string{"*"})
+	resp = corsRequest(t, app, "GET", API_IMAGE_ROUTE, "https://anywhere.example", withKey("default-token"))
+	if resp.StatusCode != 200 || resp.Header.Get(fiber.HeaderAccessControlAllowOrigin) != "*" {
+		t.Fatalf("Expected * to allow anywhere, got %v %v", resp.StatusCode, resp.Header)
+	}
+}
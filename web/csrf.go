@@ -0,0 +1,69 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+)
+
+// double submit, the page reads the cookie & sends it back in the header. Other sites can send the cookie but can't read it.
+const CSRF_COOKIE = "csrf"
+const CSRF_HEADER = "X-Csrf-Token"
+
+// plain html forms can't set headers, they send it as a hidden field instead
+const CSRF_FORM_FIELD = "_csrf"
+const CSRF_LOCAL = "csrf"
+const CSRF_TOKEN_BYTES = 32
+
+// csrfCookieName gets the __Host- prefix over https, so a subdomain can't plant its own token
+func csrfCookieName() string {
+	if isSecure {
+		return "__Host-" + CSRF_COOKIE
+	}
+	return CSRF_COOKIE
+}
+
+// csrfMiddleware hands every browser a token & turns away state changing requests that don't send it back.
+//
+//	Requests with an Authorization header are left alone, a browser won't attach one for another site.
+func csrfMiddleware(c *fiber.Ctx) error {
+	token := c.Cookies(csrfCookieName(), "")
+	if token == "" {
+		var err error
+		if token, err = randomToken(CSRF_TOKEN_BYTES); err != nil {
+			return fmt.Errorf("Failed to make a CSRF token: %v", err)
+		}
+		c.Cookie(&fiber.Cookie{
+			Name:     csrfCookieName(),
+			Value:    token,
+			Path:     "/",
+			Expires:  time.Now().Add(sessionLifetime),
+			Secure:   isSecure,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	c.Locals(CSRF_LOCAL, token)
+
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, fiber.MethodTrace:
+		return c.Next()
+	}
+	if c.Get(fiber.HeaderAuthorization) != "" {
+		return c.Next()
+	}
+	sent := c.Get(CSRF_HEADER)
+	if sent == "" && strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm) {
+		sent = c.FormValue(CSRF_FORM_FIELD)
+	}
+	if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(c.Cookies(csrfCookieName(), ""))) != 1 {
+		slog.Warn(fmt.Sprintf("Turned away a %v %v from %v without a matching CSRF token", c.Method(), c.Path(), clientIP(c)))
+		auditRejection(c, audit.CSRF_REJECTED, c.Method()+" "+c.Path())
+		return c.SendStatus(403)
+	}
+	return c.Next()
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newCsrfApp(t *testing.T) *fiber.App {
+	useAuditDir(t)
+	app := fiber.New()
+	app.Use(csrfMiddleware)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString("hi")
+	})
+	changed := func(c *fiber.Ctx) error {
+		return c.SendString("changed")
+	}
+	app.Post("/change", changed)
+	app.Delete("/change", changed)
+	return app
+}
+
+func TestForgedRequestsAreTurnedAway(t *testing.T) {
+	app := newCsrfApp(t)
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ""
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == csrfCookieName() {
+			token = cookie.Value
+			if cookie.SameSite != http.SameSiteLaxMode || cookie.HttpOnly {
+				t.Fatalf("Expected a Lax cookie the page can read, got %+v", cookie)
+			}
+		}
+	}
+	if token == "" {
+		t.Fatal("No CSRF cookie handed out")
+	}
+
+	// the browser attaches every cookie, but another origin can't read the token to put it in the header
+	forged := func(method string, body string, header string) *http.Request {
+		req := httptest.NewRequest(method, "/change", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderOrigin, "https://evil.example")
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: ACCESS_COOKIE, Value: "signed-in"})
+		req.AddCookie(&http.Cookie{Name: csrfCookieName(), Value: token})
+		if header != "" {
+			req.Header.Set(CSRF_HEADER, header)
+		}
+		return req
+	}
+	for name, req := range map[string]*http.Request{
+		"no token":         forged("POST", "email=me", ""),
+		"guessed token":    forged("DELETE", "", "guessed"),
+		"guessed field":    forged("POST", url.Values{CSRF_FORM_FIELD: {"guessed"}}.Encode(), ""),
+		"empty everywhere": forged("POST", CSRF_FORM_FIELD+"=", ""),
+	} {
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 403 {
+			t.Fatalf("Forged request with %v got %v", name, resp.StatusCode)
+		}
+	}
+
+	for name, req := range map[string]*http.Request{
+		"header":     forged("DELETE", "", token),
+		"form field": forged("POST", url.Values{CSRF_FORM_FIELD: {token}}.Encode(), ""),
+	} {
+		req.Header.Del(fiber.HeaderOrigin)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Same origin request with the token in the %v got %v", name, resp.StatusCode)
+		}
+	}
+
+	// bearer token clients carry no ambient credentials
+	req := httptest.NewRequest("POST", "/change", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer whatever")
+	if resp, err = app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Bearer request was turned away: %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/mailer"
+)
+
+// where the form posts, links are /auth/email/<token>
+const EMAIL_SIGN_IN_ROUTE = "/auth/email"
+const EMAIL_SIGN_IN_VIEW = BASE_VIEW + "/email-sign-in"
+const EMAIL_LINK_TOKEN_BYTES = 32
+
+// one link per address this often, so nobody can flood someone's inbox from the sign in form
+const EMAIL_LINK_COOLDOWN = 1 * time.Minute
+
+// the longest an address can be, RFC 5321
+const EMAIL_MAX_LENGTH = 254
+
+const EMAIL_LINK_SUBJECT = "Your ImageBarn sign in link"
+
+var emailMailer *mailer.Mailer
+var emailLinkLifetime time.Duration
+
+// sha256 of the token -> link, so a heap dump can't be used to sign in
+var emailLinks = map[string]EmailLink{}
+var emailLinksMutex = sync.Mutex{}
+
+// RegisterEmailSignIn does nothing unless email.smtp_host is set
+func RegisterEmailSignIn(barnage *BarnageWeb) {
+	emailConfig := barnage.config.Email
+	if emailConfig.SmtpHost == "" {
+		return
+	}
+	sender, err := mailer.New(mailer.Config{
+		Host:     emailConfig.SmtpHost,
+		Port:     emailConfig.SmtpPort,
+		Username: emailConfig.Username,
+		Password: emailConfig.Password,
+		From:     emailConfig.From,
+		Security: emailConfig.Security,
+	})
+	if err != nil {
+		panic(fmt.Errorf("Unable to send sign in links! Double check your email config: %v", err))
+	}
+	emailMailer = sender
+	emailLinkLifetime = emailConfig.LinkLifetime
+
+	barnage.fiber.Post(EMAIL_SIGN_IN_ROUTE, limiter.New(limiter.Config{
+		Max:               5,
+		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+	}), sendEmailLink)
+	barnage.fiber.Get(EMAIL_SIGN_IN_ROUTE+"/:token", confirmEmailLink)
+	barnage.fiber.Post(EMAIL_SIGN_IN_ROUTE+"/:token", useEmailLink)
+}
+
+// what every signed out page needs to show the sign in options
+func signedOutBind(c *fiber.Ctx, bind fiber.Map) fiber.Map {
+	bind["EmailSignIn"] = emailMailer != nil
+	bind["CsrfToken"] = c.Locals(CSRF_LOCAL)
+	return bind
+}
+
+func hashEmailLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// cleanSignInEmail is the address lowercased, or why it can't sign in
+func cleanSignInEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email || len(email) > EMAIL_MAX_LENGTH {
+		return "", fmt.Errorf("That doesn't look like an email address")
+	}
+	// guests have made up addresses, nobody can receive mail at them
+	if filestore.IsGuest(email) {
+		return "", fmt.Errorf("That address can't be used to sign in")
+	}
+	return email, nil
+}
+
+// createEmailLink is the token to mail out, empty when one already went to that address in the last EMAIL_LINK_COOLDOWN
+func createEmailLink(email string, inviteToken string) (string, error) {
+	token, err := randomToken(EMAIL_LINK_TOKEN_BYTES)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	emailLinksMutex.Lock()
+	defer emailLinksMutex.Unlock()
+	for hash, link := range emailLinks {
+		if !now.Before(link.Expires) {
+			delete(emailLinks, hash)
+		} else if link.Email == email && now.Sub(link.Created) < EMAIL_LINK_COOLDOWN {
+			return "", nil
+		}
+	}
+	emailLinks[hashEmailLinkToken(token)] = EmailLink{Email: email, Created: now, Expires: now.Add(emailLinkLifetime), InviteToken: inviteToken}
+	return token, nil
+}
+
+func forgetEmailLink(token string) {
+	emailLinksMutex.Lock()
+	defer emailLinksMutex.Unlock()
+	delete(emailLinks, hashEmailLinkToken(token))
+}
+
+// peekEmailLink doesn't use the link up, mail scanners open links before people do
+func peekEmailLink(token string) (EmailLink, bool) {
+	emailLinksMutex.Lock()
+	defer emailLinksMutex.Unlock()
+	link, exists := emailLinks[hashEmailLinkToken(token)]
+	return link, exists && time.Now().Before(link.Expires)
+}
+
+// takeEmailLink uses the link up, it works once
+func takeEmailLink(token string) (EmailLink, bool) {
+	emailLinksMutex.Lock()
+	defer emailLinksMutex.Unlock()
+	hash := hashEmailLinkToken(token)
+	link, exists := emailLinks[hash]
+	delete(emailLinks, hash)
+	return link, exists && time.Now().Before(link.Expires)
+}
+
+// e.g. 15 minutes, links never last more than an hour
+func emailLinkLifetimeText() string {
+	return fmt.Sprintf("%v minutes", int(emailLinkLifetime.Minutes()))
+}
+
+func emailLinkBody(link string) string {
+	return fmt.Sprintf("Someone, hopefully you, asked to sign in to ImageBarn with this address.\n\n"+
+		"Open this link to sign in, it works once & only for the next %v:\n\n%v\n\n"+
+		"If it wasn't you, there's nothing to do, nobody gets in without the link.\n", emailLinkLifetimeText(), link)
+}
+
+// sendEmailLink says the same thing whether or not a link went out, so the form can't be used to flood anyone
+func sendEmailLink(c *fiber.Ctx) error {
+	email, err := cleanSignInEmail(c.FormValue("email", ""))
+	if err != nil {
+		return c.Status(400).Render(EMAIL_SIGN_IN_VIEW, signedOutBind(c, fiber.Map{"Error": err.Error()}), MAIN_LAYOUT)
+	}
+	if isBanned(email) {
+		slog.Info(fmt.Sprintf("Not mailing a sign in link to %v, they're banned", email))
+		return c.Render(EMAIL_SIGN_IN_VIEW, fiber.Map{"Sent": email, "Lifetime": emailLinkLifetimeText()}, MAIN_LAYOUT)
+	}
+	// the link may be opened in another browser than the invite cookie is in, so it carries the invite too
+	inviteToken := utils.CopyString(c.Cookies(INVITE_COOKIE, ""))
+	token, err := createEmailLink(email, inviteToken)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		if err = emailMailer.Send(email, EMAIL_LINK_SUBJECT, emailLinkBody(baseUri+EMAIL_SIGN_IN_ROUTE+"/"+token)); err != nil {
+			forgetEmailLink(token)
+			slog.Error(fmt.Sprintf("Failed to mail a sign in link to %v: %v", email, err))
+			return c.Status(503).Render(EMAIL_SIGN_IN_VIEW, signedOutBind(c, fiber.Map{"Error": "Couldn't send the email, try again in a bit!"}), MAIN_LAYOUT)
+		}
+		slog.Info(fmt.Sprintf("Mailed a sign in link to %v", email))
+		recordAudit("", clientIP(c), audit.EMAIL_LINK_SENT, email, "")
+	}
+	return c.Render(EMAIL_SIGN_IN_VIEW, fiber.Map{"Sent": email, "Lifetime": emailLinkLifetimeText()}, MAIN_LAYOUT)
+}
+
+// confirmEmailLink is one button that posts back, only a person pressing it uses the link up
+func confirmEmailLink(c *fiber.Ctx) error {
+	token := utils.CopyString(c.Params("token", ""))
+	link, valid := peekEmailLink(token)
+	if !valid {
+		return c.Status(404).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This link has expired or already been used, ask for a new one!"}, MAIN_LAYOUT)
+	}
+	return c.Render(EMAIL_SIGN_IN_VIEW, fiber.Map{"Confirm": link.Email, "Token": token, "CsrfToken": c.Locals(CSRF_LOCAL)}, MAIN_LAYOUT)
+}
+
+func useEmailLink(c *fiber.Ctx) error {
+	link, valid := takeEmailLink(utils.CopyString(c.Params("token", "")))
+	if !valid {
+		return c.Status(404).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This link has expired or already been used, ask for a new one!"}, MAIN_LAYOUT)
+	}
+	inviteToken := takeInviteCookie(c)
+	if inviteToken == "" {
+		inviteToken = link.InviteToken
+	}
+	// getting the link proves the address is theirs
+	return finishSignIn(c, link.Email, inviteToken, true, "with an email link")
+}
@@ -0,0 +1,150 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/mailer"
+	"kmfg.dev/imagebarn/v1/mailer/mailertest"
+)
+
+func TestEmailLinksSignInOnce(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	lines := strings.Split(strings.TrimSpace(run("invite", "create", "1", "0", "Reunion")), "\n")
+	inviteToken := strings.TrimPrefix(lines[len(lines)-1], barnConfig.BaseUri+INVITE_ROUTE+"/")
+
+	server := mailertest.NewServer(t)
+	if emailMailer, err = mailer.New(mailer.Config{Host: server.Host, Port: server.Port, From: "ImageBarn <barn@mysite.com>", Security: mailer.SECURITY_NONE}); err != nil {
+		t.Fatal(err)
+	}
+	emailLinkLifetime = 15 * time.Minute
+	defer func() { emailMailer = nil }()
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html")})
+	app.Post(EMAIL_SIGN_IN_ROUTE, sendEmailLink)
+	app.Get(EMAIL_SIGN_IN_ROUTE+"/:token", confirmEmailLink)
+	app.Post(EMAIL_SIGN_IN_ROUTE+"/:token", useEmailLink)
+	request := func(method string, path string, form url.Values, cookies ...*http.Cookie) (*http.Response, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	linkPattern := regexp.MustCompile(regexp.QuoteMeta(barnConfig.BaseUri+EMAIL_SIGN_IN_ROUTE) + `/(\S+)`)
+	linkIn := func(message mailertest.Message) string {
+		body, err := message.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := linkPattern.FindStringSubmatch(body)
+		if found == nil {
+			t.Fatalf("No link in the mail:\n%v", body)
+		}
+		return EMAIL_SIGN_IN_ROUTE + "/" + found[1]
+	}
+
+	for _, bad := range []string{"not an address", "Someone <guest@gmail.com>", "guest-abc@guest.invalid"} {
+		if resp, _ := request("POST", EMAIL_SIGN_IN_ROUTE, url.Values{"email": {bad}}); resp.StatusCode != 400 {
+			t.Errorf("%q got %v", bad, resp.StatusCode)
+		}
+	}
+
+	if resp, body := request("POST", EMAIL_SIGN_IN_ROUTE, url.Values{"email": {" Guest@Gmail.com "}}); resp.StatusCode != 200 || !strings.Contains(body, "Check your email") {
+		t.Fatalf("Asking for a link got %v:\n%v", resp.StatusCode, body)
+	}
+	message := server.Next(t)
+	if len(message.To) != 1 || message.To[0] != "guest@gmail.com" {
+		t.Errorf("Mailed the wrong address: %v", message.To)
+	}
+	link := linkIn(message)
+	// asking again right away doesn't send another
+	request("POST", EMAIL_SIGN_IN_ROUTE, url.Values{"email": {"guest@gmail.com"}})
+	if server.Pending() != 0 {
+		t.Error("Sent a second link inside the cooldown")
+	}
+
+	// scanners open links before people do, that can't use it up
+	for i := 0; i < 2; i++ {
+		if resp, body := request("GET", link, nil); resp.StatusCode != 200 || !strings.Contains(body, "Sign in as guest@gmail.com") {
+			t.Fatalf("Opening the link got %v:\n%v", resp.StatusCode, body)
+		}
+	}
+	resp, _ := request("POST", link, nil)
+	signedIn := false
+	for _, cookie := range resp.Cookies() {
+		signedIn = signedIn || (cookie.Name == ACCESS_COOKIE && cookie.Value != "")
+	}
+	if resp.StatusCode != 200 || !signedIn {
+		t.Fatalf("Using the link got %v without a session cookie", resp.StatusCode)
+	}
+	if barnage.fs.ApprovedUsers().IsApproved("guest@gmail.com") {
+		t.Error("Signing in by email approved someone without an admin")
+	}
+	if resp, _ = request("POST", link, nil); resp.StatusCode != 404 {
+		t.Errorf("A used link worked again, got %v", resp.StatusCode)
+	}
+
+	// the invite comes along even when the link is opened in another browser
+	request("POST", EMAIL_SIGN_IN_ROUTE, url.Values{"email": {"cousin@gmail.com"}}, &http.Cookie{Name: INVITE_COOKIE, Value: inviteToken})
+	link = linkIn(server.Next(t))
+	if resp, _ = request("POST", link, nil); resp.StatusCode != 200 || !barnage.fs.ApprovedUsers().IsApproved("cousin@gmail.com") {
+		t.Errorf("Signing in by email through an invite didn't approve them, got %v", resp.StatusCode)
+	}
+
+	// links stop working once they expire
+	emailLinksMutex.Lock()
+	emailLinks = map[string]EmailLink{}
+	emailLinksMutex.Unlock()
+	token, err := createEmailLink("late@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailLinksMutex.Lock()
+	expired := emailLinks[hashEmailLinkToken(token)]
+	expired.Expires = time.Now().Add(-time.Second)
+	emailLinks[hashEmailLinkToken(token)] = expired
+	emailLinksMutex.Unlock()
+	if resp, _ = request("GET", EMAIL_SIGN_IN_ROUTE+"/"+token, nil); resp.StatusCode != 404 {
+		t.Errorf("An expired link got %v", resp.StatusCode)
+	}
+	if resp, _ = request("POST", EMAIL_SIGN_IN_ROUTE+"/"+token, nil); resp.StatusCode != 404 {
+		t.Errorf("An expired link signed someone in, got %v", resp.StatusCode)
+	}
+}
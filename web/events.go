@@ -0,0 +1,107 @@
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+const EVENTS_ROUTE = "/events"
+
+// keeps proxies from closing idle streams & lets us notice signed out users
+const SSE_HEARTBEAT = 15 * time.Second
+
+func RegisterEvents(barnage *BarnageWeb) {
+	barnage.fiber.Get(EVENTS_ROUTE, streamEvents)
+}
+
+// streams the events of the signed in user to one of their tabs
+//
+//	approval isn't required, awaiting users listen for their approval here
+func streamEvents(c *fiber.Ctx) error {
+	claims, valid := currentSession(c)
+	if !valid {
+		return c.SendStatus(401)
+	}
+	email, familyId := claims.Subject, claims.Family
+
+	// the access token expires long before a tab is closed, the session is what counts
+	isStillValid := func() bool {
+		return sessionFamilyAlive(familyId, email) && claims.Version == currentVersion(email)
+	}
+	return streamSSE(c, isStillValid, func(event events.Event) (string, string, bool) {
+		if event.Email != email {
+			return "", "", false
+		}
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to marshal %v event for %v: %v", event.Type, email, err))
+			return "", "", false
+		}
+		return string(event.Type), string(data), true
+	})
+}
+
+// streamSSE subscribes to the event bus until the client leaves, the server stops, or isStillValid fails.
+//
+//	render decides whether an event goes out, and as what name & single line data.
+//	Anything passed as initial is written right after connecting.
+func streamSSE(c *fiber.Ctx, isStillValid func() bool, render func(events.Event) (string, string, bool), initial ...[2]string) error {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	// nginx buffers responses by default, which holds events back
+	c.Set("X-Accel-Buffering", "no")
+
+	stopChan := barnage.stopChan
+	path := utils.CopyString(c.Path())
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		eventChan, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+		heartbeat := time.NewTicker(SSE_HEARTBEAT)
+		defer heartbeat.Stop()
+
+		fmt.Fprint(w, ": connected\n\n")
+		for _, nameAndData := range initial {
+			writeSSE(w, nameAndData[0], nameAndData[1])
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-heartbeat.C:
+				if !isStillValid() {
+					return
+				}
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case event, ok := <-eventChan:
+				if !ok {
+					return
+				}
+				name, data, send := render(event)
+				if !send {
+					continue
+				}
+				writeSSE(w, name, data)
+			}
+			if err := w.Flush(); err != nil {
+				slog.Debug(fmt.Sprintf("Event stream %v closed: %v", path, err))
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func writeSSE(w *bufio.Writer, name string, data string) {
+	fmt.Fprintf(w, "event: %v\ndata: %v\n\n", name, data)
+}
@@ -0,0 +1,25 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestEventStreamsNeedASession(t *testing.T) {
+	app := newSessionApp(t)
+	app.Get(EVENTS_ROUTE, streamEvents)
+
+	resp, err := app.Test(httptest.NewRequest("GET", EVENTS_ROUTE, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 401 || resp.Header.Get(fiber.HeaderContentType) == "text/event-stream" {
+		t.Errorf("Streamed events without a session, got %v", resp.StatusCode)
+	}
+	resp, _ = sessionRequest(t, app, EVENTS_ROUTE, map[string]string{ACCESS_COOKIE: "not-a-jwt"})
+	if resp.StatusCode != 401 {
+		t.Errorf("Streamed events with a bad access token, got %v", resp.StatusCode)
+	}
+}
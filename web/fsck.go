@@ -0,0 +1,99 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// a state file that fails its checksum, repairing restores it from the backup
+const FSCK_CORRUPT = "corrupt"
+
+// fsck checks the state files, then the images dir
+func fsck(repair bool) ([]filestore.FsckIssue, error) {
+	issues := []filestore.FsckIssue{}
+	for _, file := range []string{barnage.config.DataPath(filestore.APPROVED_USERS_FILE), issuedVersionFile, sessionsFile, adminsFile, apiKeysFile, signingKeysFile, approvalsFile, invitesFile, guestsFile} {
+		err := helpme.VerifyFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			issue := filestore.FsckIssue{Kind: FSCK_CORRUPT, Path: file, Detail: err.Error()}
+			if repair {
+				if err := helpme.RestoreBackup(file); err != nil {
+					issue.Detail = fmt.Sprintf("%v, repair failed: %v", issue.Detail, err)
+				} else {
+					issue.Repaired = true
+				}
+			}
+			issues = append(issues, issue)
+		}
+		// a write that died before its rename, the next write starts over anyway
+		if _, err := os.Stat(file + helpme.TEMP_SUFFIX); err == nil {
+			issue := filestore.FsckIssue{Kind: filestore.FSCK_STRAY, Path: file + helpme.TEMP_SUFFIX, Detail: "unfinished write"}
+			issue.Repaired = repair && os.Remove(issue.Path) == nil
+			issues = append(issues, issue)
+		}
+	}
+
+	imageIssues, err := barnage.fs.Fsck(repair)
+	if err != nil {
+		return nil, err
+	}
+	return append(issues, imageIssues...), nil
+}
+
+// runFsck is `imagebarn fsck`, it fails when anything is left unrepaired
+func runFsck(repair bool, out io.Writer) error {
+	issues, err := fsck(repair)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		fmt.Fprintln(out, "Everything checks out")
+		return nil
+	}
+
+	unrepaired := 0
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tPATH\tDETAIL\tREPAIRED")
+	for _, issue := range issues {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", issue.Kind, issue.Path, issue.Detail, issue.Repaired)
+		if !issue.Repaired {
+			unrepaired++
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if unrepaired > 0 {
+		if repair {
+			return fmt.Errorf("%v of %v problems are left", unrepaired, len(issues))
+		}
+		return fmt.Errorf("Found %v problems, run `imagebarn fsck repair` to fix what can be", len(issues))
+	}
+	return nil
+}
+
+// fsckOnStart runs before the server listens, it only ever logs
+func fsckOnStart(barnConfig *config.Config) {
+	if barnConfig.FsckOnStart == config.FSCK_OFF {
+		return
+	}
+	issues, err := fsck(barnConfig.FsckOnStart == config.FSCK_REPAIR)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to check the data dir: %v", err))
+		return
+	}
+	for _, issue := range issues {
+		if issue.Repaired {
+			slog.Info(fmt.Sprintf("fsck repaired %v %v: %v", issue.Kind, issue.Path, issue.Detail))
+		} else {
+			slog.Warn(fmt.Sprintf("fsck found %v %v: %v", issue.Kind, issue.Path, issue.Detail))
+		}
+	}
+	slog.Info(fmt.Sprintf("Checked the data dir, %v problems found", len(issues)))
+}
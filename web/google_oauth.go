@@ -13,7 +13,6 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +20,8 @@ import (
 	"github.com/goccy/go-json"
 
 	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/events"
 )
 
 const SIGN_IN_VIEW = BASE_VIEW + "/sign-in"
@@ -61,12 +62,9 @@ type GoogleOAuth struct {
 }
 
 func InitOAuth(barnage *BarnageWeb) *GoogleOAuth {
-	googleClientId = os.Getenv("GOOGLE_CLIENT_ID")
-	googleClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
-	baseUri = os.Getenv("BASE_URI")
-	if googleClientId == "" || googleClientSecret == "" || baseUri == "" {
-		panic(fmt.Errorf("Incomplete .env file! Please compare your .env with .env.example"))
-	}
+	googleClientId = barnage.config.GoogleClientId
+	googleClientSecret = barnage.config.GoogleClientSecret
+	baseUri = barnage.config.BaseUri
 
 	if baseUri[0:5] == "http:" {
 		isSecure = false
@@ -247,24 +245,25 @@ func getAccessTokenFromGoogle(code string) (string, error) {
 	return string(accessTokenBytes), nil
 }
 
-func getEmailFromGoogle(accessToken string) (string, error) {
+// the email & whether Google has verified it belongs to them
+func getEmailFromGoogle(accessToken string) (string, bool, error) {
 	req, err := http.NewRequest("GET", GOOGLE_OAUTH_V2_TOKEN_INFO, nil)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Authorization", fmt.Sprintf("%s %s", "Bearer ", accessToken))
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	var resJson map[string]json.RawMessage
@@ -272,10 +271,12 @@ func getEmailFromGoogle(accessToken string) (string, error) {
 
 	accessTokenBytes, exists := resJson["email"]
 	if !exists {
-		return "", fmt.Errorf("Access token does not exists!")
+		return "", false, fmt.Errorf("Access token does not exists!")
 	}
+	// tokeninfo sends it as a string
+	verified := strings.ReplaceAll(string(resJson["email_verified"]), "\"", "") == "true"
 
-	return strings.ReplaceAll(string(accessTokenBytes), "\"", ""), nil
+	return strings.ReplaceAll(string(accessTokenBytes), "\"", ""), verified, nil
 }
 
 func SignIn(c *fiber.Ctx) error {
@@ -294,33 +295,49 @@ func SignIn(c *fiber.Ctx) error {
 		return c.Render(SIGN_IN_VIEW, fiber.Map{"Error": "Internal Server Error: Failed to sign in!"}, MAIN_LAYOUT)
 	}
 
-	email, err := getEmailFromGoogle(accessToken)
+	email, verified, err := getEmailFromGoogle(accessToken)
 	if err != nil {
 		slog.Debug(fmt.Sprintf("Failed to get email: %v", err))
 		return c.Render(SIGN_IN_VIEW, fiber.Map{"Error": "Internal Server Error: Failed to sign in!"}, MAIN_LAYOUT)
 	}
 
-	jwt, err := CreateJwt(email)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Failed to generate JWT: %v", err))
-		return c.Render(SIGN_IN_VIEW, fiber.Map{"Error": "Internal Server Error: Failed to sign in!"}, MAIN_LAYOUT)
-	}
-
 	c.Cookie(&fiber.Cookie{
-		Name:     "jwt",
-		Value:    jwt,
-		HTTPOnly: true,
+		Name:     "state",
+		Value:    "",
+		Expires:  time.Now(),
 		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
 	})
+	return finishSignIn(c, email, takeInviteCookie(c), verified, "with Google")
+}
 
-	c.Cookie(&fiber.Cookie{
-		Name:    "state",
-		Value:   "",
-		Expires: time.Now(),
-		Secure:  isSecure,
-	})
+// finishSignIn is the same for every way of signing in, once we know who they are. method is how, for the audit log.
+func finishSignIn(c *fiber.Ctx, email string, inviteToken string, verified bool, method string) error {
+	if isBanned(email) {
+		slog.Info(fmt.Sprintf("Refused signing in %v, they're banned", email))
+		recordAudit(email, clientIP(c), audit.SIGN_IN_REFUSED, email, method+", banned")
+		return c.Status(403).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This account has been banned."}, MAIN_LAYOUT)
+	}
+	if err := CreateJwt(c, email); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to start a session: %v", err))
+		return c.Render(SIGN_IN_VIEW, fiber.Map{"Error": "Internal Server Error: Failed to sign in!"}, MAIN_LAYOUT)
+	}
 
-	return c.Render(SIGN_IN_VIEW, fiber.Map{}, MAIN_LAYOUT)
+	recordAudit(email, clientIP(c), audit.SIGNED_IN, email, method)
+	autoApprove(email, inviteToken, verified, clientIP(c))
+	// shows up on the approve page right away
+	barnage.fs.ApprovedUsers().IsApproved(email)
+	// suspended users aren't waiting on anyone
+	if userState(email) == USER_PENDING {
+		events.Publish(events.USER_AWAITING_APPROVAL, email, nil)
+	}
+
+	// guests who scanned an invite go straight to uploading
+	next := INDEX_ROUTE
+	if inviteToken != "" {
+		next = SHARE_ROUTE
+	}
+	return c.Render(SIGN_IN_VIEW, fiber.Map{"Next": next}, MAIN_LAYOUT)
 }
 
 func StartSignIn(c *fiber.Ctx) error {
@@ -330,6 +347,7 @@ func StartSignIn(c *fiber.Ctx) error {
 		Value:    state,
 		HTTPOnly: true,
 		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
 	})
 	return c.Redirect(GenerateOAuthLink(signedState), 302)
 }
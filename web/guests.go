@@ -0,0 +1,226 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/events"
+	"kmfg.dev/imagebarn/v1/filestore"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// everyone who joined without Google, lives in the data dir
+const GUESTS_FILE = "guests.json"
+const GUEST_ID_BYTES = 9
+const GUEST_NAME_MAX = 32
+
+var guestsFile = GUESTS_FILE
+
+// email -> guest
+var guests = map[string]Guest{}
+var guestsRWMutex = sync.RWMutex{}
+
+// guests can only join through an invite that lets them
+func RegisterGuests(barnage *BarnageWeb) {
+	barnage.fiber.Post(INVITE_ROUTE+"/:token/guest", limiter.New(limiter.Config{
+		Max:               10,
+		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+	}), joinAsGuest)
+}
+
+func loadGuests() error {
+	data, err := helpme.ReadFileVerified(guestsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", guestsFile, err)
+	}
+	loaded := map[string]Guest{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", guestsFile, err)
+	}
+	guestsRWMutex.Lock()
+	defer guestsRWMutex.Unlock()
+	guests = loaded
+	return nil
+}
+
+func (guest Guest) Email() string {
+	return guest.Id + filestore.GUEST_DOMAIN
+}
+
+func guestByEmail(email string) (Guest, bool) {
+	if !filestore.IsGuest(email) {
+		return Guest{}, false
+	}
+	guestsRWMutex.RLock()
+	defer guestsRWMutex.RUnlock()
+	guest, exists := guests[email]
+	return guest, exists
+}
+
+// displayName is what people see instead of a guest's made up email
+func displayName(email string) string {
+	if guest, exists := guestByEmail(email); exists {
+		return guest.Name
+	}
+	return email
+}
+
+// guestName is empty for anyone who signed in with Google
+func guestName(email string) string {
+	guest, _ := guestByEmail(email)
+	return guest.Name
+}
+
+// uploaderName is what captions show, never an email
+func uploaderName(email string) string {
+	if guest, exists := guestByEmail(email); exists {
+		return guest.Name
+	}
+	uploader, _, _ := strings.Cut(email, "@")
+	return uploader
+}
+
+func cleanGuestName(name string) (string, error) {
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}), " ")
+	if name == "" {
+		return "", fmt.Errorf("Pick a name so people know whose photos are whose")
+	}
+	if len([]rune(name)) > GUEST_NAME_MAX {
+		return "", fmt.Errorf("Names can be up to %v letters", GUEST_NAME_MAX)
+	}
+	return name, nil
+}
+
+// written straight through, guests only join once
+func createGuest(name string, inviteId string) (Guest, error) {
+	id, err := randomToken(GUEST_ID_BYTES)
+	if err != nil {
+		return Guest{}, err
+	}
+	// ids end up in folder names, & emails are compared lowercase in places
+	guest := Guest{Id: "guest-" + strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(id)), Name: name, InviteId: inviteId, Created: time.Now()}
+
+	if err = storeGuest(guest); err != nil {
+		return Guest{}, err
+	}
+	return guest, nil
+}
+
+// storeGuest adds or replaces guest, written straight through
+func storeGuest(guest Guest) error {
+	guestsRWMutex.Lock()
+	defer guestsRWMutex.Unlock()
+	updated := make(map[string]Guest, len(guests)+1)
+	for email, existing := range guests {
+		updated[email] = existing
+	}
+	updated[guest.Email()] = guest
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if err = helpme.WriteFileAtomic(guestsFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", guestsFile, err)
+	}
+	guests = updated
+	return nil
+}
+
+// convertGuest moves a guest's images, approval & any promotion to a real address they sign in with from then on.
+// The address can't belong to anyone past pending, & the guest is signed out on their device. ip is empty from the CLI.
+func convertGuest(guestEmail string, email string, source string, by string, ip string) error {
+	guest, exists := guestByEmail(guestEmail)
+	if !exists || guest.ConvertedTo != "" {
+		return fmt.Errorf("%v isn't a guest", guestEmail)
+	}
+	email, err := cleanSignInEmail(email)
+	if err != nil {
+		return err
+	}
+	if state := userState(email); email == AdminUserEmail || state != USER_PENDING {
+		return fmt.Errorf("%v already has an account, they're %v", email, state)
+	}
+	if err = filestore.MoveAll(guestEmail, email); err != nil {
+		return err
+	}
+	if err = moveApproval(guestEmail, email); err != nil {
+		if undoErr := filestore.MoveAll(email, guestEmail); undoErr != nil {
+			slog.Error(fmt.Sprintf("Failed to move %v's images back to %v: %v", email, guestEmail, undoErr))
+		}
+		return err
+	}
+	guest.ConvertedTo = email
+	if err = storeGuest(guest); err != nil {
+		slog.Warn(fmt.Sprintf("Couldn't mark %v converted: %v", guestEmail, err))
+	}
+
+	if isApproved, _ := barnage.fs.ApprovedUsers().Lookup(guestEmail); isApproved {
+		barnage.fs.ApprovedUsers().Approve(email)
+	} else {
+		barnage.fs.ApprovedUsers().Disapprove(email)
+	}
+	barnage.fs.ApprovedUsers().Forget(guestEmail)
+	if isAdminEmail(guestEmail) {
+		if err := setPromotedAdmin(email, true); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to promote %v: %v", email, err))
+		}
+		if err := setPromotedAdmin(guestEmail, false); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to demote %v: %v", guestEmail, err))
+		}
+	}
+	InvalidateJwt(guestEmail)
+
+	slog.Info(fmt.Sprintf("Converted guest %v (%v) to %v", guest.Name, guestEmail, email))
+	recordAudit(approvalActor(email, source, by), ip, audit.USER_CONVERTED, email, fmt.Sprintf("from guest %v (%v)", guest.Name, guestEmail))
+	return nil
+}
+
+// joinAsGuest uses up one of the invite's uses & signs them in on this device only, there's nothing to sign in with again.
+// Guests still wait on an admin like anyone else.
+func joinAsGuest(c *fiber.Ctx) error {
+	if _, valid := sessionEmail(c); valid {
+		return c.Redirect(SHARE_ROUTE, 303)
+	}
+	token := utils.CopyString(c.Params("token", ""))
+	invite, err := usableInvite(token)
+	if err != nil || !invite.Guests {
+		return c.Status(404).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This invite has expired or been used up, ask for a new one!"}, MAIN_LAYOUT)
+	}
+	name, err := cleanGuestName(c.FormValue("name", ""))
+	if err != nil {
+		return c.Status(400).Render(INVITE_VIEW, inviteViewBind(c, invite, fiber.Map{"Error": err.Error(), "Name": c.FormValue("name", "")}), MAIN_LAYOUT)
+	}
+	if _, err = redeemInvite(token); err != nil {
+		return c.Status(404).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This invite has expired or been used up, ask for a new one!"}, MAIN_LAYOUT)
+	}
+	guest, err := createGuest(name, invite.Id)
+	if err != nil {
+		return err
+	}
+	if err = CreateJwt(c, guest.Email()); err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("%v joined as guest %v through invite %v", name, guest.Id, invite.Id))
+	recordAudit(guest.Email(), clientIP(c), audit.GUEST_JOINED, guest.Email(), fmt.Sprintf("as %v through invite %v", name, invite.Id))
+	// shows up on the approve page right away
+	barnage.fs.ApprovedUsers().IsApproved(guest.Email())
+	events.Publish(events.USER_AWAITING_APPROVAL, guest.Email(), nil)
+	return c.Redirect(INDEX_ROUTE, 303)
+}
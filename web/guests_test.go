@@ -0,0 +1,171 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+func TestGuestsJoinThroughInvitesThatAllowThem(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	lines := strings.Split(strings.TrimSpace(run("invite", "create", "1", "2", "Reunion")), "\n")
+	token := strings.TrimPrefix(lines[len(lines)-1], barnConfig.BaseUri+INVITE_ROUTE+"/")
+	invite := listInvites()[0]
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html")})
+	app.Post(INVITE_ROUTE+"/:token/guest", joinAsGuest)
+	join := func(name string) int {
+		req := httptest.NewRequest("POST", INVITE_ROUTE+"/"+token+"/guest", strings.NewReader(url.Values{"name": {name}}.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := join("Aunt May"); status != 404 || len(guests) != 0 {
+		t.Fatalf("Joined as a guest through an invite that doesn't allow guests, got %v", status)
+	}
+
+	run("invite", "guests", invite.Id, "on")
+	if status := join(" \t "); status != 400 {
+		t.Errorf("A blank name got %v", status)
+	}
+	if status := join("  Aunt \n May  "); status != 303 {
+		t.Fatalf("Expected the guest to be signed in & sent home, got %v", status)
+	}
+	if len(guests) != 1 {
+		t.Fatalf("Expected one guest, got %v", guests)
+	}
+	email := ""
+	for email = range guests {
+	}
+	guest, _ := guestByEmail(email)
+	if !filestore.IsGuest(email) || guest.InviteId != invite.Id || displayName(email) != "Aunt May" || uploaderName(email) != "Aunt May" {
+		t.Errorf("Guest wasn't made as expected: %+v", guest)
+	}
+	if uploaderName("someone@mysite.com") != "someone" || displayName("someone@mysite.com") != "someone@mysite.com" {
+		t.Error("Names changed for people who signed in with Google")
+	}
+	if barnage.fs.ApprovedUsers().IsApproved(email) {
+		t.Error("A guest was approved without an admin")
+	}
+	if filestore.MaxImagesFor(email) != barnConfig.GuestMaxImages || filestore.MaxImagesFor("someone@mysite.com") != barnConfig.MaxImagesPerUser {
+		t.Error("Guests didn't get their own quota")
+	}
+	if err = barnage.fs.StoreApprovedUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	// guests are moderated like anyone, & are still there after a restart
+	run("user", "approve", email)
+	users := run("user", "list")
+	if !strings.Contains(users, "Aunt May") || !barnage.fs.ApprovedUsers().IsApproved(email) {
+		t.Errorf("user list doesn't show the approved guest:\n%v", users)
+	}
+	if status := join("Uncle Ben"); status != 303 {
+		t.Fatalf("Second guest got %v", status)
+	}
+	if status := join("Cousin Eddie"); status != 404 {
+		t.Errorf("Joined through an invite that's used up, got %v", status)
+	}
+}
+
+func TestConvertingAGuestMovesTheirAccount(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	useAuditDir(t)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	run("user", "list")
+	may, err := createGuest("Aunt May", "DXG-MWbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := createGuest("Uncle Bob", "DXG-MWbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("user", "approve", may.Email())
+	run("user", "promote", may.Email())
+	run("user", "approve", "cousin@gmail.com")
+	image := filepath.Join(filestore.ImagePath(filestore.Encode(may.Email()), ""), filestore.Encode("cow.png"))
+	if err = os.WriteFile(image, []byte("moo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	run("user", "convert", may.Email(), " May@Gmail.com ")
+	moved := filepath.Join(filestore.ImagePath(filestore.Encode("may@gmail.com"), ""), filestore.Encode("cow.png"))
+	if _, err = os.Stat(moved); err != nil {
+		t.Errorf("Their image didn't move: %v", err)
+	}
+	if _, err = os.Stat(filepath.Dir(image)); !os.IsNotExist(err) {
+		t.Errorf("Their guest folder is still there: %v", err)
+	}
+	if userState("may@gmail.com") != USER_APPROVED || !isAdminEmail("may@gmail.com") {
+		t.Error("Their approval or promotion didn't move")
+	}
+	if _, exists := barnage.fs.ApprovedUsers().Lookup(may.Email()); exists || isAdminEmail(may.Email()) {
+		t.Error("The guest is still approved or an admin")
+	}
+	if record, exists := approvalOf("may@gmail.com"); !exists || record.Source != APPROVAL_CLI {
+		t.Errorf("Their approval record didn't move: %+v", record)
+	}
+	if guest, _ := guestByEmail(may.Email()); guest.ConvertedTo != "may@gmail.com" {
+		t.Errorf("The guest doesn't say where they went: %+v", guest)
+	}
+	if listed := run("audit", "list", "action=user.converted"); !strings.Contains(listed, may.Email()) {
+		t.Errorf("The conversion wasn't recorded:\n%v", listed)
+	}
+
+	for _, bad := range [][2]string{{may.Email(), "may2@gmail.com"}, {bob.Email(), "cousin@gmail.com"}, {bob.Email(), "admin@mysite.com"}, {bob.Email(), "not an address"}, {"cousin@gmail.com", "cousin2@gmail.com"}} {
+		if err = convertGuest(bad[0], bad[1], APPROVAL_CLI, "", ""); err == nil {
+			t.Errorf("Converted %v to %v", bad[0], bad[1])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+const CSP_REPORT_ROUTE = "/csp-report"
+
+// templates put it on their inline scripts, htmx puts it on the ones it swaps in
+const CSP_NONCE_LOCAL = "CspNonce"
+const CSP_NONCE_BYTES = 16
+
+// reports are small, anything bigger isn't one
+const CSP_REPORT_MAX_BYTES = 16 * 1024
+
+// inline style attributes are all over the templates, so styles stay unsafe-inline. Scripts need the nonce.
+const CSP_POLICY = "default-src 'self'; script-src 'self' 'nonce-%v'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; " +
+	"connect-src 'self'; font-src 'self'; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors %v; " +
+	"report-uri " + CSP_REPORT_ROUTE + "; report-to csp"
+
+var securityHeadersConfig atomic.Pointer[config.SecurityHeadersConfig]
+
+// set on start & every reload
+func setSecurityHeaders(barnConfig *config.Config) {
+	headers := barnConfig.SecurityHeaders
+	securityHeadersConfig.Store(&headers)
+}
+
+// securityHeaders sets the configured headers on every response & hands the templates this request's nonce
+func securityHeaders(c *fiber.Ctx) error {
+	headers := securityHeadersConfig.Load()
+	if headers == nil {
+		return c.Next()
+	}
+	nonce, err := randomToken(CSP_NONCE_BYTES)
+	if err != nil {
+		return fmt.Errorf("Failed to make a CSP nonce: %v", err)
+	}
+	c.Locals(CSP_NONCE_LOCAL, nonce)
+
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderReferrerPolicy, headers.ReferrerPolicy)
+	frameAncestors := "*"
+	if headers.FrameOptions != config.FRAME_OFF {
+		c.Set(fiber.HeaderXFrameOptions, headers.FrameOptions)
+		frameAncestors = "'none'"
+		if headers.FrameOptions == config.FRAME_SAMEORIGIN {
+			frameAncestors = "'self'"
+		}
+	}
+	if isSecure && headers.HstsMaxAge > 0 {
+		c.Set(fiber.HeaderStrictTransportSecurity, fmt.Sprintf("max-age=%v", int64(headers.HstsMaxAge/time.Second)))
+	}
+	switch headers.Csp {
+	case config.CSP_ENFORCE:
+		c.Set(fiber.HeaderContentSecurityPolicy, fmt.Sprintf(CSP_POLICY, nonce, frameAncestors))
+	case config.CSP_REPORT_ONLY:
+		c.Set(fiber.HeaderContentSecurityPolicyReportOnly, fmt.Sprintf(CSP_POLICY, nonce, frameAncestors))
+	}
+	if headers.Csp != config.CSP_OFF {
+		c.Set("Reporting-Endpoints", fmt.Sprintf("csp=\"%v\"", CSP_REPORT_ROUTE))
+	}
+	return c.Next()
+}
+
+// RegisterCspReports has to come before csrfMiddleware, browsers send reports without a token
+func RegisterCspReports(app *fiber.App) {
+	app.Post(CSP_REPORT_ROUTE, limiter.New(limiter.Config{
+		Max:               30,
+		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+		LimitReached: func(c *fiber.Ctx) error {
+			return c.SendStatus(204)
+		},
+	}), cspReport)
+}
+
+// cspReport logs violations, either the old report-uri shape or the Reporting API's list of reports
+func cspReport(c *fiber.Ctx) error {
+	body := c.Body()
+	if len(body) > CSP_REPORT_MAX_BYTES {
+		return c.SendStatus(413)
+	}
+	violations := []CspViolation{}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/reports+json") {
+		reports := []struct {
+			Type string       `json:"type"`
+			Body CspViolation `json:"body"`
+		}{}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return c.SendStatus(400)
+		}
+		for _, report := range reports {
+			if report.Type == "csp-violation" {
+				violations = append(violations, report.Body)
+			}
+		}
+	} else {
+		report := struct {
+			Report CspViolation `json:"csp-report"`
+		}{}
+		if err := json.Unmarshal(body, &report); err != nil {
+			return c.SendStatus(400)
+		}
+		violations = append(violations, report.Report)
+	}
+	for _, violation := range violations {
+		slog.Warn(fmt.Sprintf("CSP violation on %v: %v blocked %v", violation.page(), violation.directive(), violation.blocked()))
+	}
+	return c.SendStatus(204)
+}
+
+// report-uri & the Reporting API name the same things differently
+func (violation CspViolation) page() string {
+	return firstNonEmpty(violation.DocumentUri, violation.DocumentUrl)
+}
+
+func (violation CspViolation) directive() string {
+	return firstNonEmpty(violation.EffectiveDirective, violation.Directive, violation.ViolatedDirective)
+}
+
+func (violation CspViolation) blocked() string {
+	return firstNonEmpty(violation.BlockedUri, violation.BlockedUrl, "inline")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+func newHeadersApp(t *testing.T, csp string) *fiber.App {
+	barnConfig := config.Default()
+	barnConfig.SecurityHeaders.Csp = csp
+	setSecurityHeaders(barnConfig)
+	t.Cleanup(func() { securityHeadersConfig.Store(nil) })
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html"), PassLocalsToViews: true})
+	app.Use(securityHeaders)
+	RegisterCspReports(app)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.Render(SIGN_IN_VIEW, fiber.Map{}, MAIN_LAYOUT)
+	})
+	return app
+}
+
+func TestInlineScriptsCarryTheResponsesNonce(t *testing.T) {
+	app := newHeadersApp(t, config.CSP_ENFORCE)
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := resp.Header.Get(fiber.HeaderContentSecurityPolicy)
+	nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(policy)
+	if nonce == nil {
+		t.Fatalf("No nonce in the policy: %v", policy)
+	}
+	if resp.Header.Get(fiber.HeaderXFrameOptions) != config.FRAME_DENY || resp.Header.Get(fiber.HeaderXContentTypeOptions) != "nosniff" ||
+		resp.Header.Get(fiber.HeaderReferrerPolicy) != "same-origin" || !strings.Contains(policy, "frame-ancestors 'none'") {
+		t.Fatalf("Missing the default headers: %v", resp.Header)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	scripts := regexp.MustCompile(`<script[^>]*>`).FindAllString(string(body), -1)
+	inline := 0
+	for _, script := range scripts {
+		if strings.Contains(script, "src=") {
+			continue
+		}
+		inline++
+		if !strings.Contains(script, `nonce="`+nonce[1]+`"`) {
+			t.Fatalf("Inline script without this response's nonce: %v", script)
+		}
+	}
+	if inline == 0 {
+		t.Fatal("Expected the page to have inline scripts")
+	}
+	if !strings.Contains(string(body), `"inlineScriptNonce": "`+nonce[1]+`"`) {
+		t.Fatal("htmx wasn't given the nonce for scripts it swaps in")
+	}
+
+	// a new nonce every time
+	again, _ := app.Test(httptest.NewRequest("GET", "/", nil))
+	if again.Header.Get(fiber.HeaderContentSecurityPolicy) == policy {
+		t.Fatal("The nonce was reused")
+	}
+}
+
+func TestReportOnlyModeAndReports(t *testing.T) {
+	app := newHeadersApp(t, config.CSP_REPORT_ONLY)
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(fiber.HeaderContentSecurityPolicy) != "" || resp.Header.Get(fiber.HeaderContentSecurityPolicyReportOnly) == "" {
+		t.Fatalf("Expected only the report-only policy: %v", resp.Header)
+	}
+
+	for name, test := range map[string]struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		"report-uri":    {"application/csp-report", `{"csp-report": {"document-uri": "https://barn/", "effective-directive": "script-src-elem", "blocked-uri": "inline"}}`, 204},
+		"reporting api": {"application/reports+json", `[{"type": "csp-violation", "body": {"documentURL": "https://barn/", "effectiveDirective": "img-src", "blockedURL": "https://evil.example/x.png"}}]`, 204},
+		"not a report":  {"application/csp-report", `nope`, 400},
+		"too big":       {"application/csp-report", strings.Repeat(" ", CSP_REPORT_MAX_BYTES+1), 413},
+	} {
+		req := httptest.NewRequest("POST", CSP_REPORT_ROUTE, strings.NewReader(test.body))
+		req.Header.Set(fiber.HeaderContentType, test.contentType)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Fatalf("Expected %v for the %v, got %v", test.status, name, resp.StatusCode)
+		}
+	}
+}
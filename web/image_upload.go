@@ -1,7 +1,10 @@
 package web
 
 import (
+	"net/url"
+
 	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/audit"
 	"kmfg.dev/imagebarn/v1/filestore"
 )
 
@@ -24,17 +27,25 @@ func RegisterUploader(barnage *BarnageWeb) *ImageUpload {
 
 	imgRouter.Post("", filestore.UploadImage)
 	imgRouter.Get("/:fileName", filestore.GetImage)
-	imgRouter.Get("/hash/dir", filestore.HashImageDir)
-	imgRouter.Delete("/:fileName", filestore.DeleteImage)
+	imgRouter.Delete("/:fileName", deleteImage)
 
 	return iU
 }
 
 func jwtMiddleware(c *fiber.Ctx) error {
-	email, valid := getEmailFromJWT(c.Cookies("jwt", ""))
+	email, valid := sessionEmail(c)
 	if !valid || !barnage.fs.ApprovedUsers().IsApproved(email) {
 		return c.SendStatus(401)
 	}
 	c.Locals("email", email)
 	return c.Next()
 }
+
+func deleteImage(c *fiber.Ctx) error {
+	if err := filestore.DeleteImage(c); err != nil {
+		return err
+	}
+	fileName, _ := url.PathUnescape(c.Params("fileName", ""))
+	auditRequest(c, audit.IMAGE_DELETED, c.Locals("email").(string), fileName)
+	return nil
+}
@@ -0,0 +1,406 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/skip2/go-qrcode"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/helpme"
+	"kmfg.dev/imagebarn/v1/poster"
+)
+
+// invites made on the admin page or from the CLI, lives in the data dir
+const INVITES_FILE = "invites.json"
+
+// where an invite's link points, /invite/<token>
+const INVITE_ROUTE = "/invite"
+const INVITES_ROUTE = "/invites"
+const PARTIALS_INVITES_VIEW = BASE_PARTIAL + "/invites"
+
+// the mobile page guests land on from an invite, & where they end up once signed in
+const INVITE_VIEW = BASE_VIEW + "/invite"
+const SHARE_ROUTE = "/share"
+const SHARE_VIEW = BASE_VIEW + "/share"
+
+// what posters are lettered in, the same as the site
+const POSTER_FONT = "static/fonts/Poppins-SemiBold.ttf"
+const POSTER_CAPTION = "Scan to sign in & share your photos"
+
+// holds the token through Google's sign in, long enough for someone to find their password
+const INVITE_COOKIE = "invite"
+const INVITE_COOKIE_LIFETIME = 15 * time.Minute
+
+const INVITE_TOKEN_BYTES = 18
+const INVITE_ID_BYTES = 6
+const INVITE_MAX_LIFETIME = 365 * 24 * time.Hour
+
+// pixels on a side of the QR code on the admin page
+const INVITE_QR_SIZE = 256
+
+var invitesFile = INVITES_FILE
+var invites = []Invite{}
+var invitesRWMutex = sync.RWMutex{}
+
+func RegisterInvites(barnage *BarnageWeb) {
+	barnage.fiber.Get(INVITE_ROUTE+"/:token", landOnInvite)
+	barnage.fiber.Get(SHARE_ROUTE, share)
+
+	invitesRouter := barnage.fiber.Group(INVITES_ROUTE)
+	invitesRouter.Use(adminCheckMiddleware)
+	invitesRouter.Get("", showInvites)
+	invitesRouter.Post("", addInvite)
+	invitesRouter.Delete("/:id", removeInvite)
+	invitesRouter.Get("/:id/qr.png", inviteQrCode)
+	invitesRouter.Get("/:id/poster.:format", invitePoster)
+}
+
+func loadInvites() error {
+	data, err := helpme.ReadFileVerified(invitesFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", invitesFile, err)
+	}
+	loaded := []Invite{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", invitesFile, err)
+	}
+	invitesRWMutex.Lock()
+	defer invitesRWMutex.Unlock()
+	invites = loaded
+	return nil
+}
+
+// written straight through like the admins, callers hold invitesRWMutex
+func saveInvites(updated []Invite) error {
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if err = helpme.WriteFileAtomic(invitesFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", invitesFile, err)
+	}
+	invites = updated
+	return nil
+}
+
+// Problem is why nobody can sign in through the invite right now, empty when they can
+func (invite Invite) Problem(now time.Time) string {
+	switch {
+	case invite.Revoked:
+		return "revoked"
+	case !now.Before(invite.Expires):
+		return "expired"
+	case invite.MaxUses > 0 && invite.Uses >= invite.MaxUses:
+		return "used up"
+	}
+	return ""
+}
+
+func (invite Invite) Link() string {
+	return baseUri + INVITE_ROUTE + "/" + invite.Token
+}
+
+func createInvite(label string, createdBy string, lifetime time.Duration, maxUses int, guests bool) (Invite, error) {
+	if lifetime < time.Minute || lifetime > INVITE_MAX_LIFETIME {
+		return Invite{}, fmt.Errorf("Invites last between a minute & %v days", int(INVITE_MAX_LIFETIME.Hours()/24))
+	}
+	if maxUses < 0 {
+		return Invite{}, fmt.Errorf("Max uses can't be negative")
+	}
+	id, err := randomToken(INVITE_ID_BYTES)
+	if err != nil {
+		return Invite{}, err
+	}
+	token, err := randomToken(INVITE_TOKEN_BYTES)
+	if err != nil {
+		return Invite{}, err
+	}
+	now := time.Now()
+	invite := Invite{
+		Id:        id,
+		Label:     strings.TrimSpace(label),
+		Token:     token,
+		CreatedBy: createdBy,
+		Created:   now,
+		Expires:   now.Add(lifetime),
+		MaxUses:   maxUses,
+		Guests:    guests,
+	}
+
+	invitesRWMutex.Lock()
+	defer invitesRWMutex.Unlock()
+	if err = saveInvites(append(append([]Invite{}, invites...), invite)); err != nil {
+		return Invite{}, err
+	}
+	slog.Info(fmt.Sprintf("%v created invite %v, good until %v", createdBy, id, invite.Expires.Format(time.DateTime)))
+	return invite, nil
+}
+
+// revoked invites are kept, approvals still point at them
+func revokeInvite(id string) error {
+	invitesRWMutex.Lock()
+	defer invitesRWMutex.Unlock()
+	updated := append([]Invite{}, invites...)
+	for i := range updated {
+		if updated[i].Id == id {
+			if updated[i].Revoked {
+				return nil
+			}
+			updated[i].Revoked = true
+			if err := saveInvites(updated); err != nil {
+				return err
+			}
+			slog.Info(fmt.Sprintf("Revoked invite %v", id))
+			return nil
+		}
+	}
+	return fmt.Errorf("No invite %v", id)
+}
+
+// allowGuests turns joining without a Google account on or off, people already in stay in
+func allowGuests(id string, allowed bool) error {
+	invitesRWMutex.Lock()
+	defer invitesRWMutex.Unlock()
+	updated := append([]Invite{}, invites...)
+	for i := range updated {
+		if updated[i].Id == id {
+			if updated[i].Guests == allowed {
+				return nil
+			}
+			updated[i].Guests = allowed
+			return saveInvites(updated)
+		}
+	}
+	return fmt.Errorf("No invite %v", id)
+}
+
+// newest first
+func listInvites() []Invite {
+	invitesRWMutex.RLock()
+	listed := append([]Invite{}, invites...)
+	invitesRWMutex.RUnlock()
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].Created.After(listed[j].Created)
+	})
+	return listed
+}
+
+func inviteById(id string) (Invite, bool) {
+	invitesRWMutex.RLock()
+	defer invitesRWMutex.RUnlock()
+	for _, invite := range invites {
+		if invite.Id == id {
+			return invite, true
+		}
+	}
+	return Invite{}, false
+}
+
+func inviteIndexLocked(token string) int {
+	for i, invite := range invites {
+		if subtle.ConstantTimeCompare([]byte(invite.Token), []byte(token)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// usableInvite is the invite token belongs to, as long as someone could still sign in through it
+func usableInvite(token string) (Invite, error) {
+	invitesRWMutex.RLock()
+	defer invitesRWMutex.RUnlock()
+	i := inviteIndexLocked(token)
+	if i < 0 {
+		return Invite{}, fmt.Errorf("No such invite")
+	}
+	if problem := invites[i].Problem(time.Now()); problem != "" {
+		return Invite{}, fmt.Errorf("Invite %v is %v", invites[i].Id, problem)
+	}
+	return invites[i], nil
+}
+
+// redeemInvite uses up one of the invite's uses, it's on disk before anyone is approved through it
+func redeemInvite(token string) (Invite, error) {
+	invitesRWMutex.Lock()
+	defer invitesRWMutex.Unlock()
+	i := inviteIndexLocked(token)
+	if i < 0 {
+		return Invite{}, fmt.Errorf("No such invite")
+	}
+	if problem := invites[i].Problem(time.Now()); problem != "" {
+		return Invite{}, fmt.Errorf("Invite %v is %v", invites[i].Id, problem)
+	}
+	updated := append([]Invite{}, invites...)
+	updated[i].Uses++
+	if err := saveInvites(updated); err != nil {
+		return Invite{}, err
+	}
+	return updated[i], nil
+}
+
+// landOnInvite is where an invite link or QR code goes, a page with one button to sign in. The token waits in a cookie
+// until Google sends them back, or approves them right away when they're already signed in.
+func landOnInvite(c *fiber.Ctx) error {
+	token := utils.CopyString(c.Params("token", ""))
+	invite, err := usableInvite(token)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Turned away an invite: %v", err))
+		return c.Status(404).Render(SIGN_IN_VIEW, fiber.Map{"Error": "This invite has expired or been used up, ask for a new one!"}, MAIN_LAYOUT)
+	}
+	if email, valid := sessionEmail(c); valid {
+		autoApprove(email, token, false, clientIP(c))
+		return c.Redirect(SHARE_ROUTE, 302)
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     INVITE_COOKIE,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(INVITE_COOKIE_LIFETIME),
+		HTTPOnly: true,
+		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return c.Render(INVITE_VIEW, inviteViewBind(c, invite, fiber.Map{}), MAIN_LAYOUT)
+}
+
+// the guest form posts back to the same token, so it's only on the page when the invite lets guests in
+func inviteViewBind(c *fiber.Ctx, invite Invite, bind fiber.Map) fiber.Map {
+	bind["Label"] = invite.Label
+	bind["Guests"] = invite.Guests
+	bind["Token"] = invite.Token
+	bind["NameMax"] = GUEST_NAME_MAX
+	return signedOutBind(c, bind)
+}
+
+// share is the upload button & little else, for guests on their phones
+func share(c *fiber.Ctx) error {
+	email, valid := sessionEmail(c)
+	if !valid || !barnage.fs.ApprovedUsers().IsApproved(email) {
+		return c.Redirect(INDEX_ROUTE, 302)
+	}
+	return c.Render(SHARE_VIEW, fiber.Map{"BarnageUser": getBarnageUser(email), "ImageUploadRoute": IMAGE_ROUTE}, MAIN_LAYOUT)
+}
+
+// takeInviteCookie is the invite someone is signing in through, the cookie goes either way
+func takeInviteCookie(c *fiber.Ctx) string {
+	token := utils.CopyString(c.Cookies(INVITE_COOKIE, ""))
+	if token != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     INVITE_COOKIE,
+			Value:    "",
+			Path:     "/",
+			Expires:  time.Now(),
+			HTTPOnly: true,
+			Secure:   isSecure,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	return token
+}
+
+func showInvites(c *fiber.Ctx) error {
+	return renderInvites(c, fiber.Map{})
+}
+
+func addInvite(c *fiber.Ctx) error {
+	adminEmail, _ := sessionEmail(c)
+	days, err := strconv.ParseFloat(c.FormValue("days", ""), 64)
+	if err != nil {
+		return renderInvites(c, fiber.Map{"Error": "How many days the invite lasts has to be a number"})
+	}
+	maxUses, err := strconv.Atoi(c.FormValue("max_uses", "0"))
+	if err != nil {
+		return renderInvites(c, fiber.Map{"Error": "Max uses has to be a whole number"})
+	}
+	created, err := createInvite(c.FormValue("label", ""), adminEmail, time.Duration(days*float64(24*time.Hour)), maxUses, c.FormValue("guests", "") == "on")
+	if err != nil {
+		return renderInvites(c, fiber.Map{"Error": err.Error()})
+	}
+	auditRequest(c, audit.INVITE_CREATED, created.Id, inviteAuditDetail(created))
+	return renderInvites(c, fiber.Map{"Created": created})
+}
+
+func removeInvite(c *fiber.Ctx) error {
+	id := utils.CopyString(c.Params("id", ""))
+	if err := revokeInvite(id); err != nil {
+		return renderInvites(c, fiber.Map{"Error": err.Error()})
+	}
+	auditRequest(c, audit.INVITE_REVOKED, id, "")
+	return renderInvites(c, fiber.Map{})
+}
+
+// e.g. "Reunion" for 10 uses, guests welcome
+func inviteAuditDetail(invite Invite) string {
+	detail := fmt.Sprintf("%q until %v", invite.Label, invite.Expires.Format(time.RFC3339))
+	if invite.MaxUses > 0 {
+		detail += fmt.Sprintf(" for %v uses", invite.MaxUses)
+	}
+	if invite.Guests {
+		detail += ", guests welcome"
+	}
+	return detail
+}
+
+func inviteQrCode(c *fiber.Ctx) error {
+	invite, exists := inviteById(c.Params("id", ""))
+	if !exists {
+		return c.SendStatus(404)
+	}
+	png, err := qrcode.Encode(invite.Link(), qrcode.Medium, INVITE_QR_SIZE)
+	if err != nil {
+		return fmt.Errorf("Failed to make a QR code for invite %v: %v", invite.Id, err)
+	}
+	c.Set(fiber.HeaderContentType, "image/png")
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Send(png)
+}
+
+// invitePoster is a page to print & put on the tables, as a png, svg, or pdf
+func invitePoster(c *fiber.Ctx) error {
+	invite, exists := inviteById(c.Params("id", ""))
+	format := c.Params("format", "")
+	contentType, known := poster.CONTENT_TYPES[format]
+	if !exists || !known {
+		return c.SendStatus(404)
+	}
+	data, err := renderInvitePoster(invite, format)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("inline; filename=\"invite-%v.%v\"", invite.Id, format))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Send(data)
+}
+
+// shared with `imagebarn invite poster`
+func renderInvitePoster(invite Invite, format string) ([]byte, error) {
+	fontData, err := staticFS.ReadFile(POSTER_FONT)
+	if err != nil {
+		return nil, err
+	}
+	title := invite.Label
+	if title == "" {
+		title = "Share your photos"
+	}
+	return poster.Render(format, poster.Poster{Title: title, Caption: POSTER_CAPTION, Link: invite.Link()}, fontData)
+}
+
+func renderInvites(c *fiber.Ctx, bind fiber.Map) error {
+	bind["Invites"] = listInvites()
+	bind["Now"] = time.Now()
+	return c.Render(PARTIALS_INVITES_VIEW, bind)
+}
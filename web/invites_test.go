@@ -0,0 +1,87 @@
+package web
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+func TestInvitesAndDomainsApproveWithoutAnAdmin(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	barnConfig := config.Default()
+	barnConfig.AdminUser = "admin@mysite.com"
+	barnConfig.BearerToken = "token"
+	barnConfig.BaseUri = "https://barn.mysite.com"
+	barnConfig.AutoApproveDomains = []string{"@OurCompany.com"}
+	run := func(args ...string) string {
+		out := bytes.Buffer{}
+		if err := RunOffline(barnConfig, ControlRequest{Args: args}, &out); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args, err, out.String())
+		}
+		return out.String()
+	}
+	created := run("invite", "create", "2", "1", "Summer", "party")
+	lines := strings.Split(strings.TrimSpace(created), "\n")
+	link := lines[len(lines)-1]
+	token, found := strings.CutPrefix(link, barnConfig.BaseUri+INVITE_ROUTE+"/")
+	if !found {
+		t.Fatalf("Invite didn't print its link: %v", created)
+	}
+	isApproved := func(email string) bool { return barnage.fs.ApprovedUsers().IsApproved(email) }
+	// every run loads the data dir again, so write what signing in changed
+	signIn := func(email string, inviteToken string, verified bool) {
+		autoApprove(email, inviteToken, verified, "")
+		if err := barnage.fs.StoreApprovedUsers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signIn("guest@gmail.com", token, false)
+	if !isApproved("guest@gmail.com") {
+		t.Fatal("Signing in through an invite didn't approve them")
+	}
+	signIn("plusone@gmail.com", token, false)
+	if isApproved("plusone@gmail.com") {
+		t.Fatal("An invite with one use approved a second person")
+	}
+
+	signIn("intern@ourcompany.com", "", false)
+	if isApproved("intern@ourcompany.com") {
+		t.Fatal("An address Google hadn't verified was approved by its domain")
+	}
+	signIn("intern@ourcompany.com", "", true)
+	if !isApproved("intern@ourcompany.com") {
+		t.Fatal("A verified address at an auto approved domain wasn't approved")
+	}
+	signIn("someone@notourcompany.com", "", true)
+	if isApproved("someone@notourcompany.com") {
+		t.Fatal("A domain that only ends like an auto approved one was approved")
+	}
+
+	run("user", "ban", "intern@ourcompany.com")
+	signIn("intern@ourcompany.com", "", true)
+	if isApproved("intern@ourcompany.com") {
+		t.Fatal("Their domain approved someone an admin banned")
+	}
+
+	users := run("user", "list")
+	for _, wanted := range []string{"approved through invite Summer party", "banned from the CLI"} {
+		if !strings.Contains(users, wanted) {
+			t.Errorf("user list is missing %q:\n%v", wanted, users)
+		}
+	}
+	if invites := run("invite", "list"); !strings.Contains(invites, "1/1") || !strings.Contains(invites, "used up") {
+		t.Errorf("invite list doesn't show the invite used up:\n%v", invites)
+	}
+}
@@ -2,8 +2,6 @@ package web
 
 import (
 	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -13,45 +11,58 @@ import (
 	"time"
 
 	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
 	gojwt "github.com/golang-jwt/jwt/v5"
+	"kmfg.dev/imagebarn/v1/helpme"
 )
 
-const JWT_GOOD_FOR = 90 * 24 * time.Hour
-const KEY_FILE = "./ec_private_key.pem"
-const ISSUED_VERSION_FILE = "./issued-versions.json"
+// both live in the data dir. KEY_FILE is only read to move it into SIGNING_KEYS_FILE
+const KEY_FILE = "ec_private_key.pem"
+const ISSUED_VERSION_FILE = "issued-versions.json"
+
+var keyFile = KEY_FILE
+var issuedVersionFile = ISSUED_VERSION_FILE
+
+// how long a session lasts without being used, each refresh starts it over
+var sessionLifetime = 90 * 24 * time.Hour
 
 var issuedVersion = map[string]int{}
 var issuedVersionRWMutex = sync.RWMutex{}
 
-var loaded = false
+// bumped with every version change, storage skips writes when it matches what was last stored
+var issuedVersionChanges uint64
+var storedIssuedVersionChanges uint64
+var storeIssuedVersionMutex = sync.Mutex{}
 
-var EC, EC_ERR = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+var loaded = false
 
+// StartJWTServices expects openState to have loaded the issued versions, sessions & signing keys
 func StartJWTServices(stopChan chan struct{}, wg *sync.WaitGroup) {
 	if !loaded {
 		loaded = true
-		AdminUserEmail = os.Getenv("ADMIN_USER")
-		if AdminUserEmail == "" {
-			panic("Missing email in .env for ADMIN_USER=")
-		}
-		genOrLoadEc()
-		loadIssuedVersions()
 		storeIssuedVersionsRoutine(stopChan, wg)
+		storeSessionsRoutine(stopChan, wg)
+		signingKeysRoutine(stopChan, wg)
 	} else {
 		slog.Debug("Attempted to start JWT services after they have been started!")
 	}
 }
 
 func loadIssuedVersions() {
-	data, err := os.ReadFile(ISSUED_VERSION_FILE)
+	data, err := helpme.ReadFileVerified(issuedVersionFile)
+	if os.IsNotExist(err) {
+		// nobody has signed in yet
+		return
+	}
 	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to read file %v: %v", ISSUED_VERSION_FILE, err))
+		slog.Error(fmt.Sprintf("Failed to read file %v, every session starts signed out: %v", issuedVersionFile, err))
 		return
 	}
 
 	var issuedVersionTmp map[string]int
 	if err = json.Unmarshal(data, &issuedVersionTmp); err != nil {
-		panic(fmt.Errorf("Error loading issued versions json: %v", err))
+		slog.Error(fmt.Sprintf("Error loading issued versions json, every session starts signed out: %v", err))
+		return
 	}
 
 	issuedVersionRWMutex.Lock()
@@ -60,97 +71,55 @@ func loadIssuedVersions() {
 }
 
 func storeIssuedVersionsRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
-			wg.Add(1)
-			defer wg.Done()
 			select {
 			case <-stopChan:
+				if err := storeIssuedVersions(); err != nil {
+					slog.Error(fmt.Sprintf("Failed final store of issued versions!: %v", err))
+				}
 				slog.Info("Safely stopping issue storage routine.")
 				return
 			default:
 				time.Sleep(2 * time.Second)
-				// why copy data then save?
-				//  on devices that use sd card storage this could be super slow to lock for an entire marshal
-				issuedVersionRWMutex.RLock()
-				copiedIssuedVersion := make(map[string]int, len(issuedVersion))
-				for email, version := range issuedVersion {
-					copiedIssuedVersion[email] = version
-				}
-				issuedVersionRWMutex.RUnlock()
-
-				data, err := json.Marshal(copiedIssuedVersion)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed to marshal issued versions for storge!: %v", err))
-					continue
-				}
-
-				file, err := os.Create(ISSUED_VERSION_FILE)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed to create file issued version storge!: %v", err))
-					continue
-				}
-
-				_, err = file.Write(data)
-				file.Close()
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed write to file issued version storge!: %v", err))
-					continue
+				if err := storeIssuedVersions(); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to store issued versions!: %v", err))
 				}
 			}
 		}
 	}()
 }
 
-func genOrLoadEc() {
-	if _, err := os.Stat(KEY_FILE); err == nil {
-		loadEcFromFile()
-	} else if os.IsNotExist(err) {
-		generateEcToFile()
-	} else {
-		panic(fmt.Sprintf("failed to check key file: %v", err))
-	}
-}
-
-func generateEcToFile() {
-	slog.Info("Key file not found. Using & saving generated...")
-	if EC_ERR != nil {
-		panic(EC_ERR)
-	}
-
-	encodedEC, err := encodePrivateKeyToPEM(EC)
-	if err != nil {
-		panic(err)
-	}
-
-	err = os.WriteFile(KEY_FILE, []byte(encodedEC), 0600)
-	if err != nil {
-		panic(fmt.Sprintf("failed to write key to file: %v", err))
+// writes the issued versions to disk if they changed since the last write
+func storeIssuedVersions() error {
+	storeIssuedVersionMutex.Lock()
+	defer storeIssuedVersionMutex.Unlock()
+	// why copy data then save?
+	//  on devices that use sd card storage this could be super slow to lock for an entire marshal
+	issuedVersionRWMutex.RLock()
+	if issuedVersionChanges == storedIssuedVersionChanges {
+		issuedVersionRWMutex.RUnlock()
+		return nil
 	}
-
-	err = os.Chmod(KEY_FILE, 0600)
-	if err != nil {
-		panic(fmt.Sprintf("failed to set file permissions: %v", err))
+	copiedIssuedVersion := make(map[string]int, len(issuedVersion))
+	for email, version := range issuedVersion {
+		copiedIssuedVersion[email] = version
 	}
+	changes := issuedVersionChanges
+	issuedVersionRWMutex.RUnlock()
 
-	slog.Info("Successfully generated and saved EC private key.")
-}
-
-func loadEcFromFile() {
-	slog.Info("Loading EC private key from file...")
-
-	pemData, err := os.ReadFile(KEY_FILE)
+	data, err := json.Marshal(copiedIssuedVersion)
 	if err != nil {
-		panic(fmt.Sprintf("failed to read key file: %v", err))
+		return fmt.Errorf("Failed to marshal issued versions: %v", err)
 	}
 
-	elc, err := decodePrivateKeyFromPEM(pemData)
-	if err != nil {
-		panic(fmt.Sprintf("failed to decode private key: %v", err))
+	if err = helpme.WriteFileAtomic(issuedVersionFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write issued versions: %v", err)
 	}
-	EC = elc
-
-	slog.Info("Successfully loaded EC private key.")
+	storedIssuedVersionChanges = changes
+	return nil
 }
 
 func decodePrivateKeyFromPEM(pemData []byte) (*ecdsa.PrivateKey, error) {
@@ -179,101 +148,60 @@ func encodePrivateKeyToPEM(priv *ecdsa.PrivateKey) (string, error) {
 	return string(privPEM), nil
 }
 
-func IsValid(jwtStr string) (gojwt.MapClaims, bool) {
-	token, err := gojwt.Parse(jwtStr, func(token *gojwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*gojwt.SigningMethodECDSA); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-
-		if EC_ERR != nil {
-			return nil, fmt.Errorf("Error with ECSDA gen: %v", EC_ERR)
-		}
-
-		return &EC.PublicKey, nil
-	})
-
-	if err != nil {
+// IsValid checks an access token's signature, exp & iat, then that its session hasn't been revoked
+func IsValid(jwtStr string) (*SessionClaims, bool) {
+	if jwtStr == "" {
+		return nil, false
+	}
+	claims := &SessionClaims{}
+	token, err := gojwt.ParseWithClaims(jwtStr, claims, ecKeyFunc,
+		gojwt.WithValidMethods([]string{gojwt.SigningMethodES256.Alg()}),
+		gojwt.WithExpirationRequired(),
+		gojwt.WithIssuedAt(),
+	)
+	if err != nil || !token.Valid {
 		slog.Debug(fmt.Sprintf("Error parsing token!:\n\t%v", err))
 		return nil, false
 	}
-
-	claims, ok := token.Claims.(gojwt.MapClaims)
-
-	if token.Valid && ok && claims["expires"] != "" {
-		claimExpStr := fmt.Sprint(claims["expires"])
-		expires, err := time.Parse(time.RFC3339Nano, claimExpStr)
-
-		if err != nil {
-			slog.Error(fmt.Sprintf("Error parsing expires time!:\n\t%v", err))
-			return nil, false
-		}
-
-		if claims["version"] == nil {
-			slog.Error("No version provided in JWT.")
-			return nil, false
-		}
-		claimVersion := int(claims["version"].(float64))
-
-		issuedVersionRWMutex.RLock()
-		defer issuedVersionRWMutex.RUnlock()
-		if issuedVersion[claims["email"].(string)] == claimVersion {
-			return claims, time.Now().Before(expires)
-		} else {
-			return nil, false
-		}
-	} else {
-		slog.Error(fmt.Sprintf("Error parsing claims!:\n\t%v", err))
+	if claims.Subject == "" || claims.ID == "" || claims.Family == "" {
+		slog.Debug("Token is missing sub, jti or its session.")
 		return nil, false
 	}
-}
-
-func CreateJwt(email string) (string, error) {
-	issuedVersionRWMutex.Lock()
-	issuedVersion[email]++
-	issuedVersionRWMutex.Unlock()
-
-	if EC_ERR != nil {
-		return "", EC_ERR
+	if claims.Version != currentVersion(claims.Subject) || !sessionFamilyAlive(claims.Family, claims.Subject) {
+		return nil, false
 	}
+	return claims, true
+}
 
-	expireTime := expiresAt()
-
-	issuedVersionRWMutex.RLock()
-	token := gojwt.NewWithClaims(gojwt.SigningMethodES256, gojwt.MapClaims{
-		"version": issuedVersion[email],
-		"expires": expireTime.UTC(),
-		"email":   email,
-	})
-	tokStr, err := token.SignedString(EC)
-	issuedVersionRWMutex.RUnlock()
-
+// createAccessToken signs a short lived token for a session family, refreshSession makes the next one
+func createAccessToken(email string, familyId string) (string, error) {
+	jti, err := randomToken(SESSION_ID_BYTES)
 	if err != nil {
 		return "", err
 	}
+	now := time.Now()
+	return signJwt(SessionClaims{
+		Version: currentVersion(email),
+		Family:  familyId,
+		RegisteredClaims: gojwt.RegisteredClaims{
+			Subject:   email,
+			ID:        jti,
+			IssuedAt:  gojwt.NewNumericDate(now),
+			ExpiresAt: gojwt.NewNumericDate(now.Add(ACCESS_TOKEN_LIFETIME)),
+		},
+	})
+}
 
-	return tokStr, nil
+// CreateJwt starts a new session for this browser, any other sessions of email are left alone
+func CreateJwt(c *fiber.Ctx, email string) error {
+	return startSession(c, email)
 }
 
+// InvalidateJwt signs email out everywhere
 func InvalidateJwt(email string) {
 	issuedVersionRWMutex.Lock()
 	issuedVersion[email]++
+	issuedVersionChanges++
 	issuedVersionRWMutex.Unlock()
-}
-
-func getEmailFromJWT(jwt string) (string, bool) {
-	claims, valid := IsValid(jwt)
-	if !valid {
-		slog.Debug(fmt.Sprintf("Failed to validate JWT"))
-		return "", false
-	}
-	email, exists := claims["email"]
-	if !exists {
-		slog.Debug(fmt.Sprintf("Email doesn't exist in JWT"))
-		return "", false
-	}
-	return email.(string), true
-}
-
-func expiresAt() time.Time {
-	return time.Now().Add(JWT_GOOD_FOR)
+	revokeSessionFamilies(email)
 }
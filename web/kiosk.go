@@ -0,0 +1,305 @@
+package web
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/utils"
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+const KIOSK_ROUTE = "/kiosk"
+const KIOSK_PAIR_ROUTE = KIOSK_ROUTE + "/pair"
+const KIOSK_PAIR_CODE_ROUTE = KIOSK_ROUTE + "/pair-code"
+const KIOSK_NEXT_ROUTE = KIOSK_ROUTE + "/next"
+const KIOSK_EVENTS_ROUTE = KIOSK_ROUTE + "/events"
+const KIOSK_EMPTY_ROUTE = KIOSK_ROUTE + "/empty"
+
+const KIOSK_VIEW = BASE_VIEW + "/kiosk"
+const KIOSK_PAIR_VIEW = BASE_VIEW + "/kiosk-pair"
+const PARTIALS_PAIR_CODE_VIEW = BASE_PARTIAL + "/pair-code"
+
+const KIOSK_COOKIE = "kiosk"
+const KIOSK_GOOD_FOR = 90 * 24 * time.Hour
+const PAIRING_CODE_GOOD_FOR = 5 * time.Minute
+const PAIRING_CODE_SIZE = 6
+const PAIRING_CODE_CLEAN_EVERY = 30 * time.Second
+
+// no 0/O or 1/I, these get typed in on a remote
+const PAIRING_CODE_BYTES = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const CAPTION_HEADER = "X-ImageBarn-Caption"
+
+const KIOSK_TRANSITION_FADE = "fade"
+const KIOSK_TRANSITION_SLIDE = "slide"
+const KIOSK_TRANSITION_NONE = "none"
+const KIOSK_DEFAULT_INTERVAL = 10
+const KIOSK_MIN_INTERVAL = 3
+const KIOSK_MAX_INTERVAL = 60 * 60
+
+var (
+	pairingCodesRWMutex = sync.RWMutex{}
+	pairingCodes        = map[string]*PairingCode{}
+
+	kioskEmptyArtwork string
+)
+
+// RegisterKiosk serves a full-screen slideshow at /kiosk that pulls from the pool like any other display.
+//
+//	A display is paired by entering a code minted with the bearer token, either through
+//	POST /api/display/pair or the admin's "Pair a display" button.
+func RegisterKiosk(barnage *BarnageWeb) {
+	kioskEmptyArtwork = barnage.config.KioskEmptyArtwork
+
+	kioskRouter := barnage.fiber.Group(KIOSK_ROUTE)
+	kioskRouter.Get("", kiosk)
+	// codes are short enough to guess without this
+	kioskRouter.Post("/pair", limiter.New(limiter.Config{
+		Max:               10,
+		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+	}), pairKiosk)
+	kioskRouter.Get("/empty", kioskEmpty)
+	kioskRouter.Get("/next", limiter.New(limiter.Config{
+		Max:               60,
+		Expiration:        1 * time.Minute,
+		KeyGenerator:      clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+	}), kioskMiddleware, kioskNext)
+	kioskRouter.Get("/events", kioskMiddleware, streamKioskEvents)
+	kioskRouter.Post("/pair-code", adminCheckMiddleware, createPairingCodeAdmin)
+
+	pairingCodesRoutine(barnage.stopChan, barnage.wg)
+}
+
+func pairingCodesRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping pairing codes routine.")
+				return
+			case <-time.After(PAIRING_CODE_CLEAN_EVERY):
+				cleanPairingCodes()
+			}
+		}
+	}()
+}
+
+func kiosk(c *fiber.Ctx) error {
+	settings, valid := getKioskSettingsFromJWT(c.Cookies(KIOSK_COOKIE, ""))
+	if !valid {
+		return c.Render(KIOSK_PAIR_VIEW, fiber.Map{"PairRoute": KIOSK_PAIR_ROUTE, "CsrfToken": c.Locals(CSRF_LOCAL)}, DISPLAY_LAYOUT)
+	}
+	return c.Render(KIOSK_VIEW, fiber.Map{
+		"Settings":    settings,
+		"NextRoute":   KIOSK_NEXT_ROUTE,
+		"EmptyRoute":  KIOSK_EMPTY_ROUTE,
+		"EventsRoute": KIOSK_EVENTS_ROUTE,
+	}, DISPLAY_LAYOUT)
+}
+
+func pairKiosk(c *fiber.Ctx) error {
+	code := strings.ToUpper(strings.ReplaceAll(c.FormValue("code", ""), " ", ""))
+	pairingCode, valid := redeemPairingCode(code)
+	if !valid {
+		return c.Render(KIOSK_PAIR_VIEW, fiber.Map{
+			"PairRoute": KIOSK_PAIR_ROUTE,
+			"CsrfToken": c.Locals(CSRF_LOCAL),
+			"Error":     "That code is invalid or has expired.",
+		}, DISPLAY_LAYOUT)
+	}
+	jwt, err := createKioskJwt(pairingCode)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to create kiosk JWT: %v", err))
+		return c.SendStatus(500)
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     KIOSK_COOKIE,
+		Value:    jwt,
+		Expires:  time.Now().Add(KIOSK_GOOD_FOR),
+		HTTPOnly: true,
+		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	slog.Info("Paired a new kiosk display.")
+	recordAudit("", clientIP(c), audit.KIOSK_PAIRED, "", fmt.Sprintf("every %v seconds", pairingCode.settings.IntervalSeconds))
+	return c.Redirect(KIOSK_ROUTE, 303)
+}
+
+func kioskMiddleware(c *fiber.Ctx) error {
+	if _, valid := getKioskSettingsFromJWT(c.Cookies(KIOSK_COOKIE, "")); !valid {
+		return c.SendStatus(401)
+	}
+	return c.Next()
+}
+
+func kioskNext(c *fiber.Ctx) error {
+	return consumeImage(c, func(email string, fileName string) {
+		c.Set(CAPTION_HEADER, url.PathEscape(uploaderName(email)))
+	})
+}
+
+// tells paired displays to skip ahead, e.g. when an MQTT "next" command comes in
+func streamKioskEvents(c *fiber.Ctx) error {
+	jwt := utils.CopyString(c.Cookies(KIOSK_COOKIE, ""))
+	isStillValid := func() bool {
+		_, valid := getKioskSettingsFromJWT(jwt)
+		return valid
+	}
+	return streamSSE(c, isStillValid, func(event events.Event) (string, string, bool) {
+		if event.Type != events.DISPLAY_ADVANCE {
+			return "", "", false
+		}
+		return string(event.Type), "{}", true
+	})
+}
+
+func kioskEmpty(c *fiber.Ctx) error {
+	if kioskEmptyArtwork == "" {
+		return c.Redirect("/static/barnage.webp", 302)
+	}
+	return c.SendFile(kioskEmptyArtwork)
+}
+
+// the API flavor, settings come in as JSON & the code goes back as JSON
+func createPairingCodeApi(c *fiber.Ctx) error {
+	settings := KioskSettings{IntervalSeconds: KIOSK_DEFAULT_INTERVAL, Transition: KIOSK_TRANSITION_FADE, Captions: true}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&settings); err != nil {
+			return c.SendStatus(400)
+		}
+	}
+	// the display stays paired for as long as this key does
+	code, err := insertPairingCode(keyFingerprint(c.Locals("apiKey").(string)), settings)
+	if err != nil {
+		return c.SendStatus(400)
+	}
+	return c.JSON(fiber.Map{"code": code, "expiresIn": int(PAIRING_CODE_GOOD_FOR.Seconds())})
+}
+
+func createPairingCodeAdmin(c *fiber.Ctx) error {
+	interval, err := strconv.Atoi(c.FormValue("interval", strconv.Itoa(KIOSK_DEFAULT_INTERVAL)))
+	if err != nil {
+		return c.Render(PARTIALS_PAIR_CODE_VIEW, fiber.Map{"Error": "Interval must be a whole number of seconds."})
+	}
+	settings := KioskSettings{
+		IntervalSeconds: interval,
+		Transition:      c.FormValue("transition", KIOSK_TRANSITION_FADE),
+		Captions:        c.FormValue("captions", "") == "on",
+	}
+	code, err := insertPairingCode(defaultKeyFingerprint(), settings)
+	if err != nil {
+		return c.Render(PARTIALS_PAIR_CODE_VIEW, fiber.Map{"Error": err.Error()})
+	}
+	return c.Render(PARTIALS_PAIR_CODE_VIEW, fiber.Map{
+		"Code":      code,
+		"KioskPath": KIOSK_ROUTE,
+		"Minutes":   int(PAIRING_CODE_GOOD_FOR.Minutes()),
+	})
+}
+
+func validateKioskSettings(settings KioskSettings) error {
+	if settings.IntervalSeconds < KIOSK_MIN_INTERVAL || settings.IntervalSeconds > KIOSK_MAX_INTERVAL {
+		return fmt.Errorf("Interval must be between %v and %v seconds.", KIOSK_MIN_INTERVAL, KIOSK_MAX_INTERVAL)
+	}
+	switch settings.Transition {
+	case KIOSK_TRANSITION_FADE, KIOSK_TRANSITION_SLIDE, KIOSK_TRANSITION_NONE:
+		return nil
+	default:
+		return fmt.Errorf("Unknown transition \"%v\".", settings.Transition)
+	}
+}
+
+func insertPairingCode(keyFingerprint string, settings KioskSettings) (string, error) {
+	if err := validateKioskSettings(settings); err != nil {
+		return "", err
+	}
+	b := make([]byte, PAIRING_CODE_SIZE)
+	for i := range b {
+		randomPos, err := rand.Int(rand.Reader, big.NewInt(int64(len(PAIRING_CODE_BYTES))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = PAIRING_CODE_BYTES[randomPos.Int64()]
+	}
+	code := string(b)
+
+	pairingCodesRWMutex.Lock()
+	pairingCodes[code] = &PairingCode{keyFingerprint, settings, time.Now()}
+	pairingCodesRWMutex.Unlock()
+	return code, nil
+}
+
+// codes are single use
+func redeemPairingCode(code string) (*PairingCode, bool) {
+	pairingCodesRWMutex.Lock()
+	defer pairingCodesRWMutex.Unlock()
+	pairingCode, exists := pairingCodes[code]
+	if !exists {
+		return nil, false
+	}
+	delete(pairingCodes, code)
+	if time.Since(pairingCode.createdAt) > PAIRING_CODE_GOOD_FOR {
+		return nil, false
+	}
+	return pairingCode, true
+}
+
+func cleanPairingCodes() {
+	pairingCodesRWMutex.Lock()
+	defer pairingCodesRWMutex.Unlock()
+	for code, pairingCode := range pairingCodes {
+		if time.Since(pairingCode.createdAt) > PAIRING_CODE_GOOD_FOR {
+			delete(pairingCodes, code)
+		}
+	}
+}
+
+// the start of the key's hash, enough to tell keys apart without storing anything usable
+func keyFingerprint(token string) string {
+	return hashApiKey(token)[:API_KEY_FINGERPRINT_LENGTH]
+}
+
+func createKioskJwt(pairingCode *PairingCode) (string, error) {
+	return signJwt(gojwt.MapClaims{
+		"kiosk":      true,
+		"key":        pairingCode.keyFingerprint,
+		"interval":   pairingCode.settings.IntervalSeconds,
+		"transition": pairingCode.settings.Transition,
+		"captions":   pairingCode.settings.Captions,
+		"exp":        time.Now().Add(KIOSK_GOOD_FOR).Unix(),
+	})
+}
+
+func getKioskSettingsFromJWT(jwt string) (KioskSettings, bool) {
+	if jwt == "" {
+		return KioskSettings{}, false
+	}
+	token, err := gojwt.Parse(jwt, ecKeyFunc, gojwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		slog.Debug(fmt.Sprintf("Failed to validate kiosk JWT: %v", err))
+		return KioskSettings{}, false
+	}
+	claims, ok := token.Claims.(gojwt.MapClaims)
+	if !ok || claims["kiosk"] != true || !isCurrentKeyFingerprint(fmt.Sprint(claims["key"])) {
+		return KioskSettings{}, false
+	}
+	interval, _ := claims["interval"].(float64)
+	transition, _ := claims["transition"].(string)
+	captions, _ := claims["captions"].(bool)
+	return KioskSettings{int(interval), transition, captions}, true
+}
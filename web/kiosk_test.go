@@ -0,0 +1,132 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"kmfg.dev/imagebarn/v1/config"
+)
+
+func TestPairingCodesWorkOnceUntilTheyExpire(t *testing.T) {
+	settings := KioskSettings{IntervalSeconds: KIOSK_DEFAULT_INTERVAL, Transition: KIOSK_TRANSITION_FADE, Captions: true}
+	code, err := insertPairingCode("fingerprint", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != PAIRING_CODE_SIZE || strings.Trim(code, PAIRING_CODE_BYTES) != "" {
+		t.Errorf("%q isn't made of the code letters", code)
+	}
+	if _, valid := redeemPairingCode("nope"); valid {
+		t.Error("Redeemed a code that was never made")
+	}
+	pairingCode, valid := redeemPairingCode(code)
+	if !valid || pairingCode.keyFingerprint != "fingerprint" || pairingCode.settings != settings {
+		t.Fatalf("Redeeming got %+v %v", pairingCode, valid)
+	}
+	if _, valid = redeemPairingCode(code); valid {
+		t.Error("A code worked twice")
+	}
+
+	expired, err := insertPairingCode("fingerprint", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := insertPairingCode("fingerprint", settings)
+	pairingCodesRWMutex.Lock()
+	pairingCodes[expired].createdAt = time.Now().Add(-PAIRING_CODE_GOOD_FOR - time.Second)
+	pairingCodes[stale].createdAt = time.Now().Add(-PAIRING_CODE_GOOD_FOR - time.Second)
+	pairingCodesRWMutex.Unlock()
+	if _, valid = redeemPairingCode(expired); valid {
+		t.Error("An expired code worked")
+	}
+	cleanPairingCodes()
+	pairingCodesRWMutex.RLock()
+	_, kept := pairingCodes[stale]
+	pairingCodesRWMutex.RUnlock()
+	if kept {
+		t.Error("Cleaning kept an expired code")
+	}
+
+	for _, bad := range []KioskSettings{{IntervalSeconds: 1, Transition: KIOSK_TRANSITION_FADE}, {IntervalSeconds: 10, Transition: "spin"}} {
+		if _, err = insertPairingCode("fingerprint", bad); err == nil {
+			t.Errorf("Made a code for %+v", bad)
+		}
+	}
+}
+
+func TestPairedKiosksGetACookieThatLetsThemIn(t *testing.T) {
+	useSigningKeysDir(t, nil)
+	useAuditDir(t)
+	barnConfig := config.Default()
+	barnConfig.BearerToken = "default-token"
+	oldKeys := configApiKeys.Load()
+	t.Cleanup(func() { configApiKeys.Store(oldKeys) })
+	setApiKeys(barnConfig)
+
+	app := fiber.New(fiber.Config{Views: html.NewFileSystem(http.FS(viewsFS), ".html")})
+	app.Post(KIOSK_PAIR_ROUTE, pairKiosk)
+	app.Get(KIOSK_NEXT_ROUTE, kioskMiddleware, func(c *fiber.Ctx) error {
+		return c.SendString("next")
+	})
+	pair := func(code string) (*http.Response, *http.Cookie) {
+		req := httptest.NewRequest("POST", KIOSK_PAIR_ROUTE, strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == KIOSK_COOKIE {
+				return resp, cookie
+			}
+		}
+		return resp, nil
+	}
+
+	code, err := insertPairingCode(defaultKeyFingerprint(), KioskSettings{IntervalSeconds: 5, Transition: KIOSK_TRANSITION_NONE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// typed in on a remote, lowercase & with spaces
+	resp, cookie := pair(strings.ToLower(code[:3] + " " + code[3:]))
+	if resp.StatusCode != 303 || cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("Pairing got %v with cookie %+v", resp.StatusCode, cookie)
+	}
+	if resp, cookie := pair(code); resp.StatusCode != 200 || cookie != nil {
+		t.Errorf("Pairing twice with one code got %v with cookie %+v", resp.StatusCode, cookie)
+	}
+
+	next := func(cookie *http.Cookie) int {
+		req := httptest.NewRequest("GET", KIOSK_NEXT_ROUTE, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := next(cookie); status != 200 {
+		t.Errorf("A paired kiosk got %v", status)
+	}
+	if status := next(nil); status != 401 {
+		t.Errorf("An unpaired kiosk got %v", status)
+	}
+	if settings, valid := getKioskSettingsFromJWT(cookie.Value); !valid || settings.IntervalSeconds != 5 || settings.Transition != KIOSK_TRANSITION_NONE {
+		t.Errorf("The cookie carries %+v %v", settings, valid)
+	}
+
+	// kiosks stop once the key that paired them is gone
+	barnConfig.BearerToken = "rotated-token"
+	setApiKeys(barnConfig)
+	if status := next(cookie); status != 401 {
+		t.Errorf("A kiosk paired with a revoked key got %v", status)
+	}
+}
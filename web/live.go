@@ -0,0 +1,154 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/events"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+const LIVE_ROUTE = "/live"
+const LIVE_EVENTS_ROUTE = LIVE_ROUTE + "/events"
+const LIVE_IMAGE_ROUTE = LIVE_ROUTE + "/image"
+
+const DISPLAY_LAYOUT = BASE_VIEW + "/layouts/display"
+const LIVE_VIEW = BASE_VIEW + "/live"
+
+var liveFeedEnabled bool
+var liveFeedKey string
+var nowShowing = &NowShowing{}
+
+// RegisterLiveFeed mirrors whatever /api/image hands out to a projector page at /live.
+//
+//	LIVE_FEED=public lets anyone watch, LIVE_FEED=keyed requires ?key=LIVE_FEED_KEY.
+func RegisterLiveFeed(barnage *BarnageWeb) {
+	mode := barnage.config.LiveFeed
+	switch mode {
+	case config.LIVE_FEED_OFF:
+		return
+	case config.LIVE_FEED_PUBLIC:
+		liveFeedKey = ""
+	case config.LIVE_FEED_KEYED:
+		liveFeedKey = barnage.config.LiveFeedKey
+	}
+	liveFeedEnabled = true
+	slog.Info(fmt.Sprintf("Live feed is %v at %v", mode, LIVE_ROUTE))
+
+	liveRouter := barnage.fiber.Group(LIVE_ROUTE)
+	liveRouter.Use(liveKeyMiddleware)
+	liveRouter.Get("", live)
+	liveRouter.Get("/events", streamLive)
+	liveRouter.Get("/image/:seq", liveImage)
+}
+
+func liveKeyMiddleware(c *fiber.Ctx) error {
+	if liveFeedKey == "" {
+		return c.Next()
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("key", "")), []byte(liveFeedKey)) != 1 {
+		return c.SendStatus(401)
+	}
+	return c.Next()
+}
+
+func live(c *fiber.Ctx) error {
+	return c.Render(LIVE_VIEW, fiber.Map{
+		"EventsRoute": LIVE_EVENTS_ROUTE + keyQuery(c),
+		"NowShowing":  template.HTML(nowShowingFragment(nowShowing.Seq(), keyQuery(c))),
+	}, DISPLAY_LAYOUT)
+}
+
+func streamLive(c *fiber.Ctx) error {
+	keyQuery := utils.CopyString(keyQuery(c))
+	var initial [][2]string
+	if seq := nowShowing.Seq(); seq > 0 {
+		initial = append(initial, [2]string{"now-showing", nowShowingFragment(seq, keyQuery)})
+	}
+	return streamSSE(c, func() bool { return true }, func(event events.Event) (string, string, bool) {
+		if event.Type != events.IMAGE_CONSUMED || event.Data["seq"] == "" {
+			return "", "", false
+		}
+		seq, err := strconv.Atoi(event.Data["seq"])
+		if err != nil {
+			return "", "", false
+		}
+		return "now-showing", nowShowingFragment(seq, keyQuery), true
+	}, initial...)
+}
+
+func liveImage(c *fiber.Ctx) error {
+	seq, err := strconv.Atoi(c.Params("seq", ""))
+	if err != nil {
+		return c.SendStatus(400)
+	}
+	image, contentType, currentSeq := nowShowing.Get()
+	if seq != currentSeq || image == nil {
+		// a newer image already took its place
+		return c.SendStatus(404)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+	return c.Send(image)
+}
+
+// showNow reads the image about to be ghosted so the live feed can keep showing it.
+//
+//	Returns the feed's sequence number for it, or 0 when the feed is off.
+func showNow(fullPath string) int {
+	if !liveFeedEnabled {
+		return 0
+	}
+	image, err := filestore.ReadImage(fullPath)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Couldn't read %v for the live feed: %v", fullPath, err))
+		return 0
+	}
+	return nowShowing.Set(image, http.DetectContentType(image))
+}
+
+func keyQuery(c *fiber.Ctx) string {
+	if liveFeedKey == "" {
+		return ""
+	}
+	return "?key=" + url.QueryEscape(c.Query("key", ""))
+}
+
+// single line so it fits in one SSE data field, swapped in by sse-swap="now-showing"
+func nowShowingFragment(seq int, keyQuery string) string {
+	if seq == 0 {
+		return `<p class="shine">Nothing has been shown yet.</p>`
+	}
+	src := fmt.Sprintf("%v/%d%v", LIVE_IMAGE_ROUTE, seq, keyQuery)
+	return fmt.Sprintf(`<img class="now-showing" src="%v" alt="Now showing" />`, html.EscapeString(src))
+}
+
+func (ns *NowShowing) Set(image []byte, contentType string) int {
+	ns.rwMutex.Lock()
+	defer ns.rwMutex.Unlock()
+	ns.seq++
+	ns.image = image
+	ns.contentType = contentType
+	return ns.seq
+}
+
+func (ns *NowShowing) Get() ([]byte, string, int) {
+	ns.rwMutex.RLock()
+	defer ns.rwMutex.RUnlock()
+	return ns.image, ns.contentType, ns.seq
+}
+
+func (ns *NowShowing) Seq() int {
+	ns.rwMutex.RLock()
+	defer ns.rwMutex.RUnlock()
+	return ns.seq
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestKeyedLiveFeedOnlyShowsTheCurrentImageWithTheKey(t *testing.T) {
+	oldKey, oldNowShowing := liveFeedKey, nowShowing
+	liveFeedKey, nowShowing = "projector key", &NowShowing{}
+	t.Cleanup(func() { liveFeedKey, nowShowing = oldKey, oldNowShowing })
+
+	app := fiber.New()
+	liveRouter := app.Group(LIVE_ROUTE)
+	liveRouter.Use(liveKeyMiddleware)
+	liveRouter.Get("/image/:seq", liveImage)
+	get := func(path string) (int, string) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	first := nowShowing.Set([]byte("moo"), "image/webp")
+	for _, key := range []string{"", "?key=wrong", "?key=projector"} {
+		if status, _ := get(LIVE_IMAGE_ROUTE + "/1" + key); status != 401 {
+			t.Errorf("%q got %v", key, status)
+		}
+	}
+	if status, body := get(LIVE_IMAGE_ROUTE + "/1?key=projector+key"); status != 200 || body != "moo" {
+		t.Errorf("The right key got %v %q", status, body)
+	}
+
+	nowShowing.Set([]byte("oink"), "image/webp")
+	if status, _ := get(LIVE_IMAGE_ROUTE + "/1?key=projector+key"); status != 404 {
+		t.Errorf("An image that's no longer showing got %v", status)
+	}
+	// links carry the key so the projector page keeps working
+	if fragment := nowShowingFragment(first+1, "?key=projector+key"); !strings.Contains(fragment, "/2?key=projector+key") {
+		t.Errorf("The image link lost its key: %v", fragment)
+	}
+}
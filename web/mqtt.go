@@ -0,0 +1,28 @@
+package web
+
+import (
+	"fmt"
+
+	"kmfg.dev/imagebarn/v1/mqttbridge"
+)
+
+// RegisterMqtt publishes pool stats & consumptions to the MQTT broker when one is configured
+func RegisterMqtt(barnage *BarnageWeb) {
+	mqttConfig := barnage.config.Mqtt
+	if mqttConfig.Broker == "" {
+		return
+	}
+	bridge, err := mqttbridge.Connect(mqttbridge.Config{
+		Broker:        mqttConfig.Broker,
+		ClientId:      mqttConfig.ClientId,
+		Username:      mqttConfig.Username,
+		Password:      mqttConfig.Password,
+		PoolTopic:     mqttConfig.PoolTopic,
+		ConsumedTopic: mqttConfig.ConsumedTopic,
+		CommandTopic:  mqttConfig.CommandTopic,
+	}, barnage.fs.AvailableCounts)
+	if err != nil {
+		panic(fmt.Errorf("Unable to start the MQTT bridge! Double check your mqtt config: %v", err))
+	}
+	bridge.Start(barnage.drainedChan, barnage.wg)
+}
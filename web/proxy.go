@@ -0,0 +1,62 @@
+package web
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var trustedProxies atomic.Pointer[[]netip.Addr]
+
+// localhost is always trusted
+func setTrustedProxies(proxies []string) {
+	addrs := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}
+	for _, proxy := range proxies {
+		// already validated by the config
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	trustedProxies.Store(&addrs)
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	proxies := trustedProxies.Load()
+	if proxies == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range *proxies {
+		if proxy == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is who actually sent the request. X-Forwarded-For is only believed when a trusted proxy
+// sent it, then the rightmost address that isn't one of our proxies is the client.
+//
+//	fiber's own proxy handling is fixed at startup, this follows config reloads.
+func clientIP(c *fiber.Ctx) string {
+	remote, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok {
+		return c.Context().RemoteIP().String()
+	}
+	if !isTrustedProxy(remote) {
+		return remote.Unmap().String()
+	}
+	forwarded := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop.Unmap().String()
+		}
+	}
+	return remote.Unmap().String()
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+func clientIPFrom(t *testing.T, remote string, forwardedFor string) string {
+	t.Helper()
+	app := fiber.New()
+	req := &fasthttp.Request{}
+	if forwardedFor != "" {
+		req.Header.Set(fiber.HeaderXForwardedFor, forwardedFor)
+	}
+	fctx := &fasthttp.RequestCtx{}
+	fctx.Init(req, &net.TCPAddr{IP: net.ParseIP(remote)}, nil)
+	c := app.AcquireCtx(fctx)
+	defer app.ReleaseCtx(c)
+	return clientIP(c)
+}
+
+func TestClientIPFollowsTrustedProxyReloads(t *testing.T) {
+	setTrustedProxies([]string{"10.0.0.66"})
+
+	if ip := clientIPFrom(t, "203.0.113.9", "198.51.100.1"); ip != "203.0.113.9" {
+		t.Fatalf("Believed X-Forwarded-For from an untrusted client: %v", ip)
+	}
+	// the client can prepend anything, only the hop our proxy added counts
+	if ip := clientIPFrom(t, "10.0.0.66", "6.6.6.6, 198.51.100.1"); ip != "198.51.100.1" {
+		t.Fatalf("Wanted the address our proxy saw, got %v", ip)
+	}
+	if ip := clientIPFrom(t, "10.0.0.66", "198.51.100.1, 127.0.0.1"); ip != "198.51.100.1" {
+		t.Fatalf("Didn't skip a chained trusted proxy, got %v", ip)
+	}
+
+	setTrustedProxies([]string{})
+	if ip := clientIPFrom(t, "10.0.0.66", "198.51.100.1"); ip != "10.0.0.66" {
+		t.Fatalf("Still trusting a proxy removed by a reload: %v", ip)
+	}
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+// what the server started with, set before anything is served
+var startupConfig atomic.Pointer[config.Config]
+
+// ApplyConfig swaps in the reloadable settings of an already validated config without touching sessions.
+//
+//	Anything else that changed is only logged, it needs a restart.
+func ApplyConfig(newConfig *config.Config) {
+	running := startupConfig.Load()
+	if running == nil {
+		slog.Warn("Still starting up, ignoring the config reload.")
+		return
+	}
+	setTrustedProxies(newConfig.TrustedProxies)
+	setApiKeys(newConfig)
+	filestore.ApplyLimits(newConfig)
+	applySigningKeyRotation(newConfig)
+	setSecurityHeaders(newConfig)
+	setCorsPolicy(newConfig)
+	setAutoApproveDomains(newConfig)
+	applyAuditRetention(newConfig)
+
+	// fiber already reads bodies up to the startup limit, uploads can only get smaller than that
+	if newConfig.UploadLimitMb > running.UploadLimitMb {
+		slog.Warn(fmt.Sprintf("upload_limit_mb above %v MB needs a restart, uploads are still capped there until then", running.UploadLimitMb))
+	}
+	if restartOnly := newConfig.RestartOnlyChanges(running); len(restartOnly) > 0 {
+		slog.Warn(fmt.Sprintf("These changes need a restart to take effect: %v", strings.Join(restartOnly, ", ")))
+	}
+	slog.Info(fmt.Sprintf("Reloaded config: %v api keys, %v trusted proxies, %v MB uploads, %v images per user, %v selection",
+		len(newConfig.ApiKeys)+1, len(newConfig.TrustedProxies), newConfig.UploadLimitMb, newConfig.MaxImagesPerUser, newConfig.SelectionPolicy))
+}
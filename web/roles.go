@@ -0,0 +1,85 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// admins promoted next to ADMIN_USER, lives in the data dir
+const ADMINS_FILE = "admins.json"
+
+var adminsFile = ADMINS_FILE
+var promotedAdmins = map[string]bool{}
+var promotedAdminsRWMutex = sync.RWMutex{}
+
+func loadPromotedAdmins() error {
+	data, err := helpme.ReadFileVerified(adminsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", adminsFile, err)
+	}
+	var emails []string
+	if err = json.Unmarshal(data, &emails); err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", adminsFile, err)
+	}
+	promotedAdminsRWMutex.Lock()
+	defer promotedAdminsRWMutex.Unlock()
+	promotedAdmins = map[string]bool{}
+	for _, email := range emails {
+		promotedAdmins[email] = true
+	}
+	return nil
+}
+
+func isAdminEmail(email string) bool {
+	if email == AdminUserEmail {
+		return true
+	}
+	promotedAdminsRWMutex.RLock()
+	defer promotedAdminsRWMutex.RUnlock()
+	return promotedAdmins[email]
+}
+
+// written straight through, promotions are rare
+func setPromotedAdmin(email string, isAdmin bool) error {
+	promotedAdminsRWMutex.Lock()
+	defer promotedAdminsRWMutex.Unlock()
+	if promotedAdmins[email] == isAdmin {
+		return nil
+	}
+
+	emails := []string{}
+	for promoted := range promotedAdmins {
+		if promoted != email {
+			emails = append(emails, promoted)
+		}
+	}
+	if isAdmin {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	data, err := json.Marshal(emails)
+	if err != nil {
+		return err
+	}
+	// only change who's an admin once it's on disk
+	if err = helpme.WriteFileAtomic(adminsFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", adminsFile, err)
+	}
+	if isAdmin {
+		promotedAdmins[email] = true
+		slog.Info(fmt.Sprintf("Promoted %v to admin", email))
+	} else {
+		delete(promotedAdmins, email)
+		slog.Info(fmt.Sprintf("Demoted %v from admin", email))
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// lives in the data dir
+const SESSIONS_FILE = "sessions.json"
+
+const ACCESS_COOKIE = "jwt"
+const REFRESH_COOKIE = "refresh"
+
+// access tokens are checked without a lookup, so keep them short. The refresh token gets a new one silently.
+const ACCESS_TOKEN_LIFETIME = 15 * time.Minute
+
+// a page firing a few requests at once sends the same refresh token with each, that's not reuse
+const REFRESH_REUSE_GRACE = 30 * time.Second
+
+// spent refresh tokens each family remembers, presenting one of these revokes the family
+const SPENT_REFRESH_TOKENS_KEPT = 64
+
+const SESSION_ID_BYTES = 16
+const REFRESH_SECRET_BYTES = 32
+
+// last seen is kept to the minute, so busy pages don't rewrite the sessions file with every request
+const SESSION_SEEN_EVERY = time.Minute
+const USER_AGENT_KEPT = 256
+
+// checked in order, the first one found in the user agent names it
+var USER_AGENT_BROWSERS = [][2]string{{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"SamsungBrowser/", "Samsung Internet"}, {"Firefox/", "Firefox"}, {"FxiOS/", "Firefox"}, {"CriOS/", "Chrome"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"}}
+var USER_AGENT_SYSTEMS = [][2]string{{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"CrOS", "ChromeOS"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"}}
+
+const SESSIONS_ROUTE = "/sessions"
+const ALL_SESSIONS_ROUTE = SESSIONS_ROUTE + "/all"
+const PARTIALS_SESSIONS_VIEW = BASE_PARTIAL + "/sessions"
+
+// where currentSession keeps what it found, so a request only refreshes once
+const SESSION_LOCAL = "session"
+
+var sessionsFile = SESSIONS_FILE
+var sessionFamilies = map[string]*SessionFamily{}
+var sessionsRWMutex = sync.RWMutex{}
+
+// bumped with every change, storage skips writes when it matches what was last stored
+var sessionChanges uint64
+var storedSessionChanges uint64
+var storeSessionsMutex = sync.Mutex{}
+
+func loadSessions() {
+	data, err := helpme.ReadFileVerified(sessionsFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to read file %v, every session starts signed out: %v", sessionsFile, err))
+		return
+	}
+	families := map[string]*SessionFamily{}
+	if err = json.Unmarshal(data, &families); err != nil {
+		slog.Error(fmt.Sprintf("Error loading sessions json, every session starts signed out: %v", err))
+		return
+	}
+	sessionsRWMutex.Lock()
+	sessionFamilies = families
+	sessionsRWMutex.Unlock()
+}
+
+func storeSessionsRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopChan:
+				if err := storeSessions(); err != nil {
+					slog.Error(fmt.Sprintf("Failed final store of sessions!: %v", err))
+				}
+				slog.Info("Safely stopping session storage routine.")
+				return
+			default:
+				time.Sleep(2 * time.Second)
+				pruneSessions()
+				if err := storeSessions(); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to store sessions!: %v", err))
+				}
+			}
+		}
+	}()
+}
+
+// writes the sessions to disk if they changed since the last write
+func storeSessions() error {
+	storeSessionsMutex.Lock()
+	defer storeSessionsMutex.Unlock()
+	sessionsRWMutex.RLock()
+	if sessionChanges == storedSessionChanges {
+		sessionsRWMutex.RUnlock()
+		return nil
+	}
+	data, err := json.Marshal(sessionFamilies)
+	changes := sessionChanges
+	sessionsRWMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Failed to marshal sessions: %v", err)
+	}
+
+	if err = helpme.WriteFileAtomic(sessionsFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write sessions: %v", err)
+	}
+	storedSessionChanges = changes
+	return nil
+}
+
+// drops the families nobody has refreshed within the session lifetime
+func pruneSessions() {
+	sessionsRWMutex.Lock()
+	defer sessionsRWMutex.Unlock()
+	for id, family := range sessionFamilies {
+		if family.expired() {
+			delete(sessionFamilies, id)
+			sessionChanges++
+		}
+	}
+}
+
+// sliding, every refresh pushes it back
+func (family *SessionFamily) expired() bool {
+	return time.Since(family.LastUsed) > sessionLifetime
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// the family id is in the clear so the family can be found, only the secret's hash is kept
+func newRefreshToken(familyId string) (string, string, error) {
+	secret, err := randomToken(REFRESH_SECRET_BYTES)
+	if err != nil {
+		return "", "", err
+	}
+	return familyId + "." + secret, hashApiKey(secret), nil
+}
+
+// startSession signs email in with a new session family, setting its access & refresh cookies
+func startSession(c *fiber.Ctx, email string) error {
+	familyId, err := randomToken(SESSION_ID_BYTES)
+	if err != nil {
+		return err
+	}
+	refreshToken, refreshHash, err := newRefreshToken(familyId)
+	if err != nil {
+		return err
+	}
+	issuedVersionRWMutex.RLock()
+	version := issuedVersion[email]
+	issuedVersionRWMutex.RUnlock()
+
+	now := time.Now().UTC()
+	userAgent, ip := sessionDevice(c)
+	family := &SessionFamily{Id: familyId, Email: email, Version: version, Current: refreshHash, Spent: []string{}, Created: now, LastUsed: now, Rotated: now, UserAgent: userAgent, Ip: ip}
+	accessToken, err := createAccessToken(email, familyId)
+	if err != nil {
+		return err
+	}
+	sessionsRWMutex.Lock()
+	sessionFamilies[familyId] = family
+	sessionChanges++
+	sessionsRWMutex.Unlock()
+	setSessionCookies(c, accessToken, refreshToken)
+	return nil
+}
+
+// currentSession is whoever the access cookie says, refreshing it first if it has expired
+func currentSession(c *fiber.Ctx) (*SessionClaims, bool) {
+	if claims, found := c.Locals(SESSION_LOCAL).(*SessionClaims); found {
+		return claims, claims != nil
+	}
+	claims, valid := IsValid(c.Cookies(ACCESS_COOKIE, ""))
+	if valid {
+		touchSession(c, claims.Family)
+	} else {
+		claims, valid = refreshSession(c)
+	}
+	c.Locals(SESSION_LOCAL, claims)
+	return claims, valid
+}
+
+// keeps last seen & where from up to date between refreshes
+func touchSession(c *fiber.Ctx, familyId string) {
+	sessionsRWMutex.RLock()
+	family := sessionFamilies[familyId]
+	stale := family != nil && time.Since(family.LastUsed) > SESSION_SEEN_EVERY
+	sessionsRWMutex.RUnlock()
+	if !stale {
+		return
+	}
+	userAgent, ip := sessionDevice(c)
+	sessionsRWMutex.Lock()
+	if family = sessionFamilies[familyId]; family != nil {
+		family.LastUsed = time.Now().UTC()
+		family.UserAgent, family.Ip = userAgent, ip
+		sessionChanges++
+	}
+	sessionsRWMutex.Unlock()
+}
+
+func sessionDevice(c *fiber.Ctx) (string, string) {
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > USER_AGENT_KEPT {
+		userAgent = strings.ToValidUTF8(userAgent[:USER_AGENT_KEPT], "")
+	}
+	return userAgent, clientIP(c)
+}
+
+// sessionEmail is the signed in user's email, if anyone is
+func sessionEmail(c *fiber.Ctx) (string, bool) {
+	claims, valid := currentSession(c)
+	if !valid {
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+// refreshSession swaps the refresh cookie for a new one & a fresh access token.
+//
+//	A refresh token that was already swapped means someone else has a copy, so the whole family is revoked.
+func refreshSession(c *fiber.Ctx) (*SessionClaims, bool) {
+	familyId, secret, found := strings.Cut(c.Cookies(REFRESH_COOKIE, ""), ".")
+	if !found {
+		return nil, false
+	}
+	hash := hashApiKey(secret)
+
+	sessionsRWMutex.Lock()
+	family := sessionFamilies[familyId]
+	if family == nil || family.expired() || family.Version != currentVersion(family.Email) {
+		sessionsRWMutex.Unlock()
+		return nil, false
+	}
+	refreshToken := ""
+	switch {
+	case hash == family.Current:
+		newToken, newHash, err := newRefreshToken(familyId)
+		if err != nil {
+			sessionsRWMutex.Unlock()
+			slog.Error(fmt.Sprintf("Failed to make a refresh token: %v", err))
+			return nil, false
+		}
+		family.Spent = append(family.Spent, family.Current)
+		if len(family.Spent) > SPENT_REFRESH_TOKENS_KEPT {
+			family.Spent = family.Spent[len(family.Spent)-SPENT_REFRESH_TOKENS_KEPT:]
+		}
+		family.Current = newHash
+		family.Rotated = time.Now().UTC()
+		refreshToken = newToken
+	case len(family.Spent) > 0 && hash == family.Spent[len(family.Spent)-1] && time.Since(family.Rotated) < REFRESH_REUSE_GRACE:
+		// lost a race with a sibling request, whose response carries the new refresh token
+	case slices.Contains(family.Spent, hash):
+		delete(sessionFamilies, familyId)
+		sessionChanges++
+		sessionsRWMutex.Unlock()
+		slog.Warn(fmt.Sprintf("A spent refresh token for %v was used again, revoked that session in case it was stolen", family.Email))
+		recordAudit("", clientIP(c), audit.REFRESH_TOKEN_REUSE, family.Email, describeUserAgent(family.UserAgent))
+		return nil, false
+	default:
+		sessionsRWMutex.Unlock()
+		return nil, false
+	}
+	family.LastUsed = time.Now().UTC()
+	family.UserAgent, family.Ip = sessionDevice(c)
+	sessionChanges++
+	email := family.Email
+	sessionsRWMutex.Unlock()
+
+	accessToken, err := createAccessToken(email, familyId)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to make an access token: %v", err))
+		return nil, false
+	}
+	setSessionCookies(c, accessToken, refreshToken)
+	claims, valid := IsValid(accessToken)
+	return claims, valid
+}
+
+// endSession signs this browser out & revokes its family
+func endSession(c *fiber.Ctx) {
+	familyId, _, _ := strings.Cut(c.Cookies(REFRESH_COOKIE, ""), ".")
+	if claims, valid := IsValid(c.Cookies(ACCESS_COOKIE, "")); valid {
+		familyId = claims.Family
+	}
+	revokeSessionFamily(familyId)
+	for _, name := range []string{ACCESS_COOKIE, REFRESH_COOKIE} {
+		c.Cookie(&fiber.Cookie{
+			Name:     name,
+			Value:    "",
+			Expires:  time.Now(),
+			HTTPOnly: true,
+			Secure:   isSecure,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+}
+
+// an empty refresh token leaves the refresh cookie as it is. Lax so following a link here still arrives signed in.
+func setSessionCookies(c *fiber.Ctx, accessToken string, refreshToken string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     ACCESS_COOKIE,
+		Value:    accessToken,
+		HTTPOnly: true,
+		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	if refreshToken == "" {
+		return
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     REFRESH_COOKIE,
+		Value:    refreshToken,
+		Expires:  time.Now().Add(sessionLifetime),
+		HTTPOnly: true,
+		Secure:   isSecure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// revokeSessionFamily returns the family it revoked, nil when there wasn't one
+func revokeSessionFamily(familyId string) *SessionFamily {
+	sessionsRWMutex.Lock()
+	defer sessionsRWMutex.Unlock()
+	family, exists := sessionFamilies[familyId]
+	if exists {
+		delete(sessionFamilies, familyId)
+		sessionChanges++
+	}
+	return family
+}
+
+// revokes every family of email, their access tokens stop working right away too
+func revokeSessionFamilies(email string) {
+	sessionsRWMutex.Lock()
+	defer sessionsRWMutex.Unlock()
+	for id, family := range sessionFamilies {
+		if family.Email == email {
+			delete(sessionFamilies, id)
+			sessionChanges++
+		}
+	}
+}
+
+// signs email out everywhere but keepId
+func revokeOtherSessionFamilies(email string, keepId string) {
+	sessionsRWMutex.Lock()
+	defer sessionsRWMutex.Unlock()
+	for id, family := range sessionFamilies {
+		if family.Email == email && id != keepId {
+			delete(sessionFamilies, id)
+			sessionChanges++
+		}
+	}
+}
+
+func sessionFamilyAlive(familyId string, email string) bool {
+	sessionsRWMutex.RLock()
+	defer sessionsRWMutex.RUnlock()
+	family := sessionFamilies[familyId]
+	return family != nil && family.Email == email && !family.expired()
+}
+
+func currentVersion(email string) int {
+	issuedVersionRWMutex.RLock()
+	defer issuedVersionRWMutex.RUnlock()
+	return issuedVersion[email]
+}
+
+// listSessions is every live session of email, or everyone's when email is empty. currentId is marked as the current one.
+func listSessions(email string, currentId string) []ViewSession {
+	sessionsRWMutex.RLock()
+	listed := make([]ViewSession, 0)
+	for id, family := range sessionFamilies {
+		if (email != "" && family.Email != email) || family.expired() {
+			continue
+		}
+		listed = append(listed, ViewSession{
+			Id:       id,
+			Email:    family.Email,
+			Device:   describeUserAgent(family.UserAgent),
+			Ip:       family.Ip,
+			Created:  family.Created.Local(),
+			LastSeen: family.LastUsed.Local(),
+			Current:  id == currentId,
+		})
+	}
+	sessionsRWMutex.RUnlock()
+
+	sort.Slice(listed, func(i, j int) bool {
+		if listed[i].Email != listed[j].Email {
+			return listed[i].Email < listed[j].Email
+		}
+		return listed[i].LastSeen.After(listed[j].LastSeen)
+	})
+	return listed
+}
+
+// a rough "Firefox on Android", good enough to tell your own devices apart
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	browser, system := "", ""
+	for _, known := range USER_AGENT_BROWSERS {
+		if strings.Contains(userAgent, known[0]) {
+			browser = known[1]
+			break
+		}
+	}
+	for _, known := range USER_AGENT_SYSTEMS {
+		if strings.Contains(userAgent, known[0]) {
+			system = known[1]
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return userAgent
+}
+
+func RegisterSessions(barnage *BarnageWeb) {
+	allSessionsRouter := barnage.fiber.Group(ALL_SESSIONS_ROUTE)
+	allSessionsRouter.Use(adminCheckMiddleware)
+	allSessionsRouter.Get("", showAllSessions)
+	allSessionsRouter.Delete("/:id", killSession)
+
+	sessionsRouter := barnage.fiber.Group(SESSIONS_ROUTE)
+	sessionsRouter.Get("", showMySessions)
+	sessionsRouter.Delete("", endMyOtherSessions)
+	sessionsRouter.Delete("/:id", endMySession)
+}
+
+func showMySessions(c *fiber.Ctx) error {
+	claims, valid := currentSession(c)
+	if !valid {
+		return fmt.Errorf("Invalid JWT!")
+	}
+	return renderSessions(c, claims, false)
+}
+
+func endMySession(c *fiber.Ctx) error {
+	claims, valid := currentSession(c)
+	if !valid {
+		return fmt.Errorf("Invalid JWT!")
+	}
+	return endSessionFromPage(c, claims, false)
+}
+
+func endMyOtherSessions(c *fiber.Ctx) error {
+	claims, valid := currentSession(c)
+	if !valid {
+		return fmt.Errorf("Invalid JWT!")
+	}
+	revokeOtherSessionFamilies(claims.Subject, claims.Family)
+	slog.Info(fmt.Sprintf("%v signed out everywhere else", claims.Subject))
+	auditRequest(c, audit.SESSIONS_REVOKED, claims.Subject, "everywhere but here")
+	return renderSessions(c, claims, false)
+}
+
+func showAllSessions(c *fiber.Ctx) error {
+	claims, _ := currentSession(c)
+	return renderSessions(c, claims, true)
+}
+
+func killSession(c *fiber.Ctx) error {
+	claims, _ := currentSession(c)
+	return endSessionFromPage(c, claims, true)
+}
+
+// users can only end their own sessions, admins anyone's. Ending the one making the request signs this browser out.
+func endSessionFromPage(c *fiber.Ctx, claims *SessionClaims, asAdmin bool) error {
+	familyId := utils.CopyString(c.Params("id", ""))
+	sessionsRWMutex.RLock()
+	family := sessionFamilies[familyId]
+	sessionsRWMutex.RUnlock()
+	if family == nil || (!asAdmin && family.Email != claims.Subject) {
+		return c.SendStatus(404)
+	}
+	revokeSessionFamily(familyId)
+	slog.Info(fmt.Sprintf("%v ended a session of %v from %v", claims.Subject, family.Email, describeUserAgent(family.UserAgent)))
+	recordAudit(claims.Subject, clientIP(c), audit.SESSION_ENDED, family.Email, describeUserAgent(family.UserAgent))
+	if familyId == claims.Family {
+		endSession(c)
+		c.Set("HX-Refresh", "true")
+		return c.SendStatus(200)
+	}
+	return renderSessions(c, claims, asAdmin)
+}
+
+func renderSessions(c *fiber.Ctx, claims *SessionClaims, all bool) error {
+	email, route, target := claims.Subject, SESSIONS_ROUTE, "#sessions-container"
+	if all {
+		email, route, target = "", ALL_SESSIONS_ROUTE, "#all-sessions-container"
+	}
+	return c.Render(PARTIALS_SESSIONS_VIEW, fiber.Map{
+		"Sessions": listSessions(email, claims.Family),
+		"All":      all,
+		"Route":    route,
+		"Target":   target,
+	})
+}
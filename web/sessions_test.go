@@ -0,0 +1,157 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gojwt "github.com/golang-jwt/jwt/v5"
+)
+
+// a tiny app that signs in at /in & says who's signed in at /who
+func newSessionApp(t *testing.T) *fiber.App {
+	useSigningKeysDir(t, nil)
+	useAuditDir(t)
+	oldSessionsFile, oldSessionFamilies := sessionsFile, sessionFamilies
+	sessionsFile, sessionFamilies = filepath.Join(t.TempDir(), SESSIONS_FILE), map[string]*SessionFamily{}
+	t.Cleanup(func() { sessionsFile, sessionFamilies = oldSessionsFile, oldSessionFamilies })
+
+	app := fiber.New()
+	app.Get("/in", func(c *fiber.Ctx) error {
+		return CreateJwt(c, c.Query("email", "guest@gmail.com"))
+	})
+	app.Delete(SESSIONS_ROUTE+"/:id", endMySession)
+	app.Get("/who", func(c *fiber.Ctx) error {
+		email, valid := sessionEmail(c)
+		if !valid {
+			return c.SendStatus(401)
+		}
+		return c.SendString(email)
+	})
+	return app
+}
+
+func sessionRequest(t *testing.T, app *fiber.App, path string, cookies map[string]string) (*http.Response, map[string]string) {
+	return deviceRequest(t, app, "GET", path, "", cookies)
+}
+
+func deviceRequest(t *testing.T, app *fiber.App, method string, path string, userAgent string, cookies map[string]string) (*http.Response, map[string]string) {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(fiber.HeaderUserAgent, userAgent)
+	for name, value := range cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]string{}
+	for _, cookie := range resp.Cookies() {
+		set[cookie.Name] = cookie.Value
+	}
+	return resp, set
+}
+
+func TestAccessTokensHaveStandardClaims(t *testing.T) {
+	app := newSessionApp(t)
+	_, cookies := sessionRequest(t, app, "/in", nil)
+	claims := &SessionClaims{}
+	if _, _, err := gojwt.NewParser().ParseUnverified(cookies[ACCESS_COOKIE], claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "guest@gmail.com" || claims.ID == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		t.Fatalf("Missing standard claims: %+v", claims)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != ACCESS_TOKEN_LIFETIME {
+		t.Fatalf("Expected a %v access token, got %v", ACCESS_TOKEN_LIFETIME, lifetime)
+	}
+
+	// expired access tokens are turned away by the library itself
+	expired := *claims
+	expired.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(-time.Minute))
+	token, err := signJwt(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, valid := IsValid(token); valid {
+		t.Fatal("Expired access token was accepted")
+	}
+}
+
+func TestRefreshTokensRotateAndReuseRevokesTheFamily(t *testing.T) {
+	app := newSessionApp(t)
+	_, cookies := sessionRequest(t, app, "/in", nil)
+	firstRefresh := cookies[REFRESH_COOKIE]
+	if firstRefresh == "" {
+		t.Fatal("No refresh cookie")
+	}
+
+	// the access token is gone, the refresh token silently gets a new one & swaps itself
+	resp, refreshed := sessionRequest(t, app, "/who", map[string]string{REFRESH_COOKIE: firstRefresh})
+	if resp.StatusCode != 200 || refreshed[ACCESS_COOKIE] == "" || refreshed[REFRESH_COOKIE] == "" || refreshed[REFRESH_COOKIE] == firstRefresh {
+		t.Fatalf("Expected a silent refresh, got %v %v", resp.StatusCode, refreshed)
+	}
+
+	// a sibling request racing with the same token is let through without a new refresh token
+	resp, raced := sessionRequest(t, app, "/who", map[string]string{REFRESH_COOKIE: firstRefresh})
+	if resp.StatusCode != 200 || raced[REFRESH_COOKIE] != "" {
+		t.Fatalf("Expected the racing request through, got %v %v", resp.StatusCode, raced)
+	}
+
+	// later on it's a copy of a spent token, so the whole family goes
+	familyId, _, _ := strings.Cut(firstRefresh, ".")
+	sessionsRWMutex.Lock()
+	sessionFamilies[familyId].Rotated = time.Now().Add(-2 * REFRESH_REUSE_GRACE)
+	sessionsRWMutex.Unlock()
+	if resp, _ = sessionRequest(t, app, "/who", map[string]string{REFRESH_COOKIE: firstRefresh}); resp.StatusCode != 401 {
+		t.Fatalf("Reused refresh token was accepted: %v", resp.StatusCode)
+	}
+	for name, cookies := range map[string]map[string]string{
+		"newest refresh token": {REFRESH_COOKIE: refreshed[REFRESH_COOKIE]},
+		"access token":         {ACCESS_COOKIE: refreshed[ACCESS_COOKIE]},
+	} {
+		if resp, _ = sessionRequest(t, app, "/who", cookies); resp.StatusCode != 401 {
+			t.Fatalf("The family's %v survived the reuse: %v", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestSessionsAreSignedOutOneAtATime(t *testing.T) {
+	app := newSessionApp(t)
+	_, phone := deviceRequest(t, app, "GET", "/in", "Mozilla/5.0 (Android 14; Mobile; rv:131.0) Gecko/131.0 Firefox/131.0", nil)
+	_, laptop := deviceRequest(t, app, "GET", "/in", "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15", nil)
+	_, stranger := sessionRequest(t, app, "/in?email=other@gmail.com", nil)
+
+	// signing in on the laptop left the phone signed in
+	for name, cookies := range map[string]map[string]string{"phone": phone, "laptop": laptop} {
+		if resp, _ := sessionRequest(t, app, "/who", cookies); resp.StatusCode != 200 {
+			t.Fatalf("The %v was signed out: %v", name, resp.StatusCode)
+		}
+	}
+	devices := []string{}
+	for _, session := range listSessions("guest@gmail.com", "") {
+		devices = append(devices, session.Device)
+	}
+	if strings.Join(devices, ",") != "Safari on macOS,Firefox on Android" {
+		t.Fatalf("Expected both devices newest first, got %v", devices)
+	}
+
+	phoneId, _, _ := strings.Cut(phone[REFRESH_COOKIE], ".")
+	if resp, _ := deviceRequest(t, app, "DELETE", SESSIONS_ROUTE+"/"+phoneId, "", stranger); resp.StatusCode != 404 {
+		t.Fatalf("Someone else ended the phone's session: %v", resp.StatusCode)
+	}
+	resp, cleared := deviceRequest(t, app, "DELETE", SESSIONS_ROUTE+"/"+phoneId, "", phone)
+	if resp.StatusCode != 200 || resp.Header.Get("HX-Refresh") != "true" || cleared[REFRESH_COOKIE] != "" {
+		t.Fatalf("Expected the phone signed out & reloaded, got %v %v", resp.StatusCode, cleared)
+	}
+	if resp, _ = sessionRequest(t, app, "/who", phone); resp.StatusCode != 401 {
+		t.Fatalf("The phone is still signed in: %v", resp.StatusCode)
+	}
+	if resp, _ = sessionRequest(t, app, "/who", laptop); resp.StatusCode != 200 {
+		t.Fatalf("Signing the phone out took the laptop too: %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"kmfg.dev/imagebarn/v1/filestore"
+)
+
+func TestShutdownDoesNotLoseUploads(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// grab a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	uploadStarted := make(chan struct{})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/upload", func(c *fiber.Ctx) error {
+		c.Locals("email", "a@b.c")
+		close(uploadStarted)
+		// stand in for a slow heic conversion
+		time.Sleep(500 * time.Millisecond)
+		return filestore.UploadImage(c)
+	})
+
+	stopChan := make(chan struct{})
+	drainedChan := make(chan struct{})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(app, addr, stopChan, drainedChan)
+	}()
+
+	// the storage routines do their final flush once drained, the upload must be on disk by then
+	imagePath := filepath.Join("images", filestore.Encode("a@b.c"), filestore.Encode("barn.jpg"))
+	onDiskWhenDrained := make(chan bool, 1)
+	go func() {
+		<-drainedChan
+		_, err := os.Stat(imagePath)
+		onDiskWhenDrained <- err == nil
+	}()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="image"; filename="barn.jpg"`)
+	partHeader.Set("Content-Type", "image/jpeg")
+	part, err := writer.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("not really a jpeg"))
+	writer.Close()
+
+	waitForListener(t, addr)
+	go func() {
+		<-uploadStarted
+		close(stopChan)
+	}()
+	resp, err := http.Post("http://"+addr+"/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Upload got status %v during shutdown", resp.StatusCode)
+	}
+
+	if err = <-serveErr; err != nil {
+		t.Fatalf("Serve didn't stop cleanly: %v", err)
+	}
+	if !<-onDiskWhenDrained {
+		t.Fatal("Drained before the upload was written")
+	}
+
+	if _, err = net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("Still accepting connections after shutdown")
+	}
+}
+
+func waitForListener(t *testing.T, addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Server never started listening on %v", addr)
+}
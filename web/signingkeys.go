@@ -0,0 +1,353 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/config"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// lives in the data dir, the current key first. Retired keys only keep their public half.
+const SIGNING_KEYS_FILE = "signing-keys.json"
+
+// companion services verify ImageBarn's tokens with the keys listed here
+const JWKS_ROUTE = "/.well-known/jwks.json"
+
+// how often the routine looks for a scheduled rotation & retired keys nothing can use anymore
+const SIGNING_KEY_CHECK_EVERY = time.Hour
+
+var signingKeysFile = SIGNING_KEYS_FILE
+var signingKeys = []*SigningKey{}
+var signingKeysRWMutex = sync.RWMutex{}
+
+// 0 leaves rotating to `imagebarn signing-key rotate`, can change on a config reload
+var signingKeyRotation atomic.Int64
+
+// RegisterJwks publishes the public half of every signing key still in use
+func RegisterJwks(barnage *BarnageWeb) {
+	barnage.fiber.Get(JWKS_ROUTE, jwks)
+}
+
+func applySigningKeyRotation(barnConfig *config.Config) {
+	signingKeyRotation.Store(int64(barnConfig.SigningKeyRotation))
+}
+
+// loadSigningKeys reads the keyset, moving an ec_private_key.pem into it or generating the first key if there's none
+func loadSigningKeys() error {
+	data, err := helpme.ReadFileVerified(signingKeysFile)
+	if os.IsNotExist(err) {
+		return firstSigningKey()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %v: %v", signingKeysFile, err)
+	}
+	keys, err := parseSigningKeys(data)
+	if err != nil {
+		return fmt.Errorf("Failed to load %v: %v", signingKeysFile, err)
+	}
+	signingKeysRWMutex.Lock()
+	signingKeys = keys
+	signingKeysRWMutex.Unlock()
+	return nil
+}
+
+func firstSigningKey() error {
+	var key *SigningKey
+	pemData, err := os.ReadFile(keyFile)
+	if err == nil {
+		// displays paired before key ids were a thing keep working, see ecKeyFunc
+		private, err := decodePrivateKeyFromPEM(pemData)
+		if err != nil {
+			return fmt.Errorf("Failed to load %v: %v", keyFile, err)
+		}
+		created := time.Now()
+		if info, err := os.Stat(keyFile); err == nil {
+			created = info.ModTime()
+		}
+		if key, err = newSigningKey(private, created); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("Moving %v into %v as key %v", keyFile, signingKeysFile, key.Kid))
+	} else if os.IsNotExist(err) {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if key, err = newSigningKey(private, time.Now()); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("No signing keys yet, generated %v", key.Kid))
+	} else {
+		return fmt.Errorf("Failed to check %v: %v", keyFile, err)
+	}
+
+	signingKeysRWMutex.Lock()
+	signingKeys = []*SigningKey{key}
+	signingKeysRWMutex.Unlock()
+	if err = storeSigningKeys(); err != nil {
+		return err
+	}
+	// the keyset has it now, a second copy would only be something else to leak
+	if err = os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+		slog.Warn(fmt.Sprintf("Couldn't remove %v, it's no longer used: %v", keyFile, err))
+	}
+	return nil
+}
+
+func newSigningKey(private *ecdsa.PrivateKey, created time.Time) (*SigningKey, error) {
+	privatePem, err := encodePrivateKeyToPEM(private)
+	if err != nil {
+		return nil, err
+	}
+	publicPem, err := encodePublicKeyToPEM(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{PrivatePem: privatePem, PublicPem: publicPem, Created: created.UTC(), private: private, public: &private.PublicKey}
+	if key.Kid, err = jwkThumbprint(key.public); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parseSigningKeys checks a keyset fully, the backup restore uses it too
+func parseSigningKeys(data []byte) ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || keys[0].PrivatePem == "" || keys[0].Retired != nil {
+		return nil, fmt.Errorf("there's no current key")
+	}
+	for i, key := range keys {
+		if i > 0 && (key.Retired == nil || key.PrivatePem != "") {
+			return nil, fmt.Errorf("key %v should be retired", key.Kid)
+		}
+		block, _ := pem.Decode([]byte(key.PublicPem))
+		if block == nil {
+			return nil, fmt.Errorf("key %v has no public key", key.Kid)
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %v", key.Kid, err)
+		}
+		public, ok := parsed.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %v isn't an EC key", key.Kid)
+		}
+		if kid, err := jwkThumbprint(public); err != nil || kid != key.Kid {
+			return nil, fmt.Errorf("key %v doesn't match its id", key.Kid)
+		}
+		key.public = public
+		if key.PrivatePem != "" {
+			if key.private, err = decodePrivateKeyFromPEM([]byte(key.PrivatePem)); err != nil {
+				return nil, fmt.Errorf("key %v: %v", key.Kid, err)
+			}
+			if !key.private.PublicKey.Equal(public) {
+				return nil, fmt.Errorf("key %v's halves don't match", key.Kid)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func storeSigningKeys() error {
+	signingKeysRWMutex.RLock()
+	data, err := json.Marshal(signingKeys)
+	signingKeysRWMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Failed to marshal signing keys: %v", err)
+	}
+	if err = helpme.WriteFileAtomic(signingKeysFile, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write signing keys: %v", err)
+	}
+	return nil
+}
+
+// rotateSigningKey signs everything new with a fresh key, the old one keeps verifying until its last token expires
+func rotateSigningKey() (*SigningKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newSigningKey(private, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	signingKeysRWMutex.Lock()
+	retired := *signingKeys[0]
+	retired.Retired, retired.PrivatePem, retired.private = &now, "", nil
+	signingKeys = append([]*SigningKey{key, &retired}, signingKeys[1:]...)
+	signingKeysRWMutex.Unlock()
+	pruneSigningKeys()
+	if err = storeSigningKeys(); err != nil {
+		return nil, err
+	}
+	slog.Info(fmt.Sprintf("Rotated the signing key, %v retired for %v", retired.Kid, key.Kid))
+	return key, nil
+}
+
+// tokens signed before a key retired can live this long after, refresh tokens aren't signed
+func maxTokenLifetime() time.Duration {
+	return max(ACCESS_TOKEN_LIFETIME, KIOSK_GOOD_FOR)
+}
+
+// a retired key is dropped once every token it signed has expired. Returns whether any were.
+func pruneSigningKeys() bool {
+	signingKeysRWMutex.Lock()
+	defer signingKeysRWMutex.Unlock()
+	kept := signingKeys[:1]
+	for _, key := range signingKeys[1:] {
+		if key.verifies() {
+			kept = append(kept, key)
+		}
+	}
+	pruned := len(kept) != len(signingKeys)
+	signingKeys = kept
+	return pruned
+}
+
+func (key *SigningKey) verifies() bool {
+	return key.Retired == nil || time.Since(*key.Retired) < maxTokenLifetime()
+}
+
+func signingKeysRoutine(stopChan chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping signing key routine.")
+				return
+			case <-time.After(SIGNING_KEY_CHECK_EVERY):
+			}
+			signingKeysRWMutex.RLock()
+			current := signingKeys[0]
+			signingKeysRWMutex.RUnlock()
+			every := time.Duration(signingKeyRotation.Load())
+			if every > 0 && time.Since(current.Created) >= every {
+				if key, err := rotateSigningKey(); err != nil {
+					slog.Error(fmt.Sprintf("Scheduled signing key rotation failed!: %v", err))
+				} else {
+					recordAudit(AUDIT_SYSTEM, "", audit.SIGNING_KEY_ROTATED, key.Kid, "on schedule")
+				}
+			} else if pruneSigningKeys() {
+				if err := storeSigningKeys(); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to store signing keys!: %v", err))
+				}
+			}
+		}
+	}()
+}
+
+// signJwt signs with the current key & names it in the kid header
+func signJwt(claims gojwt.Claims) (string, error) {
+	signingKeysRWMutex.RLock()
+	defer signingKeysRWMutex.RUnlock()
+	if len(signingKeys) == 0 {
+		return "", fmt.Errorf("Signing keys aren't loaded")
+	}
+	current := signingKeys[0]
+	token := gojwt.NewWithClaims(gojwt.SigningMethodES256, claims)
+	token.Header["kid"] = current.Kid
+	return token.SignedString(current.private)
+}
+
+// ecKeyFunc picks the key a token names. Tokens from before key ids are tried against every key still verifying.
+func ecKeyFunc(token *gojwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*gojwt.SigningMethodECDSA); !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	signingKeysRWMutex.RLock()
+	defer signingKeysRWMutex.RUnlock()
+	if kid == "" {
+		keySet := gojwt.VerificationKeySet{}
+		for _, key := range signingKeys {
+			if key.verifies() {
+				keySet.Keys = append(keySet.Keys, key.public)
+			}
+		}
+		return keySet, nil
+	}
+	for _, key := range signingKeys {
+		if key.Kid == kid && key.verifies() {
+			return key.public, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown signing key: %v", kid)
+}
+
+func jwks(c *fiber.Ctx) error {
+	signingKeysRWMutex.RLock()
+	keys := []Jwk{}
+	for _, key := range signingKeys {
+		if key.verifies() {
+			jwk, err := publicJwk(key.public)
+			if err != nil {
+				signingKeysRWMutex.RUnlock()
+				return err
+			}
+			jwk.Kid, jwk.Use, jwk.Alg = key.Kid, "sig", gojwt.SigningMethodES256.Alg()
+			keys = append(keys, jwk)
+		}
+	}
+	signingKeysRWMutex.RUnlock()
+	// short enough that a rotation is picked up well before anything is signed with only the new key in mind
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": keys})
+}
+
+func publicJwk(public *ecdsa.PublicKey) (Jwk, error) {
+	ecdhKey, err := public.ECDH()
+	if err != nil {
+		return Jwk{}, err
+	}
+	// 0x04 then X then Y
+	point := ecdhKey.Bytes()
+	size := (len(point) - 1) / 2
+	return Jwk{
+		Kty: "EC",
+		Crv: public.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+	}, nil
+}
+
+// jwkThumbprint is the RFC 7638 key id, anyone holding the public key can work it out
+func jwkThumbprint(public *ecdsa.PublicKey) (string, error) {
+	jwk, err := publicJwk(public)
+	if err != nil {
+		return "", err
+	}
+	// members in lexical order without whitespace, exactly as the RFC wants
+	canonical := fmt.Sprintf(`{"crv":"%v","kty":"%v","x":"%v","y":"%v"}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func encodePublicKeyToPEM(public *ecdsa.PublicKey) (string, error) {
+	publicBytes, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal EC public key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes})), nil
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	gojwt "github.com/golang-jwt/jwt/v5"
+)
+
+// points the signing keys at a temp dir, with a legacy ec_private_key.pem when one is given
+func useSigningKeysDir(t *testing.T, legacy *ecdsa.PrivateKey) {
+	dir := t.TempDir()
+	oldKeyFile, oldSigningKeysFile := keyFile, signingKeysFile
+	keyFile, signingKeysFile = filepath.Join(dir, KEY_FILE), filepath.Join(dir, SIGNING_KEYS_FILE)
+	t.Cleanup(func() { keyFile, signingKeysFile = oldKeyFile, oldSigningKeysFile })
+	if legacy != nil {
+		encoded, err := encodePrivateKeyToPEM(legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(keyFile, []byte(encoded), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetiredSigningKeysVerifyUntilTheirTokensExpire(t *testing.T) {
+	legacy, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSigningKeysDir(t, legacy)
+	if _, err = os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v to be moved into the keyset, got %v", KEY_FILE, err)
+	}
+
+	// signed before key ids, still good
+	legacyToken, err := gojwt.NewWithClaims(gojwt.SigningMethodES256, gojwt.MapClaims{"email": "guest@gmail.com"}).SignedString(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := signJwt(gojwt.MapClaims{"email": "guest@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := signingKeys[0].Kid
+
+	rotated, err := rotateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := signJwt(gojwt.MapClaims{"email": "guest@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"legacy": legacyToken, "old": oldToken, "new": newToken} {
+		if _, err := gojwt.Parse(token, ecKeyFunc); err != nil {
+			t.Fatalf("%v token stopped verifying: %v", name, err)
+		}
+	}
+	parsed, _ := gojwt.Parse(newToken, ecKeyFunc)
+	if parsed.Header["kid"] != rotated.Kid {
+		t.Fatalf("Expected kid %v, got %v", rotated.Kid, parsed.Header["kid"])
+	}
+
+	// the keyset survives a reload, without the retired private key
+	if err = loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if len(signingKeys) != 2 || signingKeys[1].Kid != oldKid || signingKeys[1].private != nil {
+		t.Fatalf("Expected the retired key to reload public only, got %+v", signingKeys)
+	}
+
+	app := fiber.New()
+	app.Get(JWKS_ROUTE, jwks)
+	resp, err := app.Test(httptest.NewRequest("GET", JWKS_ROUTE, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	published := struct{ Keys []Jwk }{}
+	if err = json.Unmarshal(body, &published); err != nil || len(published.Keys) != 2 {
+		t.Fatalf("Expected both keys published, got %s: %v", body, err)
+	}
+	for _, jwk := range published.Keys {
+		if jwk.Kid != rotated.Kid && jwk.Kid != oldKid {
+			t.Fatalf("Published an unknown key %v", jwk.Kid)
+		}
+	}
+
+	// once every token the old key signed has expired it's gone
+	longAgo := time.Now().Add(-maxTokenLifetime() - time.Minute)
+	signingKeys[1].Retired = &longAgo
+	if !pruneSigningKeys() {
+		t.Fatal("Expected the retired key to be pruned")
+	}
+	if _, err := gojwt.Parse(oldToken, ecKeyFunc); err == nil {
+		t.Fatal("Token from a pruned key still verifies")
+	}
+}
@@ -0,0 +1,9 @@
+// sends the csrf cookie back as a header, the server turns away changes without it
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|;\s*)(?:__Host-)?csrf=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : "";
+}
+
+document.addEventListener("htmx:configRequest", (event) => {
+    event.detail.headers["X-Csrf-Token"] = csrfToken();
+});
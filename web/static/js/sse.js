@@ -0,0 +1,110 @@
+/*
+* Minimal Server-Sent Events extension for htmx 2.
+*
+* Supports the same attributes as the official extension that ImageBarn uses:
+*   hx-ext="sse" sse-connect="/events"   opens an EventSource on the element
+*   hx-trigger="sse:<event>"             fires the element's request when <event> arrives
+*   sse-swap="<event>"                   swaps the event data into the element
+*
+* Dispatches htmx:sseOpen and htmx:sseError on the connected element.
+*/
+(function () {
+    var api;
+
+    function closestSource(elt) {
+        while (elt) {
+            var data = api.getInternalData(elt);
+            if (data.sseEventSource) {
+                return elt;
+            }
+            elt = elt.parentElement;
+        }
+        return null;
+    }
+
+    function triggerNames(elt) {
+        var names = [];
+        var trigger = elt.getAttribute("hx-trigger");
+        if (trigger) {
+            trigger.split(",").forEach(function (part) {
+                var name = part.trim().split(/\s+/)[0];
+                if (name.indexOf("sse:") === 0) {
+                    names.push(name.slice(4));
+                }
+            });
+        }
+        return names;
+    }
+
+    function listen(sourceElt, name) {
+        var data = api.getInternalData(sourceElt);
+        if (data.sseListening[name]) {
+            return;
+        }
+        data.sseListening[name] = true;
+        data.sseEventSource.addEventListener(name, function (event) {
+            sourceElt.querySelectorAll("[hx-trigger*='sse:" + name + "']").forEach(function (elt) {
+                htmx.trigger(elt, "sse:" + name, { data: event.data });
+            });
+            if (sourceElt.matches("[hx-trigger*='sse:" + name + "']")) {
+                htmx.trigger(sourceElt, "sse:" + name, { data: event.data });
+            }
+            sourceElt.querySelectorAll("[sse-swap='" + name + "']").forEach(function (elt) {
+                htmx.swap(elt, event.data, { swapStyle: "innerHTML" });
+            });
+        });
+    }
+
+    function connect(elt) {
+        var data = api.getInternalData(elt);
+        if (data.sseEventSource) {
+            return;
+        }
+        var source = new EventSource(elt.getAttribute("sse-connect"));
+        data.sseEventSource = source;
+        data.sseListening = {};
+        source.onopen = function () {
+            htmx.trigger(elt, "htmx:sseOpen", { source: source });
+        };
+        source.onerror = function (err) {
+            htmx.trigger(elt, "htmx:sseError", { error: err, source: source });
+        };
+    }
+
+    function register(elt) {
+        if (elt.hasAttribute("sse-connect")) {
+            connect(elt);
+        }
+        var sourceElt = closestSource(elt);
+        if (sourceElt == null) {
+            return;
+        }
+        triggerNames(elt).forEach(function (name) {
+            listen(sourceElt, name);
+        });
+        if (elt.hasAttribute("sse-swap")) {
+            listen(sourceElt, elt.getAttribute("sse-swap"));
+        }
+    }
+
+    htmx.defineExtension("sse", {
+        init: function (apiRef) {
+            api = apiRef;
+        },
+        getSelectors: function () {
+            return ["[sse-connect]", "[sse-swap]", "[hx-trigger*='sse:']"];
+        },
+        onEvent: function (name, evt) {
+            var elt = evt.target || evt.detail.elt;
+            if (name === "htmx:beforeCleanupElement") {
+                var data = api.getInternalData(elt);
+                if (data.sseEventSource) {
+                    data.sseEventSource.close();
+                    data.sseEventSource = null;
+                }
+            } else if (name === "htmx:afterProcessNode") {
+                register(elt);
+            }
+        }
+    });
+})();
@@ -1,29 +1,152 @@
 package web
 
 import (
+	"crypto/ecdsa"
 	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"kmfg.dev/imagebarn/v1/config"
 	"kmfg.dev/imagebarn/v1/filestore"
 	"kmfg.dev/imagebarn/v1/helpme"
 )
 
 type BarnageUser struct {
-	authUser   *helpme.AuthUser
-	Email      string
+	authUser *helpme.AuthUser
+	Email    string
+	// a guest's display name, otherwise the email
+	Name       string
 	IsApproved bool
 	IsAdmin    bool
+	// why & until when, only while they're suspended
+	Suspension *ApprovalRecord
+}
+
+// SessionClaims are an access token's, exp, iat, sub & jti are checked by the jwt library
+type SessionClaims struct {
+	// bumped to sign someone out everywhere
+	Version int `json:"version"`
+	// the session family the refresh token belongs to
+	Family string `json:"fam"`
+	gojwt.RegisteredClaims
+}
+
+// SessionFamily is one sign in & every refresh token it has been through
+type SessionFamily struct {
+	Id      string `json:"id"`
+	Email   string `json:"email"`
+	Version int    `json:"version"`
+	// hash of the refresh token that's good right now
+	Current string `json:"current"`
+	// hashes of refresh tokens already swapped, oldest first. Seeing one again means it was copied.
+	Spent    []string  `json:"spent"`
+	Rotated  time.Time `json:"rotated"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	// where it was last used from, so people can tell their sessions apart
+	UserAgent string `json:"user_agent"`
+	Ip        string `json:"ip"`
+}
+
+// ViewSession is a session as the sessions pages show it
+type ViewSession struct {
+	Id       string
+	Email    string
+	Device   string
+	Ip       string
+	Created  time.Time
+	LastSeen time.Time
+	// the session making the request
+	Current bool
+}
+
+// SigningKey signs sessions & kiosk tokens while it's current, then only verifies until they've all expired
+type SigningKey struct {
+	// RFC 7638 thumbprint, in the kid header of everything it signed
+	Kid string `json:"kid"`
+	// dropped once retired, nothing new is signed with it
+	PrivatePem string     `json:"private_pem,omitempty"`
+	PublicPem  string     `json:"public_pem"`
+	Created    time.Time  `json:"created"`
+	Retired    *time.Time `json:"retired,omitempty"`
+	private    *ecdsa.PrivateKey
+	public     *ecdsa.PublicKey
+}
+
+// the public half of a signing key as JWKS lists it
+type Jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
 }
 
 type BarnageWeb struct {
-	fiber *fiber.App
-	fs    *filestore.Filestore
+	config   *config.Config
+	fiber    *fiber.App
+	fs       *filestore.Filestore
+	stopChan chan struct{}
+	// closed after stopChan once requests have drained
+	drainedChan chan struct{}
+	wg          *sync.WaitGroup
+}
+
+// the image /api/image served last, kept in memory because it's ghosted right after
+type NowShowing struct {
+	seq         int
+	image       []byte
+	contentType string
+	rwMutex     sync.RWMutex
+}
+
+type KioskSettings struct {
+	IntervalSeconds int    `json:"interval"`
+	Transition      string `json:"transition"`
+	Captions        bool   `json:"captions"`
+}
+
+// only the hash of a key is kept, the token is shown once when it's created
+type StoredApiKey struct {
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+type ApiKeyInfo struct {
+	Name        string
+	Fingerprint string
+	// bearer_token & api_keys can only be changed in the config
+	FromConfig bool
+	Created    time.Time
+}
+
+// what the CLI sends over the control socket, & what comes back
+type ControlRequest struct {
+	Args []string `json:"args"`
+	// only for backups, kept out of Args so it's never logged
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+type ControlResponse struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
 }
 
-func NewBarnage(fiber *fiber.App, stopChan chan struct{}, wg *sync.WaitGroup) *BarnageWeb {
-	fs := filestore.NewFilestore(AdminUserEmail, wg)
-	fs.StoreApprovedUsersRoutine(stopChan)
-	return &BarnageWeb{fiber, fs}
+// a short-lived code a display trades for its kiosk cookie
+type PairingCode struct {
+	// which bearer token minted the code, the display stops working once that token changes
+	keyFingerprint string
+	settings       KioskSettings
+	createdAt      time.Time
+}
+
+func NewBarnage(barnConfig *config.Config, fiber *fiber.App, stopChan chan struct{}, drainedChan chan struct{}, wg *sync.WaitGroup) *BarnageWeb {
+	fs := filestore.NewFilestore(barnConfig, wg)
+	fs.StoreApprovedUsersRoutine(drainedChan)
+	return &BarnageWeb{barnConfig, fiber, fs, stopChan, drainedChan, wg}
 }
 
 func IsApproved(authUser *helpme.AuthUser) bool {
@@ -31,15 +154,15 @@ func IsApproved(authUser *helpme.AuthUser) bool {
 }
 
 func IsAdmin(authUser *helpme.AuthUser) bool {
-	return authUser.Email() == AdminUserEmail
+	return isAdminEmail(authUser.Email())
 }
 
-func (barnUser *BarnageUser) Images() *[helpme.MAX_IMAGES_PER_USER]string {
+func (barnUser *BarnageUser) Images() []string {
 	return barnUser.authUser.Images
 }
 
 func (barnUser *BarnageUser) MaxedOut() bool {
-	return barnUser.ActualImageCount() >= MAX_IMAGES_PER_USER
+	return barnUser.ActualImageCount() >= filestore.MaxImagesFor(barnUser.Email)
 }
 
 func (barnUser *BarnageUser) ActualImageCount() int {
@@ -61,7 +184,75 @@ func getBarnageUser(email string) *BarnageUser {
 	return &BarnageUser{
 		authUser,
 		authUser.Email(),
+		displayName(authUser.Email()),
 		IsApproved(authUser),
 		IsAdmin(authUser),
+		suspensionOf(authUser.Email()),
 	}
 }
+
+// CspViolation is a browser's report, report-uri & the Reporting API each fill in their own names
+type CspViolation struct {
+	DocumentUri        string `json:"document-uri"`
+	BlockedUri         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	DocumentUrl        string `json:"documentURL"`
+	BlockedUrl         string `json:"blockedURL"`
+	Directive          string `json:"effectiveDirective"`
+}
+
+// ApprovalRecord is who or what last approved, suspended, or banned someone, kept for auditing
+type ApprovalRecord struct {
+	Approved bool `json:"approved"`
+	// approved, suspended, or banned. Empty in records from before there were states, see UserState
+	State string `json:"state,omitempty"`
+	// admin, cli, domain, invite, or suspension_ended
+	Source string `json:"source"`
+	// the admin, the domain, or the invite's id
+	By string    `json:"by"`
+	At time.Time `json:"at"`
+	// why they were suspended or banned, they're shown it
+	Reason string `json:"reason,omitempty"`
+	// when a suspension ends on its own, zero if an admin has to end it
+	Until time.Time `json:"until"`
+	// the state a suspension ends back in, approved or pending
+	Before string `json:"before,omitempty"`
+}
+
+// Invite approves whoever signs in through its link until it expires, runs out of uses, or is revoked
+type Invite struct {
+	Id    string `json:"id"`
+	Label string `json:"label"`
+	// kept so the link & QR code can be shown again, treat the file like the signing keys
+	Token     string    `json:"token"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// 0 for no limit
+	MaxUses int  `json:"max_uses"`
+	Uses    int  `json:"uses"`
+	Revoked bool `json:"revoked"`
+	// people without a Google account can join through it too, as guests an admin still has to approve
+	Guests bool `json:"guests"`
+}
+
+// Guest joined through an invite without a Google account, they're known by Id + filestore.GUEST_DOMAIN
+type Guest struct {
+	Id string `json:"id"`
+	// what they typed in, shown wherever an email would be
+	Name     string    `json:"name"`
+	InviteId string    `json:"invite_id"`
+	Created  time.Time `json:"created"`
+	// the address they became a regular account with, kept so the audit log still makes sense
+	ConvertedTo string `json:"converted_to,omitempty"`
+}
+
+// EmailLink is a sign in link that's been mailed out & not used yet, kept in memory only
+type EmailLink struct {
+	Email   string
+	Created time.Time
+	Expires time.Time
+	// the invite they asked from, the link may well be opened in another browser than the invite cookie is in
+	InviteToken string
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"kmfg.dev/imagebarn/v1/audit"
+	"kmfg.dev/imagebarn/v1/webhook"
+)
+
+const WEBHOOKS_FILE = "webhooks.json"
+const WEBHOOKS_ROUTE = "/webhooks"
+
+const PARTIALS_WEBHOOKS_VIEW = BASE_PARTIAL + "/webhooks"
+
+var webhooks *webhook.Dispatcher
+
+func RegisterWebhooks(barnage *BarnageWeb) {
+	store, err := webhook.LoadStore(barnage.config.DataPath(WEBHOOKS_FILE))
+	if err != nil {
+		panic(fmt.Errorf("Unable to load webhooks: %v", err))
+	}
+	webhooks = webhook.NewDispatcher(store)
+	webhooks.Start(barnage.drainedChan, barnage.wg)
+
+	webhooksRouter := barnage.fiber.Group(WEBHOOKS_ROUTE)
+	webhooksRouter.Use(adminCheckMiddleware)
+	webhooksRouter.Get("", showWebhooks)
+	webhooksRouter.Post("", addWebhook)
+	webhooksRouter.Delete("/:id", removeWebhook)
+}
+
+func showWebhooks(c *fiber.Ctx) error {
+	return renderWebhooks(c, fiber.Map{})
+}
+
+func addWebhook(c *fiber.Ctx) error {
+	form, err := c.MultipartForm()
+	var eventNames []string
+	if err == nil {
+		eventNames = form.Value["events"]
+	} else {
+		// urlencoded forms, which is what htmx sends without files
+		c.Request().PostArgs().VisitAll(func(key []byte, value []byte) {
+			if string(key) == "events" {
+				eventNames = append(eventNames, string(value))
+			}
+		})
+	}
+	created, err := webhooks.Store().Add(strings.TrimSpace(c.FormValue("url", "")), eventNames)
+	if err != nil {
+		return renderWebhooks(c, fiber.Map{"Error": err.Error()})
+	}
+	slog.Info(fmt.Sprintf("Added webhook %v for %v", created.Id, created.Url))
+	auditRequest(c, audit.WEBHOOK_ADDED, created.Id, created.Url)
+	return renderWebhooks(c, fiber.Map{"Created": created})
+}
+
+func removeWebhook(c *fiber.Ctx) error {
+	id := utils.CopyString(c.Params("id", ""))
+	if err := webhooks.Store().Remove(id); err != nil {
+		return renderWebhooks(c, fiber.Map{"Error": err.Error()})
+	}
+	slog.Info(fmt.Sprintf("Removed webhook %v", id))
+	auditRequest(c, audit.WEBHOOK_REMOVED, id, "")
+	return renderWebhooks(c, fiber.Map{})
+}
+
+func renderWebhooks(c *fiber.Ctx, bind fiber.Map) error {
+	bind["Webhooks"] = webhooks.Store().All()
+	bind["Deliveries"] = webhooks.Deliveries()
+	bind["EventNames"] = webhook.EVENT_NAMES
+	return c.Render(PARTIALS_WEBHOOKS_VIEW, bind)
+}
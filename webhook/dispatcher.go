@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+const USER_AWAITING_APPROVAL = "user.awaiting_approval"
+const USER_APPROVED = "user.approved"
+const USER_SUSPENDED = "user.suspended"
+
+// sent when someone's banned, it kept its name from before there were suspensions
+const USER_DISAPPROVED = "user.disapproved"
+const IMAGE_UPLOADED = "image.uploaded"
+const IMAGE_GHOSTED = "image.ghosted"
+const POOL_EMPTY = "pool.empty"
+
+var EVENT_NAMES = []string{USER_AWAITING_APPROVAL, USER_APPROVED, USER_SUSPENDED, USER_DISAPPROVED, IMAGE_UPLOADED, IMAGE_GHOSTED, POOL_EMPTY}
+
+const EVENT_HEADER = "X-ImageBarn-Event"
+const DELIVERY_HEADER = "X-ImageBarn-Delivery"
+const TIMESTAMP_HEADER = "X-ImageBarn-Timestamp"
+const SIGNATURE_HEADER = "X-ImageBarn-Signature"
+
+const DEFAULT_BACKOFF = 2 * time.Second
+const DEFAULT_MAX_ATTEMPTS = 6
+const MAX_CONCURRENT_DELIVERIES = 4
+const DELIVERY_LOG_SIZE = 200
+const DELIVERY_TIMEOUT = 10 * time.Second
+
+func NewDispatcher(store *Store) *Dispatcher {
+	return &Dispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: DELIVERY_TIMEOUT},
+		backoff:     DEFAULT_BACKOFF,
+		maxAttempts: DEFAULT_MAX_ATTEMPTS,
+		semaphore:   make(chan struct{}, MAX_CONCURRENT_DELIVERIES),
+		log:         []Delivery{},
+	}
+}
+
+func (dispatcher *Dispatcher) Store() *Store {
+	return dispatcher.store
+}
+
+// Start delivers bus events to subscribed webhooks until stopChan closes.
+//
+//	Retries still waiting on their backoff are dropped at shutdown.
+func (dispatcher *Dispatcher) Start(stopChan chan struct{}, wg *sync.WaitGroup) {
+	eventChan, unsubscribe := events.Subscribe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer unsubscribe()
+		for {
+			select {
+			case <-stopChan:
+				slog.Info("Safely stopping webhook dispatcher.")
+				return
+			case event, ok := <-eventChan:
+				if !ok {
+					return
+				}
+				dispatcher.Dispatch(event, stopChan)
+			}
+		}
+	}()
+}
+
+// Dispatch sends event to every webhook subscribed to it, each delivery retrying on its own
+func (dispatcher *Dispatcher) Dispatch(event events.Event, stopChan chan struct{}) {
+	eventName, matters := nameOf(event)
+	if !matters {
+		return
+	}
+	for _, webhook := range dispatcher.store.subscribedTo(eventName) {
+		deliveryId, err := randomHex(12)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to create webhook delivery id: %v", err))
+			continue
+		}
+		body, err := json.Marshal(Payload{deliveryId, eventName, event.At.UTC(), event.Email, event.Data})
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to marshal %v webhook payload: %v", eventName, err))
+			continue
+		}
+		go dispatcher.deliver(webhook, deliveryId, eventName, body, stopChan)
+	}
+}
+
+func (dispatcher *Dispatcher) deliver(webhook Webhook, deliveryId string, eventName string, body []byte, stopChan chan struct{}) {
+	wait := dispatcher.backoff
+	for attempt := 1; attempt <= dispatcher.maxAttempts; attempt++ {
+		dispatcher.semaphore <- struct{}{}
+		statusCode, err := dispatcher.post(webhook, deliveryId, eventName, body)
+		<-dispatcher.semaphore
+
+		delivery := Delivery{
+			Id:         deliveryId,
+			WebhookId:  webhook.Id,
+			Url:        webhook.Url,
+			Event:      eventName,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			At:         time.Now(),
+			Succeeded:  err == nil,
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		dispatcher.record(delivery)
+		if err == nil {
+			return
+		}
+
+		slog.Debug(fmt.Sprintf("Webhook %v delivery %v attempt %v failed: %v", webhook.Id, deliveryId, attempt, err))
+		if attempt == dispatcher.maxAttempts {
+			slog.Warn(fmt.Sprintf("Giving up on webhook %v delivery %v after %v attempts: %v", webhook.Id, deliveryId, attempt, err))
+			return
+		}
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (dispatcher *Dispatcher) post(webhook Webhook, deliveryId string, eventName string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ImageBarn-Webhook")
+	req.Header.Set(EVENT_HEADER, eventName)
+	req.Header.Set(DELIVERY_HEADER, deliveryId)
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(SIGNATURE_HEADER, "sha256="+Sign(webhook.Secret, timestamp, body))
+
+	resp, err := dispatcher.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Receiver responded with %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign is what receivers recompute to trust a delivery, HMAC-SHA256 over "<timestamp>.<body>".
+//
+//	Including the timestamp lets receivers reject replays of old deliveries.
+func Sign(secret string, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Deliveries returns the most recent delivery attempts, newest first
+func (dispatcher *Dispatcher) Deliveries() []Delivery {
+	dispatcher.logRWMutex.RLock()
+	defer dispatcher.logRWMutex.RUnlock()
+	copied := make([]Delivery, len(dispatcher.log))
+	for i := range dispatcher.log {
+		copied[i] = dispatcher.log[len(dispatcher.log)-1-i]
+	}
+	return copied
+}
+
+func (dispatcher *Dispatcher) record(delivery Delivery) {
+	dispatcher.logRWMutex.Lock()
+	defer dispatcher.logRWMutex.Unlock()
+	dispatcher.log = append(dispatcher.log, delivery)
+	if len(dispatcher.log) > DELIVERY_LOG_SIZE {
+		dispatcher.log = dispatcher.log[len(dispatcher.log)-DELIVERY_LOG_SIZE:]
+	}
+}
+
+func nameOf(event events.Event) (string, bool) {
+	switch event.Type {
+	case events.USER_AWAITING_APPROVAL:
+		return USER_AWAITING_APPROVAL, true
+	case events.APPROVAL_CHANGED:
+		if event.Data["isApproved"] == "true" {
+			return USER_APPROVED, true
+		}
+		switch event.Data["state"] {
+		case "suspended":
+			return USER_SUSPENDED, true
+		// a suspension of someone who was never approved ended
+		case "pending":
+			return USER_AWAITING_APPROVAL, true
+		}
+		return USER_DISAPPROVED, true
+	case events.IMAGE_PROCESSED:
+		return IMAGE_UPLOADED, true
+	case events.IMAGE_GHOSTED:
+		return IMAGE_GHOSTED, true
+	case events.POOL_EMPTY:
+		return POOL_EMPTY, true
+	default:
+		return "", false
+	}
+}
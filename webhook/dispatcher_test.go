@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/events"
+)
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, failFirst int32) (*httptest.Server, chan received) {
+	receivedChan := make(chan received, 10)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) <= failFirst {
+			w.WriteHeader(503)
+			return
+		}
+		receivedChan <- received{r.Header.Clone(), body}
+		w.WriteHeader(204)
+	}))
+	t.Cleanup(server.Close)
+	return server, receivedChan
+}
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	store, err := LoadStore(filepath.Join(t.TempDir(), "webhooks.json"))
+	if err != nil {
+		t.Fatalf("Failed to load store: %v", err)
+	}
+	dispatcher := NewDispatcher(store)
+	dispatcher.backoff = 10 * time.Millisecond
+	return dispatcher
+}
+
+func waitFor(t *testing.T, receivedChan chan received) received {
+	select {
+	case got := <-receivedChan:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receiver never got the delivery")
+		return received{}
+	}
+}
+
+func TestDeliverySignedPayload(t *testing.T) {
+	server, receivedChan := newReceiver(t, 0)
+	dispatcher := newTestDispatcher(t)
+	webhook, err := dispatcher.Store().Add(server.URL, []string{USER_APPROVED})
+	if err != nil {
+		t.Fatalf("Failed to add webhook: %v", err)
+	}
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	// not subscribed, should never arrive
+	dispatcher.Dispatch(events.Event{Type: events.IMAGE_GHOSTED, Email: "a@b.c", At: time.Now()}, stopChan)
+	dispatcher.Dispatch(events.Event{Type: events.APPROVAL_CHANGED, Email: "a@b.c", Data: map[string]string{"isApproved": "true"}, At: time.Now()}, stopChan)
+
+	got := waitFor(t, receivedChan)
+	if got.header.Get(EVENT_HEADER) != USER_APPROVED {
+		t.Fatalf("Got event %v but wanted %v", got.header.Get(EVENT_HEADER), USER_APPROVED)
+	}
+	wantSignature := "sha256=" + Sign(webhook.Secret, got.header.Get(TIMESTAMP_HEADER), got.body)
+	if got.header.Get(SIGNATURE_HEADER) != wantSignature {
+		t.Fatalf("Signature %v doesn't match %v", got.header.Get(SIGNATURE_HEADER), wantSignature)
+	}
+	var payload Payload
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatalf("Payload isn't JSON: %v", err)
+	}
+	if payload.Email != "a@b.c" || payload.Event != USER_APPROVED || payload.Id != got.header.Get(DELIVERY_HEADER) {
+		t.Fatalf("Unexpected payload %+v", payload)
+	}
+	select {
+	case extra := <-receivedChan:
+		t.Fatalf("Received an event the webhook isn't subscribed to: %v", extra.header.Get(EVENT_HEADER))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	server, receivedChan := newReceiver(t, 2)
+	dispatcher := newTestDispatcher(t)
+	if _, err := dispatcher.Store().Add(server.URL, nil); err != nil {
+		t.Fatalf("Failed to add webhook: %v", err)
+	}
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	dispatcher.Dispatch(events.Event{Type: events.POOL_EMPTY, At: time.Now()}, stopChan)
+
+	got := waitFor(t, receivedChan)
+	if got.header.Get(EVENT_HEADER) != POOL_EMPTY {
+		t.Fatalf("Got event %v but wanted %v", got.header.Get(EVENT_HEADER), POOL_EMPTY)
+	}
+	// the log is written right after the receiver answers
+	time.Sleep(50 * time.Millisecond)
+	deliveries := dispatcher.Deliveries()
+	if len(deliveries) != 3 {
+		t.Fatalf("Logged %v attempts but wanted 3", len(deliveries))
+	}
+	if !deliveries[0].Succeeded || deliveries[0].Attempt != 3 {
+		t.Fatalf("Newest attempt should be the successful third, got %+v", deliveries[0])
+	}
+	if deliveries[1].Succeeded || deliveries[1].StatusCode != 503 {
+		t.Fatalf("Second attempt should have failed with 503, got %+v", deliveries[1])
+	}
+}
+
+func TestStoreRejectsBadWebhooks(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	if _, err := dispatcher.Store().Add("ftp://example.com", nil); err == nil {
+		t.Fatal("Accepted a non http(s) URL")
+	}
+	if _, err := dispatcher.Store().Add("https://example.com", []string{"user.exploded"}); err == nil {
+		t.Fatal("Accepted an unknown event")
+	}
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+	"kmfg.dev/imagebarn/v1/helpme"
+)
+
+// LoadStore reads the webhooks saved at path, a missing file is an empty store
+func LoadStore(path string) (*Store, error) {
+	store := &Store{path: path, webhooks: []*Webhook{}}
+	data, err := helpme.ReadFileVerified(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &store.webhooks); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal %v: %v", path, err)
+	}
+	return store, nil
+}
+
+// Add creates a webhook with a freshly generated signing secret
+func (store *Store) Add(rawUrl string, eventNames []string) (*Webhook, error) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+		return nil, fmt.Errorf("\"%v\" is not an http(s) URL.", rawUrl)
+	}
+	for _, eventName := range eventNames {
+		if !slices.Contains(EVENT_NAMES, eventName) {
+			return nil, fmt.Errorf("Unknown event \"%v\".", eventName)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	webhook := &Webhook{id, parsedUrl.String(), secret, eventNames, time.Now().UTC()}
+
+	store.rwMutex.Lock()
+	store.webhooks = append(store.webhooks, webhook)
+	store.rwMutex.Unlock()
+	return webhook, store.save()
+}
+
+func (store *Store) Remove(id string) error {
+	store.rwMutex.Lock()
+	store.webhooks = slices.DeleteFunc(store.webhooks, func(webhook *Webhook) bool {
+		return webhook.Id == id
+	})
+	store.rwMutex.Unlock()
+	return store.save()
+}
+
+func (store *Store) All() []Webhook {
+	store.rwMutex.RLock()
+	defer store.rwMutex.RUnlock()
+	copied := make([]Webhook, len(store.webhooks))
+	for i := range store.webhooks {
+		copied[i] = *store.webhooks[i]
+	}
+	return copied
+}
+
+func (store *Store) subscribedTo(eventName string) []Webhook {
+	subscribed := []Webhook{}
+	for _, webhook := range store.All() {
+		if len(webhook.Events) == 0 || slices.Contains(webhook.Events, eventName) {
+			subscribed = append(subscribed, webhook)
+		}
+	}
+	return subscribed
+}
+
+func (store *Store) save() error {
+	data, err := json.Marshal(store.All())
+	if err != nil {
+		return err
+	}
+	// the file holds signing secrets
+	if err = helpme.WriteFileAtomic(store.path, data, 0600); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to save webhooks to %v: %v", store.path, err))
+		return err
+	}
+	return nil
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Webhook struct {
+	Id     string `json:"id"`
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+	// when empty, the webhook gets every event
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type Store struct {
+	path     string
+	webhooks []*Webhook
+	rwMutex  sync.RWMutex
+}
+
+type Payload struct {
+	Id         string            `json:"id"`
+	Event      string            `json:"event"`
+	OccurredAt time.Time         `json:"occurredAt"`
+	Email      string            `json:"email,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+type Delivery struct {
+	Id         string
+	WebhookId  string
+	Url        string
+	Event      string
+	Attempt    int
+	StatusCode int
+	Error      string
+	At         time.Time
+	Succeeded  bool
+}
+
+type Dispatcher struct {
+	store  *Store
+	client *http.Client
+	// first retry waits this long, every retry after doubles it
+	backoff     time.Duration
+	maxAttempts int
+	semaphore   chan struct{}
+
+	log        []Delivery
+	logRWMutex sync.RWMutex
+}